@@ -643,8 +643,8 @@ export function AgentDetailView() {
                             <SelectItem value={PROVIDERS.OPENAI}>
                               OpenAI
                             </SelectItem>
-                            <SelectItem value={PROVIDERS.GOOGLE} disabled>
-                              Google (Coming Soon)
+                            <SelectItem value={PROVIDERS.GOOGLE}>
+                              Google
                             </SelectItem>
                           </SelectContent>
                         </Select>
@@ -217,8 +217,8 @@ export function CreateAgentForm() {
                           Anthropic
                         </SelectItem>
                         <SelectItem value={PROVIDERS.OPENAI}>OpenAI</SelectItem>
-                        <SelectItem value={PROVIDERS.GOOGLE} disabled>
-                          Google (Coming Soon)
+                        <SelectItem value={PROVIDERS.GOOGLE}>
+                          Google
                         </SelectItem>
                       </SelectContent>
                     </Select>
@@ -255,7 +255,7 @@ export function SettingsPage() {
                 </Button>
               </div>
               <p className="text-xs text-muted-foreground">
-                Required for Gemini models (Coming soon)
+                Required for Gemini models (e.g., Gemini 2.5 Pro, Gemini 2.5 Flash)
               </p>
               {settings?.gemini_api_key && (
                 <p className="text-xs text-green-600 flex items-center">
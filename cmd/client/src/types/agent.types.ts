@@ -83,7 +83,11 @@ export const MODELS = {
     { value: "o4-mini", label: "o4 Mini" },
   ],
   [PROVIDERS.GOOGLE]: [
-    // TODO: Add Google models when implemented
+    { value: "gemini-2.5-pro", label: "Gemini 2.5 Pro" },
+    { value: "gemini-2.5-flash", label: "Gemini 2.5 Flash" },
+    { value: "gemini-2.5-flash-lite", label: "Gemini 2.5 Flash-Lite" },
+    { value: "gemini-2.0-flash", label: "Gemini 2.0 Flash" },
+    { value: "gemini-2.0-flash-lite", label: "Gemini 2.0 Flash-Lite" },
   ],
 } as const;
 
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/arnavsurve/glyfs/internal/db"
 	"github.com/arnavsurve/glyfs/internal/handlers"
@@ -38,7 +39,7 @@ func main() {
 		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 			AllowOrigins:     []string{"http://localhost:5173"},
 			AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions},
-			AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+			AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, "Last-Event-ID"},
 			AllowCredentials: true,
 		}))
 	}
@@ -51,7 +52,8 @@ func main() {
 		CookieSameSite: http.SameSiteStrictMode,
 		Skipper: func(c echo.Context) bool {
 			return strings.HasPrefix(c.Path(), "/api/auth/") ||
-				strings.HasPrefix(c.Path(), "/api/agents/") && (strings.HasSuffix(c.Path(), "/invoke") || strings.HasSuffix(c.Path(), "/invoke/stream"))
+				strings.HasPrefix(c.Path(), "/api/agents/:agentId/invoke") ||
+				c.Path() == "/api/webhooks/:webhookId"
 		},
 	}))
 
@@ -73,15 +75,28 @@ func main() {
 
 	oauthHandler := handlers.NewOAuthHandler(db, jwtSecret)
 
+	files, err := services.NewFileStoreFromEnv()
+	if err != nil {
+		log.Fatal("Failed to initialize attachment storage:", err)
+	}
+
 	h := handlers.Handler{
 		DB:              db,
 		MCPConnManager:  mcpManager,
 		SettingsHandler: settingsHandler,
 		PlanMiddleware:  planMiddleware,
 		OAuthHandler:    oauthHandler,
+		Approvals:       services.NewApprovalBroker(),
+		Generations:     services.NewGenerationRegistry(),
+		Streams:         services.NewStreamBuffer(),
+		Files:           files,
+		Knowledge:       services.NewKnowledgeService(services.NewPgVectorStore(db)),
 	}
 
 	h.StartTokenCleanupWorker(1 * time.Hour)
+	h.FailInterruptedDocuments()
+	h.StartScheduleWorker(30 * time.Second)
+	h.StartEventDeliveryWorker(10 * time.Second)
 
 	go oauthHandler.CleanupExpiredStates()
 
@@ -149,6 +164,9 @@ func main() {
 	protected.POST("/agents", func(c echo.Context) error {
 		return h.HandleCreateAgent(c)
 	})
+	protected.POST("/agents/import", func(c echo.Context) error {
+		return h.HandleImportAgent(c)
+	})
 	protected.GET("/agents/:agentId", func(c echo.Context) error {
 		return h.HandleGetAgent(c)
 	})
@@ -161,12 +179,159 @@ func main() {
 	protected.POST("/agents/:agentId/restore", func(c echo.Context) error {
 		return h.HandleRestoreAgent(c)
 	})
+	protected.POST("/agents/:agentId/clone", func(c echo.Context) error {
+		return h.HandleCloneAgent(c)
+	})
+	protected.GET("/agents/:agentId/export", func(c echo.Context) error {
+		return h.HandleExportAgent(c)
+	})
+	protected.GET("/agents/:agentId/versions", func(c echo.Context) error {
+		return h.HandleGetAgentVersions(c)
+	})
+	protected.GET("/agents/:agentId/versions/diff", func(c echo.Context) error {
+		return h.HandleDiffAgentVersions(c)
+	})
+	protected.GET("/agents/:agentId/versions/:version", func(c echo.Context) error {
+		return h.HandleGetAgentVersion(c)
+	})
+	protected.POST("/agents/:agentId/versions/:version/rollback", func(c echo.Context) error {
+		return h.HandleRollbackAgent(c)
+	})
+	protected.POST("/agents/:agentId/attachments", func(c echo.Context) error {
+		return h.HandleUploadAttachment(c)
+	})
+	protected.GET("/agents/:agentId/attachments/:attachmentId/content", func(c echo.Context) error {
+		return h.HandleGetAttachmentContent(c)
+	})
+	protected.DELETE("/agents/:agentId/attachments/:attachmentId", func(c echo.Context) error {
+		return h.HandleDeleteAttachment(c)
+	})
+	protected.GET("/agents/:agentId/delegates", func(c echo.Context) error {
+		return h.HandleListAgentDelegates(c)
+	})
+	protected.POST("/agents/:agentId/delegates", func(c echo.Context) error {
+		return h.HandleAddAgentDelegate(c)
+	})
+	protected.DELETE("/agents/:agentId/delegates/:delegateId", func(c echo.Context) error {
+		return h.HandleRemoveAgentDelegate(c)
+	})
+	protected.GET("/agents/:agentId/knowledge-bases", func(c echo.Context) error {
+		return h.HandleListAgentKnowledgeBases(c)
+	})
+	protected.POST("/agents/:agentId/knowledge-bases", func(c echo.Context) error {
+		return h.HandleAttachKnowledgeBase(c)
+	})
+	protected.DELETE("/agents/:agentId/knowledge-bases/:knowledgeBaseId", func(c echo.Context) error {
+		return h.HandleDetachKnowledgeBase(c)
+	})
+	protected.GET("/agents/:agentId/memories", func(c echo.Context) error {
+		return h.HandleListAgentMemories(c)
+	})
+	protected.DELETE("/agents/:agentId/memories", func(c echo.Context) error {
+		return h.HandleClearAgentMemories(c)
+	})
+	protected.DELETE("/agents/:agentId/memories/:memoryId", func(c echo.Context) error {
+		return h.HandleDeleteAgentMemory(c)
+	})
+	protected.GET("/agents/:agentId/schedules", func(c echo.Context) error {
+		return h.HandleListSchedules(c)
+	})
+	protected.POST("/agents/:agentId/schedules", func(c echo.Context) error {
+		return h.HandleCreateSchedule(c)
+	})
+	protected.GET("/agents/:agentId/schedules/:scheduleId", func(c echo.Context) error {
+		return h.HandleGetSchedule(c)
+	})
+	protected.PUT("/agents/:agentId/schedules/:scheduleId", func(c echo.Context) error {
+		return h.HandleUpdateSchedule(c)
+	})
+	protected.DELETE("/agents/:agentId/schedules/:scheduleId", func(c echo.Context) error {
+		return h.HandleDeleteSchedule(c)
+	})
+	protected.POST("/agents/:agentId/schedules/:scheduleId/run", func(c echo.Context) error {
+		return h.HandleRunSchedule(c)
+	})
+	protected.GET("/agents/:agentId/schedules/:scheduleId/runs", func(c echo.Context) error {
+		return h.HandleListScheduleRuns(c)
+	})
+	protected.GET("/agents/:agentId/webhooks", func(c echo.Context) error {
+		return h.HandleListWebhooks(c)
+	})
+	protected.POST("/agents/:agentId/webhooks", func(c echo.Context) error {
+		return h.HandleCreateWebhook(c)
+	})
+	protected.GET("/agents/:agentId/webhooks/:webhookId", func(c echo.Context) error {
+		return h.HandleGetWebhook(c)
+	})
+	protected.PUT("/agents/:agentId/webhooks/:webhookId", func(c echo.Context) error {
+		return h.HandleUpdateWebhook(c)
+	})
+	protected.DELETE("/agents/:agentId/webhooks/:webhookId", func(c echo.Context) error {
+		return h.HandleDeleteWebhook(c)
+	})
+	protected.POST("/agents/:agentId/webhooks/:webhookId/secret", func(c echo.Context) error {
+		return h.HandleRotateWebhookSecret(c)
+	})
+	protected.GET("/agents/:agentId/webhooks/:webhookId/runs", func(c echo.Context) error {
+		return h.HandleListWebhookRuns(c)
+	})
+	protected.GET("/event-webhooks", func(c echo.Context) error {
+		return h.HandleListEventWebhooks(c)
+	})
+	protected.POST("/event-webhooks", func(c echo.Context) error {
+		return h.HandleCreateEventWebhook(c)
+	})
+	protected.GET("/event-webhooks/:webhookId", func(c echo.Context) error {
+		return h.HandleGetEventWebhook(c)
+	})
+	protected.PUT("/event-webhooks/:webhookId", func(c echo.Context) error {
+		return h.HandleUpdateEventWebhook(c)
+	})
+	protected.DELETE("/event-webhooks/:webhookId", func(c echo.Context) error {
+		return h.HandleDeleteEventWebhook(c)
+	})
+	protected.POST("/event-webhooks/:webhookId/secret", func(c echo.Context) error {
+		return h.HandleRotateEventWebhookSecret(c)
+	})
+	protected.GET("/event-webhooks/:webhookId/deliveries", func(c echo.Context) error {
+		return h.HandleListEventDeliveries(c)
+	})
+	protected.POST("/event-webhooks/:webhookId/deliveries/:deliveryId/redeliver", func(c echo.Context) error {
+		return h.HandleRedeliverEvent(c)
+	})
+	protected.GET("/knowledge-bases", func(c echo.Context) error {
+		return h.HandleListKnowledgeBases(c)
+	})
+	protected.POST("/knowledge-bases", func(c echo.Context) error {
+		return h.HandleCreateKnowledgeBase(c)
+	})
+	protected.GET("/knowledge-bases/:knowledgeBaseId", func(c echo.Context) error {
+		return h.HandleGetKnowledgeBase(c)
+	})
+	protected.DELETE("/knowledge-bases/:knowledgeBaseId", func(c echo.Context) error {
+		return h.HandleDeleteKnowledgeBase(c)
+	})
+	protected.POST("/knowledge-bases/:knowledgeBaseId/documents", func(c echo.Context) error {
+		return h.HandleUploadKnowledgeDocument(c)
+	})
+	protected.DELETE("/knowledge-bases/:knowledgeBaseId/documents/:documentId", func(c echo.Context) error {
+		return h.HandleDeleteKnowledgeDocument(c)
+	})
 	protected.POST("/agents/:agentId/chat", func(c echo.Context) error {
 		return h.HandleAgentInferenceInternal(c)
 	})
 	protected.POST("/agents/:agentId/chat/stream", func(c echo.Context) error {
 		return h.HandleChatStream(c)
 	})
+	protected.GET("/agents/:agentId/chat/runs/:runId/stream", func(c echo.Context) error {
+		return h.HandleResumeChatStream(c)
+	})
+	protected.POST("/agents/:agentId/chat/approvals/:approvalId", func(c echo.Context) error {
+		return h.HandleResolveApproval(c)
+	})
+	protected.POST("/agents/:agentId/runs/:runId/resume", func(c echo.Context) error {
+		return h.HandleResumeRun(c)
+	})
 	protected.GET("/agents/:agentId/chat/sessions", func(c echo.Context) error {
 		return h.HandleGetChatSessions(c)
 	})
@@ -176,6 +341,9 @@ func main() {
 	protected.DELETE("/agents/:agentId/chat/sessions/:sessionId", func(c echo.Context) error {
 		return h.HandleDeleteChatSession(c)
 	})
+	protected.POST("/agents/:agentId/chat/sessions/:sessionId/cancel", func(c echo.Context) error {
+		return h.HandleCancelChatStream(c)
+	})
 
 	protected.GET("/agents/:agentId/keys", func(c echo.Context) error {
 		return h.HandleGetAPIKeys(c)
@@ -186,6 +354,9 @@ func main() {
 	protected.DELETE("/agents/:agentId/keys/:keyId", func(c echo.Context) error {
 		return h.HandleDeleteAPIKey(c)
 	})
+	protected.PUT("/agents/:agentId/keys/:keyId/pin", func(c echo.Context) error {
+		return h.HandlePinAPIKey(c)
+	})
 
 	mcpHandler := handlers.NewMCPHandler(db, mcpManager, planMiddleware)
 	mcpHandler.RegisterMCPRoutes(protected)
@@ -200,12 +371,56 @@ func main() {
 		return settingsHandler.UpdateUserSettings(c)
 	})
 
+	// Inbound webhooks are authenticated by their signature.
+	api.POST("/webhooks/:webhookId", func(c echo.Context) error {
+		return h.HandleTriggerWebhook(c)
+	})
+
 	api.POST("/agents/:agentId/invoke", h.APIKeyMiddleware(func(c echo.Context) error {
 		return h.HandleAgentInference(c)
 	}))
 	api.POST("/agents/:agentId/invoke/stream", h.APIKeyMiddleware(func(c echo.Context) error {
 		return h.HandleAgentInferenceStream(c)
 	}))
+	api.GET("/agents/:agentId/invoke/runs/:runId/stream", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleResumeAgentInferenceStream(c)
+	}))
+	api.GET("/agents/:agentId/invoke/sessions", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleGetAPISessions(c)
+	}))
+	api.GET("/agents/:agentId/invoke/sessions/:sessionId", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleGetAPISession(c)
+	}))
+	api.DELETE("/agents/:agentId/invoke/sessions/:sessionId", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleDeleteAPISession(c)
+	}))
+	api.GET("/agents/:agentId/invoke/memories", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleGetAPIMemories(c)
+	}))
+	api.DELETE("/agents/:agentId/invoke/memories", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleClearAPIMemories(c)
+	}))
+	api.DELETE("/agents/:agentId/invoke/memories/:memoryId", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleDeleteAPIMemory(c)
+	}))
+	api.POST("/agents/:agentId/invoke/attachments", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleUploadAPIAttachment(c)
+	}))
+	api.GET("/agents/:agentId/invoke/attachments/:attachmentId/content", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleGetAPIAttachmentContent(c)
+	}))
+	api.DELETE("/agents/:agentId/invoke/attachments/:attachmentId", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleDeleteAPIAttachment(c)
+	}))
+	api.POST("/agents/:agentId/invoke/approvals/:approvalId", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleResolveApprovalAPI(c)
+	}))
+	api.POST("/agents/:agentId/invoke/runs/:runId/resume", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleResumeRunAPI(c)
+	}))
+	api.POST("/agents/:agentId/invoke/runs/:runId/cancel", h.APIKeyMiddleware(func(c echo.Context) error {
+		return h.HandleCancelAgentInferenceStream(c)
+	}))
 
 	// Catch-all route for React Router
 	if _, err := os.Stat(staticPath); err == nil {
@@ -18,6 +18,11 @@ func SetupDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect to database")
 	}
+	// Knowledge base chunks are stored with pgvector embeddings.
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS vector").Error; err != nil {
+		log.Printf("Warning: Failed to create vector extension: %v", err)
+	}
+
 	db.AutoMigrate(
 		&shared.AgentConfig{},
 		&shared.AgentAPIKey{},
@@ -31,6 +36,22 @@ func SetupDB() *gorm.DB {
 		&shared.MCPServer{},
 		&shared.AgentMCPServer{},
 		&shared.UsageMetric{},
+		&shared.AgentRun{},
+		&shared.AgentVersion{},
+		&shared.Attachment{},
+		&shared.AgentDelegate{},
+		&shared.KnowledgeBase{},
+		&shared.KnowledgeDocument{},
+		&shared.KnowledgeChunk{},
+		&shared.AgentKnowledgeBase{},
+		&shared.AgentMemory{},
+		&shared.AgentSchedule{},
+		&shared.ScheduleRun{},
+		&shared.AgentWebhook{},
+		&shared.WebhookRun{},
+		&shared.WebhookReceipt{},
+		&shared.EventWebhook{},
+		&shared.EventDelivery{},
 	)
 
 	if err := db.Exec(`
@@ -1,17 +1,24 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/arnavsurve/glyfs/internal/middleware"
 	"github.com/arnavsurve/glyfs/internal/services"
 	"github.com/arnavsurve/glyfs/internal/shared"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
 )
 
 func (h *Handler) HandleCreateAgent(c echo.Context) error {
@@ -25,12 +32,8 @@ func (h *Handler) HandleCreateAgent(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
 	}
 
-	if !req.IsValidModel() {
-		return echo.NewHTTPError(http.StatusBadRequest, "Invalid model for the specified provider")
-	}
-
-	if req.Provider == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "provider is required")
+	if err := validateCreateAgentRequest(&req); err != nil {
+		return err
 	}
 
 	if err := h.PlanMiddleware.CheckResourceLimit(userID, middleware.ResourceAgent); err != nil {
@@ -61,13 +64,31 @@ func (h *Handler) HandleCreateAgent(c echo.Context) error {
 	}
 
 	agent := shared.AgentConfig{
-		UserID:       userID,
-		Name:         req.Name,
-		Provider:     string(req.Provider),
-		LLMModel:     req.Model,
-		SystemPrompt: systemPrompt,
-		MaxTokens:    req.MaxTokens,
-		Temperature:  req.Temperature,
+		UserID: userID,
+		Name:   req.Name,
+		AgentSettings: shared.AgentSettings{
+			Provider:     string(req.Provider),
+			LLMModel:     req.Model,
+			SystemPrompt: systemPrompt,
+			MaxTokens:    req.MaxTokens,
+			Temperature:  req.Temperature,
+
+			ToolResultHistoryLimit: req.ToolResultHistoryLimit,
+
+			ContextStrategy:       string(req.ContextStrategy),
+			ContextBudget:         req.ContextBudget,
+			ContextWindowMessages: req.ContextWindowMessages,
+
+			PromptVariables: req.PromptVariables,
+
+			ResponseSchema: req.ResponseSchema,
+
+			KnowledgeMode: string(req.KnowledgeMode),
+			KnowledgeTopK: req.KnowledgeTopK,
+
+			MemoryEnabled:     req.MemoryEnabled,
+			MemoryTokenBudget: req.MemoryTokenBudget,
+		},
 	}
 	if err := tx.Create(&agent).Error; err != nil {
 		tx.Rollback()
@@ -77,6 +98,11 @@ func (h *Handler) HandleCreateAgent(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent")
 	}
 
+	if err := recordAgentVersion(tx, &agent, ""); err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent version")
+	}
+
 	if err := tx.Commit().Error; err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit transaction")
 	}
@@ -87,6 +113,61 @@ func (h *Handler) HandleCreateAgent(c echo.Context) error {
 	})
 }
 
+// validateCreateAgentRequest checks the settings of a new agent.
+func validateCreateAgentRequest(req *shared.CreateAgentRequest) error {
+	if !req.IsValidModel() {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid model for the specified provider")
+	}
+
+	if req.Provider == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "provider is required")
+	}
+
+	if !req.ContextStrategy.IsValid() {
+		return echo.NewHTTPError(http.StatusBadRequest, "context_strategy must be 'keep_system_and_recent', 'sliding_window' or 'summarize'")
+	}
+	if req.ContextBudget < 0 || req.ContextWindowMessages < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "context_budget and context_window_messages cannot be negative")
+	}
+	if req.ToolResultHistoryLimit < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tool_result_history_limit cannot be negative")
+	}
+	if !req.KnowledgeMode.IsValid() {
+		return echo.NewHTTPError(http.StatusBadRequest, "knowledge_mode must be 'tool' or 'inject'")
+	}
+	if req.KnowledgeTopK < 0 || req.KnowledgeTopK > shared.MaxKnowledgeTopK {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("knowledge_top_k must be between 0 and %d", shared.MaxKnowledgeTopK))
+	}
+	if req.MemoryTokenBudget < 0 || req.MemoryTokenBudget > shared.MaxMemoryTokenBudget {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("memory_token_budget must be between 0 and %d", shared.MaxMemoryTokenBudget))
+	}
+
+	systemPrompt := ""
+	if req.SystemPrompt != nil {
+		systemPrompt = *req.SystemPrompt
+	}
+	if err := services.ValidatePromptTemplate(systemPrompt, req.PromptVariables); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if req.ResponseSchema != nil {
+		if err := services.ValidateResponseSchema(req.ResponseSchema); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// renderSystemPrompt fills in the agent's prompt variables for a request.
+func renderSystemPrompt(agent *shared.AgentConfig, variables map[string]string) (*shared.AgentConfig, error) {
+	rendered, err := services.RenderSystemPrompt(agent, variables, time.Now())
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return rendered, nil
+}
+
 func (h *Handler) HandleAgentInferenceInternal(c echo.Context) error {
 	agentIdStr := c.Param("agentId")
 	if agentIdStr == "" {
@@ -107,28 +188,57 @@ func (h *Handler) HandleAgentInferenceInternal(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "message is required")
 	}
 
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "User not authenticated")
+	}
+
 	var agent shared.AgentConfig
-	if err := h.DB.First(&agent, agentId).Error; err != nil {
+	if err := h.DB.Where(&shared.AgentConfig{UserID: userID, ID: agentId}).First(&agent).Error; err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "Agent not found")
 	}
 
-	userID, ok := c.Get("user_id").(uint)
-	if !ok {
-		return echo.NewHTTPError(http.StatusUnauthorized, "User not authenticated")
+	rendered, err := renderSystemPrompt(&agent, req.Variables)
+	if err != nil {
+		return err
 	}
+	agent = *rendered
 
-	apiKey, err := h.SettingsHandler.GetAPIKeyForProvider(userID, agent.Provider)
-	if err != nil || apiKey == "" {
+	if err := h.loadRequestFiles(c, &agent, &req); err != nil {
+		return err
+	}
+
+	creds, err := h.SettingsHandler.GetProviderCredentials(userID, agent.Provider)
+	if err != nil || creds == nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Please configure your %s API key in Settings", agent.Provider))
 	}
 
-	llmService := services.NewLLMService(h.MCPConnManager)
+	llmService := h.newLLMService(nil, &memoryScope{})
 
-	response, err := llmService.GenerateResponse(c.Request().Context(), &agent, &req, apiKey)
+	start, summary := h.compactHistory(c.Request().Context(), llmService, &agent, creds, nil, req.History, req.Message)
+	req.History = req.History[start:]
+	req.ContextSummary = summary
+
+	response, pending, err := llmService.GenerateResponse(c.Request().Context(), &agent, &req, creds, nil)
 	if err != nil {
+		if response != nil {
+			h.recordUsage(userID, &agent, nil, nil, response.Usage)
+		}
+		h.publishRunEvent(&agent, "chat", nil, response, err)
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to generate response: %v", err))
 	}
 
+	h.recordUsage(userID, &agent, nil, nil, response.Usage)
+
+	if pending != nil {
+		run := shared.AgentRun{UserID: userID, AgentID: agent.ID, AgentVersion: agent.Version}
+		if err := h.saveRun(&run, response, pending); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save run")
+		}
+	} else {
+		h.publishRunEvent(&agent, "chat", nil, response, nil)
+	}
+
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -147,23 +257,86 @@ func (h *Handler) HandleAgentInference(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "message is required")
 	}
 
+	agent, err := renderSystemPrompt(agent, req.Variables)
+	if err != nil {
+		return err
+	}
+
 	var user shared.User
 	if err := h.DB.Where("id = ?", agent.UserID).First(&user).Error; err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get agent owner")
 	}
 
-	apiKey, err := h.SettingsHandler.GetAPIKeyForProvider(agent.UserID, agent.Provider)
-	if err != nil || apiKey == "" {
+	creds, err := h.SettingsHandler.GetProviderCredentials(agent.UserID, agent.Provider)
+	if err != nil || creds == nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Agent owner has not configured %s API key", agent.Provider))
 	}
 
-	llmService := services.NewLLMService(h.MCPConnManager)
+	if err := h.loadRequestFiles(c, agent, &req); err != nil {
+		return err
+	}
+
+	memory, err := requestMemoryScope(c, req.EndUserID)
+	if err != nil {
+		return err
+	}
+
+	session, err := h.startAPISession(c, agent, &req)
+	if err != nil {
+		return err
+	}
+
+	var toolEventFunc func(*shared.ToolCallEvent)
+	var toolSteps []shared.ToolStep
+	var sessionID *uuid.UUID
+	if session != nil {
+		sessionID = &session.ID
+		toolEventFunc = h.toolStepRecorder(session.ID, &toolSteps)
+	}
+
+	llmService := h.newLLMService(sessionID, memory)
+
+	start, summary := h.compactHistory(c.Request().Context(), llmService, agent, creds, session, req.History, req.Message)
+	req.History = req.History[start:]
+	req.ContextSummary = summary
 
-	response, err := llmService.GenerateResponse(c.Request().Context(), agent, &req, apiKey)
+	response, pending, err := llmService.GenerateResponse(c.Request().Context(), agent, &req, creds, toolEventFunc)
 	if err != nil {
+		if response != nil {
+			h.recordUsage(agent.UserID, agent, sessionID, nil, response.Usage)
+		}
+		h.publishRunEvent(agent, "api", sessionID, response, err)
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to generate response: %v", err))
 	}
 
+	h.recordUsage(agent.UserID, agent, sessionID, nil, response.Usage)
+	response.SessionID = sessionID
+
+	if pending != nil {
+		run := shared.AgentRun{
+			UserID:    agent.UserID,
+			AgentID:   agent.ID,
+			SessionID: sessionID,
+			APIKeyID:  memory.APIKeyID,
+			EndUserID: memory.EndUserID,
+
+			AgentVersion: agent.Version,
+		}
+		if err := h.saveRun(&run, response, pending); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save run")
+		}
+		// The steps taken so far are stored now. The reply itself is stored
+		// when the run is resumed.
+		if session != nil && len(toolSteps) > 0 {
+			h.saveAssistantMessage(session.ID, agent.Version, "", "pending_approval", toolSteps)
+		}
+	} else {
+		if session != nil {
+			h.saveAssistantMessage(session.ID, agent.Version, response.Response, "completed", toolSteps)
+		}
+		h.publishRunEvent(agent, "api", sessionID, response, nil)
+	}
+
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -182,6 +355,37 @@ func (h *Handler) HandleAgentInferenceStream(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "message is required")
 	}
 
+	agent, err := renderSystemPrompt(agent, req.Variables)
+	if err != nil {
+		return err
+	}
+
+	if err := h.loadRequestFiles(c, agent, &req); err != nil {
+		return err
+	}
+
+	memory, err := requestMemoryScope(c, req.EndUserID)
+	if err != nil {
+		return err
+	}
+
+	session, err := h.startAPISession(c, agent, &req)
+	if err != nil {
+		return err
+	}
+
+	var sessionID *uuid.UUID
+	if session != nil {
+		sessionID = &session.ID
+	}
+
+	llmService := h.newLLMService(sessionID, memory)
+
+	creds, credsErr := h.SettingsHandler.GetProviderCredentials(agent.UserID, agent.Provider)
+
+	start, summary := h.compactHistory(c.Request().Context(), llmService, agent, creds, session, req.History, req.Message)
+	req.History = req.History[start:]
+
 	var contextMessages []shared.ChatContextMessage
 	for i, msg := range req.History {
 		contextMessages = append(contextMessages, shared.ChatContextMessage{
@@ -189,69 +393,141 @@ func (h *Handler) HandleAgentInferenceStream(c echo.Context) error {
 			Role:      msg.Role,
 			Content:   msg.Content,
 			CreatedAt: "",
+			ToolSteps: msg.ToolSteps,
+
+			Attachments: msg.Attachments,
+			Files:       msg.Files,
 		})
 	}
 
 	streamReq := &shared.ChatStreamRequest{
-		Message: req.Message,
-		Context: contextMessages,
+		Message:        req.Message,
+		Context:        contextMessages,
+		ContextSummary: summary,
+		Files:          req.Files,
 	}
 
-	c.Response().Header().Set("Content-Type", "text/event-stream")
-	c.Response().Header().Set("Cache-Control", "no-cache")
-	c.Response().Header().Set("Connection", "keep-alive")
-	c.Response().Header().Set("Access-Control-Allow-Origin", "*")
-	c.Response().Header().Set("Access-Control-Allow-Headers", "Cache-Control")
-
-	h.sendStreamEvent(c, "metadata", "", map[string]any{
-		"agent_id": agent.ID,
-	})
+	stream := h.Streams.Start(agent.UserID, agent.ID, requestAPIKeyID(c))
 
-	var user shared.User
-	if err := h.DB.Where("id = ?", agent.UserID).First(&user).Error; err != nil {
-		h.sendStreamEvent(c, "error", "Failed to get agent owner", nil)
-		return nil
+	emit := func(eventType, content string, data any) {
+		publishStreamEvent(stream, eventType, content, data)
 	}
 
-	apiKey, err := h.SettingsHandler.GetAPIKeyForProvider(agent.UserID, agent.Provider)
-	if err != nil || apiKey == "" {
-		h.sendStreamEvent(c, "error", fmt.Sprintf("Agent owner has not configured %s API key", agent.Provider), nil)
-		return nil
+	metadata := map[string]any{
+		"agent_id": agent.ID,
+		"run_id":   stream.ID,
 	}
+	if session != nil {
+		metadata["session_id"] = session.ID
+	}
+	emit("metadata", "", metadata)
 
-	llmService := services.NewLLMService(h.MCPConnManager)
-	fullResponse := ""
-	var finalUsage *shared.Usage
+	// Generation is detached from the request so that it keeps going if the
+	// client disconnects. The client can reconnect to the run's stream.
+	ctx, done := h.Generations.Start(context.WithoutCancel(c.Request().Context()), stream.ID.String(), agent.UserID, agent.ID, requestAPIKeyID(c))
 
-	streamFunc := func(chunk string) {
-		fullResponse += chunk
-		h.sendStreamEvent(c, "token", chunk, nil)
-		c.Response().Flush()
-	}
+	go func() {
+		defer h.Streams.Finish(stream)
+		defer done()
+
+		var user shared.User
+		if err := h.DB.Where("id = ?", agent.UserID).First(&user).Error; err != nil {
+			emit("error", "Failed to get agent owner", nil)
+			return
+		}
+
+		if credsErr != nil || creds == nil {
+			emit("error", fmt.Sprintf("Agent owner has not configured %s API key", agent.Provider), nil)
+			return
+		}
+
+		fullResponse := ""
+
+		streamFunc := func(chunk string) {
+			fullResponse += chunk
+			emit("token", chunk, nil)
+		}
+
+		var toolSteps []shared.ToolStep
+
+		toolEventFunc := func(event *shared.ToolCallEvent) {
+			if session != nil {
+				if event.Step != nil {
+					toolSteps = append(toolSteps, *event.Step)
+				}
+				h.saveToolEvent(session.ID, event)
+			}
+			emit("tool_event", "", streamToolEvent(event))
+		}
+
+		approveTool := h.Approvals.Approver(agent.UserID, agent.ID, memory.APIKeyID, toolEventFunc)
+
+		// A reply that failed the response schema is discarded and the model
+		// is asked again, so clients drop the tokens received so far.
+		retryFunc := func(err error) {
+			fullResponse = ""
+			emit("structured_output_retry", err.Error(), nil)
+		}
 
-	toolEventFunc := func(event *shared.ToolCallEvent) {
-		h.sendStreamEvent(c, "tool_event", "", event)
-		c.Response().Flush()
+		response, err := llmService.GenerateResponseStream(ctx, agent, streamReq, creds, streamFunc, toolEventFunc, approveTool, retryFunc)
+		var usage *shared.Usage
+		if response != nil {
+			usage = response.Usage
+		}
+		if err != nil {
+			if services.IsCancelled(ctx) {
+				h.recordUsage(agent.UserID, agent, sessionID, nil, usage)
+				if session != nil {
+					h.saveAssistantMessage(session.ID, agent.Version, fullResponse, "cancelled", toolSteps)
+				}
+
+				emit("cancelled", "", map[string]any{
+					"response": fullResponse,
+					"usage":    usage,
+				})
+				return
+			}
+			h.recordUsage(agent.UserID, agent, sessionID, nil, usage)
+			h.publishRunEvent(agent, "api", sessionID, response, err)
+			emit("error", fmt.Sprintf("Failed to generate response: %v", err), nil)
+			return
+		}
+
+		h.recordUsage(agent.UserID, agent, sessionID, nil, usage)
+		if session != nil {
+			h.saveAssistantMessage(session.ID, agent.Version, fullResponse, "completed", toolSteps)
+		}
+		h.publishRunEvent(agent, "api", sessionID, response, nil)
+
+		emit("done", "", map[string]any{
+			"response":   fullResponse,
+			"usage":      usage,
+			"structured": response.Structured,
+			"citations":  response.Citations,
+		})
+	}()
+
+	return h.followStream(c, stream, 0)
+}
+
+// HandleCancelAgentInferenceStream stops an API-key stream by the run ID sent
+// in its metadata event.
+func (h *Handler) HandleCancelAgentInferenceStream(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
 	}
 
-	err = llmService.GenerateResponseStream(c.Request().Context(), agent, streamReq, apiKey, streamFunc, toolEventFunc)
+	runID, err := uuid.Parse(c.Param("runId"))
 	if err != nil {
-		h.sendStreamEvent(c, "error", fmt.Sprintf("Failed to generate response: %v", err), nil)
-		return nil
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid runId format")
 	}
 
-	finalUsage = &shared.Usage{
-		PromptTokens:     len(req.Message) / 4,
-		CompletionTokens: len(fullResponse) / 4,
-		TotalTokens:      (len(req.Message) + len(fullResponse)) / 4,
+	if !h.Generations.Cancel(runID.String(), agent.UserID, agent.ID, requestAPIKeyID(c)) {
+		return echo.NewHTTPError(http.StatusNotFound, "No generation in progress for this run")
 	}
 
-	h.sendStreamEvent(c, "done", "", map[string]any{
-		"response": fullResponse,
-		"usage":    finalUsage,
-	})
-
-	return nil
+	return c.JSON(http.StatusOK, map[string]string{"message": "Generation cancelled"})
 }
 
 func (h *Handler) HandleUpdateAgent(c echo.Context) error {
@@ -303,21 +579,148 @@ func (h *Handler) HandleUpdateAgent(c echo.Context) error {
 	if req.Temperature != nil {
 		updates["temperature"] = *req.Temperature
 	}
+	if req.ToolResultHistoryLimit != nil {
+		if *req.ToolResultHistoryLimit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "tool_result_history_limit cannot be negative")
+		}
+		updates["tool_result_history_limit"] = *req.ToolResultHistoryLimit
+	}
+	if req.ContextStrategy != nil {
+		if !req.ContextStrategy.IsValid() {
+			return echo.NewHTTPError(http.StatusBadRequest, "context_strategy must be 'keep_system_and_recent', 'sliding_window' or 'summarize'")
+		}
+		updates["context_strategy"] = string(*req.ContextStrategy)
+	}
+	if req.ContextBudget != nil {
+		if *req.ContextBudget < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "context_budget cannot be negative")
+		}
+		updates["context_budget"] = *req.ContextBudget
+	}
+	if req.ContextWindowMessages != nil {
+		if *req.ContextWindowMessages < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "context_window_messages cannot be negative")
+		}
+		updates["context_window_messages"] = *req.ContextWindowMessages
+	}
+	if req.KnowledgeMode != nil {
+		if !req.KnowledgeMode.IsValid() {
+			return echo.NewHTTPError(http.StatusBadRequest, "knowledge_mode must be 'tool' or 'inject'")
+		}
+		updates["knowledge_mode"] = string(*req.KnowledgeMode)
+	}
+	if req.KnowledgeTopK != nil {
+		if *req.KnowledgeTopK < 0 || *req.KnowledgeTopK > shared.MaxKnowledgeTopK {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("knowledge_top_k must be between 0 and %d", shared.MaxKnowledgeTopK))
+		}
+		updates["knowledge_top_k"] = *req.KnowledgeTopK
+	}
+	if req.MemoryEnabled != nil {
+		updates["memory_enabled"] = *req.MemoryEnabled
+	}
+	if req.MemoryTokenBudget != nil {
+		if *req.MemoryTokenBudget < 0 || *req.MemoryTokenBudget > shared.MaxMemoryTokenBudget {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("memory_token_budget must be between 0 and %d", shared.MaxMemoryTokenBudget))
+		}
+		updates["memory_token_budget"] = *req.MemoryTokenBudget
+	}
+	if req.SystemPrompt != nil || req.PromptVariables != nil {
+		systemPrompt, variables := agent.SystemPrompt, agent.PromptVariables
+		if req.SystemPrompt != nil {
+			systemPrompt = *req.SystemPrompt
+		}
+		if req.PromptVariables != nil {
+			variables = *req.PromptVariables
+		}
+		if err := services.ValidatePromptTemplate(systemPrompt, variables); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	var responseSchema map[string]any
+	if req.ResponseSchema != nil {
+		if err := json.Unmarshal(req.ResponseSchema, &responseSchema); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "response_schema must be a JSON object or null")
+		}
+		if responseSchema != nil {
+			if err := services.ValidateResponseSchema(responseSchema); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+	}
 
-	if len(updates) == 0 {
+	if len(updates) == 0 && req.PromptVariables == nil && req.ResponseSchema == nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "No fields to update")
 	}
 
-	if err := h.DB.Model(&agent).Updates(updates).Error; err != nil {
-		if strings.Contains(err.Error(), "idx_user_agent_name_active") || strings.Contains(err.Error(), "duplicate") {
-			return echo.NewHTTPError(http.StatusConflict, "An active agent with this name already exists")
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Agents from before versioning get their current settings recorded
+	// first so the edit can be rolled back.
+	if agent.Version == 0 {
+		if err := recordAgentVersion(tx, &agent, ""); err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent version")
+		}
+	}
+	previous := agent.AgentSettings
+
+	if len(updates) > 0 {
+		if err := tx.Model(&agent).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			if strings.Contains(err.Error(), "idx_user_agent_name_active") || strings.Contains(err.Error(), "duplicate") {
+				return echo.NewHTTPError(http.StatusConflict, "An active agent with this name already exists")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update agent")
+		}
+	}
+	// Map updates skip the JSON serializer, so the variables and schema are
+	// saved from the struct.
+	if req.PromptVariables != nil {
+		agent.PromptVariables = *req.PromptVariables
+		if len(agent.PromptVariables) == 0 {
+			agent.PromptVariables = nil
 		}
+		if err := tx.Model(&agent).Select("prompt_variables").Updates(&agent).Error; err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update agent")
+		}
+	}
+	if req.ResponseSchema != nil {
+		agent.ResponseSchema = responseSchema
+		if err := tx.Model(&agent).Select("response_schema").Updates(&agent).Error; err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update agent")
+		}
+	}
+
+	if err := tx.First(&agent, "id = ?", agent.ID).Error; err != nil {
+		tx.Rollback()
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update agent")
 	}
+	if !reflect.DeepEqual(previous, agent.AgentSettings) {
+		if err := recordAgentVersion(tx, &agent, ""); err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent version")
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit transaction")
+	}
 
 	return c.JSON(http.StatusOK, map[string]any{
 		"message":  "Agent updated successfully",
 		"agent_id": agent.ID,
+		"version":  agent.Version,
 	})
 }
 
@@ -358,6 +761,18 @@ func (h *Handler) HandleGetAgents(c echo.Context) error {
 			"mcp_servers_used": resourceCounts["mcp_servers_used"],
 			"api_key_limit":    tierConfig.APIKeyLimit,
 			"api_keys_used":    resourceCounts["api_keys_used"],
+
+			"knowledge_base_limit": tierConfig.KnowledgeBaseLimit,
+			"knowledge_bases_used": resourceCounts["knowledge_bases_used"],
+
+			"schedule_limit": tierConfig.ScheduleLimit,
+			"schedules_used": resourceCounts["schedules_used"],
+
+			"webhook_limit": tierConfig.WebhookLimit,
+			"webhooks_used": resourceCounts["webhooks_used"],
+
+			"event_webhook_limit": tierConfig.EventWebhookLimit,
+			"event_webhooks_used": resourceCounts["event_webhooks_used"],
 		},
 	})
 }
@@ -452,6 +867,204 @@ func (h *Handler) HandleRestoreAgent(c echo.Context) error {
 	})
 }
 
+// HandleCloneAgent copies an agent's settings, MCP server associations and
+// delegates, and optionally the names of its API keys, into a new agent.
+func (h *Handler) HandleCloneAgent(c echo.Context) error {
+	source, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	var req shared.CloneAgentRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name cannot be empty")
+	}
+
+	if err := h.PlanMiddleware.CheckResourceLimit(source.UserID, middleware.ResourceAgent); err != nil {
+		return err
+	}
+
+	var associations []shared.AgentMCPServer
+	if err := h.DB.Where("agent_id = ?", source.ID).Order("created_at ASC").Find(&associations).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load MCP servers")
+	}
+
+	var delegates []shared.AgentDelegate
+	if err := h.DB.Where("agent_id = ?", source.ID).Order("created_at ASC").Find(&delegates).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load delegates")
+	}
+
+	var knowledgeBases []shared.AgentKnowledgeBase
+	if err := h.DB.Where("agent_id = ?", source.ID).Order("created_at ASC").Find(&knowledgeBases).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load knowledge bases")
+	}
+
+	var apiKeys []shared.AgentAPIKey
+	if req.CopyAPIKeys {
+		if err := h.DB.Where("agent_id = ? AND is_active = true", source.ID).Order("created_at ASC").Find(&apiKeys).Error; err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to retrieve API keys")
+		}
+		if len(apiKeys) > 0 {
+			if err := h.PlanMiddleware.CheckResourceLimitN(source.UserID, middleware.ResourceAPIKey, len(apiKeys)); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := ""
+	if req.Name != nil {
+		name = *req.Name
+	} else if name, err = h.copyName(source.UserID, source.Name); err != nil {
+		return err
+	}
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	agent := shared.AgentConfig{
+		UserID:        source.UserID,
+		Name:          name,
+		AgentSettings: source.AgentSettings,
+	}
+	if err := tx.Create(&agent).Error; err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "idx_user_agent_name_active") || strings.Contains(err.Error(), "duplicate") {
+			return echo.NewHTTPError(http.StatusConflict, "An active agent with this name already exists")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent")
+	}
+
+	comment := fmt.Sprintf("Cloned from %s", source.Name)
+	if source.Version > 0 {
+		comment = fmt.Sprintf("Cloned from %s version %d", source.Name, source.Version)
+	}
+	if err := recordAgentVersion(tx, &agent, comment); err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent version")
+	}
+
+	for _, assoc := range associations {
+		association := shared.AgentMCPServer{
+			AgentID:     agent.ID,
+			MCPServerID: assoc.MCPServerID,
+			Enabled:     assoc.Enabled,
+
+			AllowedTools:          assoc.AllowedTools,
+			DeniedTools:           assoc.DeniedTools,
+			ApprovalRequiredTools: assoc.ApprovalRequiredTools,
+		}
+		if err := createAgentMCPServer(tx, &association); err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent association")
+		}
+	}
+
+	for _, delegate := range delegates {
+		link := shared.AgentDelegate{
+			AgentID:     agent.ID,
+			DelegateID:  delegate.DelegateID,
+			Description: delegate.Description,
+		}
+		if err := tx.Create(&link).Error; err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to copy delegates")
+		}
+	}
+
+	for _, knowledgeBase := range knowledgeBases {
+		link := shared.AgentKnowledgeBase{
+			AgentID:         agent.ID,
+			KnowledgeBaseID: knowledgeBase.KnowledgeBaseID,
+		}
+		if err := tx.Create(&link).Error; err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to copy knowledge bases")
+		}
+	}
+
+	type clonedAPIKey struct {
+		KeyID  uint   `json:"key_id"`
+		Name   string `json:"name"`
+		APIKey string `json:"api_key"`
+	}
+	clonedKeys := []clonedAPIKey{}
+	for _, key := range apiKeys {
+		apiKey, err := generateAPIKey()
+		if err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate API key")
+		}
+
+		keyHash := sha256.Sum256([]byte(apiKey))
+		agentAPIKey := shared.AgentAPIKey{
+			AgentID:  agent.ID,
+			Key:      hex.EncodeToString(keyHash[:]),
+			Name:     key.Name,
+			IsActive: true,
+		}
+		if err := tx.Create(&agentAPIKey).Error; err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to create API key")
+		}
+		clonedKeys = append(clonedKeys, clonedAPIKey{KeyID: agentAPIKey.ID, Name: agentAPIKey.Name, APIKey: apiKey})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit transaction")
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"message":  "Agent cloned successfully",
+		"agent":    agent,
+		"api_keys": clonedKeys,
+	})
+}
+
+// copyName returns the first of "name (copy)", "name (copy 2)", ... that no
+// active agent of the user has.
+func (h *Handler) copyName(userID uint, name string) (string, error) {
+	for i := 1; i <= 100; i++ {
+		candidate := name + " (copy)"
+		if i > 1 {
+			candidate = fmt.Sprintf("%s (copy %d)", name, i)
+		}
+
+		var count int64
+		if err := h.DB.Model(&shared.AgentConfig{}).Where("user_id = ? AND name = ?", userID, candidate).Count(&count).Error; err != nil {
+			return "", echo.NewHTTPError(http.StatusInternalServerError, "Failed to check agent names")
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+	}
+	return "", echo.NewHTTPError(http.StatusConflict, "Too many copies of this agent, please choose a name")
+}
+
+// createAgentMCPServer creates an association, keeping Enabled when it is
+// false, which Create alone would replace with the column default.
+func createAgentMCPServer(tx *gorm.DB, association *shared.AgentMCPServer) error {
+	enabled := association.Enabled
+	if err := tx.Create(association).Error; err != nil {
+		return err
+	}
+	if !enabled {
+		if err := tx.Model(association).Update("enabled", false).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func generateAPIKey() (string, error) {
 	randomBytes := make([]byte, 32)
 	_, err := rand.Read(randomBytes)
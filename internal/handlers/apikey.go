@@ -5,6 +5,7 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -43,6 +44,16 @@ func (h *Handler) APIKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusNotFound, "agent not found")
 		}
 
+		// A pinned key runs the agent with the settings of its version.
+		if apiKeyRecord.PinnedVersion != nil {
+			var version shared.AgentVersion
+			if err := h.DB.Where("agent_id = ? AND version = ?", agent.ID, *apiKeyRecord.PinnedVersion).First(&version).Error; err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "pinned agent version not found")
+			}
+			agent.AgentSettings = version.AgentSettings
+			agent.Version = version.Version
+		}
+
 		now := time.Now()
 		h.DB.Model(&apiKeyRecord).Update("last_used", &now)
 
@@ -92,6 +103,8 @@ func (h *Handler) HandleGetAPIKeys(c echo.Context) error {
 		CreatedAt time.Time  `json:"created_at"`
 		LastUsed  *time.Time `json:"last_used"`
 		IsActive  bool       `json:"is_active"`
+
+		PinnedVersion *int `json:"pinned_version"`
 	}
 
 	var response []APIKeyResponse
@@ -102,6 +115,8 @@ func (h *Handler) HandleGetAPIKeys(c echo.Context) error {
 			CreatedAt: key.CreatedAt,
 			LastUsed:  key.LastUsed,
 			IsActive:  key.IsActive,
+
+			PinnedVersion: key.PinnedVersion,
 		})
 	}
 
@@ -128,7 +143,8 @@ func (h *Handler) HandleCreateAPIKey(c echo.Context) error {
 	}
 
 	var req struct {
-		Name string `json:"name"`
+		Name          string `json:"name"`
+		PinnedVersion *int   `json:"pinned_version"`
 	}
 	if err := c.Bind(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid request format")
@@ -148,6 +164,12 @@ func (h *Handler) HandleCreateAPIKey(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "agent not found")
 	}
 
+	if req.PinnedVersion != nil {
+		if _, err := h.findAgentVersion(agentId, strconv.Itoa(*req.PinnedVersion)); err != nil {
+			return err
+		}
+	}
+
 	apiKey, err := generateAPIKey()
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate API key")
@@ -159,6 +181,8 @@ func (h *Handler) HandleCreateAPIKey(c echo.Context) error {
 		Key:      hex.EncodeToString(keyHash[:]),
 		Name:     req.Name,
 		IsActive: true,
+
+		PinnedVersion: req.PinnedVersion,
 	}
 
 	if err := h.DB.Create(&agentAPIKey).Error; err != nil {
@@ -171,6 +195,44 @@ func (h *Handler) HandleCreateAPIKey(c echo.Context) error {
 		"key_id":     agentAPIKey.ID,
 		"name":       agentAPIKey.Name,
 		"created_at": agentAPIKey.CreatedAt,
+
+		"pinned_version": agentAPIKey.PinnedVersion,
+	})
+}
+
+// HandlePinAPIKey pins an API key to an agent version, or unpins it when the
+// version is null.
+func (h *Handler) HandlePinAPIKey(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Version *int `json:"version"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request format")
+	}
+
+	var apiKey shared.AgentAPIKey
+	if err := h.DB.Where("id = ? AND agent_id = ? AND is_active = true", c.Param("keyId"), agent.ID).First(&apiKey).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "API key not found")
+	}
+
+	if req.Version != nil {
+		if _, err := h.findAgentVersion(agent.ID, strconv.Itoa(*req.Version)); err != nil {
+			return err
+		}
+	}
+
+	if err := h.DB.Model(&apiKey).Update("pinned_version", req.Version).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to pin API key")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"key_id":         apiKey.ID,
+		"pinned_version": req.Version,
 	})
 }
 
@@ -206,6 +268,13 @@ func (h *Handler) HandleDeleteAPIKey(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke API key")
 	}
 
+	h.publishEvent(userID, shared.EventAPIKeyRevoked, shared.APIKeyRevokedEventData{
+		AgentID:   agent.ID,
+		AgentName: agent.Name,
+		KeyID:     apiKey.ID,
+		KeyName:   apiKey.Name,
+	})
+
 	return c.JSON(http.StatusOK, map[string]any{
 		"message": "API key revoked successfully",
 	})
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// HandleResolveApproval decides a tool call that a chat stream is waiting on.
+func (h *Handler) HandleResolveApproval(c echo.Context) error {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	agentID, err := uuid.Parse(c.Param("agentId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid agentId format")
+	}
+
+	return h.resolveApproval(c, userID, agentID)
+}
+
+// HandleResolveApprovalAPI decides a tool call that an API-key stream is
+// waiting on.
+func (h *Handler) HandleResolveApprovalAPI(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
+	}
+
+	return h.resolveApproval(c, agent.UserID, agent.ID)
+}
+
+func (h *Handler) resolveApproval(c echo.Context, userID uint, agentID uuid.UUID) error {
+	approvalID, err := uuid.Parse(c.Param("approvalId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid approvalId format")
+	}
+
+	var decision shared.ToolApprovalDecision
+	if err := c.Bind(&decision); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+	if err := decision.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := h.Approvals.Resolve(approvalID, userID, agentID, requestAPIKeyID(c), &decision); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Decision recorded"})
+}
+
+// HandleResumeRun continues a chat run paused for tool approval.
+func (h *Handler) HandleResumeRun(c echo.Context) error {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	agentID, err := uuid.Parse(c.Param("agentId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid agentId format")
+	}
+
+	var agent shared.AgentConfig
+	if err := h.DB.Where("id = ? AND user_id = ?", agentID, userID).First(&agent).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Agent not found")
+	}
+
+	return h.resumeRun(c, &agent)
+}
+
+// HandleResumeRunAPI continues an invoke run paused for tool approval.
+func (h *Handler) HandleResumeRunAPI(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
+	}
+
+	return h.resumeRun(c, agent)
+}
+
+func (h *Handler) resumeRun(c echo.Context, agent *shared.AgentConfig) error {
+	runID, err := uuid.Parse(c.Param("runId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid runId format")
+	}
+
+	var req shared.ResumeRunRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+
+	// A run can only be resumed by whoever started it: the dashboard, or the
+	// same API key and end user.
+	query := h.DB.Where("id = ? AND agent_id = ?", runID, agent.ID)
+	if apiKeyID, ok := c.Get("api_key_id").(uint); ok {
+		query = query.Where("api_key_id = ? AND end_user_id = ?", apiKeyID, req.EndUserID)
+	} else {
+		query = query.Where("api_key_id IS NULL")
+	}
+
+	var run shared.AgentRun
+	if err := query.First(&run).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return echo.NewHTTPError(http.StatusNotFound, "Run not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch run")
+	}
+	if run.Status != "pending_approval" {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("Run is %s", run.Status))
+	}
+
+	// The run continues with the settings it started with, which may be an
+	// older version than the agent's or the one its API key is pinned to now.
+	if run.AgentVersion > 0 && run.AgentVersion != agent.Version {
+		var version shared.AgentVersion
+		if err := h.DB.Where("agent_id = ? AND version = ?", agent.ID, run.AgentVersion).First(&version).Error; err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load the agent version of the run")
+		}
+		snapshot := *agent
+		snapshot.AgentSettings = version.AgentSettings
+		snapshot.Version = version.Version
+		agent = &snapshot
+	}
+
+	var pending services.PendingRun
+	if err := json.Unmarshal(run.State, &pending); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load run state")
+	}
+
+	// After the timeout every pending call is rejected, whatever the request
+	// says, and the model is left to finish without them.
+	decisions := make(map[string]*shared.ToolApprovalDecision)
+	expired := time.Now().After(run.ExpiresAt)
+	for _, call := range pending.Calls {
+		if !call.RequiresApproval {
+			continue
+		}
+		if expired {
+			decisions[call.CallID] = &shared.ToolApprovalDecision{Action: "reject", Reason: "approval timed out"}
+			continue
+		}
+
+		decision := req.Decisions[call.CallID]
+		if decision == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("missing decision for tool call %s", call.CallID))
+		}
+		if err := decision.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tool call %s: %v", call.CallID, err))
+		}
+		decisions[call.CallID] = decision
+	}
+
+	// Claim the run so concurrent resumes cannot execute the tools twice.
+	result := h.DB.Model(&shared.AgentRun{}).
+		Where("id = ? AND status = ?", run.ID, "pending_approval").
+		Update("status", "running")
+	if result.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update run")
+	}
+	if result.RowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "Run is already being resumed")
+	}
+
+	creds, err := h.SettingsHandler.GetProviderCredentials(agent.UserID, agent.Provider)
+	if err != nil || creds == nil {
+		h.DB.Model(&run).Update("status", "pending_approval")
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Agent owner has not configured %s API key", agent.Provider))
+	}
+
+	llmService := h.newLLMService(run.SessionID, runMemoryScope(&run))
+
+	var toolEventFunc func(*shared.ToolCallEvent)
+	var toolSteps []shared.ToolStep
+	if run.SessionID != nil {
+		toolEventFunc = h.toolStepRecorder(*run.SessionID, &toolSteps)
+	}
+
+	source := "chat"
+	if run.APIKeyID != nil {
+		source = "api"
+	}
+
+	response, next, err := llmService.ResumeResponse(c.Request().Context(), agent, &pending, decisions, creds, toolEventFunc)
+	if err != nil {
+		h.DB.Model(&run).Update("status", "failed")
+		if response != nil {
+			h.recordUsage(agent.UserID, agent, run.SessionID, nil, response.Usage)
+		}
+		h.publishRunEvent(agent, source, run.SessionID, response, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to generate response: %v", err))
+	}
+
+	h.recordUsage(agent.UserID, agent, run.SessionID, nil, response.Usage)
+	response.SessionID = run.SessionID
+
+	if err := h.saveRun(&run, response, next); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save run")
+	}
+	if run.SessionID != nil {
+		if next == nil {
+			h.saveAssistantMessage(*run.SessionID, agent.Version, response.Response, "completed", toolSteps)
+		} else if len(toolSteps) > 0 {
+			h.saveAssistantMessage(*run.SessionID, agent.Version, "", "pending_approval", toolSteps)
+		}
+	}
+	if next == nil {
+		h.publishRunEvent(agent, source, run.SessionID, response, nil)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// saveRun stores the outcome of a run. When next is non-nil the run is paused
+// again and response is filled in with the details needed to resume it.
+func (h *Handler) saveRun(run *shared.AgentRun, response *shared.AgentInferenceResponse, next *services.PendingRun) error {
+	run.Response = response.Response
+	run.Status = "completed"
+	run.State = nil
+	run.PendingToolCalls = nil
+
+	if next != nil {
+		state, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+		run.Status = "pending_approval"
+		run.State = state
+		run.PendingToolCalls = next.Calls
+		run.ExpiresAt = time.Now().Add(services.PendingRunTimeout)
+	}
+
+	if err := h.DB.Save(run).Error; err != nil {
+		return err
+	}
+
+	if next != nil {
+		response.RunID = &run.ID
+		response.ExpiresAt = &run.ExpiresAt
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// maxAttachmentsPerMessage bounds the files sent with a single message.
+const maxAttachmentsPerMessage = 10
+
+// maxFilenameLength bounds the stored name of an uploaded file.
+const maxFilenameLength = 255
+
+// truncateFilename makes an uploaded file's name valid UTF-8 and cuts it to
+// maxFilenameLength bytes without splitting a character, since Postgres
+// rejects invalid UTF-8.
+func truncateFilename(filename string) string {
+	filename = strings.ToValidUTF8(filename, "\uFFFD")
+	if len(filename) <= maxFilenameLength {
+		return filename
+	}
+	cut := maxFilenameLength
+	for cut > 0 && !utf8.RuneStart(filename[cut]) {
+		cut--
+	}
+	return filename[:cut]
+}
+
+// agentAttachments scopes a query to the attachments of an agent visible to a
+// request: all of them for the agent's owner, and only its own for an API key.
+func (h *Handler) agentAttachments(c echo.Context, agentID uuid.UUID) *gorm.DB {
+	query := h.DB.Where("agent_id = ?", agentID)
+	if apiKeyID, ok := c.Get("api_key_id").(uint); ok {
+		query = query.Where("api_key_id = ?", apiKeyID)
+	}
+	return query
+}
+
+// loadAttachments loads the files of the attachments sent with a message.
+// Attachments referenced by the caller must exist and be accepted by the
+// agent's model. Those of messages stored in a session were checked when they
+// were sent, so stored attachments that were since deleted, or that the
+// agent's current model cannot take, are left out instead.
+func (h *Handler) loadAttachments(c echo.Context, agent *shared.AgentConfig, ids []uuid.UUID, stored bool) ([]shared.FileContent, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	query := h.DB.Where("agent_id = ?", agent.ID)
+	if !stored {
+		if len(ids) > maxAttachmentsPerMessage {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("A message can have at most %d attachments", maxAttachmentsPerMessage))
+		}
+		query = h.agentAttachments(c, agent.ID)
+	}
+
+	var attachments []shared.Attachment
+	if err := query.Where("id IN ?", ids).Find(&attachments).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load attachments")
+	}
+	byID := make(map[uuid.UUID]shared.Attachment, len(attachments))
+	for _, attachment := range attachments {
+		byID[attachment.ID] = attachment
+	}
+
+	var files []shared.FileContent
+	for _, id := range ids {
+		attachment, ok := byID[id]
+		switch {
+		case !ok && stored:
+			continue
+		case !ok:
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Attachment %s not found", id))
+		case !services.SupportsAttachment(agent, attachment.ContentType) && stored:
+			continue
+		case !services.SupportsAttachment(agent, attachment.ContentType):
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Model %s does not accept %s attachments", agent.LLMModel, attachment.ContentType))
+		}
+
+		data, err := h.Files.Get(c.Request().Context(), attachment.StorageKey)
+		if err != nil {
+			if stored && errors.Is(err, services.ErrFileNotFound) {
+				continue
+			}
+			log.Printf("Failed to read attachment %s: %v\n", attachment.ID, err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to read attachment")
+		}
+		files = append(files, shared.FileContent{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Data:        data,
+		})
+	}
+	return files, nil
+}
+
+// loadRequestFiles loads the attachments of an invoke request's message and of
+// the history sent with it.
+func (h *Handler) loadRequestFiles(c echo.Context, agent *shared.AgentConfig, req *shared.AgentInferenceRequest) error {
+	files, err := h.loadAttachments(c, agent, req.Attachments, false)
+	if err != nil {
+		return err
+	}
+	req.Files = files
+
+	for i := range req.History {
+		files, err := h.loadAttachments(c, agent, req.History[i].Attachments, false)
+		if err != nil {
+			return err
+		}
+		req.History[i].Files = files
+	}
+	return nil
+}
+
+// uploadAttachment stores the file in the request's multipart "file" field
+// as an attachment of agent. The content type is detected from the file
+// itself rather than trusted from the client.
+func (h *Handler) uploadAttachment(c echo.Context, agent *shared.AgentConfig) error {
+	maxBytes, err := h.PlanMiddleware.AttachmentMaxBytes(agent.UserID)
+	if err != nil {
+		return err
+	}
+	// Leave room for the multipart framing around the file.
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxBytes+1<<20)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Attachment is too large. The limit is %d MB.", maxBytes>>20))
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, "file is required as multipart form data")
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read file")
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read file")
+	}
+	if len(data) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "file is empty")
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if err := h.PlanMiddleware.CheckAttachment(agent.UserID, contentType, int64(len(data))); err != nil {
+		return err
+	}
+	if !services.SupportsAttachment(agent, contentType) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Model %s does not accept %s attachments", agent.LLMModel, contentType))
+	}
+
+	filename := filepath.Base(fileHeader.Filename)
+	if filename == "." || filename == string(filepath.Separator) {
+		filename = "attachment"
+	}
+	filename = truncateFilename(filename)
+
+	attachment := shared.Attachment{
+		ID:          uuid.New(),
+		UserID:      agent.UserID,
+		AgentID:     agent.ID,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+	}
+	if apiKeyID, ok := c.Get("api_key_id").(uint); ok {
+		attachment.APIKeyID = &apiKeyID
+	}
+	attachment.StorageKey = fmt.Sprintf("attachments/%s/%s", agent.ID, attachment.ID)
+
+	if err := h.Files.Put(c.Request().Context(), attachment.StorageKey, contentType, data); err != nil {
+		log.Printf("Failed to store attachment %s: %v\n", attachment.ID, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to store attachment")
+	}
+	if err := h.DB.Create(&attachment).Error; err != nil {
+		h.Files.Delete(c.Request().Context(), attachment.StorageKey)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save attachment")
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"attachment": attachment,
+	})
+}
+
+// findAttachment loads the attachment in the attachmentId path parameter if
+// it is visible to the request.
+func (h *Handler) findAttachment(c echo.Context, agentID uuid.UUID) (*shared.Attachment, error) {
+	attachmentID, err := uuid.Parse(c.Param("attachmentId"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid attachmentId format")
+	}
+
+	var attachment shared.Attachment
+	if err := h.agentAttachments(c, agentID).Where("id = ?", attachmentID).First(&attachment).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Attachment not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load attachment")
+	}
+	return &attachment, nil
+}
+
+// serveAttachment writes the content of the attachment in the path.
+func (h *Handler) serveAttachment(c echo.Context, agentID uuid.UUID) error {
+	attachment, err := h.findAttachment(c, agentID)
+	if err != nil {
+		return err
+	}
+
+	data, err := h.Files.Get(c.Request().Context(), attachment.StorageKey)
+	if err != nil {
+		if errors.Is(err, services.ErrFileNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Attachment content not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read attachment")
+	}
+
+	c.Response().Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	return c.Blob(http.StatusOK, attachment.ContentType, data)
+}
+
+// deleteAttachment removes the attachment in the path. Messages that sent it
+// keep their text and are replayed without the file.
+func (h *Handler) deleteAttachment(c echo.Context, agentID uuid.UUID) error {
+	attachment, err := h.findAttachment(c, agentID)
+	if err != nil {
+		return err
+	}
+
+	if err := h.DB.Delete(attachment).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete attachment")
+	}
+	if err := h.Files.Delete(c.Request().Context(), attachment.StorageKey); err != nil {
+		log.Printf("Failed to delete stored file of attachment %s: %v\n", attachment.ID, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Attachment deleted successfully",
+	})
+}
+
+// HandleUploadAttachment uploads a file for the user's agent.
+func (h *Handler) HandleUploadAttachment(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	return h.uploadAttachment(c, agent)
+}
+
+// HandleGetAttachmentContent downloads a file of the user's agent.
+func (h *Handler) HandleGetAttachmentContent(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	return h.serveAttachment(c, agent.ID)
+}
+
+// HandleDeleteAttachment deletes a file of the user's agent.
+func (h *Handler) HandleDeleteAttachment(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	return h.deleteAttachment(c, agent.ID)
+}
+
+// HandleUploadAPIAttachment uploads a file with an API key.
+func (h *Handler) HandleUploadAPIAttachment(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
+	}
+	return h.uploadAttachment(c, agent)
+}
+
+// HandleGetAPIAttachmentContent downloads a file uploaded with the API key.
+func (h *Handler) HandleGetAPIAttachmentContent(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
+	}
+	return h.serveAttachment(c, agent.ID)
+}
+
+// HandleDeleteAPIAttachment deletes a file uploaded with the API key.
+func (h *Handler) HandleDeleteAPIAttachment(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
+	}
+	return h.deleteAttachment(c, agent.ID)
+}
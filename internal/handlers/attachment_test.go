@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{strings.Repeat("a", 300), strings.Repeat("a", 255)},
+		{strings.Repeat("é", 200), strings.Repeat("é", 127)},
+		{"a" + strings.Repeat("日", 100), "a" + strings.Repeat("日", 84)},
+		{"bad\xffname.txt", "bad�name.txt"},
+	}
+	for _, tt := range tests {
+		got := truncateFilename(tt.name)
+		if got != tt.want {
+			t.Errorf("truncateFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if !utf8.ValidString(got) || len(got) > maxFilenameLength {
+			t.Errorf("truncateFilename(%q) = %q, invalid or too long", tt.name, got)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -15,13 +16,6 @@ import (
 	"gorm.io/gorm"
 )
 
-func max(x, y int) int {
-	if x > y {
-		return x
-	}
-	return y
-}
-
 func (h *Handler) HandleChatStream(c echo.Context) error {
 	agentIdStr := c.Param("agentId")
 	if agentIdStr == "" {
@@ -52,6 +46,12 @@ func (h *Handler) HandleChatStream(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "Agent not found")
 	}
 
+	rendered, err := renderSystemPrompt(&agent, req.Variables)
+	if err != nil {
+		return err
+	}
+	agent = *rendered
+
 	session, err := h.getOrCreateChatSession(agentId, userID, req.SessionID)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to get chat session: %v", err))
@@ -68,176 +68,222 @@ func (h *Handler) HandleChatStream(c echo.Context) error {
 	var contextMessages []shared.ChatContextMessage
 	if len(conversationHistory) > 0 {
 		for _, msg := range conversationHistory {
+			if msg.Role == "tool" {
+				continue
+			}
+			files, err := h.loadAttachments(c, &agent, msg.Attachments, true)
+			if err != nil {
+				return err
+			}
 			contextMessages = append(contextMessages, shared.ChatContextMessage{
 				ID:        msg.ID.String(),
 				Role:      msg.Role,
 				Content:   msg.Content,
 				CreatedAt: msg.CreatedAt.Format("2006-01-02T15:04:05.000000Z07:00"),
+				ToolSteps: msg.ToolSteps,
+
+				Attachments: msg.Attachments,
+				Files:       files,
 			})
 		}
 		req.Context = contextMessages
 	} else if req.Context == nil {
 		req.Context = []shared.ChatContextMessage{}
+	} else {
+		for i := range req.Context {
+			files, err := h.loadAttachments(c, &agent, req.Context[i].Attachments, false)
+			if err != nil {
+				return err
+			}
+			req.Context[i].Files = files
+		}
 	}
 
+	files, err := h.loadAttachments(c, &agent, req.Attachments, false)
+	if err != nil {
+		return err
+	}
+	req.Files = files
+
+	llmService := h.newLLMService(&session.ID, &memoryScope{})
+
+	creds, credsErr := h.SettingsHandler.GetProviderCredentials(userID, agent.Provider)
+
+	history := make([]shared.Message, len(req.Context))
+	for i, msg := range req.Context {
+		history[i] = shared.Message{Role: msg.Role, Content: msg.Content, ToolSteps: msg.ToolSteps, Attachments: msg.Attachments}
+	}
+	start, summary := h.compactHistory(c.Request().Context(), llmService, &agent, creds, session, history, req.Message)
+	req.Context = req.Context[start:]
+	req.ContextSummary = summary
+
 	userMessage := shared.ChatMessage{
-		SessionID: session.ID,
-		Role:      "user",
-		Content:   req.Message,
-		Metadata:  "{}",
+		SessionID:   session.ID,
+		Role:        "user",
+		Content:     req.Message,
+		Metadata:    "{}",
+		Attachments: req.Attachments,
 	}
 	if err := h.DB.Create(&userMessage).Error; err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save user message")
 	}
 
-	c.Response().Header().Set("Content-Type", "text/event-stream")
-	c.Response().Header().Set("Cache-Control", "no-cache")
-	c.Response().Header().Set("Connection", "keep-alive")
-	c.Response().Header().Set("Access-Control-Allow-Origin", "*")
-	c.Response().Header().Set("Access-Control-Allow-Headers", "Cache-Control")
+	stream := h.Streams.Start(userID, agent.ID, nil)
+
+	emit := func(eventType, content string, data any) {
+		publishStreamEvent(stream, eventType, content, data)
+	}
 
-	h.sendStreamEvent(c, "metadata", "", map[string]any{
+	emit("metadata", "", map[string]any{
 		"session_id": session.ID,
 		"message_id": userMessage.ID,
+		"run_id":     stream.ID,
 	})
 
 	assistantMessage := shared.ChatMessage{
-		SessionID: session.ID,
-		Role:      "assistant",
-		Content:   "",
-		Metadata:  "{}",
+		SessionID:    session.ID,
+		Role:         "assistant",
+		Content:      "",
+		Metadata:     "{}",
+		AgentVersion: agent.Version,
 	}
 	if err := h.DB.Create(&assistantMessage).Error; err != nil {
+		h.Streams.Finish(stream)
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create assistant message")
 	}
 
-	apiKey, err := h.SettingsHandler.GetAPIKeyForProvider(userID, agent.Provider)
-	if err != nil || apiKey == "" {
-		h.sendStreamEvent(c, "error", fmt.Sprintf("Please configure your %s API key in Settings", agent.Provider), nil)
-		return nil
-	}
-
-	llmService := services.NewLLMService(h.MCPConnManager)
-	fullResponse := ""
+	// Generation is detached from the request so that it keeps going if the
+	// client disconnects. The client can reconnect to the run's stream.
+	ctx, done := h.Generations.Start(context.WithoutCancel(c.Request().Context()), session.ID.String(), userID, agent.ID, nil)
 
-	streamFunc := func(chunk string) {
-		fullResponse += chunk
-		h.sendStreamEvent(c, "token", chunk, nil)
-		c.Response().Flush()
-	}
+	go func() {
+		defer h.Streams.Finish(stream)
+		defer done()
 
-	toolEventFunc := func(event *shared.ToolCallEvent) {
-		if event.Type == "tool_batch_complete" {
-			h.sendStreamEvent(c, "tool_event", "", event)
+		if credsErr != nil || creds == nil {
+			emit("error", fmt.Sprintf("Please configure your %s API key in Settings", agent.Provider), nil)
 			return
 		}
 
-		toolMessage := shared.ChatMessage{
-			SessionID: session.ID,
-			Role:      "tool",
-			Content:   "", // We'll set this based on the event type
-			Metadata:  "",
+		fullResponse := ""
+
+		streamFunc := func(chunk string) {
+			fullResponse += chunk
+			emit("token", chunk, nil)
 		}
 
-		// Set content and metadata based on tool event type
-		switch event.Type {
-		case "tool_start":
-			toolMessage.Content = fmt.Sprintf("Executing tool: %s", event.ToolName)
-			metadataBytes, _ := json.Marshal(event)
-			toolMessage.Metadata = string(metadataBytes)
-		case "tool_result":
-			toolMessage.Content = fmt.Sprintf("Tool completed: %s", event.ToolName)
-			metadataBytes, _ := json.Marshal(event)
-			toolMessage.Metadata = string(metadataBytes)
-		case "tool_error":
-			toolMessage.Content = fmt.Sprintf("Tool failed: %s", event.ToolName)
-			metadataBytes, _ := json.Marshal(event)
-			toolMessage.Metadata = string(metadataBytes)
+		var toolSteps []shared.ToolStep
+
+		toolEventFunc := func(event *shared.ToolCallEvent) {
+			if event.Step != nil {
+				toolSteps = append(toolSteps, *event.Step)
+			}
+			h.saveToolEvent(session.ID, event)
+			emit("tool_event", "", streamToolEvent(event))
 		}
 
-		// Save to database
-		h.DB.Create(&toolMessage)
+		approveTool := h.Approvals.Approver(userID, agent.ID, nil, toolEventFunc)
 
-		// Create a copy of the event for streaming with truncated result if needed
-		streamEvent := *event
-		if len(streamEvent.Result) > 2000 {
-			streamEvent.Result = streamEvent.Result[:2000] + "... [truncated for streaming]"
+		// A reply that failed the response schema is discarded and the model
+		// is asked again, so clients drop the tokens received so far.
+		retryFunc := func(err error) {
+			fullResponse = ""
+			emit("structured_output_retry", err.Error(), nil)
 		}
 
-		// Send real-time event with potentially truncated data
-		h.sendStreamEvent(c, "tool_event", "", &streamEvent)
-		c.Response().Flush()
-	}
+		response, err := llmService.GenerateResponseStream(ctx, &agent, &req, creds, streamFunc, toolEventFunc, approveTool, retryFunc)
+		var usage *shared.Usage
+		if response != nil {
+			usage = response.Usage
+		}
+		if err != nil {
+			if services.IsCancelled(ctx) {
+				assistantMessage.Content = fullResponse
+				assistantMessage.ToolSteps = toolSteps
+				assistantMessage.Status = "cancelled"
+				assistantMessage.CreatedAt = time.Now()
+				h.DB.Save(&assistantMessage)
+
+				h.recordUsage(userID, &agent, &session.ID, &assistantMessage.ID, usage)
+
+				emit("cancelled", "", map[string]any{
+					"message_id": assistantMessage.ID,
+					"content":    fullResponse,
+					"usage":      usage,
+				})
+				return
+			}
+			h.recordUsage(userID, &agent, &session.ID, &assistantMessage.ID, usage)
+			h.publishRunEvent(&agent, "chat", &session.ID, response, err)
+			emit("error", fmt.Sprintf("Failed to generate response: %v", err), nil)
+			return
+		}
 
-	err = llmService.GenerateResponseStream(c.Request().Context(), &agent, &req, apiKey, streamFunc, toolEventFunc)
-	if err != nil {
-		h.sendStreamEvent(c, "error", fmt.Sprintf("Failed to generate response: %v", err), nil)
-		return nil
-	}
+		// Update the assistant message with the full response and set timestamp to now
+		assistantMessage.Content = fullResponse
+		assistantMessage.ToolSteps = toolSteps
+		assistantMessage.CreatedAt = time.Now() // Set timestamp to when response finishes
+		h.DB.Save(&assistantMessage)
+
+		h.recordUsage(userID, &agent, &session.ID, &assistantMessage.ID, usage)
+		h.publishRunEvent(&agent, "chat", &session.ID, response, nil)
+
+		// Generate title for new sessions
+		log.Printf("Session title before generation: '%s'\n", session.Title)
+		if session.Title == "New Chat" {
+			title, err := llmService.GenerateChatTitle(ctx, req.Message)
+			if err != nil {
+				log.Printf("Error generating title with LLM: %v, falling back to simple title\n", err)
+				title = h.generateChatTitle(req.Message)
+			} else {
+				log.Printf("Generated title with LLM: '%s' for message: '%s'\n", title, req.Message)
+			}
 
-	// Update the assistant message with the full response and set timestamp to now
-	assistantMessage.Content = fullResponse
-	assistantMessage.CreatedAt = time.Now() // Set timestamp to when response finishes
-	h.DB.Save(&assistantMessage)
+			if title != "" && title != "New Chat" {
+				session.Title = title
+				log.Printf("Updating session title to: '%s'\n", title)
+				if err := h.DB.Save(&session).Error; err != nil {
+					log.Printf("Error saving session title: %v\n", err)
+				}
+			}
+		}
 
-	// Track usage metrics with improved token estimation
-	// Use a more realistic approximation: ~3.5 chars per token, with minimum of 1 token
-	promptChars := len(req.Message)
-	completionChars := len(fullResponse)
+		// Send completion event
+		emit("done", "", map[string]any{
+			"message_id": assistantMessage.ID,
+			"content":    fullResponse,
+			"usage":      usage,
+			"structured": response.Structured,
+			"citations":  response.Citations,
+		})
+	}()
 
-	promptTokens := max(1, (promptChars*10+35)/35)         // Equivalent to chars/3.5 rounded up, min 1
-	completionTokens := max(1, (completionChars*10+35)/35) // Equivalent to chars/3.5 rounded up, min 1
+	return h.followStream(c, stream, 0)
+}
 
-	usage := &shared.Usage{
-		PromptTokens:     promptTokens,
-		CompletionTokens: completionTokens,
-		TotalTokens:      promptTokens + completionTokens,
+// HandleCancelChatStream stops the generation running in a chat session. The
+// stream saves what was generated so far and ends with a cancelled event.
+func (h *Handler) HandleCancelChatStream(c echo.Context) error {
+	agentId, err := uuid.Parse(c.Param("agentId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid agentId format")
 	}
 
-	usageMetric := shared.UsageMetric{
-		UserID:           userID,
-		AgentID:          agent.ID,
-		SessionID:        &session.ID,
-		MessageID:        &assistantMessage.ID,
-		Provider:         agent.Provider,
-		Model:            agent.LLMModel,
-		PromptTokens:     usage.PromptTokens,
-		CompletionTokens: usage.CompletionTokens,
-		TotalTokens:      usage.TotalTokens,
+	sessionId, err := uuid.Parse(c.Param("sessionId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid sessionId format")
 	}
 
-	if err := h.DB.Create(&usageMetric).Error; err != nil {
-		log.Printf("Warning: Failed to save usage metrics for message %s: %v", assistantMessage.ID, err)
-		// Continue execution - don't fail the entire request for metrics collection failure
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
 	}
 
-	// Generate title for new sessions
-	log.Printf("Session title before generation: '%s'\n", session.Title)
-	if session.Title == "New Chat" {
-		title, err := llmService.GenerateChatTitle(c.Request().Context(), req.Message)
-		if err != nil {
-			log.Printf("Error generating title with LLM: %v, falling back to simple title\n", err)
-			title = h.generateChatTitle(req.Message)
-		} else {
-			log.Printf("Generated title with LLM: '%s' for message: '%s'\n", title, req.Message)
-		}
-
-		if title != "" && title != "New Chat" {
-			session.Title = title
-			log.Printf("Updating session title to: '%s'\n", title)
-			if err := h.DB.Save(&session).Error; err != nil {
-				log.Printf("Error saving session title: %v\n", err)
-			}
-		}
+	if !h.Generations.Cancel(sessionId.String(), userID, agentId, nil) {
+		return echo.NewHTTPError(http.StatusNotFound, "No generation in progress for this session")
 	}
 
-	// Send completion event
-	h.sendStreamEvent(c, "done", "", map[string]any{
-		"message_id": assistantMessage.ID,
-		"content":    fullResponse,
-	})
-
-	return nil
+	return c.JSON(http.StatusOK, map[string]string{"message": "Generation cancelled"})
 }
 
 // HandleGetChatSessions returns all chat sessions for an agent
@@ -258,7 +304,7 @@ func (h *Handler) HandleGetChatSessions(c echo.Context) error {
 	}
 
 	var sessions []shared.ChatSession
-	if err := h.DB.Where("agent_id = ? AND user_id = ?", agentId, userID).
+	if err := h.DB.Where("agent_id = ? AND user_id = ? AND api_key_id IS NULL", agentId, userID).
 		Order("updated_at DESC").Find(&sessions).Error; err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to retrieve chat sessions")
 	}
@@ -366,34 +412,126 @@ func (h *Handler) HandleDeleteChatSession(c echo.Context) error {
 }
 
 // Helper functions
-func (h *Handler) sendStreamEvent(c echo.Context, eventType, content string, data any) {
-	event := shared.ChatStreamEvent{
-		Type:    eventType,
-		Content: content,
-		Data:    data,
+
+// compactHistory fits history into the agent's context budget and stores a
+// new summary on the session when one is written. It returns the index of the
+// first message to send and the summary to send before it. session may be nil
+// for conversations the server does not store. Summaries are written with the
+// owner's credentials and their usage is recorded against the agent.
+func (h *Handler) compactHistory(ctx context.Context, llmService *services.LLMService, agent *shared.AgentConfig, creds *shared.ProviderCredentials, session *shared.ChatSession, history []shared.Message, message string) (int, string) {
+	var prior services.ContextSummary
+	var sessionID *uuid.UUID
+	if session != nil {
+		prior = services.ContextSummary{Content: session.ContextSummary, Messages: session.SummarizedMessages}
+		sessionID = &session.ID
 	}
 
-	jsonData, err := json.Marshal(event)
-	if err != nil {
-		// If JSON marshaling fails, send a simplified error event
-		errorEvent := shared.ChatStreamEvent{
-			Type:    eventType,
-			Content: content,
-			Data:    map[string]string{"error": "Failed to serialize event data"},
+	window := llmService.CompactHistory(ctx, agent, creds, history, message, prior)
+
+	if window.Usage != nil {
+		summaryAgent := *agent
+		summaryAgent.LLMModel = services.SummaryModel(agent)
+		h.recordUsage(agent.UserID, &summaryAgent, sessionID, nil, window.Usage)
+	}
+
+	if session != nil && window.Summary != prior {
+		session.ContextSummary = window.Summary.Content
+		session.SummarizedMessages = window.Summary.Messages
+		if err := h.DB.Model(session).Select("context_summary", "summarized_messages").Updates(session).Error; err != nil {
+			log.Printf("Warning: Failed to save context summary for session %s: %v", session.ID, err)
 		}
-		if fallbackData, fallbackErr := json.Marshal(errorEvent); fallbackErr == nil {
-			fmt.Fprintf(c.Response(), "data: %s\n\n", fallbackData)
+	}
+
+	return window.Start, window.Summary.Content
+}
+
+// saveToolEvent stores a tool event in the session's history.
+func (h *Handler) saveToolEvent(sessionID uuid.UUID, event *shared.ToolCallEvent) {
+	if event.Type == "tool_batch_complete" {
+		return
+	}
+
+	toolMessage := shared.ChatMessage{
+		SessionID: sessionID,
+		Role:      "tool",
+		Content:   "", // We'll set this based on the event type
+		Metadata:  "",
+	}
+
+	// Set content and metadata based on tool event type
+	switch event.Type {
+	case "tool_start":
+		toolMessage.Content = fmt.Sprintf("Executing tool: %s", event.ToolName)
+	case "tool_result":
+		toolMessage.Content = fmt.Sprintf("Tool completed: %s", event.ToolName)
+	case "tool_error":
+		toolMessage.Content = fmt.Sprintf("Tool failed: %s", event.ToolName)
+	case "tool_approval_required":
+		toolMessage.Content = fmt.Sprintf("Awaiting approval: %s", event.ToolName)
+	case "tool_rejected":
+		toolMessage.Content = fmt.Sprintf("Tool rejected: %s", event.ToolName)
+	}
+	metadataBytes, _ := json.Marshal(event)
+	toolMessage.Metadata = string(metadataBytes)
+
+	// Save to database
+	h.DB.Create(&toolMessage)
+}
+
+// maxStreamedToolResult bounds, in characters, the tool results sent in
+// tool_event stream events.
+const maxStreamedToolResult = 2000
+
+// streamToolEvent returns a copy of the event for streaming with the result
+// truncated if needed and without the step record. The full result is kept in
+// the session history.
+func streamToolEvent(event *shared.ToolCallEvent) *shared.ToolCallEvent {
+	streamEvent := *event
+	streamEvent.Step = nil
+	if len(streamEvent.Result) > maxStreamedToolResult {
+		kept := 0
+		for i := range streamEvent.Result {
+			if kept == maxStreamedToolResult {
+				streamEvent.Result = streamEvent.Result[:i] + "... [truncated for streaming]"
+				break
+			}
+			kept++
 		}
+	}
+	return &streamEvent
+}
+
+// recordUsage persists the provider-reported token usage for a generation.
+// Failures are logged rather than returned so metrics never fail a request.
+func (h *Handler) recordUsage(userID uint, agent *shared.AgentConfig, sessionID, messageID *uuid.UUID, usage *shared.Usage) {
+	if usage == nil {
 		return
 	}
 
-	fmt.Fprintf(c.Response(), "data: %s\n\n", jsonData)
+	usageMetric := shared.UsageMetric{
+		UserID:           userID,
+		AgentID:          agent.ID,
+		SessionID:        sessionID,
+		MessageID:        messageID,
+		Provider:         agent.Provider,
+		Model:            agent.LLMModel,
+		AgentVersion:     agent.Version,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+
+	if err := h.DB.Create(&usageMetric).Error; err != nil {
+		log.Printf("Warning: Failed to save usage metrics for agent %s: %v", agent.ID, err)
+		return
+	}
+	h.checkUsageThresholds(userID)
 }
 
 func (h *Handler) getOrCreateChatSession(agentId uuid.UUID, userID uint, sessionID *uuid.UUID) (*shared.ChatSession, error) {
 	if sessionID != nil {
 		var session shared.ChatSession
-		if err := h.DB.Where("id = ? AND agent_id = ? AND user_id = ?", *sessionID, agentId, userID).First(&session).Error; err == nil {
+		if err := h.DB.Where("id = ? AND agent_id = ? AND user_id = ? AND api_key_id IS NULL", *sessionID, agentId, userID).First(&session).Error; err == nil {
 			return &session, nil
 		}
 	}
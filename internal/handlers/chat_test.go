@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+)
+
+func TestStreamToolEvent(t *testing.T) {
+	step := &shared.ToolStep{}
+	tests := []struct {
+		result string
+		want   string
+	}{
+		{"short", "short"},
+		{strings.Repeat("a", 2000), strings.Repeat("a", 2000)},
+		{strings.Repeat("a", 2001), strings.Repeat("a", 2000) + "... [truncated for streaming]"},
+		{strings.Repeat("é", 2000), strings.Repeat("é", 2000)},
+		{"a" + strings.Repeat("日", 2000), "a" + strings.Repeat("日", 1999) + "... [truncated for streaming]"},
+	}
+	for _, tt := range tests {
+		event := &shared.ToolCallEvent{Result: tt.result, Step: step}
+		got := streamToolEvent(event)
+		if got.Result != tt.want {
+			t.Errorf("streamToolEvent(%d bytes) result = %d bytes, want %d bytes", len(tt.result), len(got.Result), len(tt.want))
+		}
+		if !utf8.ValidString(got.Result) {
+			t.Errorf("streamToolEvent(%d bytes) result is not valid UTF-8", len(tt.result))
+		}
+		if got.Step != nil || event.Step != step || event.Result != tt.result {
+			t.Error("streamToolEvent() changed the event or kept the step")
+		}
+	}
+}
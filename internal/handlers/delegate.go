@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// maxDelegateDescriptionLength bounds the description an agent is shown for
+// a delegate.
+const maxDelegateDescriptionLength = 1000
+
+// delegateSource gives delegated runs the delegates, credentials and usage
+// records of the request's session.
+type delegateSource struct {
+	h         *Handler
+	sessionID *uuid.UUID
+}
+
+func (s *delegateSource) Delegates(ctx context.Context, agentID uuid.UUID) ([]services.Delegate, error) {
+	var links []shared.AgentDelegate
+	if err := s.h.DB.WithContext(ctx).Preload("Delegate").Where("agent_id = ?", agentID).Order("created_at ASC").Find(&links).Error; err != nil {
+		return nil, err
+	}
+
+	var delegates []services.Delegate
+	for _, link := range links {
+		// Deleted agents are not preloaded. The link is kept so that
+		// restoring the agent restores the delegation too.
+		if link.Delegate.ID == uuid.Nil {
+			continue
+		}
+		delegate := link.Delegate
+		delegates = append(delegates, services.Delegate{
+			Agent:       &delegate,
+			Description: link.Description,
+		})
+	}
+	return delegates, nil
+}
+
+func (s *delegateSource) Credentials(userID uint, provider string) (*shared.ProviderCredentials, error) {
+	return s.h.SettingsHandler.GetProviderCredentials(userID, provider)
+}
+
+func (s *delegateSource) RecordUsage(agent, parent *shared.AgentConfig, usage *shared.Usage) {
+	if usage == nil {
+		return
+	}
+
+	usageMetric := shared.UsageMetric{
+		UserID:           agent.UserID,
+		AgentID:          agent.ID,
+		ParentAgentID:    &parent.ID,
+		SessionID:        s.sessionID,
+		Provider:         agent.Provider,
+		Model:            agent.LLMModel,
+		AgentVersion:     agent.Version,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+
+	if err := s.h.DB.Create(&usageMetric).Error; err != nil {
+		log.Printf("Warning: Failed to save usage metrics for delegated agent %s: %v", agent.ID, err)
+		return
+	}
+	s.h.checkUsageThresholds(agent.UserID)
+}
+
+// newLLMService creates the LLM service for a request, with usage of
+// delegated agents recorded against sessionID, which may be nil, and the
+// memories of memory, the person the request comes from. A nil memory turns
+// memory off. Failed tool calls are sent to the owner's event webhooks.
+func (h *Handler) newLLMService(sessionID *uuid.UUID, memory *memoryScope) *services.LLMService {
+	var memories services.MemorySource
+	if memory != nil {
+		memories = &memorySource{h: h, scope: memory}
+	}
+	return services.NewLLMService(h.MCPConnManager, &delegateSource{h: h, sessionID: sessionID}, &knowledgeSource{h: h}, memories, &eventSink{h: h})
+}
+
+// delegatesTo reports whether start delegates to agentID, directly or
+// through other agents.
+func (h *Handler) delegatesTo(start, agentID uuid.UUID) (bool, error) {
+	seen := map[uuid.UUID]bool{start: true}
+	queue := []uuid.UUID{start}
+	for len(queue) > 0 {
+		var next []uuid.UUID
+		if err := h.DB.Model(&shared.AgentDelegate{}).Where("agent_id IN ?", queue).Pluck("delegate_id", &next).Error; err != nil {
+			return false, err
+		}
+		queue = nil
+		for _, id := range next {
+			if id == agentID {
+				return true, nil
+			}
+			if !seen[id] {
+				seen[id] = true
+				queue = append(queue, id)
+			}
+		}
+	}
+	return false, nil
+}
+
+// HandleListAgentDelegates lists the agents the user's agent can delegate to.
+func (h *Handler) HandleListAgentDelegates(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	delegates := []shared.AgentDelegate{}
+	if err := h.DB.Preload("Delegate").Where("agent_id = ?", agent.ID).Order("created_at ASC").Find(&delegates).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load delegates")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"delegates": delegates,
+	})
+}
+
+// HandleAddAgentDelegate lets the user's agent delegate to another of the
+// user's agents.
+func (h *Handler) HandleAddAgentDelegate(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	var req shared.AddAgentDelegateRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+	if req.DelegateID == uuid.Nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "delegate_id is required")
+	}
+	if req.DelegateID == agent.ID {
+		return echo.NewHTTPError(http.StatusBadRequest, "An agent cannot delegate to itself")
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	if len(req.Description) > maxDelegateDescriptionLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "description is too long")
+	}
+
+	var delegate shared.AgentConfig
+	if err := h.DB.Where(&shared.AgentConfig{UserID: agent.UserID, ID: req.DelegateID}).First(&delegate).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Delegate agent not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load delegate agent")
+	}
+
+	var count int64
+	if err := h.DB.Model(&shared.AgentDelegate{}).Where("agent_id = ? AND delegate_id = ?", agent.ID, delegate.ID).Count(&count).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check delegates")
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "Agent already delegates to this agent")
+	}
+
+	cycle, err := h.delegatesTo(delegate.ID, agent.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check delegates")
+	}
+	if cycle {
+		return echo.NewHTTPError(http.StatusBadRequest, "Delegate agent already delegates to this agent, directly or through other agents")
+	}
+
+	link := shared.AgentDelegate{
+		AgentID:     agent.ID,
+		DelegateID:  delegate.ID,
+		Description: req.Description,
+	}
+	if err := h.DB.Create(&link).Error; err != nil {
+		if strings.Contains(err.Error(), "idx_agent_delegate") || strings.Contains(err.Error(), "duplicate") {
+			return echo.NewHTTPError(http.StatusConflict, "Agent already delegates to this agent")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to add delegate")
+	}
+	link.Delegate = delegate
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"delegate": link,
+	})
+}
+
+// HandleRemoveAgentDelegate stops the user's agent from delegating to
+// another agent.
+func (h *Handler) HandleRemoveAgentDelegate(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	delegateID, err := uuid.Parse(c.Param("delegateId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid delegateId format")
+	}
+
+	result := h.DB.Where("agent_id = ? AND delegate_id = ?", agent.ID, delegateID).Delete(&shared.AgentDelegate{})
+	if result.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to remove delegate")
+	}
+	if result.RowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Delegate not found")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Delegate removed successfully",
+	})
+}
@@ -0,0 +1,630 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/middleware"
+	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxEventWebhookDescriptionLength = 500
+
+	// eventDeliveryBatch bounds the deliveries one worker claims per tick.
+	eventDeliveryBatch = 20
+
+	// maxEventDeliveryAttempts bounds the attempts to deliver an event. The
+	// wait after a failed attempt starts at eventRetryDelay and doubles
+	// after each one, so the attempts span about an hour.
+	maxEventDeliveryAttempts = 8
+	eventRetryDelay          = 30 * time.Second
+
+	// eventDeliveryLease is how long a claimed delivery is hidden from
+	// other workers. A delivery whose worker stopped mid-attempt is tried
+	// again after it.
+	eventDeliveryLease = 2 * time.Minute
+
+	// eventDeliveryRetention is how long finished deliveries are kept.
+	eventDeliveryRetention = 30 * 24 * time.Hour
+)
+
+// publishEvent queues an event for each of the user's enabled event webhooks
+// that subscribes to it. Failures are logged, so that reporting an event
+// never fails what it reports.
+func (h *Handler) publishEvent(userID uint, eventType string, data any) {
+	var webhooks []shared.EventWebhook
+	if err := h.DB.Where("user_id = ? AND enabled = ?", userID, true).Find(&webhooks).Error; err != nil {
+		log.Printf("Warning: Failed to load event webhooks of user %d: %v", userID, err)
+		return
+	}
+
+	var subscribed []shared.EventWebhook
+	for _, webhook := range webhooks {
+		if slices.Contains(webhook.Events, eventType) {
+			subscribed = append(subscribed, webhook)
+		}
+	}
+	h.queueEvent(subscribed, eventType, data)
+}
+
+// queueEvent queues a delivery of a new event to each webhook.
+func (h *Handler) queueEvent(webhooks []shared.EventWebhook, eventType string, data any) {
+	if len(webhooks) == 0 {
+		return
+	}
+
+	event := shared.Event{
+		ID:        uuid.New(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Warning: Failed to encode %s event: %v", eventType, err)
+		return
+	}
+
+	now := time.Now()
+	deliveries := make([]shared.EventDelivery, len(webhooks))
+	for i, webhook := range webhooks {
+		deliveries[i] = shared.EventDelivery{
+			WebhookID:     webhook.ID,
+			UserID:        webhook.UserID,
+			EventID:       event.ID,
+			EventType:     eventType,
+			Payload:       payload,
+			Status:        "pending",
+			NextAttemptAt: &now,
+		}
+	}
+	if err := h.DB.Create(&deliveries).Error; err != nil {
+		log.Printf("Warning: Failed to queue %s event: %v", eventType, err)
+	}
+}
+
+// publishRunEvent sends run.completed for a run of an agent from source, or
+// run.failed when err is non-nil.
+func (h *Handler) publishRunEvent(agent *shared.AgentConfig, source string, sessionID *uuid.UUID, response *shared.AgentInferenceResponse, err error) {
+	data := shared.RunEventData{
+		AgentID:   agent.ID,
+		AgentName: agent.Name,
+		Source:    source,
+		SessionID: sessionID,
+	}
+	eventType := shared.EventRunCompleted
+	if err != nil {
+		eventType = shared.EventRunFailed
+		data.Error = err.Error()
+	}
+	if response != nil {
+		data.Usage = response.Usage
+		if err == nil {
+			data.Response = response.Response
+			data.Structured = response.Structured
+		}
+	}
+	h.publishEvent(agent.UserID, eventType, data)
+}
+
+// eventSink sends tool.error events for the tool calls of runs.
+type eventSink struct {
+	h *Handler
+}
+
+func (s *eventSink) ToolError(agent *shared.AgentConfig, toolName string, err error) {
+	s.h.publishEvent(agent.UserID, shared.EventToolError, shared.ToolErrorEventData{
+		AgentID:   agent.ID,
+		AgentName: agent.Name,
+		ToolName:  toolName,
+		Error:     err.Error(),
+	})
+}
+
+// checkUsageThresholds sends usage.threshold_crossed to the user's event
+// webhooks whose threshold the month's usage has reached, once a month each.
+func (h *Handler) checkUsageThresholds(userID uint) {
+	var webhooks []shared.EventWebhook
+	if err := h.DB.Where("user_id = ? AND enabled = ? AND usage_threshold > 0", userID, true).Find(&webhooks).Error; err != nil {
+		log.Printf("Warning: Failed to load event webhooks of user %d: %v", userID, err)
+		return
+	}
+	webhooks = slices.DeleteFunc(webhooks, func(webhook shared.EventWebhook) bool {
+		return !slices.Contains(webhook.Events, shared.EventUsageThresholdCrossed)
+	})
+	if len(webhooks) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var used int64
+	if err := h.DB.Model(&shared.UsageMetric{}).
+		Where("user_id = ? AND created_at >= ?", userID, monthStart).
+		Select("COALESCE(SUM(total_tokens), 0)").
+		Scan(&used).Error; err != nil {
+		log.Printf("Warning: Failed to sum usage of user %d: %v", userID, err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if used < int64(webhook.UsageThreshold) {
+			continue
+		}
+		// Marking the threshold crossed first means concurrent runs send
+		// the event once.
+		result := h.DB.Model(&shared.EventWebhook{}).
+			Where("id = ? AND (usage_threshold_crossed_at IS NULL OR usage_threshold_crossed_at < ?)", webhook.ID, monthStart).
+			Update("usage_threshold_crossed_at", now)
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+		h.queueEvent([]shared.EventWebhook{webhook}, shared.EventUsageThresholdCrossed, shared.UsageThresholdEventData{
+			Threshold:   webhook.UsageThreshold,
+			TokensUsed:  used,
+			PeriodStart: monthStart,
+		})
+	}
+}
+
+// StartEventDeliveryWorker delivers queued events every interval. Deliveries
+// are claimed with row locks, so any number of replicas can run the worker
+// without an event being sent twice at once.
+func (h *Handler) StartEventDeliveryWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			deliveries, err := h.claimEventDeliveries()
+			if err != nil {
+				log.Printf("Event delivery worker error: %v", err)
+				continue
+			}
+			for _, delivery := range deliveries {
+				go h.deliverEvent(delivery)
+			}
+
+			if err := h.DB.Where("created_at < ? AND status <> ?", time.Now().Add(-eventDeliveryRetention), "pending").
+				Delete(&shared.EventDelivery{}).Error; err != nil {
+				log.Printf("Warning: Failed to delete old event deliveries: %v", err)
+			}
+		}
+	}()
+
+	log.Printf("Started event delivery worker with interval: %v", interval)
+}
+
+// claimEventDeliveries claims the deliveries due for an attempt by moving
+// their next attempt past the lease.
+func (h *Handler) claimEventDeliveries() ([]shared.EventDelivery, error) {
+	now := time.Now()
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var deliveries []shared.EventDelivery
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("status = ? AND next_attempt_at <= ?", "pending", now).
+		Order("next_attempt_at ASC").
+		Limit(eventDeliveryBatch).
+		Find(&deliveries).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		tx.Rollback()
+		return nil, nil
+	}
+
+	ids := make([]uuid.UUID, len(deliveries))
+	for i, delivery := range deliveries {
+		ids[i] = delivery.ID
+	}
+	if err := tx.Model(&shared.EventDelivery{}).Where("id IN ?", ids).
+		Update("next_attempt_at", now.Add(eventDeliveryLease)).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// deliverEvent makes one attempt to deliver an event and schedules the next
+// attempt if it fails. Events for webhooks that were deleted or disabled
+// are not retried.
+func (h *Handler) deliverEvent(delivery shared.EventDelivery) {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.ResponseStatus = 0
+
+	var webhook shared.EventWebhook
+	var err error
+	retry := true
+	if err = h.DB.Where("id = ?", delivery.WebhookID).First(&webhook).Error; err != nil {
+		err, retry = fmt.Errorf("webhook not found"), false
+	} else if !webhook.Enabled {
+		err, retry = fmt.Errorf("webhook is disabled"), false
+	} else {
+		delivery.ResponseStatus, err = h.postEvent(&webhook, &delivery)
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status = "succeeded"
+		delivery.NextAttemptAt = nil
+		delivery.Error = ""
+	case retry && delivery.Attempts < maxEventDeliveryAttempts:
+		next := now.Add(eventRetryDelay << (delivery.Attempts - 1))
+		delivery.NextAttemptAt = &next
+		delivery.Error = err.Error()
+	default:
+		delivery.Status = "failed"
+		delivery.NextAttemptAt = nil
+		delivery.Error = err.Error()
+	}
+
+	if err := h.DB.Model(&delivery).Updates(map[string]any{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"next_attempt_at": delivery.NextAttemptAt,
+		"last_attempt_at": delivery.LastAttemptAt,
+		"response_status": delivery.ResponseStatus,
+		"error":           delivery.Error,
+	}).Error; err != nil {
+		log.Printf("Warning: Failed to save event delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// postEvent posts an event to its webhook, signed with the webhook's secret
+// in the X-Glyfs-Signature and X-Glyfs-Timestamp headers, and returns the
+// status it answered with.
+func (h *Handler) postEvent(webhook *shared.EventWebhook, delivery *shared.EventDelivery) (int, error) {
+	encryptionService, err := services.NewEncryptionService()
+	if err != nil {
+		return 0, err
+	}
+	secret, err := encryptionService.Decrypt(webhook.Secret)
+	if err != nil {
+		return 0, fmt.Errorf("decrypting secret: %w", err)
+	}
+
+	timestamp := time.Now().Unix()
+	return postJSON(context.Background(), webhook.URL, delivery.Payload, map[string]string{
+		"User-Agent":        "Glyfs-Webhooks",
+		"X-Glyfs-Signature": services.SignWebhookPayload(secret, timestamp, delivery.Payload),
+		"X-Glyfs-Timestamp": strconv.FormatInt(timestamp, 10),
+		"X-Glyfs-Event":     delivery.EventType,
+		"X-Glyfs-Delivery":  delivery.ID.String(),
+	})
+}
+
+// validateEventWebhook checks an event webhook's URL, events and usage
+// threshold.
+func validateEventWebhook(webhook *shared.EventWebhook) error {
+	if !isHTTPURL(webhook.URL) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid url: must be an http or https URL")
+	}
+	if len(webhook.Description) > maxEventWebhookDescriptionLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "description is too long")
+	}
+	if len(webhook.Events) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "events is required")
+	}
+	for _, event := range webhook.Events {
+		if !slices.Contains(shared.EventTypes, event) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown event %q: must be one of %s", event, strings.Join(shared.EventTypes, ", ")))
+		}
+	}
+	slices.Sort(webhook.Events)
+	webhook.Events = slices.Compact(webhook.Events)
+
+	if webhook.UsageThreshold < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "usage_threshold must not be negative")
+	}
+	if slices.Contains(webhook.Events, shared.EventUsageThresholdCrossed) && webhook.UsageThreshold == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "usage_threshold is required for usage.threshold_crossed")
+	}
+	return nil
+}
+
+// userEventWebhook loads the user's event webhook in the webhookId path
+// parameter.
+func (h *Handler) userEventWebhook(c echo.Context) (*shared.EventWebhook, error) {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+	webhookID, err := uuid.Parse(c.Param("webhookId"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid webhookId format")
+	}
+
+	var webhook shared.EventWebhook
+	if err := h.DB.Where("id = ? AND user_id = ?", webhookID, userID).First(&webhook).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Event webhook not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load event webhook")
+	}
+	return &webhook, nil
+}
+
+// HandleListEventWebhooks lists the user's event webhooks.
+func (h *Handler) HandleListEventWebhooks(c echo.Context) error {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	webhooks := []shared.EventWebhook{}
+	if err := h.DB.Where("user_id = ?", userID).Order("created_at ASC").Find(&webhooks).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load event webhooks")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"webhooks": webhooks,
+	})
+}
+
+// HandleCreateEventWebhook subscribes a URL to the user's events. The secret
+// is only returned here and when it is rotated.
+func (h *Handler) HandleCreateEventWebhook(c echo.Context) error {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	var req shared.CreateEventWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+
+	webhook := shared.EventWebhook{
+		UserID:         userID,
+		URL:            strings.TrimSpace(req.URL),
+		Description:    strings.TrimSpace(req.Description),
+		Events:         req.Events,
+		UsageThreshold: req.UsageThreshold,
+		Enabled:        req.Enabled == nil || *req.Enabled,
+	}
+	if err := validateEventWebhook(&webhook); err != nil {
+		return err
+	}
+
+	secret, encrypted, err := encryptWebhookSecret(req.Secret)
+	if err != nil {
+		return err
+	}
+	webhook.Secret = encrypted
+
+	if err := h.PlanMiddleware.CheckResourceLimit(userID, middleware.ResourceEventWebhook); err != nil {
+		return err
+	}
+
+	if err := h.DB.Create(&webhook).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create event webhook")
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"webhook": webhook,
+		"secret":  secret,
+	})
+}
+
+// HandleGetEventWebhook returns one of the user's event webhooks.
+func (h *Handler) HandleGetEventWebhook(c echo.Context) error {
+	webhook, err := h.userEventWebhook(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"webhook": webhook,
+	})
+}
+
+// HandleUpdateEventWebhook changes one of the user's event webhooks. Changing
+// the usage threshold lets it be crossed again this month.
+func (h *Handler) HandleUpdateEventWebhook(c echo.Context) error {
+	webhook, err := h.userEventWebhook(c)
+	if err != nil {
+		return err
+	}
+
+	var req shared.UpdateEventWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+
+	if req.URL != nil {
+		webhook.URL = strings.TrimSpace(*req.URL)
+	}
+	if req.Description != nil {
+		webhook.Description = strings.TrimSpace(*req.Description)
+	}
+	if req.Events != nil {
+		webhook.Events = *req.Events
+	}
+	if req.UsageThreshold != nil && *req.UsageThreshold != webhook.UsageThreshold {
+		webhook.UsageThreshold = *req.UsageThreshold
+		webhook.UsageThresholdCrossedAt = nil
+	}
+	if req.Enabled != nil {
+		webhook.Enabled = *req.Enabled
+	}
+	if err := validateEventWebhook(webhook); err != nil {
+		return err
+	}
+
+	if err := h.DB.Save(webhook).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update event webhook")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"webhook": webhook,
+	})
+}
+
+// HandleRotateEventWebhookSecret replaces the secret of one of the user's
+// event webhooks. Deliveries are signed with the new secret from then on,
+// including retries of earlier events.
+func (h *Handler) HandleRotateEventWebhookSecret(c echo.Context) error {
+	webhook, err := h.userEventWebhook(c)
+	if err != nil {
+		return err
+	}
+
+	var req shared.RotateWebhookSecretRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+
+	secret, encrypted, err := encryptWebhookSecret(req.Secret)
+	if err != nil {
+		return err
+	}
+	if err := h.DB.Model(webhook).Update("secret", encrypted).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update secret")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"webhook": webhook,
+		"secret":  secret,
+	})
+}
+
+// HandleDeleteEventWebhook deletes one of the user's event webhooks with its
+// deliveries.
+func (h *Handler) HandleDeleteEventWebhook(c echo.Context) error {
+	webhook, err := h.userEventWebhook(c)
+	if err != nil {
+		return err
+	}
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err := tx.Where("webhook_id = ?", webhook.ID).Delete(&shared.EventDelivery{}).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete event deliveries")
+	}
+	if err := tx.Delete(webhook).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete event webhook")
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit transaction")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Event webhook deleted successfully",
+	})
+}
+
+// HandleListEventDeliveries lists the latest deliveries of one of the user's
+// event webhooks, newest first. The status query parameter filters them, and
+// limit defaults to 20.
+func (h *Handler) HandleListEventDeliveries(c echo.Context) error {
+	webhook, err := h.userEventWebhook(c)
+	if err != nil {
+		return err
+	}
+
+	limit := 20
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > 100 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and 100")
+		}
+	}
+
+	query := h.DB.Where("webhook_id = ?", webhook.ID)
+	if status := c.QueryParam("status"); status != "" {
+		if status != "pending" && status != "succeeded" && status != "failed" {
+			return echo.NewHTTPError(http.StatusBadRequest, "status must be 'pending', 'succeeded' or 'failed'")
+		}
+		query = query.Where("status = ?", status)
+	}
+
+	deliveries := []shared.EventDelivery{}
+	if err := query.Order("created_at DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load event deliveries")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"deliveries": deliveries,
+	})
+}
+
+// HandleRedeliverEvent queues a new delivery of the event of one of the
+// user's event webhook's deliveries, with a fresh set of attempts.
+func (h *Handler) HandleRedeliverEvent(c echo.Context) error {
+	webhook, err := h.userEventWebhook(c)
+	if err != nil {
+		return err
+	}
+	if !webhook.Enabled {
+		return echo.NewHTTPError(http.StatusConflict, "Event webhook is disabled")
+	}
+
+	deliveryID, err := uuid.Parse(c.Param("deliveryId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid deliveryId format")
+	}
+	var original shared.EventDelivery
+	if err := h.DB.Where("id = ? AND webhook_id = ?", deliveryID, webhook.ID).First(&original).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Delivery not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load delivery")
+	}
+
+	now := time.Now()
+	delivery := shared.EventDelivery{
+		WebhookID:     webhook.ID,
+		UserID:        webhook.UserID,
+		EventID:       original.EventID,
+		EventType:     original.EventType,
+		Payload:       original.Payload,
+		Status:        "pending",
+		NextAttemptAt: &now,
+	}
+	if err := h.DB.Create(&delivery).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to queue delivery")
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]any{
+		"delivery": delivery,
+	})
+}
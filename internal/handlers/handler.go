@@ -3,6 +3,7 @@ package handlers
 import (
 	"github.com/arnavsurve/glyfs/internal/middleware"
 	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/labstack/echo/v4"
 	"gorm.io/gorm"
 )
 
@@ -12,4 +13,19 @@ type Handler struct {
 	SettingsHandler *SettingsHandler
 	OAuthHandler    *OAuthHandler
 	PlanMiddleware  *middleware.PlanMiddleware
+	Approvals       *services.ApprovalBroker
+	Generations     *services.GenerationRegistry
+	Streams         *services.StreamBuffer
+	Files           services.FileStore
+	Knowledge       *services.KnowledgeService
+}
+
+// requestAPIKeyID returns the ID of the API key a request was made with, or
+// nil for dashboard requests.
+func requestAPIKeyID(c echo.Context) *uint {
+	apiKeyID, ok := c.Get("api_key_id").(uint)
+	if !ok {
+		return nil
+	}
+	return &apiKeyID
 }
@@ -0,0 +1,432 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/arnavsurve/glyfs/internal/middleware"
+	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// maxKnowledgeBaseNameLength bounds the name of a knowledge base, which is
+// shown to agents in the search_knowledge tool.
+const maxKnowledgeBaseNameLength = 100
+
+// knowledgeSource gives runs the knowledge bases of their agents.
+type knowledgeSource struct {
+	h *Handler
+}
+
+func (s *knowledgeSource) KnowledgeBases(ctx context.Context, agentID uuid.UUID) ([]shared.KnowledgeBase, error) {
+	var kbs []shared.KnowledgeBase
+	err := s.h.DB.WithContext(ctx).
+		Joins("JOIN agent_knowledge_bases ON agent_knowledge_bases.knowledge_base_id = knowledge_bases.id").
+		Where("agent_knowledge_bases.agent_id = ?", agentID).
+		Order("agent_knowledge_bases.created_at ASC").
+		Find(&kbs).Error
+	return kbs, err
+}
+
+func (s *knowledgeSource) Search(ctx context.Context, userID uint, kbs []shared.KnowledgeBase, query string, k int) ([]services.ChunkMatch, error) {
+	return s.h.Knowledge.Search(ctx, kbs, query, k, func(provider string) (*shared.ProviderCredentials, error) {
+		return s.h.SettingsHandler.GetProviderCredentials(userID, provider)
+	})
+}
+
+// FailInterruptedDocuments marks the documents whose processing was cut
+// short by a restart as failed, so they can be uploaded again.
+func (h *Handler) FailInterruptedDocuments() {
+	if err := h.DB.Model(&shared.KnowledgeDocument{}).
+		Where("status = ?", "processing").
+		Updates(map[string]any{"status": "failed", "error": "Processing was interrupted. Upload the document again."}).Error; err != nil {
+		log.Printf("Warning: Failed to update interrupted knowledge documents: %v", err)
+	}
+}
+
+// userKnowledgeBase loads the knowledge base in the knowledgeBaseId path
+// parameter if it belongs to the user making the request.
+func (h *Handler) userKnowledgeBase(c echo.Context) (*shared.KnowledgeBase, error) {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	kbID, err := uuid.Parse(c.Param("knowledgeBaseId"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid knowledgeBaseId format")
+	}
+
+	var kb shared.KnowledgeBase
+	if err := h.DB.Where("id = ? AND user_id = ?", kbID, userID).First(&kb).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Knowledge base not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load knowledge base")
+	}
+	return &kb, nil
+}
+
+// HandleListKnowledgeBases lists the user's knowledge bases.
+func (h *Handler) HandleListKnowledgeBases(c echo.Context) error {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	kbs := []shared.KnowledgeBase{}
+	if err := h.DB.Where("user_id = ?", userID).Order("created_at ASC").Find(&kbs).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load knowledge bases")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"knowledge_bases": kbs,
+	})
+}
+
+// HandleCreateKnowledgeBase creates a knowledge base for the user.
+func (h *Handler) HandleCreateKnowledgeBase(c echo.Context) error {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	var req shared.CreateKnowledgeBaseRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	if len(req.Name) > maxKnowledgeBaseNameLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is too long")
+	}
+
+	if req.EmbeddingProvider == "" {
+		req.EmbeddingProvider = shared.OpenAI
+	}
+	defaultModel, ok := services.DefaultEmbeddingModel(req.EmbeddingProvider)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "embedding_provider must be 'openai', 'google' or 'custom'")
+	}
+	req.EmbeddingModel = strings.TrimSpace(req.EmbeddingModel)
+	if req.EmbeddingModel == "" {
+		if defaultModel == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "embedding_model is required for custom endpoints")
+		}
+		req.EmbeddingModel = defaultModel
+	}
+
+	if err := h.PlanMiddleware.CheckResourceLimit(userID, middleware.ResourceKnowledgeBase); err != nil {
+		return err
+	}
+
+	kb := shared.KnowledgeBase{
+		UserID:            userID,
+		Name:              req.Name,
+		Description:       strings.TrimSpace(req.Description),
+		EmbeddingProvider: string(req.EmbeddingProvider),
+		EmbeddingModel:    req.EmbeddingModel,
+	}
+	if err := h.DB.Create(&kb).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create knowledge base")
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"knowledge_base": kb,
+	})
+}
+
+// HandleGetKnowledgeBase returns one of the user's knowledge bases with its
+// documents.
+func (h *Handler) HandleGetKnowledgeBase(c echo.Context) error {
+	kb, err := h.userKnowledgeBase(c)
+	if err != nil {
+		return err
+	}
+
+	kb.Documents = []shared.KnowledgeDocument{}
+	if err := h.DB.Where("knowledge_base_id = ?", kb.ID).Order("created_at ASC").Find(&kb.Documents).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load documents")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"knowledge_base": kb,
+	})
+}
+
+// HandleDeleteKnowledgeBase deletes one of the user's knowledge bases with
+// its documents, and detaches it from agents.
+func (h *Handler) HandleDeleteKnowledgeBase(c echo.Context) error {
+	kb, err := h.userKnowledgeBase(c)
+	if err != nil {
+		return err
+	}
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err := tx.Where("knowledge_base_id = ?", kb.ID).Delete(&shared.AgentKnowledgeBase{}).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to detach knowledge base from agents")
+	}
+	if err := tx.Where("knowledge_base_id = ?", kb.ID).Delete(&shared.KnowledgeDocument{}).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete knowledge base documents")
+	}
+	if err := tx.Delete(kb).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete knowledge base")
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit transaction")
+	}
+	if err := h.Knowledge.Store.DeleteKnowledgeBase(c.Request().Context(), kb.ID); err != nil {
+		log.Printf("Failed to delete chunks of knowledge base %s: %v\n", kb.ID, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Knowledge base deleted successfully",
+	})
+}
+
+// documentContentType returns the content type of an uploaded document:
+// Markdown by its extension, other types by their content.
+func documentContentType(filename string, data []byte) string {
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if contentType == "text/plain" {
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".md", ".markdown":
+			return "text/markdown"
+		}
+	}
+	return contentType
+}
+
+// HandleUploadKnowledgeDocument adds the file in the request's multipart
+// "file" field to one of the user's knowledge bases. The document is chunked
+// and embedded in the background; poll the knowledge base for its status.
+func (h *Handler) HandleUploadKnowledgeDocument(c echo.Context) error {
+	kb, err := h.userKnowledgeBase(c)
+	if err != nil {
+		return err
+	}
+
+	creds, err := h.SettingsHandler.GetProviderCredentials(kb.UserID, kb.EmbeddingProvider)
+	if err != nil || creds == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Please configure your %s API key in Settings", kb.EmbeddingProvider))
+	}
+
+	maxBytes, err := h.PlanMiddleware.KnowledgeDocumentMaxBytes(kb.UserID)
+	if err != nil {
+		return err
+	}
+	// Leave room for the multipart framing around the file.
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxBytes+1<<20)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Document is too large. The limit is %d MB.", maxBytes>>20))
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, "file is required as multipart form data")
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read file")
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read file")
+	}
+	if len(data) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "file is empty")
+	}
+	if int64(len(data)) > maxBytes {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Document is too large. The limit is %d MB.", maxBytes>>20))
+	}
+
+	filename := filepath.Base(fileHeader.Filename)
+	if filename == "." || filename == string(filepath.Separator) {
+		filename = "document"
+	}
+	filename = truncateFilename(filename)
+
+	contentType := documentContentType(filename, data)
+	if !slices.Contains(services.KnowledgeDocumentTypes, contentType) {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, fmt.Sprintf("%s documents are not supported. Upload Markdown, plain text or PDF.", contentType))
+	}
+
+	doc := shared.KnowledgeDocument{
+		ID:              uuid.New(),
+		KnowledgeBaseID: kb.ID,
+		Filename:        filename,
+		ContentType:     contentType,
+		Size:            int64(len(data)),
+		Status:          "processing",
+	}
+	if err := h.DB.Create(&doc).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save document")
+	}
+
+	go h.ingestDocument(kb, doc, data, creds)
+
+	return c.JSON(http.StatusAccepted, map[string]any{
+		"document": doc,
+	})
+}
+
+// ingestDocument chunks and embeds a document and records the outcome on it.
+func (h *Handler) ingestDocument(kb *shared.KnowledgeBase, doc shared.KnowledgeDocument, data []byte, creds *shared.ProviderCredentials) {
+	ctx := context.Background()
+	count, err := h.Knowledge.Ingest(ctx, kb, &doc, data, creds)
+	if err != nil {
+		log.Printf("Failed to process knowledge document %s: %v\n", doc.ID, err)
+		h.DB.Model(&doc).Updates(map[string]any{"status": "failed", "error": err.Error()})
+		return
+	}
+
+	result := h.DB.Model(&doc).Where("status = ?", "processing").Updates(map[string]any{"status": "ready", "chunk_count": count})
+	if result.Error == nil && result.RowsAffected == 0 {
+		// The document was deleted while it was processed.
+		h.Knowledge.Store.DeleteDocument(ctx, doc.ID)
+	}
+}
+
+// HandleDeleteKnowledgeDocument removes a document and its chunks from one
+// of the user's knowledge bases.
+func (h *Handler) HandleDeleteKnowledgeDocument(c echo.Context) error {
+	kb, err := h.userKnowledgeBase(c)
+	if err != nil {
+		return err
+	}
+
+	docID, err := uuid.Parse(c.Param("documentId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid documentId format")
+	}
+
+	result := h.DB.Where("id = ? AND knowledge_base_id = ?", docID, kb.ID).Delete(&shared.KnowledgeDocument{})
+	if result.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete document")
+	}
+	if result.RowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Document not found")
+	}
+	if err := h.Knowledge.Store.DeleteDocument(c.Request().Context(), docID); err != nil {
+		log.Printf("Failed to delete chunks of knowledge document %s: %v\n", docID, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Document deleted successfully",
+	})
+}
+
+// HandleListAgentKnowledgeBases lists the knowledge bases of the user's
+// agent.
+func (h *Handler) HandleListAgentKnowledgeBases(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	links := []shared.AgentKnowledgeBase{}
+	if err := h.DB.Preload("KnowledgeBase").Where("agent_id = ?", agent.ID).Order("created_at ASC").Find(&links).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load knowledge bases")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"knowledge_bases": links,
+	})
+}
+
+// HandleAttachKnowledgeBase lets the user's agent search one of the user's
+// knowledge bases.
+func (h *Handler) HandleAttachKnowledgeBase(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	var req shared.AttachKnowledgeBaseRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+	if req.KnowledgeBaseID == uuid.Nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "knowledge_base_id is required")
+	}
+
+	var kb shared.KnowledgeBase
+	if err := h.DB.Where("id = ? AND user_id = ?", req.KnowledgeBaseID, agent.UserID).First(&kb).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Knowledge base not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load knowledge base")
+	}
+
+	link := shared.AgentKnowledgeBase{
+		AgentID:         agent.ID,
+		KnowledgeBaseID: kb.ID,
+	}
+	if err := h.DB.Create(&link).Error; err != nil {
+		if strings.Contains(err.Error(), "idx_agent_knowledge_base") || strings.Contains(err.Error(), "duplicate") {
+			return echo.NewHTTPError(http.StatusConflict, "Knowledge base is already attached to this agent")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to attach knowledge base")
+	}
+	link.KnowledgeBase = kb
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"knowledge_base": link,
+	})
+}
+
+// HandleDetachKnowledgeBase stops the user's agent from searching a
+// knowledge base.
+func (h *Handler) HandleDetachKnowledgeBase(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	kbID, err := uuid.Parse(c.Param("knowledgeBaseId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid knowledgeBaseId format")
+	}
+
+	result := h.DB.Where("agent_id = ? AND knowledge_base_id = ?", agent.ID, kbID).Delete(&shared.AgentKnowledgeBase{})
+	if result.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to detach knowledge base")
+	}
+	if result.RowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Knowledge base is not attached to this agent")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Knowledge base detached successfully",
+	})
+}
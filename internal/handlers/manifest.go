@@ -0,0 +1,416 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/arnavsurve/glyfs/internal/middleware"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// maxManifestSize bounds the body of an import request.
+const maxManifestSize = 1 << 20
+
+// secretPlaceholder matches the ${secret:NAME} placeholders written in place
+// of secrets on export.
+var secretPlaceholder = regexp.MustCompile(`\$\{secret:([A-Za-z0-9_]+)\}`)
+
+var nonSecretNameChars = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// secretName derives a placeholder name such as GITHUB_HEADER_AUTHORIZATION
+// from a server name and the secret's place in it.
+func secretName(parts ...string) string {
+	name := nonSecretNameChars.ReplaceAllString(strings.ToUpper(strings.Join(parts, "_")), "_")
+	return strings.Trim(name, "_")
+}
+
+func placeholder(name string) string {
+	return "${secret:" + name + "}"
+}
+
+// HandleExportAgent returns an agent and its MCP servers as a manifest, in
+// JSON or, with ?format=yaml, YAML. The server URL and headers marked
+// sensitive and all environment variables are replaced by placeholders.
+func (h *Handler) HandleExportAgent(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "yaml" {
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be 'json' or 'yaml'")
+	}
+
+	var associations []shared.AgentMCPServer
+	if err := h.DB.Preload("MCPServer").Where("agent_id = ?", agent.ID).
+		Order("created_at ASC").Find(&associations).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load MCP servers")
+	}
+
+	manifest := shared.AgentManifest{
+		ManifestVersion: shared.AgentManifestVersion,
+		Name:            agent.Name,
+		Provider:        shared.InferenceProvider(agent.Provider),
+		Model:           agent.LLMModel,
+		SystemPrompt:    agent.SystemPrompt,
+		MaxTokens:       agent.MaxTokens,
+		Temperature:     agent.Temperature,
+
+		ToolResultHistoryLimit: agent.ToolResultHistoryLimit,
+
+		ContextStrategy:       shared.ContextStrategy(agent.ContextStrategy),
+		ContextBudget:         agent.ContextBudget,
+		ContextWindowMessages: agent.ContextWindowMessages,
+
+		PromptVariables: agent.PromptVariables,
+
+		ResponseSchema: agent.ResponseSchema,
+
+		KnowledgeMode: shared.KnowledgeMode(agent.KnowledgeMode),
+		KnowledgeTopK: agent.KnowledgeTopK,
+
+		MemoryEnabled:     agent.MemoryEnabled,
+		MemoryTokenBudget: agent.MemoryTokenBudget,
+	}
+	for _, assoc := range associations {
+		// Associations of deleted servers have no server to export.
+		if assoc.MCPServer.ID == uuid.Nil {
+			continue
+		}
+		manifest.MCPServers = append(manifest.MCPServers, exportMCPServer(&assoc))
+	}
+
+	filename := secretName(agent.Name)
+	if filename == "" {
+		filename = "agent"
+	}
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, strings.ToLower(filename), format))
+
+	if format == "yaml" {
+		data, err := yaml.Marshal(manifest)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to write manifest")
+		}
+		return c.Blob(http.StatusOK, "application/yaml", data)
+	}
+	return c.JSONPretty(http.StatusOK, manifest, "  ")
+}
+
+// exportMCPServer describes an associated server with its secrets redacted.
+func exportMCPServer(assoc *shared.AgentMCPServer) shared.MCPServerManifest {
+	server := assoc.MCPServer
+
+	var sensitiveHeaders []string
+	if server.SensitiveHeaders != "" {
+		json.Unmarshal([]byte(server.SensitiveHeaders), &sensitiveHeaders)
+	}
+
+	enabled := assoc.Enabled
+	manifest := shared.MCPServerManifest{
+		Name:             server.Name,
+		Description:      server.Description,
+		ServerType:       server.ServerType,
+		ServerURL:        server.ServerURL,
+		Command:          server.Command,
+		Args:             server.Args,
+		Timeout:          server.Timeout,
+		MaxRetries:       server.MaxRetries,
+		SensitiveURL:     server.EncryptedURL,
+		SensitiveHeaders: sensitiveHeaders,
+
+		Enabled:               &enabled,
+		AllowedTools:          assoc.AllowedTools,
+		DeniedTools:           assoc.DeniedTools,
+		ApprovalRequiredTools: assoc.ApprovalRequiredTools,
+	}
+
+	if server.EncryptedURL {
+		manifest.ServerURL = placeholder(secretName(server.Name, "URL"))
+	}
+
+	if len(server.Headers) > 0 {
+		manifest.Headers = make(map[string]string, len(server.Headers))
+		for name, value := range server.Headers {
+			if slices.Contains(sensitiveHeaders, name) {
+				value = placeholder(secretName(server.Name, "HEADER", name))
+			}
+			manifest.Headers[name] = value
+		}
+	}
+
+	// Environment variables of stdio servers usually hold credentials and are
+	// not marked, so none of them are exported.
+	if len(server.Env) > 0 {
+		manifest.Env = make(map[string]string, len(server.Env))
+		for name := range server.Env {
+			manifest.Env[name] = placeholder(secretName(server.Name, "ENV", name))
+		}
+	}
+
+	return manifest
+}
+
+// bindImportRequest reads an import request as YAML when the content type
+// says so, and as JSON otherwise.
+func bindImportRequest(c echo.Context) (*shared.ImportAgentRequest, error) {
+	var req shared.ImportAgentRequest
+	if !strings.Contains(c.Request().Header.Get("Content-Type"), "yaml") {
+		if err := c.Bind(&req); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+		}
+		return &req, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxManifestSize+1))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Failed to read manifest")
+	}
+	if len(body) > maxManifestSize {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Manifest is too large")
+	}
+	if err := yaml.Unmarshal(body, &req); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid manifest: %v", err))
+	}
+	return &req, nil
+}
+
+// resolveSecrets replaces the placeholders in value with their secrets and
+// adds the names of secrets that were not supplied to missing.
+func resolveSecrets(value string, secrets map[string]string, missing map[string]bool) string {
+	return secretPlaceholder.ReplaceAllStringFunc(value, func(match string) string {
+		name := secretPlaceholder.FindStringSubmatch(match)[1]
+		secret, ok := secrets[name]
+		if !ok {
+			missing[name] = true
+			return match
+		}
+		return secret
+	})
+}
+
+// HandleImportAgent creates an agent and its MCP servers from a manifest. MCP
+// servers the user already has, by name and type, are reused and their
+// secrets are not needed. If any secret is missing nothing is created and the
+// response lists the missing names.
+func (h *Handler) HandleImportAgent(c echo.Context) error {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	req, err := bindImportRequest(c)
+	if err != nil {
+		return err
+	}
+
+	if req.ManifestVersion != shared.AgentManifestVersion {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unsupported manifest_version %d", req.ManifestVersion))
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+
+	createReq := req.CreateRequest()
+	if err := validateCreateAgentRequest(&createReq); err != nil {
+		return err
+	}
+
+	var existing []shared.MCPServer
+	if err := h.DB.Where("user_id = ?", userID).Find(&existing).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load MCP servers")
+	}
+
+	// Each server in the manifest is either an existing server or a new one.
+	serverIDs := make([]uuid.UUID, len(req.MCPServers))
+	newServers := make([]*CreateMCPServerRequest, len(req.MCPServers))
+	seen := make(map[string]bool)
+	missing := make(map[string]bool)
+	creating := 0
+	for i, def := range req.MCPServers {
+		if seen[def.Name] {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("MCP server %q appears more than once", def.Name))
+		}
+		seen[def.Name] = true
+
+		if err := shared.ValidateToolPatterns(def.AllowedTools, def.DeniedTools, def.ApprovalRequiredTools); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("MCP server %q: %v", def.Name, err))
+		}
+
+		if j := slices.IndexFunc(existing, func(s shared.MCPServer) bool {
+			return s.Name == def.Name && s.ServerType == def.ServerType
+		}); j >= 0 {
+			serverIDs[i] = existing[j].ID
+			continue
+		}
+
+		server := &CreateMCPServerRequest{
+			Name:             def.Name,
+			Description:      def.Description,
+			ServerURL:        resolveSecrets(def.ServerURL, req.Secrets, missing),
+			ServerType:       def.ServerType,
+			Command:          def.Command,
+			Args:             def.Args,
+			Timeout:          def.Timeout,
+			MaxRetries:       def.MaxRetries,
+			SensitiveURL:     def.SensitiveURL,
+			SensitiveHeaders: def.SensitiveHeaders,
+		}
+		if def.Headers != nil {
+			server.Headers = make(map[string]string, len(def.Headers))
+			for name, value := range def.Headers {
+				server.Headers[name] = resolveSecrets(value, req.Secrets, missing)
+			}
+		}
+		if def.Env != nil {
+			server.Env = make(map[string]string, len(def.Env))
+			for name, value := range def.Env {
+				server.Env[name] = resolveSecrets(value, req.Secrets, missing)
+			}
+		}
+		newServers[i] = server
+		creating++
+	}
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return echo.NewHTTPError(http.StatusBadRequest, map[string]any{
+			"message":         "Secrets are missing for the MCP servers in the manifest",
+			"missing_secrets": names,
+		})
+	}
+
+	if err := h.PlanMiddleware.CheckResourceLimit(userID, middleware.ResourceAgent); err != nil {
+		return err
+	}
+	if creating > 0 {
+		if err := h.PlanMiddleware.CheckResourceLimitN(userID, middleware.ResourceMCPServer, creating); err != nil {
+			return err
+		}
+	}
+
+	hasKey, err := h.SettingsHandler.CheckAPIKeyForProvider(userID, string(req.Provider))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check API key configuration")
+	}
+	if !hasKey {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Please configure your %s API key in Settings before creating an agent", req.Provider))
+	}
+
+	// Validate and encrypt every new server before anything is written.
+	servers := make([]*shared.MCPServer, len(req.MCPServers))
+	for i, serverReq := range newServers {
+		if serverReq == nil {
+			continue
+		}
+		server, err := newMCPServer(userID, serverReq)
+		if err != nil {
+			if he, ok := err.(*echo.HTTPError); ok {
+				he.Message = fmt.Sprintf("MCP server %q: %v", serverReq.Name, he.Message)
+			}
+			return err
+		}
+		servers[i] = server
+	}
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	agent := shared.AgentConfig{
+		UserID: userID,
+		Name:   req.Name,
+		AgentSettings: shared.AgentSettings{
+			Provider:     string(createReq.Provider),
+			LLMModel:     createReq.Model,
+			SystemPrompt: *createReq.SystemPrompt,
+			MaxTokens:    createReq.MaxTokens,
+			Temperature:  createReq.Temperature,
+
+			ToolResultHistoryLimit: createReq.ToolResultHistoryLimit,
+
+			ContextStrategy:       string(createReq.ContextStrategy),
+			ContextBudget:         createReq.ContextBudget,
+			ContextWindowMessages: createReq.ContextWindowMessages,
+
+			PromptVariables: createReq.PromptVariables,
+
+			ResponseSchema: createReq.ResponseSchema,
+
+			KnowledgeMode: string(createReq.KnowledgeMode),
+			KnowledgeTopK: createReq.KnowledgeTopK,
+
+			MemoryEnabled:     createReq.MemoryEnabled,
+			MemoryTokenBudget: createReq.MemoryTokenBudget,
+		},
+	}
+	if err := tx.Create(&agent).Error; err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "idx_user_agent_name_active") || strings.Contains(err.Error(), "duplicate") {
+			return echo.NewHTTPError(http.StatusConflict, "An active agent with this name already exists")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent")
+	}
+
+	if err := recordAgentVersion(tx, &agent, "Imported"); err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent version")
+	}
+
+	for i, def := range req.MCPServers {
+		if servers[i] != nil {
+			if err := tx.Create(servers[i]).Error; err != nil {
+				tx.Rollback()
+				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Failed to create MCP server %q", def.Name))
+			}
+			serverIDs[i] = servers[i].ID
+		}
+
+		association := shared.AgentMCPServer{
+			AgentID:     agent.ID,
+			MCPServerID: serverIDs[i],
+			Enabled:     def.Enabled == nil || *def.Enabled,
+
+			AllowedTools:          def.AllowedTools,
+			DeniedTools:           def.DeniedTools,
+			ApprovalRequiredTools: def.ApprovalRequiredTools,
+		}
+		if err := createAgentMCPServer(tx, &association); err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent association")
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit transaction")
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"message":             "Agent imported successfully",
+		"agent":               agent,
+		"mcp_servers_created": creating,
+		"mcp_servers_reused":  len(req.MCPServers) - creating,
+	})
+}
@@ -30,8 +30,10 @@ func NewMCPHandler(db *gorm.DB, mcpManager *services.MCPConnectionManager, planM
 type CreateMCPServerRequest struct {
 	Name             string            `json:"name" binding:"required"`
 	Description      string            `json:"description"`
-	ServerURL        string            `json:"server_url" binding:"required"`
-	ServerType       string            `json:"server_type" binding:"required,oneof=http sse"`
+	ServerURL        string            `json:"server_url"`
+	ServerType       string            `json:"server_type" binding:"required,oneof=http sse stdio"`
+	Command          string            `json:"command,omitempty"`
+	Args             []string          `json:"args,omitempty"`
 	Env              map[string]string `json:"env,omitempty"`
 	Timeout          int               `json:"timeout,omitempty"`
 	Headers          map[string]string `json:"headers,omitempty"`
@@ -45,6 +47,8 @@ type UpdateMCPServerRequest struct {
 	Name             *string           `json:"name"`
 	Description      *string           `json:"description"`
 	ServerURL        *string           `json:"server_url"`
+	Command          *string           `json:"command,omitempty"`
+	Args             []string          `json:"args,omitempty"`
 	Env              map[string]string `json:"env,omitempty"`
 	Timeout          *int              `json:"timeout,omitempty"`
 	Headers          map[string]string `json:"headers,omitempty"`
@@ -53,6 +57,12 @@ type UpdateMCPServerRequest struct {
 	SensitiveHeaders []string          `json:"sensitive_headers"`
 }
 
+type UpdateAgentMCPToolsRequest struct {
+	AllowedTools          []string `json:"allowed_tools"`
+	DeniedTools           []string `json:"denied_tools"`
+	ApprovalRequiredTools []string `json:"approval_required_tools"`
+}
+
 // RegisterMCPRoutes registers all MCP-related routes
 func (h *MCPHandler) RegisterMCPRoutes(router *echo.Group) {
 	mcpGroup := router.Group("/mcp")
@@ -71,6 +81,8 @@ func (h *MCPHandler) RegisterMCPRoutes(router *echo.Group) {
 	mcpGroup.POST("/agents/:agent_id/servers/:server_id", h.AssociateAgentMCPServer)
 	mcpGroup.DELETE("/agents/:agent_id/servers/:server_id", h.DisassociateAgentMCPServer)
 	mcpGroup.PUT("/agents/:agent_id/servers/:server_id/toggle", h.ToggleAgentMCPServer)
+	mcpGroup.GET("/agents/:agent_id/servers/:server_id/tools", h.GetAgentMCPServerTools)
+	mcpGroup.PUT("/agents/:agent_id/servers/:server_id/tools", h.UpdateAgentMCPServerTools)
 }
 
 func (h *MCPHandler) CreateMCPServer(c echo.Context) error {
@@ -89,75 +101,9 @@ func (h *MCPHandler) CreateMCPServer(c echo.Context) error {
 		return err
 	}
 
-	// Validate server type
-	if req.ServerType != "http" && req.ServerType != "sse" {
-		return echo.NewHTTPError(http.StatusBadRequest, "server_type must be 'http' or 'sse'")
-	}
-
-	// Initialize encryption service
-	encryptionService, err := services.NewEncryptionService()
+	server, err := newMCPServer(userID, &req)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize encryption service")
-	}
-
-	// Set defaults
-	if req.Timeout == 0 {
-		req.Timeout = 30
-	}
-	if req.MaxRetries == 0 {
-		req.MaxRetries = 3
-	}
-
-	// Handle encryption for sensitive data
-	serverURL := req.ServerURL
-	if req.SensitiveURL {
-		encryptedURL, err := encryptionService.Encrypt(req.ServerURL)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to encrypt URL")
-		}
-		serverURL = encryptedURL
-	}
-
-	// Encrypt sensitive headers
-	headers := req.Headers
-	if len(req.SensitiveHeaders) > 0 && req.Headers != nil {
-		headerMap := make(map[string]any)
-		for k, v := range req.Headers {
-			headerMap[k] = v
-		}
-
-		encryptedHeaders, err := encryptionService.EncryptSensitiveFields(headerMap, req.SensitiveHeaders)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to encrypt headers")
-		}
-
-		// Convert back to string map
-		headers = make(map[string]string)
-		for k, v := range encryptedHeaders {
-			if str, ok := v.(string); ok {
-				headers[k] = str
-			}
-		}
-	}
-
-	// Marshal sensitive headers list
-	sensitiveHeadersJSON, err := json.Marshal(req.SensitiveHeaders)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid sensitive headers format")
-	}
-
-	server := shared.MCPServer{
-		UserID:           userID,
-		Name:             req.Name,
-		Description:      req.Description,
-		ServerURL:        serverURL,
-		ServerType:       req.ServerType,
-		Env:              req.Env,
-		Timeout:          req.Timeout,
-		Headers:          headers,
-		MaxRetries:       req.MaxRetries,
-		EncryptedURL:     req.SensitiveURL,
-		SensitiveHeaders: string(sensitiveHeadersJSON),
+		return err
 	}
 
 	// Verify agent ownership if agent_id is provided
@@ -173,7 +119,7 @@ func (h *MCPHandler) CreateMCPServer(c echo.Context) error {
 
 	tx := h.db.Begin()
 
-	if err := tx.Create(&server).Error; err != nil {
+	if err := tx.Create(server).Error; err != nil {
 		tx.Rollback()
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create MCP server")
 	}
@@ -207,6 +153,8 @@ func (h *MCPHandler) CreateMCPServer(c echo.Context) error {
 		Description:      server.Description,
 		ServerURL:        server.ServerURL,
 		ServerType:       server.ServerType,
+		Command:          server.Command,
+		Args:             server.Args,
 		Env:              server.Env,
 		Timeout:          server.Timeout,
 		Headers:          server.Headers,
@@ -223,6 +171,92 @@ func (h *MCPHandler) CreateMCPServer(c echo.Context) error {
 	})
 }
 
+// newMCPServer validates a server definition and builds the server to store,
+// with its sensitive URL and headers encrypted.
+func newMCPServer(userID uint, req *CreateMCPServerRequest) (*shared.MCPServer, error) {
+	// Validate server type
+	switch req.ServerType {
+	case "http", "sse":
+		if req.ServerURL == "" {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "server_url is required")
+		}
+	case "stdio":
+		if err := services.ValidateStdioServer(req.Command, req.Args, req.Env); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "server_type must be 'http', 'sse' or 'stdio'")
+	}
+
+	// Initialize encryption service
+	encryptionService, err := services.NewEncryptionService()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize encryption service")
+	}
+
+	// Set defaults
+	if req.Timeout == 0 {
+		req.Timeout = 30
+	}
+	if req.MaxRetries == 0 {
+		req.MaxRetries = 3
+	}
+
+	// Handle encryption for sensitive data
+	serverURL := req.ServerURL
+	if req.SensitiveURL {
+		encryptedURL, err := encryptionService.Encrypt(req.ServerURL)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to encrypt URL")
+		}
+		serverURL = encryptedURL
+	}
+
+	// Encrypt sensitive headers
+	headers := req.Headers
+	if len(req.SensitiveHeaders) > 0 && req.Headers != nil {
+		headerMap := make(map[string]any)
+		for k, v := range req.Headers {
+			headerMap[k] = v
+		}
+
+		encryptedHeaders, err := encryptionService.EncryptSensitiveFields(headerMap, req.SensitiveHeaders)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to encrypt headers")
+		}
+
+		// Convert back to string map
+		headers = make(map[string]string)
+		for k, v := range encryptedHeaders {
+			if str, ok := v.(string); ok {
+				headers[k] = str
+			}
+		}
+	}
+
+	// Marshal sensitive headers list
+	sensitiveHeadersJSON, err := json.Marshal(req.SensitiveHeaders)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid sensitive headers format")
+	}
+
+	return &shared.MCPServer{
+		UserID:           userID,
+		Name:             req.Name,
+		Description:      req.Description,
+		ServerURL:        serverURL,
+		ServerType:       req.ServerType,
+		Command:          req.Command,
+		Args:             req.Args,
+		Env:              req.Env,
+		Timeout:          req.Timeout,
+		Headers:          headers,
+		MaxRetries:       req.MaxRetries,
+		EncryptedURL:     req.SensitiveURL,
+		SensitiveHeaders: string(sensitiveHeadersJSON),
+	}, nil
+}
+
 func (h *MCPHandler) ListMCPServers(c echo.Context) error {
 	userID, ok := c.Get("user_id").(uint)
 	if !ok {
@@ -265,6 +299,8 @@ func (h *MCPHandler) ListMCPServers(c echo.Context) error {
 			Description:      decryptedServer.Description,
 			ServerURL:        decryptedServer.ServerURL,
 			ServerType:       decryptedServer.ServerType,
+			Command:          decryptedServer.Command,
+			Args:             decryptedServer.Args,
 			Env:              decryptedServer.Env,
 			Timeout:          decryptedServer.Timeout,
 			Headers:          decryptedServer.Headers,
@@ -330,6 +366,8 @@ func (h *MCPHandler) GetMCPServer(c echo.Context) error {
 		Description:      decryptedServer.Description,
 		ServerURL:        decryptedServer.ServerURL,
 		ServerType:       decryptedServer.ServerType,
+		Command:          decryptedServer.Command,
+		Args:             decryptedServer.Args,
 		Env:              decryptedServer.Env,
 		Timeout:          decryptedServer.Timeout,
 		Headers:          decryptedServer.Headers,
@@ -440,6 +478,37 @@ func (h *MCPHandler) UpdateMCPServer(c echo.Context) error {
 		updates["env"] = req.Env
 		shouldReconnect = true
 	}
+	if req.Command != nil {
+		updates["command"] = *req.Command
+		shouldReconnect = true
+	}
+	if req.Args != nil {
+		// Map updates bypass the column serializer, so store the JSON directly.
+		argsJSON, err := json.Marshal(req.Args)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid args format")
+		}
+		updates["args"] = string(argsJSON)
+		shouldReconnect = true
+	}
+
+	if server.ServerType == "stdio" && (req.Command != nil || req.Args != nil || req.Env != nil) {
+		command := server.Command
+		if req.Command != nil {
+			command = *req.Command
+		}
+		args := server.Args
+		if req.Args != nil {
+			args = req.Args
+		}
+		env := server.Env
+		if req.Env != nil {
+			env = req.Env
+		}
+		if err := services.ValidateStdioServer(command, args, env); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
 
 	// Handle sensitive data encryption
 	if req.SensitiveURL != nil || len(req.SensitiveHeaders) > 0 {
@@ -530,6 +599,8 @@ func (h *MCPHandler) UpdateMCPServer(c echo.Context) error {
 		Description:      server.Description,
 		ServerURL:        server.ServerURL,
 		ServerType:       server.ServerType,
+		Command:          server.Command,
+		Args:             server.Args,
 		Env:              server.Env,
 		Timeout:          server.Timeout,
 		Headers:          server.Headers,
@@ -699,21 +770,26 @@ func (h *MCPHandler) GetAgentMCPServers(c echo.Context) error {
 		}
 
 		response[i] = shared.AgentMCPServerDetailResponse{
-			ServerID:         assoc.MCPServerID,
-			ServerName:       decryptedServer.Name,
-			Description:      decryptedServer.Description,
-			ServerURL:        decryptedServer.ServerURL,
-			ServerType:       decryptedServer.ServerType,
-			Env:              decryptedServer.Env,
-			Timeout:          decryptedServer.Timeout,
-			Headers:          decryptedServer.Headers,
-			MaxRetries:       decryptedServer.MaxRetries,
-			Enabled:          assoc.Enabled,
-			LastSeen:         decryptedServer.LastSeen,
-			CreatedAt:        decryptedServer.CreatedAt,
-			UpdatedAt:        decryptedServer.UpdatedAt,
-			EncryptedURL:     server.EncryptedURL, // Use original server data, not decrypted
-			SensitiveHeaders: sensitiveHeaders,
+			ServerID:              assoc.MCPServerID,
+			ServerName:            decryptedServer.Name,
+			Description:           decryptedServer.Description,
+			ServerURL:             decryptedServer.ServerURL,
+			ServerType:            decryptedServer.ServerType,
+			Command:               decryptedServer.Command,
+			Args:                  decryptedServer.Args,
+			Env:                   decryptedServer.Env,
+			Timeout:               decryptedServer.Timeout,
+			Headers:               decryptedServer.Headers,
+			MaxRetries:            decryptedServer.MaxRetries,
+			Enabled:               assoc.Enabled,
+			AllowedTools:          assoc.AllowedTools,
+			DeniedTools:           assoc.DeniedTools,
+			ApprovalRequiredTools: assoc.ApprovalRequiredTools,
+			LastSeen:              decryptedServer.LastSeen,
+			CreatedAt:             decryptedServer.CreatedAt,
+			UpdatedAt:             decryptedServer.UpdatedAt,
+			EncryptedURL:          server.EncryptedURL, // Use original server data, not decrypted
+			SensitiveHeaders:      sensitiveHeaders,
 		}
 	}
 
@@ -859,3 +935,111 @@ func (h *MCPHandler) ToggleAgentMCPServer(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, map[string]string{"message": "Association " + status + " successfully"})
 }
+
+func (h *MCPHandler) GetAgentMCPServerTools(c echo.Context) error {
+	assoc, err := h.getOwnedAssociation(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, h.agentToolsResponse(assoc))
+}
+
+func (h *MCPHandler) UpdateAgentMCPServerTools(c echo.Context) error {
+	assoc, err := h.getOwnedAssociation(c)
+	if err != nil {
+		return err
+	}
+
+	var req UpdateAgentMCPToolsRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := shared.ValidateToolPatterns(req.AllowedTools, req.DeniedTools, req.ApprovalRequiredTools); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	assoc.AllowedTools = req.AllowedTools
+	assoc.DeniedTools = req.DeniedTools
+	assoc.ApprovalRequiredTools = req.ApprovalRequiredTools
+	if err := h.db.Model(assoc).Select("allowed_tools", "denied_tools", "approval_required_tools").Updates(assoc).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tool selection")
+	}
+
+	return c.JSON(http.StatusOK, h.agentToolsResponse(assoc))
+}
+
+// getOwnedAssociation loads the agent-server association named in the route,
+// checking that the agent belongs to the current user.
+func (h *MCPHandler) getOwnedAssociation(c echo.Context) (*shared.AgentMCPServer, error) {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	agentID, err := uuid.Parse(c.Param("agent_id"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid agent ID")
+	}
+	serverID, err := uuid.Parse(c.Param("server_id"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid server ID")
+	}
+
+	var agent shared.AgentConfig
+	if err := h.db.Where("id = ? AND user_id = ?", agentID, userID).First(&agent).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "agent not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch agent")
+	}
+
+	var assoc shared.AgentMCPServer
+	if err := h.db.Where("agent_id = ? AND mcp_server_id = ?", agentID, serverID).First(&assoc).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "association not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch association")
+	}
+
+	return &assoc, nil
+}
+
+// agentToolsResponse lists the server's tools with the association's
+// selection applied. Connection failures are reported in the response so the
+// selection can still be edited while the server is down.
+func (h *MCPHandler) agentToolsResponse(assoc *shared.AgentMCPServer) shared.AgentMCPToolsResponse {
+	response := shared.AgentMCPToolsResponse{
+		ServerID:              assoc.MCPServerID,
+		AllowedTools:          assoc.AllowedTools,
+		DeniedTools:           assoc.DeniedTools,
+		ApprovalRequiredTools: assoc.ApprovalRequiredTools,
+		Tools:                 []shared.AgentMCPToolState{},
+	}
+	if response.AllowedTools == nil {
+		response.AllowedTools = []string{}
+	}
+	if response.DeniedTools == nil {
+		response.DeniedTools = []string{}
+	}
+	if response.ApprovalRequiredTools == nil {
+		response.ApprovalRequiredTools = []string{}
+	}
+
+	tools, err := h.mcpManager.GetServerTools(context.Background(), assoc.MCPServerID)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	for _, name := range tools {
+		response.Tools = append(response.Tools, shared.AgentMCPToolState{
+			Name:             name,
+			Enabled:          assoc.AllowsTool(name),
+			RequiresApproval: assoc.RequiresApproval(name),
+		})
+	}
+
+	return response
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// maxMemoriesPerScope bounds the memories an agent keeps of one person.
+const maxMemoriesPerScope = 200
+
+// memoryScope identifies the person whose memories a request reads and
+// writes, like the scope of invoke API sessions. A nil APIKeyID is the
+// agent's owner in the dashboard. Otherwise an EndUserID selects that end
+// user's memories across keys, and without one the memories belong to the
+// API key.
+type memoryScope struct {
+	APIKeyID  *uint
+	EndUserID string
+}
+
+// requestMemoryScope returns the memory scope of a request: the end user's
+// when one is given to an invoke endpoint, otherwise the API key's or the
+// dashboard user's.
+func requestMemoryScope(c echo.Context, endUserID string) (*memoryScope, error) {
+	apiKeyID, ok := c.Get("api_key_id").(uint)
+	if !ok {
+		return &memoryScope{}, nil
+	}
+	if len(endUserID) > maxEndUserIDLength {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "end_user_id is too long")
+	}
+	return &memoryScope{APIKeyID: &apiKeyID, EndUserID: endUserID}, nil
+}
+
+// runMemoryScope returns the memory scope a paused run was started with.
+func runMemoryScope(run *shared.AgentRun) *memoryScope {
+	return &memoryScope{APIKeyID: run.APIKeyID, EndUserID: run.EndUserID}
+}
+
+// agentMemories scopes a query to the memories of an agent in a scope.
+func (h *Handler) agentMemories(db *gorm.DB, agentID uuid.UUID, scope *memoryScope) *gorm.DB {
+	query := db.Where("agent_id = ?", agentID)
+	switch {
+	case scope.APIKeyID == nil:
+		return query.Where("api_key_id IS NULL")
+	case scope.EndUserID != "":
+		return query.Where("api_key_id IS NOT NULL AND end_user_id = ?", scope.EndUserID)
+	default:
+		return query.Where("api_key_id = ? AND end_user_id = ''", *scope.APIKeyID)
+	}
+}
+
+// memorySource gives runs the memories of the person they talk to.
+type memorySource struct {
+	h     *Handler
+	scope *memoryScope
+}
+
+func (s *memorySource) Memories(ctx context.Context, agentID uuid.UUID) ([]shared.AgentMemory, error) {
+	var memories []shared.AgentMemory
+	err := s.h.agentMemories(s.h.DB.WithContext(ctx), agentID, s.scope).
+		Order("updated_at DESC").Limit(maxMemoriesPerScope).Find(&memories).Error
+	return memories, err
+}
+
+func (s *memorySource) Remember(ctx context.Context, agent *shared.AgentConfig, content string) (*shared.AgentMemory, error) {
+	db := s.h.DB.WithContext(ctx)
+
+	// Remembering a fact again only marks it as recent.
+	var existing shared.AgentMemory
+	err := s.h.agentMemories(db, agent.ID, s.scope).Where("content = ?", content).First(&existing).Error
+	if err == nil {
+		if err := db.Model(&existing).Update("updated_at", gorm.Expr("NOW()")).Error; err != nil {
+			return nil, err
+		}
+		return &existing, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	var count int64
+	if err := s.h.agentMemories(db.Model(&shared.AgentMemory{}), agent.ID, s.scope).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count >= maxMemoriesPerScope {
+		return nil, fmt.Errorf("memory is full (%d memories); forget an outdated memory first", maxMemoriesPerScope)
+	}
+
+	memory := shared.AgentMemory{
+		AgentID:   agent.ID,
+		UserID:    agent.UserID,
+		APIKeyID:  s.scope.APIKeyID,
+		EndUserID: s.scope.EndUserID,
+		Content:   content,
+	}
+	if err := db.Create(&memory).Error; err != nil {
+		return nil, err
+	}
+	return &memory, nil
+}
+
+func (s *memorySource) Forget(ctx context.Context, agentID, memoryID uuid.UUID) error {
+	result := s.h.agentMemories(s.h.DB.WithContext(ctx), agentID, s.scope).Where("id = ?", memoryID).Delete(&shared.AgentMemory{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("memory %s not found", memoryID)
+	}
+	return nil
+}
+
+func (h *Handler) listMemories(c echo.Context, agent *shared.AgentConfig, scope *memoryScope) error {
+	memories := []shared.AgentMemory{}
+	if err := h.agentMemories(h.DB, agent.ID, scope).Order("updated_at DESC").Find(&memories).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to retrieve memories")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"memories": memories,
+		"count":    len(memories),
+	})
+}
+
+func (h *Handler) deleteMemory(c echo.Context, agent *shared.AgentConfig, scope *memoryScope) error {
+	memoryID, err := uuid.Parse(c.Param("memoryId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid memoryId format")
+	}
+
+	result := h.agentMemories(h.DB, agent.ID, scope).Where("id = ?", memoryID).Delete(&shared.AgentMemory{})
+	if result.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete memory")
+	}
+	if result.RowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Memory not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *Handler) clearMemories(c echo.Context, agent *shared.AgentConfig, scope *memoryScope) error {
+	if err := h.agentMemories(h.DB, agent.ID, scope).Delete(&shared.AgentMemory{}).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete memories")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// HandleListAgentMemories lists what the user's agent remembers of the user
+// from dashboard chats.
+func (h *Handler) HandleListAgentMemories(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	return h.listMemories(c, agent, &memoryScope{})
+}
+
+// HandleDeleteAgentMemory deletes one of the user's agent's memories of the
+// user.
+func (h *Handler) HandleDeleteAgentMemory(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	return h.deleteMemory(c, agent, &memoryScope{})
+}
+
+// HandleClearAgentMemories deletes all of the user's agent's memories of the
+// user.
+func (h *Handler) HandleClearAgentMemories(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	return h.clearMemories(c, agent, &memoryScope{})
+}
+
+// HandleGetAPIMemories lists the agent's memories of the end user given in
+// the end_user_id query parameter, or of the API key's caller.
+func (h *Handler) HandleGetAPIMemories(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
+	}
+	scope, err := requestMemoryScope(c, c.QueryParam("end_user_id"))
+	if err != nil {
+		return err
+	}
+	return h.listMemories(c, agent, scope)
+}
+
+// HandleDeleteAPIMemory deletes one of the agent's memories of the end user
+// or the API key's caller.
+func (h *Handler) HandleDeleteAPIMemory(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
+	}
+	scope, err := requestMemoryScope(c, c.QueryParam("end_user_id"))
+	if err != nil {
+		return err
+	}
+	return h.deleteMemory(c, agent, scope)
+}
+
+// HandleClearAPIMemories deletes all of the agent's memories of the end user
+// or the API key's caller.
+func (h *Handler) HandleClearAPIMemories(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
+	}
+	scope, err := requestMemoryScope(c, c.QueryParam("end_user_id"))
+	if err != nil {
+		return err
+	}
+	return h.clearMemories(c, agent, scope)
+}
@@ -0,0 +1,534 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/middleware"
+	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxScheduleNameLength    = 100
+	maxScheduleMessageLength = 10000
+
+	// scheduleClaimBatch bounds the due schedules one worker claims per
+	// tick, so that other replicas share the load.
+	scheduleClaimBatch = 10
+
+	// scheduleRunHistory is the number of runs kept per schedule.
+	scheduleRunHistory = 100
+)
+
+// nextScheduleRun returns when a schedule is next due after after, or nil
+// if its cron expression never matches again.
+func nextScheduleRun(schedule *shared.AgentSchedule, after time.Time) (*time.Time, error) {
+	cron, err := services.ParseCron(schedule.CronExpression)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", schedule.Timezone)
+	}
+	next := cron.Next(after.In(loc))
+	if next.IsZero() {
+		return nil, nil
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+// validateSchedule checks a schedule against its agent and sets when it is
+// next due.
+func validateSchedule(agent *shared.AgentConfig, schedule *shared.AgentSchedule) error {
+	schedule.Name = strings.TrimSpace(schedule.Name)
+	if schedule.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	if len(schedule.Name) > maxScheduleNameLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is too long")
+	}
+	if strings.TrimSpace(schedule.Message) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "message is required")
+	}
+	if len(schedule.Message) > maxScheduleMessageLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "message is too long")
+	}
+	if schedule.WebhookURL != "" && !isHTTPURL(schedule.WebhookURL) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid webhook_url: must be an http or https URL")
+	}
+	if _, err := services.RenderSystemPrompt(agent, schedule.Variables, time.Now()); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+	next, err := nextScheduleRun(schedule, time.Now())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if next == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "cron_expression never matches a date")
+	}
+	schedule.NextRunAt = nil
+	if schedule.Enabled {
+		schedule.NextRunAt = next
+	}
+	return nil
+}
+
+// userSchedule loads the schedule in the scheduleId path parameter if it
+// belongs to the agent.
+func (h *Handler) userSchedule(c echo.Context, agent *shared.AgentConfig) (*shared.AgentSchedule, error) {
+	scheduleID, err := uuid.Parse(c.Param("scheduleId"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid scheduleId format")
+	}
+
+	var schedule shared.AgentSchedule
+	if err := h.DB.Where("id = ? AND agent_id = ?", scheduleID, agent.ID).First(&schedule).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Schedule not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load schedule")
+	}
+	return &schedule, nil
+}
+
+// HandleListSchedules lists the schedules of the user's agent.
+func (h *Handler) HandleListSchedules(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	schedules := []shared.AgentSchedule{}
+	if err := h.DB.Where("agent_id = ?", agent.ID).Order("created_at ASC").Find(&schedules).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load schedules")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"schedules": schedules,
+	})
+}
+
+// HandleCreateSchedule schedules runs of the user's agent.
+func (h *Handler) HandleCreateSchedule(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	var req shared.CreateScheduleRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+
+	schedule := shared.AgentSchedule{
+		AgentID:        agent.ID,
+		UserID:         agent.UserID,
+		Name:           req.Name,
+		CronExpression: req.CronExpression,
+		Timezone:       req.Timezone,
+		Message:        req.Message,
+		Variables:      req.Variables,
+		StoreSession:   req.StoreSession == nil || *req.StoreSession,
+		WebhookURL:     strings.TrimSpace(req.WebhookURL),
+		Enabled:        req.Enabled == nil || *req.Enabled,
+	}
+	if err := validateSchedule(agent, &schedule); err != nil {
+		return err
+	}
+
+	if err := h.PlanMiddleware.CheckResourceLimit(agent.UserID, middleware.ResourceSchedule); err != nil {
+		return err
+	}
+
+	if err := h.DB.Create(&schedule).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create schedule")
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"schedule": schedule,
+	})
+}
+
+// HandleGetSchedule returns a schedule of the user's agent.
+func (h *Handler) HandleGetSchedule(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	schedule, err := h.userSchedule(c, agent)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"schedule": schedule,
+	})
+}
+
+// HandleUpdateSchedule changes a schedule of the user's agent and recomputes
+// when it is next due.
+func (h *Handler) HandleUpdateSchedule(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	schedule, err := h.userSchedule(c, agent)
+	if err != nil {
+		return err
+	}
+
+	var req shared.UpdateScheduleRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+
+	if req.Name != nil {
+		schedule.Name = *req.Name
+	}
+	if req.CronExpression != nil {
+		schedule.CronExpression = *req.CronExpression
+	}
+	if req.Timezone != nil {
+		schedule.Timezone = *req.Timezone
+	}
+	if req.Message != nil {
+		schedule.Message = *req.Message
+	}
+	if req.Variables != nil {
+		schedule.Variables = *req.Variables
+	}
+	if req.StoreSession != nil {
+		schedule.StoreSession = *req.StoreSession
+	}
+	if req.WebhookURL != nil {
+		schedule.WebhookURL = strings.TrimSpace(*req.WebhookURL)
+	}
+	if req.Enabled != nil {
+		schedule.Enabled = *req.Enabled
+	}
+	if err := validateSchedule(agent, schedule); err != nil {
+		return err
+	}
+
+	// Save writes the zero values too, such as a disabled schedule's nil
+	// next_run_at and an emptied webhook_url.
+	if err := h.DB.Save(schedule).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update schedule")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"schedule": schedule,
+	})
+}
+
+// HandleDeleteSchedule deletes a schedule of the user's agent with its run
+// history. Runs in progress finish.
+func (h *Handler) HandleDeleteSchedule(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	schedule, err := h.userSchedule(c, agent)
+	if err != nil {
+		return err
+	}
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err := tx.Where("schedule_id = ?", schedule.ID).Delete(&shared.ScheduleRun{}).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete schedule runs")
+	}
+	if err := tx.Delete(schedule).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete schedule")
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit transaction")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Schedule deleted successfully",
+	})
+}
+
+// HandleRunSchedule runs a schedule of the user's agent now, whether or not
+// it is enabled. Its next scheduled run is unchanged.
+func (h *Handler) HandleRunSchedule(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	schedule, err := h.userSchedule(c, agent)
+	if err != nil {
+		return err
+	}
+
+	run := shared.ScheduleRun{
+		ScheduleID:   schedule.ID,
+		AgentID:      schedule.AgentID,
+		ScheduledFor: time.Now(),
+		Status:       "running",
+	}
+	if err := h.DB.Create(&run).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start run")
+	}
+
+	go h.executeScheduleRun(*schedule, run)
+
+	return c.JSON(http.StatusAccepted, map[string]any{
+		"run": run,
+	})
+}
+
+// HandleListScheduleRuns lists the latest runs of a schedule of the user's
+// agent, newest first. The limit query parameter defaults to 20.
+func (h *Handler) HandleListScheduleRuns(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	schedule, err := h.userSchedule(c, agent)
+	if err != nil {
+		return err
+	}
+
+	limit := 20
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > scheduleRunHistory {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", scheduleRunHistory))
+		}
+	}
+
+	runs := []shared.ScheduleRun{}
+	if err := h.DB.Where("schedule_id = ?", schedule.ID).Order("created_at DESC").Limit(limit).Find(&runs).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load schedule runs")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"runs": runs,
+	})
+}
+
+// StartScheduleWorker runs due schedules every interval. Schedules are
+// claimed with row locks, so any number of replicas can run the worker
+// without a schedule firing twice. The worker also fails the schedule and
+// webhook runs of servers that stopped, and deletes expired webhook
+// receipts.
+func (h *Handler) StartScheduleWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			h.failStaleRuns()
+			h.deleteExpiredWebhookReceipts()
+
+			claimed, err := h.claimDueSchedules()
+			if err != nil {
+				log.Printf("Schedule worker error: %v", err)
+				continue
+			}
+			for _, c := range claimed {
+				go h.executeScheduleRun(c.schedule, c.run)
+			}
+		}
+	}()
+
+	log.Printf("Started schedule worker with interval: %v", interval)
+}
+
+type claimedSchedule struct {
+	schedule shared.AgentSchedule
+	run      shared.ScheduleRun
+}
+
+// claimDueSchedules advances the due schedules of active agents to their
+// next run and starts a run of each. Schedules locked by another worker are
+// skipped. Runs missed while no worker was running fire once.
+func (h *Handler) claimDueSchedules() ([]claimedSchedule, error) {
+	now := time.Now()
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var schedules []shared.AgentSchedule
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("enabled = ? AND next_run_at <= ?", true, now).
+		Where("agent_id IN (?)", h.DB.Model(&shared.AgentConfig{}).Select("id")).
+		Order("next_run_at ASC").
+		Limit(scheduleClaimBatch).
+		Find(&schedules).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var claimed []claimedSchedule
+	for _, schedule := range schedules {
+		run := shared.ScheduleRun{
+			ScheduleID:   schedule.ID,
+			AgentID:      schedule.AgentID,
+			ScheduledFor: *schedule.NextRunAt,
+			Status:       "running",
+		}
+		if err := tx.Create(&run).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		// A schedule whose expression no longer parses, or never matches
+		// again, is left without a next run rather than retried.
+		next, err := nextScheduleRun(&schedule, now)
+		if err != nil {
+			log.Printf("Warning: Schedule %s cannot be scheduled again: %v", schedule.ID, err)
+		}
+		if err := tx.Model(&schedule).Updates(map[string]any{
+			"next_run_at": next,
+			"last_run_at": now,
+			"last_status": "running",
+		}).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		claimed = append(claimed, claimedSchedule{schedule: schedule, run: run})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// executeScheduleRun runs the agent of a schedule, delivers the result to
+// the schedule's webhook and records the outcome.
+func (h *Handler) executeScheduleRun(schedule shared.AgentSchedule, run shared.ScheduleRun) {
+	ctx, cancel := context.WithTimeout(context.Background(), unattendedRunTimeout)
+	defer cancel()
+
+	response, err := h.runSchedule(ctx, &schedule, &run)
+	run.Status = "succeeded"
+	if err != nil {
+		log.Printf("Schedule %s run %s failed: %v", schedule.ID, run.ID, err)
+		run.Status = "failed"
+		run.Error = err.Error()
+	}
+
+	if schedule.WebhookURL != "" {
+		status, err := postScheduleWebhook(&schedule, &run, response)
+		run.WebhookStatus = status
+		if err != nil {
+			log.Printf("Schedule %s run %s webhook failed: %v", schedule.ID, run.ID, err)
+			if run.Status == "succeeded" {
+				run.Status = "failed"
+				run.Error = fmt.Sprintf("webhook: %v", err)
+			}
+		}
+	}
+
+	now := time.Now()
+	run.FinishedAt = &now
+	if err := h.DB.Save(&run).Error; err != nil {
+		log.Printf("Warning: Failed to save schedule run %s: %v", run.ID, err)
+	}
+	h.DB.Model(&shared.AgentSchedule{}).Where("id = ?", schedule.ID).Update("last_status", run.Status)
+
+	// Keep the latest runs only.
+	h.DB.Where("schedule_id = ? AND id NOT IN (?)", schedule.ID,
+		h.DB.Model(&shared.ScheduleRun{}).Select("id").Where("schedule_id = ?", schedule.ID).Order("created_at DESC").Limit(scheduleRunHistory),
+	).Delete(&shared.ScheduleRun{})
+}
+
+// runSchedule runs the agent with the schedule's message, rendered in the
+// schedule's time zone, and stored in a new chat session when the schedule
+// asks for one.
+func (h *Handler) runSchedule(ctx context.Context, schedule *shared.AgentSchedule, run *shared.ScheduleRun) (*shared.AgentInferenceResponse, error) {
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", schedule.Timezone)
+	}
+	now := time.Now().In(loc)
+	run.Message = services.RenderMessageTemplate(schedule.Message, schedule.Variables, now)
+
+	unattended := unattendedRun{
+		agentID:   schedule.AgentID,
+		variables: schedule.Variables,
+		message:   run.Message,
+		source:    "schedule",
+		now:       now,
+	}
+	if schedule.StoreSession {
+		unattended.sessionTitle = fmt.Sprintf("%s (%s)", schedule.Name, now.Format("Jan 2, 15:04"))
+	}
+
+	response, sessionID, err := h.runUnattended(ctx, &unattended)
+	run.SessionID = sessionID
+	if response != nil && response.Usage != nil {
+		run.TotalTokens = response.Usage.TotalTokens
+	}
+	if err != nil {
+		return nil, err
+	}
+	run.Response = response.Response
+	return response, nil
+}
+
+// postScheduleWebhook posts the outcome of a run to the schedule's webhook
+// and returns the status it answered with.
+func postScheduleWebhook(schedule *shared.AgentSchedule, run *shared.ScheduleRun, response *shared.AgentInferenceResponse) (int, error) {
+	payload := shared.ScheduleWebhookPayload{
+		ScheduleID:   schedule.ID,
+		ScheduleName: schedule.Name,
+		RunID:        run.ID,
+		AgentID:      schedule.AgentID,
+		Status:       run.Status,
+		ScheduledFor: run.ScheduledFor,
+		Message:      run.Message,
+		Error:        run.Error,
+		SessionID:    run.SessionID,
+	}
+	if response != nil {
+		payload.Response = response.Response
+		payload.Structured = response.Structured
+		payload.Usage = response.Usage
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	// The webhook is told of runs that timed out too, so it does not share
+	// the run's deadline.
+	return postJSON(context.Background(), schedule.WebhookURL, body, map[string]string{"User-Agent": "Glyfs-Scheduler"})
+}
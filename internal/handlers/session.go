@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// maxEndUserIDLength bounds the caller-supplied end-user ID.
+const maxEndUserIDLength = 255
+
+// apiSessions scopes a query to the invoke API sessions visible to a request:
+// those of the end user when one is given, otherwise those created by the API
+// key without an end user.
+func (h *Handler) apiSessions(c echo.Context, endUserID string) *gorm.DB {
+	agentID, _ := c.Get("agent_id").(uuid.UUID)
+	apiKeyID, _ := c.Get("api_key_id").(uint)
+
+	query := h.DB.Where("agent_id = ? AND api_key_id IS NOT NULL", agentID)
+	if endUserID != "" {
+		return query.Where("end_user_id = ?", endUserID)
+	}
+	return query.Where("api_key_id = ? AND end_user_id = ''", apiKeyID)
+}
+
+// startAPISession prepares a server-stored conversation for an invoke
+// request. It returns nil when the request does not use one. Otherwise the
+// session's history is loaded into req and the user message is saved.
+func (h *Handler) startAPISession(c echo.Context, agent *shared.AgentConfig, req *shared.AgentInferenceRequest) (*shared.ChatSession, error) {
+	if req.SessionID == nil && !req.Store {
+		return nil, nil
+	}
+	if len(req.History) > 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "history cannot be combined with session_id or store")
+	}
+	if len(req.EndUserID) > maxEndUserIDLength {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "end_user_id is too long")
+	}
+
+	var session shared.ChatSession
+	if req.SessionID != nil {
+		if err := h.apiSessions(c, req.EndUserID).Where("id = ?", *req.SessionID).First(&session).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, echo.NewHTTPError(http.StatusNotFound, "Session not found")
+			}
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load session")
+		}
+
+		var history []shared.ChatMessage
+		if err := h.DB.Where("session_id = ? AND role IN ?", session.ID, []string{"user", "assistant"}).
+			Order("created_at ASC").Find(&history).Error; err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load conversation history")
+		}
+		for _, msg := range history {
+			files, err := h.loadAttachments(c, agent, msg.Attachments, true)
+			if err != nil {
+				return nil, err
+			}
+			req.History = append(req.History, shared.Message{
+				Role:        msg.Role,
+				Content:     msg.Content,
+				ToolSteps:   msg.ToolSteps,
+				Attachments: msg.Attachments,
+				Files:       files,
+			})
+		}
+	} else {
+		apiKeyID, _ := c.Get("api_key_id").(uint)
+		session = shared.ChatSession{
+			AgentID:   agent.ID,
+			UserID:    agent.UserID,
+			Title:     h.generateChatTitle(req.Message),
+			APIKeyID:  &apiKeyID,
+			EndUserID: req.EndUserID,
+		}
+		if err := h.DB.Create(&session).Error; err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to create session")
+		}
+	}
+
+	userMessage := shared.ChatMessage{
+		SessionID:   session.ID,
+		Role:        "user",
+		Content:     req.Message,
+		Metadata:    "{}",
+		Attachments: req.Attachments,
+	}
+	if err := h.DB.Create(&userMessage).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to save user message")
+	}
+
+	return &session, nil
+}
+
+// toolStepRecorder returns a tool event func that stores tool events in the
+// session and collects the steps of the reply into steps.
+func (h *Handler) toolStepRecorder(sessionID uuid.UUID, steps *[]shared.ToolStep) func(*shared.ToolCallEvent) {
+	return func(event *shared.ToolCallEvent) {
+		if event.Step != nil {
+			*steps = append(*steps, *event.Step)
+		}
+		h.saveToolEvent(sessionID, event)
+	}
+}
+
+// saveAssistantMessage adds the reply written by agentVersion to a session
+// and bumps the session's updated_at.
+func (h *Handler) saveAssistantMessage(sessionID uuid.UUID, agentVersion int, content, status string, toolSteps []shared.ToolStep) {
+	h.DB.Create(&shared.ChatMessage{
+		SessionID:    sessionID,
+		Role:         "assistant",
+		Content:      content,
+		Metadata:     "{}",
+		Status:       status,
+		ToolSteps:    toolSteps,
+		AgentVersion: agentVersion,
+	})
+	h.DB.Model(&shared.ChatSession{}).Where("id = ?", sessionID).Update("updated_at", time.Now())
+}
+
+// HandleGetAPISessions lists the invoke API sessions visible to the API key,
+// or to the end user given in the end_user_id query parameter.
+func (h *Handler) HandleGetAPISessions(c echo.Context) error {
+	var sessions []shared.ChatSession
+	if err := h.apiSessions(c, c.QueryParam("end_user_id")).
+		Order("updated_at DESC").Find(&sessions).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to retrieve sessions")
+	}
+
+	response := []shared.ChatSessionResponse{}
+	for _, session := range sessions {
+		response = append(response, shared.ChatSessionResponse{
+			ID:        session.ID,
+			Title:     session.Title,
+			AgentID:   session.AgentID,
+			EndUserID: session.EndUserID,
+			CreatedAt: session.CreatedAt,
+			UpdatedAt: session.UpdatedAt,
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"sessions": response,
+		"count":    len(response),
+	})
+}
+
+// HandleGetAPISession returns an invoke API session with its messages,
+// including tool events.
+func (h *Handler) HandleGetAPISession(c echo.Context) error {
+	sessionID, err := uuid.Parse(c.Param("sessionId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid sessionId format")
+	}
+
+	var session shared.ChatSession
+	if err := h.apiSessions(c, c.QueryParam("end_user_id")).Where("id = ?", sessionID).
+		Preload("Messages", func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at ASC")
+		}).First(&session).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Session not found")
+	}
+
+	return c.JSON(http.StatusOK, shared.ChatSessionResponse{
+		ID:        session.ID,
+		Title:     session.Title,
+		AgentID:   session.AgentID,
+		EndUserID: session.EndUserID,
+		CreatedAt: session.CreatedAt,
+		UpdatedAt: session.UpdatedAt,
+		Messages:  session.Messages,
+	})
+}
+
+// HandleDeleteAPISession soft deletes an invoke API session.
+func (h *Handler) HandleDeleteAPISession(c echo.Context) error {
+	sessionID, err := uuid.Parse(c.Param("sessionId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid sessionId format")
+	}
+
+	var session shared.ChatSession
+	if err := h.apiSessions(c, c.QueryParam("end_user_id")).Where("id = ?", sessionID).First(&session).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return echo.NewHTTPError(http.StatusNotFound, "Session not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to find session")
+	}
+
+	if err := h.DB.Delete(&session).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete session")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/arnavsurve/glyfs/internal/services"
@@ -65,6 +66,15 @@ func (h *SettingsHandler) GetUserSettings(c echo.Context) error {
 		}
 	}
 
+	response.CustomBaseURL = settings.CustomBaseURL
+	response.CustomAuthHeaderName = settings.CustomAuthHeaderName
+	if settings.CustomAuthHeaderValue != "" {
+		decrypted, err := h.encryptionService.Decrypt(settings.CustomAuthHeaderValue)
+		if err == nil && decrypted != "" {
+			response.CustomAuthHeaderValue = maskAPIKey(decrypted)
+		}
+	}
+
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -134,6 +144,34 @@ func (h *SettingsHandler) UpdateUserSettings(c echo.Context) error {
 		}
 	}
 
+	if req.CustomBaseURL != nil {
+		if *req.CustomBaseURL == "" {
+			settings.CustomBaseURL = ""
+		} else {
+			parsed, err := url.Parse(*req.CustomBaseURL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid custom base URL: must be an http or https URL")
+			}
+			settings.CustomBaseURL = strings.TrimRight(*req.CustomBaseURL, "/")
+		}
+	}
+
+	if req.CustomAuthHeaderName != nil {
+		settings.CustomAuthHeaderName = strings.TrimSpace(*req.CustomAuthHeaderName)
+	}
+
+	if req.CustomAuthHeaderValue != nil {
+		if *req.CustomAuthHeaderValue == "" {
+			settings.CustomAuthHeaderValue = ""
+		} else {
+			encrypted, err := h.encryptionService.Encrypt(*req.CustomAuthHeaderValue)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to encrypt auth header")
+			}
+			settings.CustomAuthHeaderValue = encrypted
+		}
+	}
+
 	if err := h.db.Save(&settings).Error; err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save settings")
 	}
@@ -165,6 +203,8 @@ func (h *SettingsHandler) CheckAPIKeyForProvider(userID uint, provider string) (
 		return settings.OpenAIAPIKey != "", nil
 	case string(shared.Google):
 		return settings.GeminiAPIKey != "", nil
+	case string(shared.Custom):
+		return settings.CustomBaseURL != "", nil
 	default:
 		return false, nil
 	}
@@ -194,4 +234,36 @@ func (h *SettingsHandler) GetAPIKeyForProvider(userID uint, provider string) (st
 	}
 
 	return h.encryptionService.Decrypt(encryptedKey)
-}
\ No newline at end of file
+}
+
+// GetProviderCredentials returns the decrypted credentials for a provider, or
+// nil if the user has not configured it.
+func (h *SettingsHandler) GetProviderCredentials(userID uint, provider string) (*shared.ProviderCredentials, error) {
+	if provider != string(shared.Custom) {
+		apiKey, err := h.GetAPIKeyForProvider(userID, provider)
+		if err != nil || apiKey == "" {
+			return nil, err
+		}
+		return &shared.ProviderCredentials{APIKey: apiKey}, nil
+	}
+
+	var settings shared.UserSettings
+	if err := h.db.Where("user_id = ?", userID).First(&settings).Error; err != nil {
+		return nil, err
+	}
+
+	if settings.CustomBaseURL == "" {
+		return nil, nil
+	}
+
+	authHeaderValue, err := h.encryptionService.Decrypt(settings.CustomAuthHeaderValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shared.ProviderCredentials{
+		BaseURL:         settings.CustomBaseURL,
+		AuthHeaderName:  settings.CustomAuthHeaderName,
+		AuthHeaderValue: authHeaderValue,
+	}, nil
+}
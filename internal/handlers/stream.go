@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// HandleResumeChatStream reconnects to a chat run's stream, replaying the
+// events after Last-Event-ID before following the live stream.
+func (h *Handler) HandleResumeChatStream(c echo.Context) error {
+	agentID, err := uuid.Parse(c.Param("agentId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid agentId format")
+	}
+
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	return h.resumeStream(c, userID, agentID)
+}
+
+// HandleResumeAgentInferenceStream reconnects to an API-key run's stream.
+func (h *Handler) HandleResumeAgentInferenceStream(c echo.Context) error {
+	agent, ok := c.Get("agent").(*shared.AgentConfig)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "agent context not found")
+	}
+
+	return h.resumeStream(c, agent.UserID, agent.ID)
+}
+
+func (h *Handler) resumeStream(c echo.Context, userID uint, agentID uuid.UUID) error {
+	runID, err := uuid.Parse(c.Param("runId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid runId format")
+	}
+
+	// EventSource sends Last-Event-ID on reconnect. The query parameter is for
+	// clients that cannot set headers.
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+	lastID := 0
+	if lastEventID != "" {
+		lastID, err = strconv.Atoi(lastEventID)
+		if err != nil || lastID < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid Last-Event-ID")
+		}
+	}
+
+	stream, ok := h.Streams.Get(runID, userID, agentID, requestAPIKeyID(c))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Stream not found or expired")
+	}
+
+	return h.followStream(c, stream, lastID)
+}
+
+// followStream writes the events of a run after lastID to the response and
+// then follows the live stream until the run finishes or the client goes
+// away.
+func (h *Handler) followStream(c echo.Context, stream *services.RunStream, lastID int) error {
+	c.Response().Header().Set("Content-Type", "text/event-stream")
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().Header().Set("Connection", "keep-alive")
+	c.Response().Header().Set("Access-Control-Allow-Origin", "*")
+	c.Response().Header().Set("Access-Control-Allow-Headers", "Cache-Control, Last-Event-ID")
+	c.Response().WriteHeader(http.StatusOK)
+
+	ctx := c.Request().Context()
+	for {
+		events, done, updated := stream.Since(lastID)
+		for _, event := range events {
+			fmt.Fprintf(c.Response(), "id: %d\ndata: %s\n\n", event.ID, event.Data)
+			lastID = event.ID
+		}
+		c.Response().Flush()
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// publishStreamEvent adds an event to a run's stream.
+func publishStreamEvent(stream *services.RunStream, eventType, content string, data any) {
+	event := shared.ChatStreamEvent{
+		Type:    eventType,
+		Content: content,
+		Data:    data,
+	}
+
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		// If JSON marshaling fails, send a simplified error event
+		errorEvent := shared.ChatStreamEvent{
+			Type:    eventType,
+			Content: content,
+			Data:    map[string]string{"error": "Failed to serialize event data"},
+		}
+		if fallbackData, fallbackErr := json.Marshal(errorEvent); fallbackErr == nil {
+			stream.Publish(fallbackData)
+		}
+		return
+	}
+
+	stream.Publish(jsonData)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+)
+
+// unattendedRunTimeout bounds a single run started by a schedule or a
+// webhook. Runs still marked running after twice as long were interrupted
+// by a restart.
+const unattendedRunTimeout = 10 * time.Minute
+
+var outboundClient = &http.Client{Timeout: 10 * time.Second}
+
+// unattendedRun is a run of an agent that no one watches, started by a
+// schedule or an inbound webhook.
+type unattendedRun struct {
+	agentID   uuid.UUID
+	variables map[string]string
+	message   string
+	now       time.Time
+
+	// source is the source sent in the run's events: schedule or webhook.
+	source string
+
+	// sessionTitle stores the run as a new chat session when set.
+	sessionTitle string
+}
+
+// runUnattended runs an agent with a message. The agent runs as its owner,
+// without memory, and a tool call that requires approval fails the run since
+// no one can approve it. The session the run is stored in is returned even
+// when the run fails, and the response of a run failed for approval, for its
+// usage.
+func (h *Handler) runUnattended(ctx context.Context, run *unattendedRun) (*shared.AgentInferenceResponse, *uuid.UUID, error) {
+	var agent shared.AgentConfig
+	if err := h.DB.Where("id = ?", run.agentID).First(&agent).Error; err != nil {
+		return nil, nil, fmt.Errorf("agent not found")
+	}
+
+	rendered, err := services.RenderSystemPrompt(&agent, run.variables, run.now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	creds, err := h.SettingsHandler.GetProviderCredentials(agent.UserID, agent.Provider)
+	if err != nil || creds == nil {
+		return nil, nil, fmt.Errorf("the %s API key is not configured", agent.Provider)
+	}
+
+	var sessionID *uuid.UUID
+	var toolEventFunc func(*shared.ToolCallEvent)
+	var toolSteps []shared.ToolStep
+	if run.sessionTitle != "" {
+		session := shared.ChatSession{
+			AgentID: agent.ID,
+			UserID:  agent.UserID,
+			Title:   run.sessionTitle,
+		}
+		if err := h.DB.Create(&session).Error; err != nil {
+			return nil, nil, fmt.Errorf("creating session: %w", err)
+		}
+		sessionID = &session.ID
+		if err := h.DB.Create(&shared.ChatMessage{
+			SessionID: session.ID,
+			Role:      "user",
+			Content:   run.message,
+			Metadata:  "{}",
+		}).Error; err != nil {
+			return nil, sessionID, fmt.Errorf("saving message: %w", err)
+		}
+		toolEventFunc = h.toolStepRecorder(session.ID, &toolSteps)
+	}
+
+	// Messages of unattended runs can come from third parties, so they
+	// neither see nor change the owner's memories.
+	llmService := h.newLLMService(sessionID, nil)
+	req := shared.AgentInferenceRequest{Message: run.message}
+	response, pending, err := llmService.GenerateResponse(ctx, rendered, &req, creds, toolEventFunc)
+	if err != nil {
+		if response != nil {
+			h.recordUsage(agent.UserID, rendered, sessionID, nil, response.Usage)
+		}
+		err = fmt.Errorf("generating response: %w", err)
+		h.publishRunEvent(rendered, run.source, sessionID, response, err)
+		return nil, sessionID, err
+	}
+
+	h.recordUsage(agent.UserID, rendered, sessionID, nil, response.Usage)
+
+	if pending != nil {
+		if sessionID != nil {
+			h.saveAssistantMessage(*sessionID, agent.Version, "", "cancelled", toolSteps)
+		}
+		err := fmt.Errorf("a tool call requires approval, which unattended runs cannot wait for")
+		h.publishRunEvent(rendered, run.source, sessionID, response, err)
+		return response, sessionID, err
+	}
+
+	if sessionID != nil {
+		h.saveAssistantMessage(*sessionID, agent.Version, response.Response, "completed", toolSteps)
+	}
+	h.publishRunEvent(rendered, run.source, sessionID, response, nil)
+	return response, sessionID, nil
+}
+
+// isHTTPURL reports whether raw is an absolute http or https URL.
+func isHTTPURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// postJSON posts a JSON body to url with the given headers and returns the
+// status it answered with. Any status other than 2xx is an error.
+func postJSON(ctx context.Context, url string, body []byte, headers map[string]string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// failStaleRuns fails the schedule and webhook runs left running by a server
+// that stopped.
+func (h *Handler) failStaleRuns() {
+	cutoff := time.Now().Add(-2 * unattendedRunTimeout)
+	updates := map[string]any{"status": "failed", "error": "Run was interrupted", "finished_at": time.Now()}
+	for _, model := range []any{&shared.ScheduleRun{}, &shared.WebhookRun{}} {
+		if err := h.DB.Model(model).Where("status = ? AND created_at < ?", "running", cutoff).Updates(updates).Error; err != nil {
+			log.Printf("Warning: Failed to update interrupted runs: %v", err)
+		}
+	}
+}
@@ -197,6 +197,18 @@ func (h *Handler) HandleMe(c echo.Context) error {
 			"mcp_servers_used": resourceCounts["mcp_servers_used"],
 			"api_key_limit":    tierConfig.APIKeyLimit,
 			"api_keys_used":    resourceCounts["api_keys_used"],
+
+			"knowledge_base_limit": tierConfig.KnowledgeBaseLimit,
+			"knowledge_bases_used": resourceCounts["knowledge_bases_used"],
+
+			"schedule_limit": tierConfig.ScheduleLimit,
+			"schedules_used": resourceCounts["schedules_used"],
+
+			"webhook_limit": tierConfig.WebhookLimit,
+			"webhooks_used": resourceCounts["webhooks_used"],
+
+			"event_webhook_limit": tierConfig.EventWebhookLimit,
+			"event_webhooks_used": resourceCounts["event_webhooks_used"],
 		},
 	}
 
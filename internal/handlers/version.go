@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// recordAgentVersion stores the agent's current settings as its next version
+// and points the agent at it.
+func recordAgentVersion(tx *gorm.DB, agent *shared.AgentConfig, comment string) error {
+	version := shared.AgentVersion{
+		AgentID:       agent.ID,
+		Version:       agent.Version + 1,
+		Comment:       comment,
+		AgentSettings: agent.AgentSettings,
+	}
+	if err := tx.Create(&version).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Model(agent).UpdateColumn("version", version.Version).Error; err != nil {
+		return err
+	}
+	agent.Version = version.Version
+	return nil
+}
+
+// userAgent loads the agent in the agentId path parameter if it belongs to the
+// user making the request.
+func (h *Handler) userAgent(c echo.Context) (*shared.AgentConfig, error) {
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid user context")
+	}
+
+	agentId, err := uuid.Parse(c.Param("agentId"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid agentId format")
+	}
+
+	var agent shared.AgentConfig
+	if err := h.DB.Where(&shared.AgentConfig{UserID: userID, ID: agentId}).First(&agent).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Agent not found")
+	}
+	return &agent, nil
+}
+
+// findAgentVersion loads the version of an agent whose number is given as a
+// string, as it comes from a path or query parameter.
+func (h *Handler) findAgentVersion(agentID uuid.UUID, number string) (*shared.AgentVersion, error) {
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid version %q", number))
+	}
+
+	var version shared.AgentVersion
+	if err := h.DB.Where("agent_id = ? AND version = ?", agentID, n).First(&version).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Version %d not found", n))
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load version")
+	}
+	return &version, nil
+}
+
+// HandleGetAgentVersions lists an agent's versions, newest first.
+func (h *Handler) HandleGetAgentVersions(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	var versions []shared.AgentVersion
+	if err := h.DB.Where("agent_id = ?", agent.ID).Order("version DESC").Find(&versions).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to retrieve versions")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"versions":        versions,
+		"current_version": agent.Version,
+		"count":           len(versions),
+	})
+}
+
+// HandleGetAgentVersion returns a single version of an agent.
+func (h *Handler) HandleGetAgentVersion(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	version, err := h.findAgentVersion(agent.ID, c.Param("version"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"version": version,
+	})
+}
+
+// HandleDiffAgentVersions lists the settings that changed between the
+// versions in the from and to query parameters. to defaults to the current
+// version.
+func (h *Handler) HandleDiffAgentVersions(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	if c.QueryParam("from") == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter is required")
+	}
+	from, err := h.findAgentVersion(agent.ID, c.QueryParam("from"))
+	if err != nil {
+		return err
+	}
+
+	toParam := c.QueryParam("to")
+	if toParam == "" {
+		toParam = strconv.Itoa(agent.Version)
+	}
+	to, err := h.findAgentVersion(agent.ID, toParam)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"from":    from.Version,
+		"to":      to.Version,
+		"changes": shared.DiffAgentSettings(from.AgentSettings, to.AgentSettings),
+	})
+}
+
+// HandleRollbackAgent restores the settings of an earlier version. The
+// rollback is itself recorded as a new version, so history is never lost.
+func (h *Handler) HandleRollbackAgent(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	version, err := h.findAgentVersion(agent.ID, c.Param("version"))
+	if err != nil {
+		return err
+	}
+	if version.Version == agent.Version {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Version %d is already the current version", version.Version))
+	}
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+
+	agent.AgentSettings = version.AgentSettings
+	if err := tx.Save(agent).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to roll back agent")
+	}
+	if err := recordAgentVersion(tx, agent, fmt.Sprintf("Rolled back to version %d", version.Version)); err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create agent version")
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit transaction")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"agent": agent,
+	})
+}
@@ -0,0 +1,562 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/middleware"
+	"github.com/arnavsurve/glyfs/internal/services"
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxWebhookNameLength     = 100
+	maxWebhookTemplateLength = 10000
+	minWebhookSecretLength   = 16
+	maxWebhookSecretLength   = 256
+
+	// maxWebhookBodyBytes bounds the body of an inbound webhook request.
+	maxWebhookBodyBytes = 1 << 20
+
+	// defaultWebhookTemplate passes the whole request body to the agent.
+	defaultWebhookTemplate = "{{payload}}"
+
+	// webhookRunHistory is the number of runs kept per webhook.
+	webhookRunHistory = 100
+)
+
+func generateWebhookSecret() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("generating bytes for webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(randomBytes), nil
+}
+
+// encryptWebhookSecret returns the secret to store for a webhook: the given
+// one, or a generated one when it is empty, in plain text and encrypted.
+func encryptWebhookSecret(secret string) (string, string, error) {
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		var err error
+		if secret, err = generateWebhookSecret(); err != nil {
+			return "", "", echo.NewHTTPError(http.StatusInternalServerError, "Failed to generate secret")
+		}
+	} else if len(secret) < minWebhookSecretLength || len(secret) > maxWebhookSecretLength {
+		return "", "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("secret must be %d to %d characters", minWebhookSecretLength, maxWebhookSecretLength))
+	}
+
+	encryptionService, err := services.NewEncryptionService()
+	if err != nil {
+		return "", "", echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize encryption service")
+	}
+	encrypted, err := encryptionService.Encrypt(secret)
+	if err != nil {
+		return "", "", echo.NewHTTPError(http.StatusInternalServerError, "failed to encrypt secret")
+	}
+	return secret, encrypted, nil
+}
+
+// validateWebhook checks a webhook against its agent.
+func validateWebhook(agent *shared.AgentConfig, webhook *shared.AgentWebhook) error {
+	webhook.Name = strings.TrimSpace(webhook.Name)
+	if webhook.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	if len(webhook.Name) > maxWebhookNameLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is too long")
+	}
+	if strings.TrimSpace(webhook.MessageTemplate) == "" {
+		webhook.MessageTemplate = defaultWebhookTemplate
+	}
+	if len(webhook.MessageTemplate) > maxWebhookTemplateLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "message_template is too long")
+	}
+	if webhook.ResultURL != "" && !isHTTPURL(webhook.ResultURL) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid result_url: must be an http or https URL")
+	}
+	if _, err := services.RenderSystemPrompt(agent, webhook.Variables, time.Now()); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// userWebhook loads the webhook in the webhookId path parameter if it
+// belongs to the agent.
+func (h *Handler) userWebhook(c echo.Context, agent *shared.AgentConfig) (*shared.AgentWebhook, error) {
+	webhookID, err := uuid.Parse(c.Param("webhookId"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid webhookId format")
+	}
+
+	var webhook shared.AgentWebhook
+	if err := h.DB.Where("id = ? AND agent_id = ?", webhookID, agent.ID).First(&webhook).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Webhook not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to load webhook")
+	}
+	return &webhook, nil
+}
+
+// HandleListWebhooks lists the inbound webhooks of the user's agent.
+func (h *Handler) HandleListWebhooks(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	webhooks := []shared.AgentWebhook{}
+	if err := h.DB.Where("agent_id = ?", agent.ID).Order("created_at ASC").Find(&webhooks).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load webhooks")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"webhooks": webhooks,
+	})
+}
+
+// HandleCreateWebhook creates an inbound webhook of the user's agent. The
+// secret is only returned here and when it is rotated.
+func (h *Handler) HandleCreateWebhook(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+
+	var req shared.CreateWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+
+	webhook := shared.AgentWebhook{
+		AgentID:         agent.ID,
+		UserID:          agent.UserID,
+		Name:            req.Name,
+		MessageTemplate: req.MessageTemplate,
+		Variables:       req.Variables,
+		StoreSession:    req.StoreSession == nil || *req.StoreSession,
+		ResultURL:       strings.TrimSpace(req.ResultURL),
+		Enabled:         req.Enabled == nil || *req.Enabled,
+	}
+	if err := validateWebhook(agent, &webhook); err != nil {
+		return err
+	}
+
+	secret, encrypted, err := encryptWebhookSecret(req.Secret)
+	if err != nil {
+		return err
+	}
+	webhook.Secret = encrypted
+
+	if err := h.PlanMiddleware.CheckResourceLimit(agent.UserID, middleware.ResourceWebhook); err != nil {
+		return err
+	}
+
+	if err := h.DB.Create(&webhook).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create webhook")
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"webhook": webhook,
+		"secret":  secret,
+	})
+}
+
+// HandleGetWebhook returns an inbound webhook of the user's agent.
+func (h *Handler) HandleGetWebhook(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	webhook, err := h.userWebhook(c, agent)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"webhook": webhook,
+	})
+}
+
+// HandleUpdateWebhook changes an inbound webhook of the user's agent.
+func (h *Handler) HandleUpdateWebhook(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	webhook, err := h.userWebhook(c, agent)
+	if err != nil {
+		return err
+	}
+
+	var req shared.UpdateWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+
+	if req.Name != nil {
+		webhook.Name = *req.Name
+	}
+	if req.MessageTemplate != nil {
+		webhook.MessageTemplate = *req.MessageTemplate
+	}
+	if req.Variables != nil {
+		webhook.Variables = *req.Variables
+	}
+	if req.StoreSession != nil {
+		webhook.StoreSession = *req.StoreSession
+	}
+	if req.ResultURL != nil {
+		webhook.ResultURL = strings.TrimSpace(*req.ResultURL)
+	}
+	if req.Enabled != nil {
+		webhook.Enabled = *req.Enabled
+	}
+	if err := validateWebhook(agent, webhook); err != nil {
+		return err
+	}
+
+	// Save writes the zero values too, such as an emptied result_url.
+	if err := h.DB.Save(webhook).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update webhook")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"webhook": webhook,
+	})
+}
+
+// HandleRotateWebhookSecret replaces the secret of an inbound webhook of the
+// user's agent. Requests signed with the old secret are rejected from then
+// on.
+func (h *Handler) HandleRotateWebhookSecret(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	webhook, err := h.userWebhook(c, agent)
+	if err != nil {
+		return err
+	}
+
+	var req shared.RotateWebhookSecretRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+
+	secret, encrypted, err := encryptWebhookSecret(req.Secret)
+	if err != nil {
+		return err
+	}
+	if err := h.DB.Model(webhook).Update("secret", encrypted).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update secret")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"webhook": webhook,
+		"secret":  secret,
+	})
+}
+
+// HandleDeleteWebhook deletes an inbound webhook of the user's agent with its
+// run history. Runs in progress finish.
+func (h *Handler) HandleDeleteWebhook(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	webhook, err := h.userWebhook(c, agent)
+	if err != nil {
+		return err
+	}
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err := tx.Where("webhook_id = ?", webhook.ID).Delete(&shared.WebhookRun{}).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete webhook runs")
+	}
+	if err := tx.Where("webhook_id = ?", webhook.ID).Delete(&shared.WebhookReceipt{}).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete webhook receipts")
+	}
+	if err := tx.Delete(webhook).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete webhook")
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to commit transaction")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Webhook deleted successfully",
+	})
+}
+
+// HandleListWebhookRuns lists the latest runs of an inbound webhook of the
+// user's agent, newest first. The limit query parameter defaults to 20.
+func (h *Handler) HandleListWebhookRuns(c echo.Context) error {
+	agent, err := h.userAgent(c)
+	if err != nil {
+		return err
+	}
+	webhook, err := h.userWebhook(c, agent)
+	if err != nil {
+		return err
+	}
+
+	limit := 20
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > webhookRunHistory {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", webhookRunHistory))
+		}
+	}
+
+	runs := []shared.WebhookRun{}
+	if err := h.DB.Where("webhook_id = ?", webhook.ID).Order("created_at DESC").Limit(limit).Find(&runs).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load webhook runs")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"runs": runs,
+	})
+}
+
+// HandleTriggerWebhook starts a run of a webhook's agent from a request
+// signed with the webhook's secret, instead of an API key. The request body
+// is rendered into the agent's message, and the run continues in the
+// background after the request is answered with 202.
+func (h *Handler) HandleTriggerWebhook(c echo.Context) error {
+	webhookID, err := uuid.Parse(c.Param("webhookId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Webhook not found")
+	}
+
+	var webhook shared.AgentWebhook
+	if err := h.DB.Where("id = ?", webhookID).First(&webhook).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Webhook not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load webhook")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxWebhookBodyBytes+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read request body")
+	}
+	if len(body) > maxWebhookBodyBytes {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", maxWebhookBodyBytes))
+	}
+
+	encryptionService, err := services.NewEncryptionService()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize encryption service")
+	}
+	secret, err := encryptionService.Decrypt(webhook.Secret)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to decrypt secret")
+	}
+	replayKey, err := services.VerifyWebhookSignature(secret, c.Request().Header, body, time.Now())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("Invalid signature: %v", err))
+	}
+
+	if !webhook.Enabled {
+		return echo.NewHTTPError(http.StatusForbidden, "Webhook is disabled")
+	}
+	if err := h.DB.Select("id").Where("id = ?", webhook.AgentID).First(&shared.AgentConfig{}).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Agent not found")
+	}
+
+	// The template's own placeholders are filled first, so that values in
+	// the payload are passed on as they are.
+	now := time.Now()
+	message := services.RenderMessageTemplate(webhook.MessageTemplate, webhook.Variables, now.UTC())
+	message = services.RenderPayloadTemplate(message, body, c.Request().Header)
+	if strings.TrimSpace(message) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "The request renders an empty message")
+	}
+
+	run := shared.WebhookRun{
+		ID:        uuid.New(),
+		WebhookID: webhook.ID,
+		AgentID:   webhook.AgentID,
+		Status:    "running",
+		Message:   message,
+	}
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// A request is accepted once. A replay answers with the run of the
+	// original request and starts nothing.
+	receipt := shared.WebhookReceipt{
+		WebhookID: webhook.ID,
+		Key:       replayKey.Key,
+		RunID:     run.ID,
+		ExpiresAt: &replayKey.ExpiresAt,
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&receipt)
+	if result.Error != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start run")
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		var original shared.WebhookReceipt
+		if err := h.DB.Where("webhook_id = ? AND key = ?", webhook.ID, replayKey.Key).First(&original).Error; err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load original request")
+		}
+		return c.JSON(http.StatusOK, map[string]any{
+			"run_id": original.RunID,
+			"status": "duplicate",
+		})
+	}
+
+	if err := tx.Create(&run).Error; err != nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start run")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start run")
+	}
+	h.DB.Model(&webhook).Updates(map[string]any{"last_triggered_at": now, "last_status": "running"})
+
+	go h.executeWebhookRun(webhook, secret, run)
+
+	return c.JSON(http.StatusAccepted, map[string]any{
+		"run_id": run.ID,
+		"status": run.Status,
+	})
+}
+
+// executeWebhookRun runs the agent of a webhook, delivers the result to the
+// webhook's result URL and records the outcome.
+func (h *Handler) executeWebhookRun(webhook shared.AgentWebhook, secret string, run shared.WebhookRun) {
+	ctx, cancel := context.WithTimeout(context.Background(), unattendedRunTimeout)
+	defer cancel()
+
+	unattended := unattendedRun{
+		agentID:   webhook.AgentID,
+		variables: webhook.Variables,
+		message:   run.Message,
+		source:    "webhook",
+		now:       time.Now(),
+	}
+	if webhook.StoreSession {
+		unattended.sessionTitle = fmt.Sprintf("%s (%s)", webhook.Name, time.Now().UTC().Format("Jan 2, 15:04"))
+	}
+
+	response, sessionID, err := h.runUnattended(ctx, &unattended)
+	run.SessionID = sessionID
+	if response != nil && response.Usage != nil {
+		run.TotalTokens = response.Usage.TotalTokens
+	}
+	run.Status = "succeeded"
+	if err != nil {
+		log.Printf("Webhook %s run %s failed: %v", webhook.ID, run.ID, err)
+		run.Status = "failed"
+		run.Error = err.Error()
+		response = nil
+	} else {
+		run.Response = response.Response
+	}
+
+	if webhook.ResultURL != "" {
+		status, err := postWebhookResult(&webhook, secret, &run, response)
+		run.ResultStatus = status
+		if err != nil {
+			log.Printf("Webhook %s run %s result delivery failed: %v", webhook.ID, run.ID, err)
+			if run.Status == "succeeded" {
+				run.Status = "failed"
+				run.Error = fmt.Sprintf("result_url: %v", err)
+			}
+		}
+	}
+
+	now := time.Now()
+	run.FinishedAt = &now
+	if err := h.DB.Save(&run).Error; err != nil {
+		log.Printf("Warning: Failed to save webhook run %s: %v", run.ID, err)
+	}
+	h.DB.Model(&shared.AgentWebhook{}).Where("id = ?", webhook.ID).Update("last_status", run.Status)
+
+	// Keep the latest runs only.
+	h.DB.Where("webhook_id = ? AND id NOT IN (?)", webhook.ID,
+		h.DB.Model(&shared.WebhookRun{}).Select("id").Where("webhook_id = ?", webhook.ID).Order("created_at DESC").Limit(webhookRunHistory),
+	).Delete(&shared.WebhookRun{})
+}
+
+// deleteExpiredWebhookReceipts deletes the receipts of requests whose
+// signatures have expired, since they can no longer be replayed, and of
+// GitHub requests past their retention. Receipts stored without an expiry
+// are kept for the same retention from when they were created.
+func (h *Handler) deleteExpiredWebhookReceipts() {
+	now := time.Now()
+	if err := h.DB.Where("expires_at < ? OR (expires_at IS NULL AND created_at < ?)", now, now.Add(-services.WebhookReceiptRetention)).Delete(&shared.WebhookReceipt{}).Error; err != nil {
+		log.Printf("Warning: Failed to delete expired webhook receipts: %v", err)
+	}
+}
+
+// postWebhookResult posts the outcome of a run to the webhook's result URL,
+// signed with the webhook's secret in the X-Glyfs-Signature and
+// X-Glyfs-Timestamp headers, and returns the status it answered with.
+func postWebhookResult(webhook *shared.AgentWebhook, secret string, run *shared.WebhookRun, response *shared.AgentInferenceResponse) (int, error) {
+	payload := shared.WebhookResultPayload{
+		WebhookID:   webhook.ID,
+		WebhookName: webhook.Name,
+		RunID:       run.ID,
+		AgentID:     webhook.AgentID,
+		Status:      run.Status,
+		Message:     run.Message,
+		Error:       run.Error,
+		SessionID:   run.SessionID,
+	}
+	if response != nil {
+		payload.Response = response.Response
+		payload.Structured = response.Structured
+		payload.Usage = response.Usage
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	return postJSON(context.Background(), webhook.ResultURL, body, map[string]string{
+		"User-Agent":        "Glyfs-Webhooks",
+		"X-Glyfs-Signature": services.SignWebhookPayload(secret, timestamp, body),
+		"X-Glyfs-Timestamp": strconv.FormatInt(timestamp, 10),
+	})
+}
@@ -3,6 +3,8 @@ package middleware
 import (
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/arnavsurve/glyfs/internal/shared"
@@ -27,6 +29,11 @@ const (
 	ResourceAgent     ResourceType = "agent"
 	ResourceMCPServer ResourceType = "mcp_server"
 	ResourceAPIKey    ResourceType = "api_key"
+
+	ResourceKnowledgeBase ResourceType = "knowledge_base"
+	ResourceSchedule      ResourceType = "schedule"
+	ResourceWebhook       ResourceType = "webhook"
+	ResourceEventWebhook  ResourceType = "event_webhook"
 )
 
 func NewPlanMiddleware(db *gorm.DB) *PlanMiddleware {
@@ -38,6 +45,11 @@ func NewPlanMiddleware(db *gorm.DB) *PlanMiddleware {
 
 // CheckResourceLimit verifies if the user can create more of a specific resource type
 func (pm *PlanMiddleware) CheckResourceLimit(userID uint, resourceType ResourceType) error {
+	return pm.CheckResourceLimitN(userID, resourceType, 1)
+}
+
+// CheckResourceLimitN verifies if the user can create n more of a specific resource type
+func (pm *PlanMiddleware) CheckResourceLimitN(userID uint, resourceType ResourceType, n int) error {
 	// Get user tier configuration (with caching)
 	tierConfig, tier, err := pm.getUserTierConfig(userID)
 	if err != nil {
@@ -63,12 +75,24 @@ func (pm *PlanMiddleware) CheckResourceLimit(userID uint, resourceType ResourceT
 	case ResourceAPIKey:
 		limit = tierConfig.APIKeyLimit
 		resourceName = "API keys"
+	case ResourceKnowledgeBase:
+		limit = tierConfig.KnowledgeBaseLimit
+		resourceName = "knowledge bases"
+	case ResourceSchedule:
+		limit = tierConfig.ScheduleLimit
+		resourceName = "schedules"
+	case ResourceWebhook:
+		limit = tierConfig.WebhookLimit
+		resourceName = "webhooks"
+	case ResourceEventWebhook:
+		limit = tierConfig.EventWebhookLimit
+		resourceName = "event webhooks"
 	default:
 		return echo.NewHTTPError(http.StatusInternalServerError, "Unknown resource type")
 	}
 
 	// Check if limit is exceeded
-	if currentCount >= limit {
+	if currentCount+n > limit {
 		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf(
 			"%s limit reached. Your %s tier allows %d %s. Please upgrade to create more %s.",
 			resourceName, tier, limit, resourceName, resourceName,
@@ -78,6 +102,48 @@ func (pm *PlanMiddleware) CheckResourceLimit(userID uint, resourceType ResourceT
 	return nil
 }
 
+// KnowledgeDocumentMaxBytes returns the largest knowledge base document the user's tier allows
+func (pm *PlanMiddleware) KnowledgeDocumentMaxBytes(userID uint) (int64, error) {
+	tierConfig, _, err := pm.getUserTierConfig(userID)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "Failed to get user tier information")
+	}
+	return tierConfig.KnowledgeDocumentMaxBytes, nil
+}
+
+// AttachmentMaxBytes returns the largest attachment the user's tier allows
+func (pm *PlanMiddleware) AttachmentMaxBytes(userID uint) (int64, error) {
+	tierConfig, _, err := pm.getUserTierConfig(userID)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "Failed to get user tier information")
+	}
+	return tierConfig.AttachmentMaxBytes, nil
+}
+
+// CheckAttachment verifies if the user's tier allows uploading a file of the given type and size
+func (pm *PlanMiddleware) CheckAttachment(userID uint, contentType string, size int64) error {
+	tierConfig, tier, err := pm.getUserTierConfig(userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get user tier information")
+	}
+
+	if !slices.Contains(tierConfig.AttachmentTypes, contentType) {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, fmt.Sprintf(
+			"%s attachments are not allowed on the %s tier. Allowed types: %s.",
+			contentType, tier, strings.Join(tierConfig.AttachmentTypes, ", "),
+		))
+	}
+
+	if size > tierConfig.AttachmentMaxBytes {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"Attachment is too large. Your %s tier allows attachments up to %d MB.",
+			tier, tierConfig.AttachmentMaxBytes>>20,
+		))
+	}
+
+	return nil
+}
+
 // getUserTierConfig gets user tier configuration with caching
 func (pm *PlanMiddleware) getUserTierConfig(userID uint) (shared.TierLimits, string, error) {
 	// Check cache first
@@ -139,6 +205,22 @@ func (pm *PlanMiddleware) countUserResources(userID uint, resourceType ResourceT
 		`, userID).Scan(&count).Error; err != nil {
 			return 0, err
 		}
+	case ResourceKnowledgeBase:
+		if err := pm.DB.Model(&shared.KnowledgeBase{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return 0, err
+		}
+	case ResourceSchedule:
+		if err := pm.DB.Model(&shared.AgentSchedule{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return 0, err
+		}
+	case ResourceWebhook:
+		if err := pm.DB.Model(&shared.AgentWebhook{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return 0, err
+		}
+	case ResourceEventWebhook:
+		if err := pm.DB.Model(&shared.EventWebhook{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			return 0, err
+		}
 	default:
 		return 0, fmt.Errorf("unknown resource type: %s", resourceType)
 	}
@@ -175,5 +257,29 @@ func (pm *PlanMiddleware) GetUserResourceCounts(userID uint) (map[string]int, er
 	}
 	counts["api_keys_used"] = apiKeyCount
 
+	knowledgeBaseCount, err := pm.countUserResources(userID, ResourceKnowledgeBase)
+	if err != nil {
+		return nil, err
+	}
+	counts["knowledge_bases_used"] = knowledgeBaseCount
+
+	scheduleCount, err := pm.countUserResources(userID, ResourceSchedule)
+	if err != nil {
+		return nil, err
+	}
+	counts["schedules_used"] = scheduleCount
+
+	webhookCount, err := pm.countUserResources(userID, ResourceWebhook)
+	if err != nil {
+		return nil, err
+	}
+	counts["webhooks_used"] = webhookCount
+
+	eventWebhookCount, err := pm.countUserResources(userID, ResourceEventWebhook)
+	if err != nil {
+		return nil, err
+	}
+	counts["event_webhooks_used"] = eventWebhookCount
+
 	return counts, nil
 }
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/tools"
+)
+
+const (
+	// ToolApprovalTimeout is how long a streaming run waits for a decision
+	// before the tool call is rejected.
+	ToolApprovalTimeout = 5 * time.Minute
+
+	// PendingRunTimeout is how long a paused non-streaming run accepts
+	// decisions. Resuming later rejects every pending call.
+	PendingRunTimeout = time.Hour
+)
+
+var ErrApprovalNotFound = errors.New("approval not found or already decided")
+
+// ToolApprover returns the decision for a tool call that requires approval.
+// It blocks until a decision is made.
+type ToolApprover func(ctx context.Context, toolCall llms.ToolCall) (*shared.ToolApprovalDecision, error)
+
+// ApprovalBroker hands decisions from the approval endpoints to the streaming
+// runs waiting on them.
+type ApprovalBroker struct {
+	mutex   sync.Mutex
+	pending map[uuid.UUID]*pendingApproval
+}
+
+type pendingApproval struct {
+	userID    uint
+	agentID   uuid.UUID
+	apiKeyID  *uint
+	decisions chan *shared.ToolApprovalDecision
+}
+
+func NewApprovalBroker() *ApprovalBroker {
+	return &ApprovalBroker{
+		pending: make(map[uuid.UUID]*pendingApproval),
+	}
+}
+
+// Approver returns a ToolApprover that announces each approval through
+// toolEventFunc and waits for Resolve, rejecting the call after
+// ToolApprovalTimeout. apiKeyID is the API key the run was started with, or
+// nil for the dashboard.
+func (b *ApprovalBroker) Approver(userID uint, agentID uuid.UUID, apiKeyID *uint, toolEventFunc func(*shared.ToolCallEvent)) ToolApprover {
+	return func(ctx context.Context, toolCall llms.ToolCall) (*shared.ToolApprovalDecision, error) {
+		approvalID := uuid.New()
+		decisions := make(chan *shared.ToolApprovalDecision, 1)
+
+		b.mutex.Lock()
+		b.pending[approvalID] = &pendingApproval{
+			userID:    userID,
+			agentID:   agentID,
+			apiKeyID:  apiKeyID,
+			decisions: decisions,
+		}
+		b.mutex.Unlock()
+
+		defer func() {
+			b.mutex.Lock()
+			delete(b.pending, approvalID)
+			b.mutex.Unlock()
+		}()
+
+		expiresAt := time.Now().Add(ToolApprovalTimeout)
+		if toolEventFunc != nil {
+			var args map[string]any
+			json.Unmarshal([]byte(toolCall.FunctionCall.Arguments), &args)
+
+			toolEventFunc(&shared.ToolCallEvent{
+				Type:       "tool_approval_required",
+				CallID:     toolCall.ID,
+				ToolName:   toolCall.FunctionCall.Name,
+				Arguments:  args,
+				ApprovalID: approvalID.String(),
+				ExpiresAt:  &expiresAt,
+			})
+		}
+
+		timer := time.NewTimer(ToolApprovalTimeout)
+		defer timer.Stop()
+
+		select {
+		case decision := <-decisions:
+			return decision, nil
+		case <-timer.C:
+			return &shared.ToolApprovalDecision{Action: "reject", Reason: "approval timed out"}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Resolve delivers a decision to the run waiting on approvalID. The approval
+// must belong to the given user and agent and the run must have been started
+// with the given API key.
+func (b *ApprovalBroker) Resolve(approvalID uuid.UUID, userID uint, agentID uuid.UUID, apiKeyID *uint, decision *shared.ToolApprovalDecision) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	pending, ok := b.pending[approvalID]
+	if !ok || pending.userID != userID || pending.agentID != agentID || !sameAPIKey(pending.apiKeyID, apiKeyID) {
+		return ErrApprovalNotFound
+	}
+
+	delete(b.pending, approvalID)
+	pending.decisions <- decision
+	return nil
+}
+
+// approvalTool is implemented by tools that can require approval per agent.
+type approvalTool interface {
+	RequiresApproval() bool
+}
+
+func toolRequiresApproval(tool tools.Tool) bool {
+	t, ok := tool.(approvalTool)
+	return ok && t.RequiresApproval()
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// attachmentTokenEstimate is the tokens assumed for each attachment when
+// fitting history into the context budget, since their cost depends on the
+// provider and the image size.
+const attachmentTokenEstimate = 1500
+
+// nonVisionModels are built-in models that only accept text.
+var nonVisionModels = []string{string(shared.O1Mini), string(shared.O3Mini)}
+
+// SupportsAttachment reports whether the agent's model accepts files of
+// contentType. Images go to every vision model. PDFs are only sent to Gemini,
+// the one provider whose client takes them as document input. Custom
+// endpoints are assumed to accept images in the OpenAI format.
+func SupportsAttachment(agent *shared.AgentConfig, contentType string) bool {
+	if slices.Contains(nonVisionModels, agent.LLMModel) {
+		return false
+	}
+	if slices.Contains(shared.ImageAttachmentTypes, contentType) {
+		return true
+	}
+	return contentType == shared.PDFAttachmentType && agent.Provider == string(shared.Google)
+}
+
+// attachmentPart converts a file into a content part in the form the agent's
+// provider expects. OpenAI-style APIs take images as data URLs, the others as
+// binary content.
+func attachmentPart(agent *shared.AgentConfig, file shared.FileContent) llms.ContentPart {
+	switch shared.InferenceProvider(agent.Provider) {
+	case shared.OpenAI, shared.Custom:
+		return llms.ImageURLPart(fmt.Sprintf("data:%s;base64,%s", file.ContentType, base64.StdEncoding.EncodeToString(file.Data)))
+	}
+	return llms.BinaryPart(file.ContentType, file.Data)
+}
+
+// userMessage builds a user message with its attachments placed before the
+// text, as providers recommend for images.
+func userMessage(agent *shared.AgentConfig, content string, files []shared.FileContent) llms.MessageContent {
+	if len(files) == 0 {
+		return llms.TextParts(llms.ChatMessageTypeHuman, content)
+	}
+	message := llms.MessageContent{Role: llms.ChatMessageTypeHuman}
+	for _, file := range files {
+		message.Parts = append(message.Parts, attachmentPart(agent, file))
+	}
+	message.Parts = append(message.Parts, llms.TextPart(content))
+	return message
+}
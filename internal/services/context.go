@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// defaultContextWindowMessages is the sliding window size when the agent
+	// does not set one.
+	defaultContextWindowMessages = 20
+
+	// defaultOutputReserve is kept free for the reply when the agent has no
+	// max_tokens.
+	defaultOutputReserve = 4096
+
+	// summaryReserve is kept free for the summary under the summarize
+	// strategy.
+	summaryReserve = 1024
+
+	// messageOverheadTokens approximates the per-message framing tokens.
+	messageOverheadTokens = 4
+)
+
+// ContextSummary is a summary of the first Messages messages of a
+// conversation.
+type ContextSummary struct {
+	Content  string
+	Messages int
+}
+
+// ContextWindow is the part of a conversation that fits the agent's context
+// budget: the history from Start on, preceded by Summary when there is one.
+// Usage is set when a summary was requested from the model.
+type ContextWindow struct {
+	Start   int
+	Summary ContextSummary
+	Usage   *shared.Usage
+}
+
+// ContextBudget returns the number of tokens the system prompt and the
+// conversation may use for an agent.
+func ContextBudget(agent *shared.AgentConfig) int {
+	if agent.ContextBudget > 0 {
+		return agent.ContextBudget
+	}
+
+	reserve := agent.MaxTokens
+	if reserve <= 0 {
+		reserve = defaultOutputReserve
+	}
+
+	// Tool definitions are not counted, so leave a tenth of the window spare.
+	budget := (shared.ModelContextWindow(agent.LLMModel) - reserve) * 9 / 10
+	if budget < 1024 {
+		budget = 1024
+	}
+	return budget
+}
+
+// estimateTokens approximates the token count of a text at four characters
+// per token, which is close for English across the supported providers.
+func estimateTokens(text string) int {
+	return len(text)/4 + messageOverheadTokens
+}
+
+// CompactHistory decides which part of history is sent with userMessage
+// under the agent's context strategy. prior is the summary stored for the
+// conversation, if any. Under the summarize strategy a new summary is written
+// when more messages fall out of the window with the owner's credentials for
+// the agent's provider; compare the returned Summary to prior to know whether
+// to store it.
+func (s *LLMService) CompactHistory(ctx context.Context, agent *shared.AgentConfig, creds *shared.ProviderCredentials, history []shared.Message, userMessage string, prior ContextSummary) *ContextWindow {
+	strategy := shared.ContextStrategy(agent.ContextStrategy)
+	if strategy == "" {
+		strategy = shared.ContextKeepSystemAndRecent
+	}
+
+	budget := ContextBudget(agent) - estimateTokens(agent.SystemPrompt) - estimateTokens(userMessage)
+	if strategy == shared.ContextSummarize {
+		budget -= summaryReserve
+	}
+
+	start := recentStart(agent, history, budget)
+	if strategy == shared.ContextSlidingWindow {
+		size := agent.ContextWindowMessages
+		if size <= 0 {
+			size = defaultContextWindowMessages
+		}
+		start = max(start, len(history)-size)
+	}
+	start = userTurnStart(history, start)
+
+	if strategy != shared.ContextSummarize {
+		return &ContextWindow{Start: start}
+	}
+
+	// Messages already covered by the stored summary are never sent again.
+	if prior.Messages > len(history) {
+		prior = ContextSummary{}
+	}
+	if start <= prior.Messages {
+		return &ContextWindow{Start: prior.Messages, Summary: prior}
+	}
+
+	summary, usage, err := s.summarizeHistory(ctx, agent, creds, prior.Content, history[prior.Messages:start])
+	if err != nil {
+		// Without a summary the conversation is still sent, just truncated.
+		log.Printf("Warning: Failed to summarize conversation, truncating instead: %v", err)
+		return &ContextWindow{Start: start, Summary: prior, Usage: usage}
+	}
+
+	return &ContextWindow{
+		Start:   start,
+		Summary: ContextSummary{Content: summary, Messages: start},
+		Usage:   usage,
+	}
+}
+
+// recentStart returns the index of the oldest message such that it and every
+// message after it fit in budget.
+func recentStart(agent *shared.AgentConfig, history []shared.Message, budget int) int {
+	used := 0
+	for i := len(history) - 1; i >= 0; i-- {
+		used += messageTokens(agent, history[i])
+		if used > budget {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// userTurnStart moves start forward to the next user message, since some
+// providers reject a conversation that opens with an assistant message.
+func userTurnStart(history []shared.Message, start int) int {
+	for start < len(history) && history[start].Role != "user" {
+		start++
+	}
+	return start
+}
+
+// SummaryModel returns the model that writes conversation summaries for an
+// agent: the cheapest model of the agent's provider, or the agent's own model
+// on a custom endpoint.
+func SummaryModel(agent *shared.AgentConfig) string {
+	switch shared.InferenceProvider(agent.Provider) {
+	case shared.OpenAI:
+		return string(shared.GPT41Nano)
+	case shared.Anthropic:
+		return string(shared.Claude35Haiku)
+	case shared.Google:
+		return string(shared.Gemini25FlashLite)
+	default:
+		return agent.LLMModel
+	}
+}
+
+// summarizeHistory folds messages into an existing summary using the agent's
+// provider and the owner's credentials.
+func (s *LLMService) summarizeHistory(ctx context.Context, agent *shared.AgentConfig, creds *shared.ProviderCredentials, previous string, messages []shared.Message) (string, *shared.Usage, error) {
+	llm, err := s.CreateLLM(agent.Provider, creds)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating LLM client: %w", err)
+	}
+	defer closeLLM(llm)
+
+	var transcript strings.Builder
+	for _, msg := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n\n", msg.Role, msg.Content)
+	}
+
+	prompt := fmt.Sprintf(`You maintain a running summary of a conversation between a user and an AI assistant. The summary replaces the older messages, so it must keep everything needed to continue the conversation: the user's goals, facts and decisions, names, numbers, and open questions.
+
+Current summary (may be empty):
+%s
+
+New messages to fold in:
+%s
+Write the updated summary in at most 300 words. Output only the summary.`, previous, transcript.String())
+
+	response, err := llm.GenerateContent(ctx, []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, prompt),
+	},
+		llms.WithModel(SummaryModel(agent)),
+		llms.WithTemperature(0.2),
+		llms.WithMaxTokens(600),
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("generating summary: %w", err)
+	}
+	if len(response.Choices) == 0 {
+		return "", nil, fmt.Errorf("no summary generated")
+	}
+
+	usage := usageFromGenerationInfo(response.Choices[0].GenerationInfo)
+	summary := strings.TrimSpace(response.Choices[0].Content)
+	if summary == "" {
+		return "", &usage, fmt.Errorf("empty summary")
+	}
+	return summary, &usage, nil
+}
+
+// systemPromptWithSummary appends a conversation summary to the system prompt.
+func systemPromptWithSummary(systemPrompt, summary string) string {
+	if summary == "" {
+		return systemPrompt
+	}
+	section := "Summary of the earlier part of this conversation:\n" + summary
+	if systemPrompt == "" {
+		return section
+	}
+	return systemPrompt + "\n\n" + section
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"*/15 9-17 * * mon-fri", false},
+		{"0 0 1,15 jan,jul *", false},
+		{"5/10 * * * 7", false},
+		{"@daily", false},
+		{"@Hourly", false},
+		{"* * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+		{"* * * foo *", true},
+		{"@reboot", true},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseCron(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCron(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	// In 2026 New York clocks go forward at 02:00 on March 8 and back at
+	// 02:00 on November 1.
+	est := time.FixedZone("EST", -5*60*60)
+	edt := time.FixedZone("EDT", -4*60*60)
+
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{
+			name:  "every minute",
+			expr:  "* * * * *",
+			after: time.Date(2026, 1, 1, 10, 0, 30, 0, time.UTC),
+			want:  time.Date(2026, 1, 1, 10, 1, 0, 0, time.UTC),
+		},
+		{
+			name:  "step",
+			expr:  "*/15 * * * *",
+			after: time.Date(2026, 1, 1, 10, 15, 0, 0, time.UTC),
+			want:  time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "weekdays",
+			expr:  "0 9 * * mon-fri",
+			after: time.Date(2026, 1, 2, 9, 0, 0, 0, time.UTC), // Friday
+			want:  time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "day of month or day of week",
+			expr:  "0 0 13 * fri",
+			after: time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2026, 1, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "sunday as 7",
+			expr:  "0 0 * * 7",
+			after: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "end of month",
+			expr:  "0 0 31 * *",
+			after: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "leap day",
+			expr:  "0 0 29 2 *",
+			after: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "never",
+			expr:  "0 0 30 2 *",
+			after: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Time{},
+		},
+		{
+			name:  "time zone",
+			expr:  "0 9 * * *",
+			after: time.Date(2026, 1, 1, 12, 0, 0, 0, newYork),
+			want:  time.Date(2026, 1, 2, 9, 0, 0, 0, est),
+		},
+		{
+			name:  "skipped by daylight saving",
+			expr:  "30 2 * * *",
+			after: time.Date(2026, 3, 7, 3, 0, 0, 0, newYork),
+			want:  time.Date(2026, 3, 9, 2, 30, 0, 0, edt),
+		},
+		{
+			name:  "after the skipped hour",
+			expr:  "0 3 * * *",
+			after: time.Date(2026, 3, 8, 0, 0, 0, 0, newYork),
+			want:  time.Date(2026, 3, 8, 3, 0, 0, 0, edt),
+		},
+		{
+			name:  "hourly across the skipped hour",
+			expr:  "0 * * * *",
+			after: time.Date(2026, 3, 8, 1, 0, 0, 0, newYork),
+			want:  time.Date(2026, 3, 8, 3, 0, 0, 0, edt),
+		},
+		{
+			name:  "first of a repeated time",
+			expr:  "30 1 * * *",
+			after: time.Date(2026, 10, 31, 12, 0, 0, 0, newYork),
+			want:  time.Date(2026, 11, 1, 1, 30, 0, 0, edt),
+		},
+		{
+			name:  "repeated time runs once",
+			expr:  "30 1 * * *",
+			after: time.Date(2026, 11, 1, 1, 30, 0, 0, edt),
+			want:  time.Date(2026, 11, 2, 1, 30, 0, 0, est),
+		},
+		{
+			name:  "steps in the repeated hour run once",
+			expr:  "*/30 * * * *",
+			after: time.Date(2026, 11, 1, 1, 30, 0, 0, edt),
+			want:  time.Date(2026, 11, 1, 2, 0, 0, 0, est),
+		},
+		{
+			name:  "after the repeated hour",
+			expr:  "0 2 * * *",
+			after: time.Date(2026, 11, 1, 1, 0, 0, 0, edt),
+			want:  time.Date(2026, 11, 1, 2, 0, 0, 0, est),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q) error = %v", tt.expr, err)
+			}
+			after := tt.after.In(newYork)
+			if tt.after.Location() == time.UTC {
+				after = tt.after
+			}
+			got := schedule.Next(after)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", after, got, tt.want)
+			}
+		})
+	}
+}
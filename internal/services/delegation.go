@@ -0,0 +1,254 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+)
+
+// maxDelegationDepth bounds how many agents deep a chain of delegations can
+// go below the agent the request was made to.
+const maxDelegationDepth = 3
+
+// Delegate is an agent that another agent can call as a tool.
+type Delegate struct {
+	Agent       *shared.AgentConfig
+	Description string
+}
+
+// DelegateSource supplies what delegated runs need from outside the service.
+type DelegateSource interface {
+	// Delegates lists the agents agentID can delegate to.
+	Delegates(ctx context.Context, agentID uuid.UUID) ([]Delegate, error)
+	// Credentials returns the provider credentials of a delegate's owner.
+	Credentials(userID uint, provider string) (*shared.ProviderCredentials, error)
+	// RecordUsage records the tokens a delegate used on behalf of parent.
+	RecordUsage(agent, parent *shared.AgentConfig, usage *shared.Usage)
+}
+
+type delegationChainKey struct{}
+
+// delegationChain returns the IDs of the agents running above the current
+// one, outermost first.
+func delegationChain(ctx context.Context) []uuid.UUID {
+	chain, _ := ctx.Value(delegationChainKey{}).([]uuid.UUID)
+	return chain
+}
+
+// DelegateTool runs another agent through the tool loop with the task the
+// calling agent gives it, and returns the agent's answer.
+type DelegateTool struct {
+	service     *LLMService
+	parent      *shared.AgentConfig
+	delegate    Delegate
+	name        string
+	description string
+}
+
+// newDelegateTool names the tool after the delegate, adding the start of the
+// delegate's ID when another tool in taken has the name already. The name is
+// added to taken.
+func newDelegateTool(service *LLMService, parent *shared.AgentConfig, delegate Delegate, taken map[string]bool) *DelegateTool {
+	name := delegateToolName(delegate.Agent, taken)
+	taken[name] = true
+
+	description := delegate.Description
+	if description == "" {
+		description = fmt.Sprintf("Delegate a task to the %s agent and get back its answer.", delegate.Agent.Name)
+	}
+
+	return &DelegateTool{
+		service:     service,
+		parent:      parent,
+		delegate:    delegate,
+		name:        name,
+		description: fmt.Sprintf("[agent: %s] %s", delegate.Agent.Name, description),
+	}
+}
+
+// delegateToolName returns "agent_" and the agent's name, limited to the
+// characters and length providers accept for tool names. Agents whose names
+// differ only in case or punctuation would share it, so on a clash the first
+// eight characters of the agent's ID are appended, then a counter.
+func delegateToolName(agent *shared.AgentConfig, taken map[string]bool) string {
+	base := toolNamePattern.ReplaceAllString("agent_"+strings.ToLower(agent.Name), "_")
+	name := truncateToolName(base, "")
+	if !taken[name] {
+		return name
+	}
+
+	suffix := "_" + agent.ID.String()[:8]
+	name = truncateToolName(base, suffix)
+	for i := 2; taken[name]; i++ {
+		name = truncateToolName(base, fmt.Sprintf("%s_%d", suffix, i))
+	}
+	return name
+}
+
+// truncateToolName cuts base so that base and suffix fit in 64 characters.
+// The name only has ASCII characters, so cutting bytes is safe.
+func truncateToolName(base, suffix string) string {
+	if len(base)+len(suffix) > 64 {
+		base = base[:64-len(suffix)]
+	}
+	return base + suffix
+}
+
+func (t *DelegateTool) Name() string {
+	return t.name
+}
+
+func (t *DelegateTool) Description() string {
+	return t.description
+}
+
+// InputSchema asks for the task and for the delegate's prompt variables.
+func (t *DelegateTool) InputSchema() map[string]any {
+	properties := map[string]any{
+		"task": map[string]any{
+			"type":        "string",
+			"description": "The task for the agent, with everything it needs to know. It does not see this conversation.",
+		},
+	}
+	required := []string{"task"}
+	for _, variable := range t.delegate.Agent.PromptVariables {
+		properties[variable.Name] = map[string]any{
+			"type":        "string",
+			"description": variable.Description,
+		}
+		if variable.Required {
+			required = append(required, variable.Name)
+		}
+	}
+
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// Call satisfies tools.Tool with the input taken as the task.
+func (t *DelegateTool) Call(ctx context.Context, input string) (string, error) {
+	return t.run(ctx, map[string]any{"task": input}, "", nil, nil)
+}
+
+func (t *DelegateTool) CallWithArguments(ctx context.Context, args map[string]any) (string, error) {
+	return t.run(ctx, args, "", nil, nil)
+}
+
+// run answers the task with the delegate agent. The delegate's tool events
+// are passed to toolEventFunc marked with callID, the parent's call, and its
+// tools that require approval are decided by approveTool.
+func (t *DelegateTool) run(ctx context.Context, args map[string]any, callID string, toolEventFunc func(*shared.ToolCallEvent), approveTool ToolApprover) (string, error) {
+	source := t.service.delegates
+	child := t.delegate.Agent
+
+	chain := append(slices.Clone(delegationChain(ctx)), t.parent.ID)
+	if slices.Contains(chain, child.ID) {
+		return "", fmt.Errorf("agent %s is already running in this delegation chain", child.Name)
+	}
+	if len(chain) > maxDelegationDepth {
+		return "", fmt.Errorf("delegation depth limit of %d reached", maxDelegationDepth)
+	}
+	ctx = context.WithValue(ctx, delegationChainKey{}, chain)
+
+	task, _ := args["task"].(string)
+	if strings.TrimSpace(task) == "" {
+		return "", fmt.Errorf("task is required")
+	}
+	values := make(map[string]string)
+	for _, variable := range child.PromptVariables {
+		if value, ok := args[variable.Name].(string); ok {
+			values[variable.Name] = value
+		}
+	}
+	agent, err := RenderSystemPrompt(child, values, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	creds, err := source.Credentials(agent.UserID, agent.Provider)
+	if err != nil || creds == nil {
+		return "", fmt.Errorf("no %s API key is configured for agent %s", agent.Provider, agent.Name)
+	}
+	llm, err := t.service.CreateLLM(agent.Provider, creds)
+	if err != nil {
+		return "", fmt.Errorf("creating LLM client: %w", err)
+	}
+	defer closeLLM(llm)
+
+	var childEvents func(*shared.ToolCallEvent)
+	if toolEventFunc != nil {
+		childEvents = func(event *shared.ToolCallEvent) {
+			// The delegate's steps belong to its own run, not to the
+			// parent's reply.
+			if event.Type == "tool_batch_complete" {
+				return
+			}
+			nested := *event
+			if nested.ParentCallID == "" {
+				nested.ParentCallID = callID
+				nested.AgentID = agent.ID.String()
+			}
+			toolEventFunc(&nested)
+		}
+	}
+
+	agent, _ = t.service.injectKnowledge(ctx, agent, task)
+	agent = t.service.injectMemories(ctx, agent)
+	toolsList, toolsMap := t.service.getAgentTools(ctx, agent)
+	gen := &generation{
+		llm:           llm,
+		agent:         agent,
+		toolsList:     toolsList,
+		toolsMap:      toolsMap,
+		toolEventFunc: childEvents,
+		approveTool:   approveTool,
+	}
+	messages := t.service.buildMessages(agent, "", nil, task, nil)
+	response, pending, err := t.service.generateWithToolSupport(ctx, gen, &PendingRun{Messages: messages}, nil)
+	if response != nil {
+		source.RecordUsage(agent, t.parent, response.Usage)
+	}
+	if err != nil {
+		return "", fmt.Errorf("agent %s failed: %w", agent.Name, err)
+	}
+	if pending != nil {
+		return "", fmt.Errorf("agent %s needs approval to call %s, which delegated agents can only ask for in streamed runs", agent.Name, pending.Calls[0].ToolName)
+	}
+	return response.Response, nil
+}
+
+// delegateTools returns the agents the agent can delegate to as tools. Agents
+// already running in the chain are left out, and at the depth limit there
+// are none.
+func (s *LLMService) delegateTools(ctx context.Context, agent *shared.AgentConfig, taken map[string]bool) []*DelegateTool {
+	if s.delegates == nil {
+		return nil
+	}
+
+	chain := append(slices.Clone(delegationChain(ctx)), agent.ID)
+	if len(chain) > maxDelegationDepth {
+		return nil
+	}
+
+	delegates, err := s.delegates.Delegates(ctx, agent.ID)
+	if err != nil {
+		return nil
+	}
+
+	var delegateTools []*DelegateTool
+	for _, delegate := range delegates {
+		if slices.Contains(chain, delegate.Agent.ID) {
+			continue
+		}
+		delegateTools = append(delegateTools, newDelegateTool(s, agent, delegate, taken))
+	}
+	return delegateTools
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+)
+
+func TestDelegateToolName(t *testing.T) {
+	agent := func(id, name string) *shared.AgentConfig {
+		return &shared.AgentConfig{ID: uuid.MustParse(id), Name: name}
+	}
+	taken := map[string]bool{"search_knowledge": true, "remember": true}
+
+	names := []struct {
+		agent *shared.AgentConfig
+		want  string
+	}{
+		{agent("11111111-0000-4000-8000-000000000000", "Research Bot"), "agent_research_bot"},
+		{agent("22222222-0000-4000-8000-000000000000", "research_bot"), "agent_research_bot_22222222"},
+		{agent("22222222-1111-4000-8000-000000000000", "research-bot!"), "agent_research-bot_"},
+		{agent("22222222-2222-4000-8000-000000000000", "Research.Bot"), "agent_research_bot_22222222_2"},
+	}
+	for _, tt := range names {
+		got := delegateToolName(tt.agent, taken)
+		if got != tt.want {
+			t.Errorf("delegateToolName(%q) = %q, want %q", tt.agent.Name, got, tt.want)
+		}
+		taken[got] = true
+	}
+
+	long := agent("33333333-0000-4000-8000-000000000000", strings.Repeat("a", 80))
+	first := delegateToolName(long, taken)
+	taken[first] = true
+	second := delegateToolName(agent("44444444-0000-4000-8000-000000000000", strings.Repeat("a", 80)), taken)
+	if len(first) != 64 || len(second) != 64 || first == second || !strings.HasSuffix(second, "_44444444") {
+		t.Errorf("long names = %q, %q", first, second)
+	}
+
+	clash := map[string]bool{"agent_remember": true}
+	if got := delegateToolName(agent("55555555-0000-4000-8000-000000000000", "Remember"), clash); got != "agent_remember_55555555" {
+		t.Errorf("delegateToolName() = %q, want agent_remember_55555555", got)
+	}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ErrGenerationCancelled is the cause of a generation context cancelled
+// through GenerationRegistry.Cancel.
+var ErrGenerationCancelled = errors.New("generation cancelled")
+
+// GenerationRegistry tracks in-flight streaming generations so that they can
+// be cancelled from another request. Chat streams are keyed by session ID and
+// API-key streams by run ID. A generation can only be cancelled through the
+// API key that started it, or from the dashboard when no key did.
+type GenerationRegistry struct {
+	mutex   sync.Mutex
+	running map[string]*runningGeneration
+}
+
+type runningGeneration struct {
+	userID   uint
+	agentID  uuid.UUID
+	apiKeyID *uint
+	cancel   context.CancelCauseFunc
+}
+
+func NewGenerationRegistry() *GenerationRegistry {
+	return &GenerationRegistry{
+		running: make(map[string]*runningGeneration),
+	}
+}
+
+// Start registers a generation under key and returns the context it should
+// run with. The returned func must be called when the generation ends. A new
+// generation with the same key replaces the previous registration.
+func (r *GenerationRegistry) Start(ctx context.Context, key string, userID uint, agentID uuid.UUID, apiKeyID *uint) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	gen := &runningGeneration{
+		userID:   userID,
+		agentID:  agentID,
+		apiKeyID: apiKeyID,
+		cancel:   cancel,
+	}
+
+	r.mutex.Lock()
+	r.running[key] = gen
+	r.mutex.Unlock()
+
+	return ctx, func() {
+		r.mutex.Lock()
+		if r.running[key] == gen {
+			delete(r.running, key)
+		}
+		r.mutex.Unlock()
+		cancel(nil)
+	}
+}
+
+// Cancel stops the generation registered under key. It reports false when
+// there is none for the given user, agent and API key.
+func (r *GenerationRegistry) Cancel(key string, userID uint, agentID uuid.UUID, apiKeyID *uint) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	gen, ok := r.running[key]
+	if !ok || gen.userID != userID || gen.agentID != agentID || !sameAPIKey(gen.apiKeyID, apiKeyID) {
+		return false
+	}
+
+	delete(r.running, key)
+	gen.cancel(ErrGenerationCancelled)
+	return true
+}
+
+// sameAPIKey reports whether two API key IDs are equal, nil standing for the
+// dashboard.
+func sameAPIKey(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// IsCancelled reports whether ctx was cancelled through Cancel.
+func IsCancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrGenerationCancelled)
+}
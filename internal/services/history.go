@@ -0,0 +1,99 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// historyMessages converts a stored message into the messages the model sees.
+// A user message carries its attachments' files. An assistant reply with
+// tool steps becomes, for each step, an AI message with the tool calls
+// followed by their results, and then the final text.
+func historyMessages(agent *shared.AgentConfig, role, content string, steps []shared.ToolStep, files []shared.FileContent) []llms.MessageContent {
+	if role != "assistant" {
+		return []llms.MessageContent{userMessage(agent, content, files)}
+	}
+	if len(steps) == 0 {
+		return []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeAI, content)}
+	}
+
+	var messages []llms.MessageContent
+	var stepText strings.Builder
+	for _, step := range steps {
+		stepText.WriteString(step.Content)
+
+		assistantMsg := llms.MessageContent{Role: llms.ChatMessageTypeAI}
+		if step.Content != "" {
+			assistantMsg.Parts = append(assistantMsg.Parts, llms.TextPart(step.Content))
+		}
+
+		var toolResults []llms.MessageContent
+		for _, call := range step.Calls {
+			assistantMsg.Parts = append(assistantMsg.Parts, llms.ToolCall{
+				ID:   call.CallID,
+				Type: "function",
+				FunctionCall: &llms.FunctionCall{
+					Name:      call.ToolName,
+					Arguments: call.Arguments,
+				},
+			})
+			toolResults = append(toolResults, llms.MessageContent{
+				Role: llms.ChatMessageTypeTool,
+				Parts: []llms.ContentPart{
+					llms.ToolCallResponse{
+						ToolCallID: call.CallID,
+						Name:       call.ToolName,
+						Content:    elideToolResult(call.Result, agent.ToolResultHistoryLimit),
+					},
+				},
+			})
+		}
+
+		if agent.Provider == string(shared.Google) {
+			toolResults = mergeToolResults(toolResults)
+		}
+
+		messages = append(messages, assistantMsg)
+		messages = append(messages, toolResults...)
+	}
+
+	// Streamed replies store everything the user saw, including the text
+	// written before each step, so only the remainder is the final answer.
+	final := strings.TrimPrefix(content, stepText.String())
+	if final != "" {
+		messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, final))
+	}
+
+	return messages
+}
+
+// elideToolResult shortens a replayed tool result to limit characters. A
+// limit of zero keeps the result whole.
+func elideToolResult(result string, limit int) string {
+	if limit <= 0 || len(result) <= limit {
+		return result
+	}
+	kept := 0
+	for i := range result {
+		if kept == limit {
+			return result[:i] + fmt.Sprintf("\n[%d characters elided from an earlier turn]", utf8.RuneCountInString(result[i:]))
+		}
+		kept++
+	}
+	return result
+}
+
+// messageTokens estimates the tokens a stored message takes once replayed.
+func messageTokens(agent *shared.AgentConfig, msg shared.Message) int {
+	tokens := estimateTokens(msg.Content) + len(msg.Attachments)*attachmentTokenEstimate
+	for _, step := range msg.ToolSteps {
+		for _, call := range step.Calls {
+			tokens += estimateTokens(call.Arguments) + estimateTokens(elideToolResult(call.Result, agent.ToolResultHistoryLimit))
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,31 @@
+package services
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestElideToolResult(t *testing.T) {
+	tests := []struct {
+		result string
+		limit  int
+		want   string
+	}{
+		{"hello", 0, "hello"},
+		{"hello", 5, "hello"},
+		{"hello world", 5, "hello\n[6 characters elided from an earlier turn]"},
+		{"héllo", 5, "héllo"},
+		{"日本語のテキスト", 3, "日本語\n[5 characters elided from an earlier turn]"},
+		{"a😀b", 1, "a\n[2 characters elided from an earlier turn]"},
+		{"a😀b", 2, "a😀\n[1 characters elided from an earlier turn]"},
+	}
+	for _, tt := range tests {
+		got := elideToolResult(tt.result, tt.limit)
+		if got != tt.want {
+			t.Errorf("elideToolResult(%q, %d) = %q, want %q", tt.result, tt.limit, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("elideToolResult(%q, %d) = %q, not valid UTF-8", tt.result, tt.limit, got)
+		}
+	}
+}
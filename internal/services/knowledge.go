@@ -0,0 +1,565 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/llms/googleai"
+	"github.com/tmc/langchaingo/llms/openai"
+	"github.com/tmc/langchaingo/tools"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// knowledgeChunkSize and knowledgeChunkOverlap are in characters. Each
+	// chunk repeats up to knowledgeChunkOverlap characters of the end of the
+	// previous one, so a passage split between chunks is found whole in one.
+	knowledgeChunkSize    = 1000
+	knowledgeChunkOverlap = 150
+
+	// embeddingBatchSize is the number of chunks embedded per request.
+	embeddingBatchSize = 64
+
+	// defaultKnowledgeTopK is the number of chunks retrieved per search when
+	// the agent does not set one.
+	defaultKnowledgeTopK = 5
+
+	knowledgeToolName = "search_knowledge"
+)
+
+// defaultEmbeddingModels are the models used for knowledge bases that do not
+// name one. Anthropic has no embeddings API, and custom endpoints must name
+// their model.
+var defaultEmbeddingModels = map[shared.InferenceProvider]string{
+	shared.OpenAI: "text-embedding-3-small",
+	shared.Google: "text-embedding-004",
+}
+
+// KnowledgeDocumentTypes are the content types accepted as knowledge base
+// documents.
+var KnowledgeDocumentTypes = []string{"text/plain", "text/markdown", shared.PDFAttachmentType}
+
+// DefaultEmbeddingModel returns the embedding model used for provider when
+// none is named, and whether the provider can embed at all.
+func DefaultEmbeddingModel(provider shared.InferenceProvider) (string, bool) {
+	if provider == shared.Custom {
+		return "", true
+	}
+	model, ok := defaultEmbeddingModels[provider]
+	return model, ok
+}
+
+// Embedder turns texts into embedding vectors, one per text.
+type Embedder interface {
+	CreateEmbedding(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// NewEmbedder creates a client for an embedding model of provider. Clients
+// that hold connections implement io.Closer.
+func NewEmbedder(provider, model string, creds *shared.ProviderCredentials) (Embedder, error) {
+	if creds == nil {
+		return nil, fmt.Errorf("credentials required for provider %s", provider)
+	}
+	if creds.APIKey == "" && provider != string(shared.Custom) {
+		return nil, fmt.Errorf("API key required for provider %s", provider)
+	}
+
+	switch provider {
+	case string(shared.OpenAI):
+		return openai.New(
+			openai.WithToken(creds.APIKey),
+			openai.WithEmbeddingModel(model),
+		)
+	case string(shared.Google):
+		return googleai.New(
+			context.Background(),
+			googleai.WithAPIKey(creds.APIKey),
+			googleai.WithDefaultEmbeddingModel(model),
+		)
+	case string(shared.Custom):
+		if creds.BaseURL == "" {
+			return nil, fmt.Errorf("base URL required for provider %s", provider)
+		}
+		return openai.New(
+			openai.WithBaseURL(creds.BaseURL),
+			openai.WithToken("custom"),
+			openai.WithEmbeddingModel(model),
+			openai.WithHTTPClient(&customEndpointClient{
+				headerName:  creds.AuthHeaderName,
+				headerValue: creds.AuthHeaderValue,
+			}),
+		)
+	default:
+		return nil, fmt.Errorf("provider %s does not support embeddings", provider)
+	}
+}
+
+func closeEmbedder(embedder Embedder) {
+	if closer, ok := embedder.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// ChunkMatch is a chunk found by a search, with the name of its document and
+// its cosine similarity to the query.
+type ChunkMatch struct {
+	shared.KnowledgeChunk
+	Filename string
+	Score    float64
+}
+
+// VectorStore stores knowledge base chunks and finds those closest to an
+// embedding. The embeddings searched together must come from the same model.
+type VectorStore interface {
+	AddChunks(ctx context.Context, chunks []shared.KnowledgeChunk) error
+	Search(ctx context.Context, knowledgeBaseIDs []uuid.UUID, embedding []float32, k int) ([]ChunkMatch, error)
+	DeleteDocument(ctx context.Context, documentID uuid.UUID) error
+	DeleteKnowledgeBase(ctx context.Context, knowledgeBaseID uuid.UUID) error
+}
+
+// PgVectorStore keeps chunks in Postgres and searches them with pgvector.
+type PgVectorStore struct {
+	DB *gorm.DB
+}
+
+func NewPgVectorStore(db *gorm.DB) *PgVectorStore {
+	return &PgVectorStore{DB: db}
+}
+
+func (s *PgVectorStore) AddChunks(ctx context.Context, chunks []shared.KnowledgeChunk) error {
+	return s.DB.WithContext(ctx).CreateInBatches(chunks, 100).Error
+}
+
+func (s *PgVectorStore) Search(ctx context.Context, knowledgeBaseIDs []uuid.UUID, embedding []float32, k int) ([]ChunkMatch, error) {
+	vector := shared.Vector(embedding)
+	var matches []ChunkMatch
+	err := s.DB.WithContext(ctx).Model(&shared.KnowledgeChunk{}).
+		Select("knowledge_chunks.id, knowledge_chunks.knowledge_base_id, knowledge_chunks.document_id, knowledge_chunks.position, knowledge_chunks.content, knowledge_documents.filename, 1 - (knowledge_chunks.embedding <=> CAST(? AS vector)) AS score", vector).
+		Joins("JOIN knowledge_documents ON knowledge_documents.id = knowledge_chunks.document_id").
+		Where("knowledge_chunks.knowledge_base_id IN ?", knowledgeBaseIDs).
+		Order(clause.Expr{SQL: "knowledge_chunks.embedding <=> CAST(? AS vector)", Vars: []any{vector}}).
+		Limit(k).
+		Scan(&matches).Error
+	return matches, err
+}
+
+func (s *PgVectorStore) DeleteDocument(ctx context.Context, documentID uuid.UUID) error {
+	return s.DB.WithContext(ctx).Where("document_id = ?", documentID).Delete(&shared.KnowledgeChunk{}).Error
+}
+
+func (s *PgVectorStore) DeleteKnowledgeBase(ctx context.Context, knowledgeBaseID uuid.UUID) error {
+	return s.DB.WithContext(ctx).Where("knowledge_base_id = ?", knowledgeBaseID).Delete(&shared.KnowledgeChunk{}).Error
+}
+
+// KnowledgeService chunks, embeds and searches knowledge base documents.
+type KnowledgeService struct {
+	Store VectorStore
+}
+
+func NewKnowledgeService(store VectorStore) *KnowledgeService {
+	return &KnowledgeService{Store: store}
+}
+
+// Ingest extracts the text of a document, splits it into chunks and stores
+// them embedded with the knowledge base's model. It returns the number of
+// chunks stored.
+func (s *KnowledgeService) Ingest(ctx context.Context, kb *shared.KnowledgeBase, doc *shared.KnowledgeDocument, data []byte, creds *shared.ProviderCredentials) (int, error) {
+	text, err := ExtractDocumentText(doc.ContentType, data)
+	if err != nil {
+		return 0, err
+	}
+	texts := chunkText(text, knowledgeChunkSize, knowledgeChunkOverlap)
+	if len(texts) == 0 {
+		return 0, fmt.Errorf("document has no text")
+	}
+
+	embedder, err := NewEmbedder(kb.EmbeddingProvider, kb.EmbeddingModel, creds)
+	if err != nil {
+		return 0, err
+	}
+	defer closeEmbedder(embedder)
+
+	chunks := make([]shared.KnowledgeChunk, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		batch := texts[start:min(start+embeddingBatchSize, len(texts))]
+		vectors, err := embedder.CreateEmbedding(ctx, batch)
+		if err != nil {
+			return 0, fmt.Errorf("embedding document: %w", err)
+		}
+		if len(vectors) != len(batch) {
+			return 0, fmt.Errorf("embedding document: got %d embeddings for %d chunks", len(vectors), len(batch))
+		}
+		for i, content := range batch {
+			chunks = append(chunks, shared.KnowledgeChunk{
+				ID:              uuid.New(),
+				KnowledgeBaseID: kb.ID,
+				DocumentID:      doc.ID,
+				Position:        start + i,
+				Content:         content,
+				Embedding:       vectors[i],
+			})
+		}
+	}
+
+	if err := s.Store.AddChunks(ctx, chunks); err != nil {
+		return 0, fmt.Errorf("storing chunks: %w", err)
+	}
+	return len(chunks), nil
+}
+
+// Search returns the k chunks of the knowledge bases closest to query. The
+// query is embedded once for each embedding model the knowledge bases use,
+// and credentials supplies the key for each model's provider.
+func (s *KnowledgeService) Search(ctx context.Context, kbs []shared.KnowledgeBase, query string, k int, credentials func(provider string) (*shared.ProviderCredentials, error)) ([]ChunkMatch, error) {
+	type embeddingModel struct{ provider, model string }
+	groups := make(map[embeddingModel][]uuid.UUID)
+	var order []embeddingModel
+	for _, kb := range kbs {
+		key := embeddingModel{kb.EmbeddingProvider, kb.EmbeddingModel}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], kb.ID)
+	}
+
+	var matches []ChunkMatch
+	for _, key := range order {
+		creds, err := credentials(key.provider)
+		if err != nil || creds == nil {
+			return nil, fmt.Errorf("no %s API key is configured to search the knowledge bases", key.provider)
+		}
+		embedder, err := NewEmbedder(key.provider, key.model, creds)
+		if err != nil {
+			return nil, err
+		}
+		vectors, err := embedder.CreateEmbedding(ctx, []string{query})
+		closeEmbedder(embedder)
+		if err != nil {
+			return nil, fmt.Errorf("embedding query: %w", err)
+		}
+		if len(vectors) != 1 {
+			return nil, fmt.Errorf("embedding query: got %d embeddings", len(vectors))
+		}
+
+		found, err := s.Store.Search(ctx, groups[key], vectors[0], k)
+		if err != nil {
+			return nil, fmt.Errorf("searching knowledge bases: %w", err)
+		}
+		matches = append(matches, found...)
+	}
+
+	// Scores of different models are not strictly comparable, but cosine
+	// similarity is close enough to rank them together.
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+	return matches, nil
+}
+
+// ExtractDocumentText returns the text of a knowledge base document.
+func ExtractDocumentText(contentType string, data []byte) (string, error) {
+	switch contentType {
+	case "text/plain", "text/markdown":
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("document is not valid UTF-8 text")
+		}
+		return string(data), nil
+	case shared.PDFAttachmentType:
+		return extractPDFText(data)
+	}
+	return "", fmt.Errorf("unsupported document type %s", contentType)
+}
+
+// textPiece is a piece of a text with the separator that preceded it.
+type textPiece struct {
+	separator string
+	text      string
+}
+
+// chunkText splits text into chunks of at most size characters, breaking
+// between paragraphs where it can, then between lines, then between words.
+func chunkText(text string, size, overlap int) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	pieces := splitText(text, "", []string{"\n\n", "\n", " "}, size)
+
+	var chunks []string
+	var current []textPiece
+	length := 0
+	flush := func() {
+		var b strings.Builder
+		for i, piece := range current {
+			if i > 0 {
+				b.WriteString(piece.separator)
+			}
+			b.WriteString(piece.text)
+		}
+		if chunk := strings.TrimSpace(b.String()); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+
+		// Start the next chunk with the end of this one.
+		kept := 0
+		start := len(current)
+		for start > 0 && kept+utf8.RuneCountInString(current[start-1].text) <= overlap {
+			start--
+			kept += utf8.RuneCountInString(current[start].text) + len(current[start].separator)
+		}
+		current = slices.Clone(current[start:])
+		length = kept
+	}
+
+	for _, piece := range pieces {
+		pieceLength := utf8.RuneCountInString(piece.text) + len(piece.separator)
+		if length > 0 && length+pieceLength > size {
+			flush()
+			// The overlap is dropped when it leaves no room for the piece.
+			if length+pieceLength > size {
+				current, length = nil, 0
+			}
+		}
+		current = append(current, piece)
+		length += pieceLength
+	}
+	if length > 0 {
+		flush()
+	}
+	return chunks
+}
+
+// splitText splits text on the first separator, and the parts still longer
+// than size on the next ones. Parts longer than size with no separator left
+// are cut.
+func splitText(text, separator string, separators []string, size int) []textPiece {
+	if utf8.RuneCountInString(text) <= size {
+		if strings.TrimSpace(text) == "" {
+			return nil
+		}
+		return []textPiece{{separator: separator, text: text}}
+	}
+
+	if len(separators) == 0 {
+		var pieces []textPiece
+		runes := []rune(text)
+		for start := 0; start < len(runes); start += size {
+			pieces = append(pieces, textPiece{separator: separator, text: string(runes[start:min(start+size, len(runes))])})
+			separator = ""
+		}
+		return pieces
+	}
+
+	var pieces []textPiece
+	for i, part := range strings.Split(text, separators[0]) {
+		partSeparator := separators[0]
+		if i == 0 {
+			partSeparator = separator
+		}
+		pieces = append(pieces, splitText(part, partSeparator, separators[1:], size)...)
+	}
+	return pieces
+}
+
+// KnowledgeSource supplies the knowledge bases of agents and searches them.
+type KnowledgeSource interface {
+	// KnowledgeBases lists the knowledge bases the agent can search.
+	KnowledgeBases(ctx context.Context, agentID uuid.UUID) ([]shared.KnowledgeBase, error)
+	// Search searches knowledge bases of the user with the user's keys.
+	Search(ctx context.Context, userID uint, kbs []shared.KnowledgeBase, query string, k int) ([]ChunkMatch, error)
+}
+
+// citationSet numbers the chunks given to an agent during a run, so that
+// each chunk keeps its number when it is found again.
+type citationSet struct {
+	mu        sync.Mutex
+	citations []shared.Citation
+}
+
+// add numbers the chunks and returns their citations.
+func (c *citationSet) add(matches []ChunkMatch) []shared.Citation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var added []shared.Citation
+	for _, match := range matches {
+		index := slices.IndexFunc(c.citations, func(citation shared.Citation) bool { return citation.ChunkID == match.ID })
+		if index < 0 {
+			c.citations = append(c.citations, shared.Citation{
+				Index:           len(c.citations) + 1,
+				KnowledgeBaseID: match.KnowledgeBaseID,
+				DocumentID:      match.DocumentID,
+				ChunkID:         match.ID,
+				Filename:        match.Filename,
+				Content:         match.Content,
+				Score:           match.Score,
+			})
+			index = len(c.citations) - 1
+		}
+		added = append(added, c.citations[index])
+	}
+	return added
+}
+
+func (c *citationSet) list() []shared.Citation {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.citations)
+}
+
+// formatCitations writes chunks as numbered excerpts for the model.
+func formatCitations(citations []shared.Citation) string {
+	var b strings.Builder
+	for i, citation := range citations {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "[%d] (source: %s)\n%s", citation.Index, citation.Filename, citation.Content)
+	}
+	return b.String()
+}
+
+func knowledgeTopK(agent *shared.AgentConfig) int {
+	if agent.KnowledgeTopK > 0 {
+		return agent.KnowledgeTopK
+	}
+	return defaultKnowledgeTopK
+}
+
+// KnowledgeTool searches the agent's knowledge bases.
+type KnowledgeTool struct {
+	source    KnowledgeSource
+	agent     *shared.AgentConfig
+	kbs       []shared.KnowledgeBase
+	citations *citationSet
+}
+
+func (t *KnowledgeTool) Name() string {
+	return knowledgeToolName
+}
+
+func (t *KnowledgeTool) Description() string {
+	names := make([]string, len(t.kbs))
+	for i, kb := range t.kbs {
+		names[i] = kb.Name
+		if kb.Description != "" {
+			names[i] += " (" + kb.Description + ")"
+		}
+	}
+	return fmt.Sprintf("Search your knowledge bases for passages relevant to a query. Knowledge bases: %s. Each passage is numbered; cite the passages you use by their number, like [1].", strings.Join(names, "; "))
+}
+
+func (t *KnowledgeTool) InputSchema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"query": map[string]any{
+				"type":        "string",
+				"description": "What to search for, phrased as a question or a description of the passage you need.",
+			},
+		},
+		"required": []string{"query"},
+	}
+}
+
+func (t *KnowledgeTool) Call(ctx context.Context, input string) (string, error) {
+	return t.CallWithArguments(ctx, map[string]any{"query": input})
+}
+
+func (t *KnowledgeTool) CallWithArguments(ctx context.Context, args map[string]any) (string, error) {
+	query, _ := args["query"].(string)
+	if strings.TrimSpace(query) == "" {
+		return "", fmt.Errorf("query is required")
+	}
+
+	matches, err := t.source.Search(ctx, t.agent.UserID, t.kbs, query, knowledgeTopK(t.agent))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "No passages found.", nil
+	}
+	return formatCitations(t.citations.add(matches)), nil
+}
+
+// agentKnowledgeBases lists the knowledge bases the agent can search.
+func (s *LLMService) agentKnowledgeBases(ctx context.Context, agent *shared.AgentConfig) []shared.KnowledgeBase {
+	if s.knowledge == nil {
+		return nil
+	}
+	kbs, err := s.knowledge.KnowledgeBases(ctx, agent.ID)
+	if err != nil {
+		log.Printf("Warning: Failed to get knowledge bases of agent %s: %v\n", agent.ID, err)
+		return nil
+	}
+	return kbs
+}
+
+// knowledgeTool returns the search_knowledge tool of an agent that searches
+// its knowledge bases with a tool, or nil.
+func (s *LLMService) knowledgeTool(ctx context.Context, agent *shared.AgentConfig) *KnowledgeTool {
+	if shared.KnowledgeMode(agent.KnowledgeMode) == shared.KnowledgeInject {
+		return nil
+	}
+	kbs := s.agentKnowledgeBases(ctx, agent)
+	if len(kbs) == 0 {
+		return nil
+	}
+	return &KnowledgeTool{
+		source:    s.knowledge,
+		agent:     agent,
+		kbs:       kbs,
+		citations: &citationSet{},
+	}
+}
+
+// injectKnowledge adds the chunks of the agent's knowledge bases closest to
+// message to a copy of the agent's system prompt, for agents in inject mode.
+// A failed search is logged and the agent answers without the knowledge.
+func (s *LLMService) injectKnowledge(ctx context.Context, agent *shared.AgentConfig, message string) (*shared.AgentConfig, *citationSet) {
+	if shared.KnowledgeMode(agent.KnowledgeMode) != shared.KnowledgeInject || strings.TrimSpace(message) == "" {
+		return agent, nil
+	}
+	kbs := s.agentKnowledgeBases(ctx, agent)
+	if len(kbs) == 0 {
+		return agent, nil
+	}
+
+	matches, err := s.knowledge.Search(ctx, agent.UserID, kbs, message, knowledgeTopK(agent))
+	if err != nil {
+		log.Printf("Warning: Failed to search knowledge bases of agent %s: %v\n", agent.ID, err)
+		return agent, nil
+	}
+	if len(matches) == 0 {
+		return agent, nil
+	}
+
+	citations := &citationSet{}
+	excerpts := formatCitations(citations.add(matches))
+	injected := *agent
+	injected.SystemPrompt = strings.TrimSpace(agent.SystemPrompt + "\n\n## Knowledge\n\nThese excerpts from your knowledge bases may help answer the user's latest message. Cite the ones you use by their number, like [1].\n\n" + excerpts)
+	return &injected, citations
+}
+
+// runCitations returns the citations set of a run: the injected chunks, or
+// those found with the search_knowledge tool.
+func runCitations(injected *citationSet, toolsMap map[string]tools.Tool) *citationSet {
+	if injected != nil {
+		return injected
+	}
+	if tool, ok := toolsMap[knowledgeToolName].(*KnowledgeTool); ok {
+		return tool.citations
+	}
+	return nil
+}
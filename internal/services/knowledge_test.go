@@ -0,0 +1,81 @@
+package services
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestChunkText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		size    int
+		overlap int
+		want    []string
+	}{
+		{
+			name: "short text",
+			text: "  Hello world  ",
+			size: 100,
+			want: []string{"Hello world"},
+		},
+		{
+			name: "empty text",
+			text: " \n\n ",
+			size: 100,
+			want: nil,
+		},
+		{
+			name: "paragraphs",
+			text: "aaaa\n\nbbbb\n\ncccc",
+			size: 10,
+			want: []string{"aaaa\n\nbbbb", "cccc"},
+		},
+		{
+			name: "lines before words",
+			text: "one two\nthree four",
+			size: 12,
+			want: []string{"one two", "three four"},
+		},
+		{
+			name: "windows line endings",
+			text: "aaaa\r\n\r\nbbbb",
+			size: 6,
+			want: []string{"aaaa", "bbbb"},
+		},
+		{
+			name:    "overlap",
+			text:    "one two three four five six",
+			size:    14,
+			overlap: 5,
+			want:    []string{"one two three", "three four", "four five six"},
+		},
+		{
+			name:    "overlap dropped when the next piece does not fit",
+			text:    "aaaa bbbbbbbbbb",
+			size:    10,
+			overlap: 4,
+			want:    []string{"aaaa", "bbbbbbbbbb"},
+		},
+		{
+			name: "long words are cut",
+			text: "abcdefghij",
+			size: 4,
+			want: []string{"abcd", "efgh", "ij"},
+		},
+		{
+			name: "sizes count characters",
+			text: "ééééé",
+			size: 2,
+			want: []string{"éé", "éé", "é"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chunkText(tt.text, tt.size, tt.overlap); !slices.Equal(got, tt.want) {
+				t.Errorf("chunkText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
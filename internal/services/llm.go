@@ -3,48 +3,121 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/arnavsurve/glyfs/internal/shared"
 	"github.com/tmc/langchaingo/llms"
 	"github.com/tmc/langchaingo/llms/anthropic"
+	"github.com/tmc/langchaingo/llms/googleai"
 	"github.com/tmc/langchaingo/llms/openai"
 	"github.com/tmc/langchaingo/tools"
 )
 
+// EventSink is told of failed tool calls, of the agent and of its
+// delegates, for the owner's event webhooks.
+type EventSink interface {
+	ToolError(agent *shared.AgentConfig, toolName string, err error)
+}
+
 type LLMService struct {
 	mcpManager *MCPConnectionManager
+	delegates  DelegateSource
+	knowledge  KnowledgeSource
+	memory     MemorySource
+	events     EventSink
 }
 
-func NewLLMService(mcpManager *MCPConnectionManager) *LLMService {
+// NewLLMService creates a service that gives agents their MCP tools and,
+// when the sources are non-nil, the agents they can delegate to, their
+// knowledge bases and their memories. Failed tool calls are reported to
+// events when it is non-nil.
+func NewLLMService(mcpManager *MCPConnectionManager, delegates DelegateSource, knowledge KnowledgeSource, memory MemorySource, events EventSink) *LLMService {
 	return &LLMService{
 		mcpManager: mcpManager,
+		delegates:  delegates,
+		knowledge:  knowledge,
+		memory:     memory,
+		events:     events,
 	}
 }
 
-func (s *LLMService) CreateLLM(provider string, apiKey string) (llms.Model, error) {
-	if apiKey == "" {
+func (s *LLMService) CreateLLM(provider string, creds *shared.ProviderCredentials) (llms.Model, error) {
+	if creds == nil {
+		return nil, fmt.Errorf("credentials required for provider %s", provider)
+	}
+	if creds.APIKey == "" && provider != string(shared.Custom) {
 		return nil, fmt.Errorf("API key required for provider %s", provider)
 	}
 
 	switch provider {
 	case string(shared.Anthropic):
 		return anthropic.New(
-			anthropic.WithToken(apiKey),
+			anthropic.WithToken(creds.APIKey),
 		)
 	case string(shared.OpenAI):
 		return openai.New(
-			openai.WithToken(apiKey),
+			openai.WithToken(creds.APIKey),
+		)
+	case string(shared.Google):
+		return googleai.New(
+			context.Background(),
+			googleai.WithAPIKey(creds.APIKey),
+		)
+	case string(shared.Custom):
+		if creds.BaseURL == "" {
+			return nil, fmt.Errorf("base URL required for provider %s", provider)
+		}
+		// The OpenAI client refuses to start without a token and always sends
+		// it as a bearer token, so customEndpointClient swaps in the
+		// configured auth header instead.
+		return openai.New(
+			openai.WithBaseURL(creds.BaseURL),
+			openai.WithToken("custom"),
+			openai.WithHTTPClient(&customEndpointClient{
+				headerName:  creds.AuthHeaderName,
+				headerValue: creds.AuthHeaderValue,
+			}),
 		)
 	default:
 		return nil, fmt.Errorf("unsupported provider: %s", provider)
 	}
 }
 
+// customEndpointClient sends requests to a user-configured OpenAI-compatible
+// endpoint with its optional auth header in place of the OpenAI bearer token.
+type customEndpointClient struct {
+	headerName  string
+	headerValue string
+}
+
+func (c *customEndpointClient) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Del("Authorization")
+	if c.headerValue != "" {
+		headerName := c.headerName
+		if headerName == "" {
+			headerName = "Authorization"
+		}
+		req.Header.Set(headerName, c.headerValue)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// closeLLM releases clients that hold open connections, such as the gRPC
+// connection behind the Gemini client.
+func closeLLM(llm llms.Model) {
+	if closer, ok := llm.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
 func (s *LLMService) CreateLLMForTitleGeneration() (llms.Model, error) {
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
@@ -53,15 +126,58 @@ func (s *LLMService) CreateLLMForTitleGeneration() (llms.Model, error) {
 	return openai.New(openai.WithToken(apiKey))
 }
 
-func (s *LLMService) GenerateResponse(ctx context.Context, agent *shared.AgentConfig, req *shared.AgentInferenceRequest, apiKey string) (*shared.AgentInferenceResponse, error) {
-	llm, err := s.CreateLLM(agent.Provider, apiKey)
+// GenerateResponse runs the agent without streaming. If the model calls a
+// tool that requires approval, the run stops before executing that batch and
+// the returned PendingRun can be passed to ResumeResponse. toolEventFunc may
+// be nil.
+func (s *LLMService) GenerateResponse(ctx context.Context, agent *shared.AgentConfig, req *shared.AgentInferenceRequest, creds *shared.ProviderCredentials, toolEventFunc func(*shared.ToolCallEvent)) (*shared.AgentInferenceResponse, *PendingRun, error) {
+	llm, err := s.CreateLLM(agent.Provider, creds)
 	if err != nil {
-		return nil, fmt.Errorf("creating LLM client: %w", err)
+		return nil, nil, fmt.Errorf("creating LLM client: %w", err)
+	}
+	defer closeLLM(llm)
+
+	agent, injected := s.injectKnowledge(ctx, agent, req.Message)
+	agent = s.injectMemories(ctx, agent)
+	messages := s.buildMessages(agent, req.ContextSummary, req.History, req.Message, req.Files)
+	toolsList, toolsMap := s.getAgentTools(ctx, agent)
+
+	gen := &generation{
+		llm:           llm,
+		agent:         agent,
+		toolsList:     toolsList,
+		toolsMap:      toolsMap,
+		toolEventFunc: toolEventFunc,
+		citations:     runCitations(injected, toolsMap),
+	}
+	return s.generateWithToolSupport(ctx, gen, &PendingRun{Messages: messages}, nil)
+}
+
+// ResumeResponse continues a paused run, applying decisions (keyed by tool
+// call ID) to the calls that require approval.
+func (s *LLMService) ResumeResponse(ctx context.Context, agent *shared.AgentConfig, run *PendingRun, decisions map[string]*shared.ToolApprovalDecision, creds *shared.ProviderCredentials, toolEventFunc func(*shared.ToolCallEvent)) (*shared.AgentInferenceResponse, *PendingRun, error) {
+	llm, err := s.CreateLLM(agent.Provider, creds)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating LLM client: %w", err)
 	}
+	defer closeLLM(llm)
+
+	toolsList, toolsMap := s.getAgentTools(ctx, agent)
 
-	messages := s.buildMessages(agent.SystemPrompt, req.History, req.Message)
+	gen := &generation{
+		llm:           llm,
+		agent:         agent,
+		toolsList:     toolsList,
+		toolsMap:      toolsMap,
+		toolEventFunc: toolEventFunc,
+		citations:     runCitations(nil, toolsMap),
+	}
+	return s.generateWithToolSupport(ctx, gen, run, decisions)
+}
 
+func (s *LLMService) getAgentTools(ctx context.Context, agent *shared.AgentConfig) ([]tools.Tool, map[string]tools.Tool) {
 	var toolsList []tools.Tool
+	toolsMap := make(map[string]tools.Tool)
 	if s.mcpManager != nil {
 		agentTools, err := s.mcpManager.GetAgentTools(ctx, agent.ID)
 		if err != nil {
@@ -71,85 +187,99 @@ func (s *LLMService) GenerateResponse(ctx context.Context, agent *shared.AgentCo
 		}
 	}
 
-	opts := []llms.CallOption{
-		llms.WithModel(agent.LLMModel),
-		llms.WithTemperature(agent.Temperature),
+	var builtinTools []tools.Tool
+	if tool := s.knowledgeTool(ctx, agent); tool != nil {
+		builtinTools = append(builtinTools, tool)
 	}
+	builtinTools = append(builtinTools, s.memoryTools(agent)...)
 
-	if len(toolsList) > 0 {
-		llmsTools := s.convertToLLMSTools(toolsList)
-		opts = append(opts, llms.WithTools(llmsTools))
+	// Delegates are named around the other tools, since agent names may
+	// clash with each other and with them.
+	taken := make(map[string]bool)
+	for _, tool := range slices.Concat(toolsList, builtinTools) {
+		taken[tool.Name()] = true
 	}
-
-	if agent.MaxTokens > 0 {
-		opts = append(opts, llms.WithMaxTokens(agent.MaxTokens))
-	}
-
-	content, err := llm.GenerateContent(ctx, messages, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("generating content: %w", err)
-	}
-
-	if len(content.Choices) == 0 {
-		return nil, fmt.Errorf("no content generated")
+	for _, tool := range s.delegateTools(ctx, agent, taken) {
+		toolsList = append(toolsList, tool)
 	}
-
-	response := &shared.AgentInferenceResponse{
-		Response: content.Choices[0].Content,
+	toolsList = append(toolsList, builtinTools...)
+
+	// Providers reject duplicate function names, so only the first tool with
+	// a name is sent.
+	var unique []tools.Tool
+	for _, tool := range toolsList {
+		if _, ok := toolsMap[tool.Name()]; ok {
+			log.Printf("Warning: Skipping duplicate tool %s for agent %s", tool.Name(), agent.ID)
+			continue
+		}
+		toolsMap[tool.Name()] = tool
+		unique = append(unique, tool)
 	}
-
-	return response, nil
+	return unique, toolsMap
 }
 
-func (s *LLMService) buildMessages(systemPrompt string, history []shared.Message, userMessage string) []llms.MessageContent {
+func (s *LLMService) buildMessages(agent *shared.AgentConfig, summary string, history []shared.Message, message string, files []shared.FileContent) []llms.MessageContent {
 	var messages []llms.MessageContent
 
-	if systemPrompt != "" {
+	if systemPrompt := systemPromptWithSummary(systemPromptWithSchema(agent), summary); systemPrompt != "" {
 		messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, systemPrompt))
 	}
 
 	for _, msg := range history {
-		msgType := llms.ChatMessageTypeHuman
-		if msg.Role == "assistant" {
-			msgType = llms.ChatMessageTypeAI
-		}
-		messages = append(messages, llms.TextParts(msgType, msg.Content))
+		messages = append(messages, historyMessages(agent, msg.Role, msg.Content, msg.ToolSteps, msg.Files)...)
 	}
 
-	messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, userMessage))
+	messages = append(messages, userMessage(agent, message, files))
 
 	return messages
 }
 
-func (s *LLMService) GenerateResponseStream(ctx context.Context, agent *shared.AgentConfig, req *shared.ChatStreamRequest, apiKey string, streamFunc func(string), toolEventFunc func(*shared.ToolCallEvent)) error {
-	llm, err := s.CreateLLM(agent.Provider, apiKey)
+// GenerateResponseStream streams the agent's reply through streamFunc and
+// returns the final response with the provider-reported token usage summed
+// over every tool loop iteration.
+// Tool calls that require approval are passed to approveTool, which blocks
+// until a decision is made. When a reply fails the agent's response schema,
+// retryFunc is called with the validation error before the model is asked
+// again, so the caller can discard the text streamed so far; it may be nil.
+// If generation fails part way, the usage so far is returned along with the
+// error.
+func (s *LLMService) GenerateResponseStream(ctx context.Context, agent *shared.AgentConfig, req *shared.ChatStreamRequest, creds *shared.ProviderCredentials, streamFunc func(string), toolEventFunc func(*shared.ToolCallEvent), approveTool ToolApprover, retryFunc func(error)) (*shared.AgentInferenceResponse, error) {
+	llm, err := s.CreateLLM(agent.Provider, creds)
 	if err != nil {
-		return fmt.Errorf("creating LLM client: %w", err)
+		return nil, fmt.Errorf("creating LLM client: %w", err)
 	}
-
-	messages := s.buildMessagesFromContext(agent.SystemPrompt, req.Context, req.Message)
-
-	var toolsList []tools.Tool
-	toolsMap := make(map[string]tools.Tool)
-	if s.mcpManager != nil {
-		agentTools, err := s.mcpManager.GetAgentTools(ctx, agent.ID)
-		if err != nil {
-			log.Printf("Warning: Failed to get agent tools: %v\n", err)
-		} else {
-			toolsList = agentTools
-			for _, tool := range toolsList {
-				toolsMap[tool.Name()] = tool
-			}
-		}
+	defer closeLLM(llm)
+
+	agent, injected := s.injectKnowledge(ctx, agent, req.Message)
+	agent = s.injectMemories(ctx, agent)
+	messages := s.buildMessagesFromContext(agent, req.ContextSummary, req.Context, req.Message, req.Files)
+	toolsList, toolsMap := s.getAgentTools(ctx, agent)
+
+	gen := &generation{
+		llm:           llm,
+		agent:         agent,
+		toolsList:     toolsList,
+		toolsMap:      toolsMap,
+		streamFunc:    streamFunc,
+		toolEventFunc: toolEventFunc,
+		approveTool:   approveTool,
+		retryFunc:     retryFunc,
+		citations:     runCitations(injected, toolsMap),
 	}
-
-	return s.generateWithToolSupport(ctx, llm, agent, messages, toolsList, toolsMap, streamFunc, toolEventFunc)
+	response, pending, err := s.generateWithToolSupport(ctx, gen, &PendingRun{Messages: messages}, nil)
+	if err != nil {
+		return response, err
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("tool call requires approval")
+	}
+	return response, nil
 }
 
-func (s *LLMService) buildMessagesFromContext(systemPrompt string, context []shared.ChatContextMessage, userMessage string) []llms.MessageContent {
+func (s *LLMService) buildMessagesFromContext(agent *shared.AgentConfig, summary string, context []shared.ChatContextMessage, message string, files []shared.FileContent) []llms.MessageContent {
 	var messages []llms.MessageContent
 
-	if systemPrompt != "" {
+	if systemPrompt := systemPromptWithSummary(systemPromptWithSchema(agent), summary); systemPrompt != "" {
 		messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, systemPrompt))
 	}
 
@@ -157,15 +287,10 @@ func (s *LLMService) buildMessagesFromContext(systemPrompt string, context []sha
 		if msg.Role == "tool" {
 			continue
 		}
-
-		msgType := llms.ChatMessageTypeHuman
-		if msg.Role == "assistant" {
-			msgType = llms.ChatMessageTypeAI
-		}
-		messages = append(messages, llms.TextParts(msgType, msg.Content))
+		messages = append(messages, historyMessages(agent, msg.Role, msg.Content, msg.ToolSteps, msg.Files)...)
 	}
 
-	messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, userMessage))
+	messages = append(messages, userMessage(agent, message, files))
 
 	return messages
 }
@@ -216,108 +341,400 @@ Title:`, firstMessage)
 	return title, nil
 }
 
-func (s *LLMService) generateWithToolSupport(ctx context.Context, llm llms.Model, agent *shared.AgentConfig, messages []llms.MessageContent, toolsList []tools.Tool, toolsMap map[string]tools.Tool, streamFunc func(string), toolEventFunc func(*shared.ToolCallEvent)) error {
-	conversationMessages := messages
+// PendingRun is a run stopped before a batch of tool calls that includes at
+// least one call requiring approval. It round-trips through JSON so it can be
+// stored between requests.
+type PendingRun struct {
+	Messages  []llms.MessageContent    `json:"messages"`
+	Content   string                   `json:"content"`
+	ToolCalls []llms.ToolCall          `json:"tool_calls"`
+	Calls     []shared.PendingToolCall `json:"pending_tool_calls"`
+	Iteration int                      `json:"iteration"`
+}
+
+// generation holds the inputs of a single run of the tool loop.
+type generation struct {
+	llm           llms.Model
+	agent         *shared.AgentConfig
+	toolsList     []tools.Tool
+	toolsMap      map[string]tools.Tool
+	streamFunc    func(string)
+	toolEventFunc func(*shared.ToolCallEvent)
+	approveTool   ToolApprover
+	retryFunc     func(error)
+	citations     *citationSet
+}
+
+// generateWithToolSupport runs the model until it produces a final answer,
+// executing any tool calls it makes along the way. Text is forwarded to
+// streamFunc as the provider emits it when streamFunc is non-nil.
+//
+// A run that starts with tool calls (a resumed PendingRun) executes them
+// first using decisions. When a batch needs approval and there is no
+// approveTool, the run stops and a PendingRun is returned.
+//
+// When the agent has a response schema, the final answer is validated against
+// it and the model is shown the validation error and asked again, up to
+// structuredOutputRetries times.
+func (s *LLMService) generateWithToolSupport(ctx context.Context, gen *generation, run *PendingRun, decisions map[string]*shared.ToolApprovalDecision) (*shared.AgentInferenceResponse, *PendingRun, error) {
+	agent := gen.agent
+	conversationMessages := run.Messages
 	maxIterations := 15
+	usage := &shared.Usage{}
 
-	for iteration := range maxIterations {
-		opts := []llms.CallOption{
-			llms.WithModel(agent.LLMModel),
-			llms.WithTemperature(agent.Temperature),
-		}
+	content := run.Content
+	toolCalls := run.ToolCalls
+	retries := 0
 
-			if len(toolsList) > 0 {
-			llmsTools := s.convertToLLMSTools(toolsList)
-			opts = append(opts, llms.WithTools(llmsTools))
-		}
+	for iteration := run.Iteration; iteration < maxIterations; iteration++ {
+		if toolCalls == nil {
+			opts := []llms.CallOption{
+				llms.WithModel(agent.LLMModel),
+				llms.WithTemperature(agent.Temperature),
+			}
 
-		if agent.MaxTokens > 0 {
-			opts = append(opts, llms.WithMaxTokens(agent.MaxTokens))
-		}
+			if len(gen.toolsList) > 0 {
+				llmsTools := s.convertToLLMSTools(gen.toolsList, shared.InferenceProvider(agent.Provider))
+				opts = append(opts, llms.WithTools(llmsTools))
+			}
 
-		content, err := llm.GenerateContent(ctx, conversationMessages, opts...)
-		if err != nil {
-			return fmt.Errorf("generating content: %w", err)
-		}
+			if agent.ResponseSchema != nil && usesJSONMode(agent, len(gen.toolsList) > 0) {
+				opts = append(opts, llms.WithJSONMode())
+			}
 
-		if len(content.Choices) == 0 {
-			return fmt.Errorf("no content generated")
-		}
+			if agent.MaxTokens > 0 {
+				opts = append(opts, llms.WithMaxTokens(agent.MaxTokens))
+			}
 
-		choice := content.Choices[0]
+			if gen.streamFunc != nil {
+				opts = append(opts, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+					if len(chunk) == 0 || isToolCallDelta(chunk) {
+						return nil
+					}
+					gen.streamFunc(string(chunk))
+					return nil
+				}))
+			}
 
-		if len(choice.ToolCalls) > 0 {
-			toolResults := make([]llms.MessageContent, 0)
+			response, err := gen.llm.GenerateContent(ctx, conversationMessages, opts...)
+			if err != nil {
+				return &shared.AgentInferenceResponse{Usage: usage}, nil, fmt.Errorf("generating content: %w", err)
+			}
 
-			for _, toolCall := range choice.ToolCalls {
-				result, err := s.executeToolCall(ctx, toolCall, toolsMap, toolEventFunc)
-				if err != nil {
-					result = fmt.Sprintf("Error executing tool: %v", err)
+			if len(response.Choices) == 0 {
+				return &shared.AgentInferenceResponse{Usage: usage}, nil, fmt.Errorf("no content generated")
+			}
+
+			choice := mergeChoices(response.Choices)
+			usage.Add(usageFromGenerationInfo(choice.GenerationInfo))
+
+			if len(choice.ToolCalls) == 0 {
+				if agent.ResponseSchema == nil {
+					return &shared.AgentInferenceResponse{
+						Response:  choice.Content,
+						Usage:     usage,
+						Status:    "completed",
+						Citations: gen.citations.list(),
+					}, nil, nil
 				}
 
-				progressGuidance := ""
-				if iteration >= maxIterations-5 {
-					progressGuidance = fmt.Sprintf("\n\n[Iteration %d/%d: Consider summarizing your findings and providing a final response rather than continuing exploration]", iteration+1, maxIterations)
+				structured, err := parseStructuredOutput(choice.Content, agent.ResponseSchema)
+				if err == nil {
+					return &shared.AgentInferenceResponse{
+						Response:   choice.Content,
+						Usage:      usage,
+						Status:     "completed",
+						Structured: structured,
+						Citations:  gen.citations.list(),
+					}, nil, nil
 				}
-				if iteration >= maxIterations-3 {
-					progressGuidance = fmt.Sprintf("\n\n[Iteration %d/%d: You're approaching the iteration limit. Please provide a final response based on the information gathered so far.]", iteration+1, maxIterations)
+				if retries == structuredOutputRetries {
+					return &shared.AgentInferenceResponse{Usage: usage}, nil, fmt.Errorf("response does not match the response schema after %d retries: %w", retries, err)
 				}
+				retries++
 
-				toolResults = append(toolResults, llms.MessageContent{
-					Role: llms.ChatMessageTypeTool,
-					Parts: []llms.ContentPart{
-						llms.ToolCallResponse{
-							ToolCallID: toolCall.ID,
-							Name:       toolCall.FunctionCall.Name,
-							Content:    result + progressGuidance,
-						},
-					},
-				})
+				if gen.retryFunc != nil {
+					gen.retryFunc(err)
+				}
+				conversationMessages = append(conversationMessages,
+					llms.TextParts(llms.ChatMessageTypeAI, choice.Content),
+					llms.TextParts(llms.ChatMessageTypeHuman, structuredOutputRetryPrompt(err)),
+				)
+				continue
 			}
 
-			assistantMsg := llms.MessageContent{
-				Role:  llms.ChatMessageTypeAI,
-				Parts: []llms.ContentPart{},
+			// Gemini does not assign IDs to tool calls, so give each one a
+			// stable ID for pairing results and tool events.
+			for i := range choice.ToolCalls {
+				if choice.ToolCalls[i].ID == "" {
+					choice.ToolCalls[i].ID = fmt.Sprintf("call_%d_%d", iteration, i)
+				}
 			}
-
-			if choice.Content != "" {
-				assistantMsg.Parts = append(assistantMsg.Parts, llms.TextPart(choice.Content))
+			content, toolCalls = choice.Content, choice.ToolCalls
+
+			if gen.approveTool == nil {
+				if calls := pendingToolCalls(toolCalls, gen.toolsMap); calls != nil {
+					pending := &PendingRun{
+						Messages:  conversationMessages,
+						Content:   content,
+						ToolCalls: toolCalls,
+						Calls:     calls,
+						Iteration: iteration,
+					}
+					return &shared.AgentInferenceResponse{
+						Response:         content,
+						Usage:            usage,
+						Status:           "pending_approval",
+						PendingToolCalls: calls,
+					}, pending, nil
+				}
 			}
+		}
 
-			for _, tc := range choice.ToolCalls {
-				assistantMsg.Parts = append(assistantMsg.Parts, llms.ToolCall{
-					ID:           tc.ID,
-					Type:         tc.Type,
-					FunctionCall: tc.FunctionCall,
-				})
+		toolResults := make([]llms.MessageContent, 0)
+		step := &shared.ToolStep{Content: content}
+
+		for i := range toolCalls {
+			if ctx.Err() != nil {
+				return &shared.AgentInferenceResponse{Usage: usage}, nil, context.Cause(ctx)
+			}
+			toolCall := &toolCalls[i]
+
+			var result string
+			rejection, err := s.authorizeToolCall(ctx, gen, toolCall, decisions[toolCall.ID])
+			switch {
+			case err != nil:
+				result = fmt.Sprintf("Error executing tool: %v", err)
+			case rejection != "":
+				result = rejection
+			default:
+				result, err = s.executeToolCall(ctx, gen, *toolCall)
+				if err != nil {
+					result = fmt.Sprintf("Error executing tool: %v", err)
+				}
 			}
 
-			conversationMessages = append(conversationMessages, assistantMsg)
-			conversationMessages = append(conversationMessages, toolResults...)
+			step.Calls = append(step.Calls, shared.ToolCallRecord{
+				CallID:    toolCall.ID,
+				ToolName:  toolCall.FunctionCall.Name,
+				Arguments: toolCall.FunctionCall.Arguments,
+				Result:    result,
+			})
 
-			if toolEventFunc != nil {
-				toolEventFunc(&shared.ToolCallEvent{
-					Type: "tool_batch_complete",
-				})
+			progressGuidance := ""
+			if iteration >= maxIterations-5 {
+				progressGuidance = fmt.Sprintf("\n\n[Iteration %d/%d: Consider summarizing your findings and providing a final response rather than continuing exploration]", iteration+1, maxIterations)
+			}
+			if iteration >= maxIterations-3 {
+				progressGuidance = fmt.Sprintf("\n\n[Iteration %d/%d: You're approaching the iteration limit. Please provide a final response based on the information gathered so far.]", iteration+1, maxIterations)
 			}
 
-			continue
+			toolResults = append(toolResults, llms.MessageContent{
+				Role: llms.ChatMessageTypeTool,
+				Parts: []llms.ContentPart{
+					llms.ToolCallResponse{
+						ToolCallID: toolCall.ID,
+						Name:       toolCall.FunctionCall.Name,
+						Content:    result + progressGuidance,
+					},
+				},
+			})
 		}
 
-		if choice.Content != "" {
-			for _, char := range choice.Content {
-				streamFunc(string(char))
-				time.Sleep(10 * time.Millisecond)
-			}
+		assistantMsg := llms.MessageContent{
+			Role:  llms.ChatMessageTypeAI,
+			Parts: []llms.ContentPart{},
+		}
+
+		if content != "" {
+			assistantMsg.Parts = append(assistantMsg.Parts, llms.TextPart(content))
+		}
+
+		// Built after execution so that edited arguments are what the model
+		// sees it called the tool with.
+		for _, tc := range toolCalls {
+			assistantMsg.Parts = append(assistantMsg.Parts, llms.ToolCall{
+				ID:           tc.ID,
+				Type:         tc.Type,
+				FunctionCall: tc.FunctionCall,
+			})
+		}
+
+		// Gemini expects every function response for a turn in a single
+		// message, while OpenAI expects one message per tool result.
+		if agent.Provider == string(shared.Google) {
+			toolResults = mergeToolResults(toolResults)
 		}
 
+		conversationMessages = append(conversationMessages, assistantMsg)
+		conversationMessages = append(conversationMessages, toolResults...)
+
+		if gen.toolEventFunc != nil {
+			gen.toolEventFunc(&shared.ToolCallEvent{
+				Type: "tool_batch_complete",
+				Step: step,
+			})
+		}
+
+		content, toolCalls, decisions = "", nil, nil
+	}
+
+	return &shared.AgentInferenceResponse{Usage: usage}, nil, fmt.Errorf("maximum tool iterations reached")
+}
+
+// pendingToolCalls lists a batch for the caller to decide on, or returns nil
+// when no call in it requires approval.
+func pendingToolCalls(toolCalls []llms.ToolCall, toolsMap map[string]tools.Tool) []shared.PendingToolCall {
+	var calls []shared.PendingToolCall
+	needsApproval := false
+	for _, toolCall := range toolCalls {
+		tool, exists := toolsMap[toolCall.FunctionCall.Name]
+		requiresApproval := exists && toolRequiresApproval(tool)
+		needsApproval = needsApproval || requiresApproval
+
+		var args map[string]any
+		json.Unmarshal([]byte(toolCall.FunctionCall.Arguments), &args)
+
+		calls = append(calls, shared.PendingToolCall{
+			CallID:           toolCall.ID,
+			ToolName:         toolCall.FunctionCall.Name,
+			Arguments:        args,
+			RequiresApproval: requiresApproval,
+		})
+	}
+	if !needsApproval {
 		return nil
 	}
+	return calls
+}
+
+// authorizeToolCall applies the approval policy to a tool call, asking
+// gen.approveTool when no decision was supplied. An edit rewrites the call's
+// arguments in place. A rejection returns the result to give the model in
+// place of running the tool.
+func (s *LLMService) authorizeToolCall(ctx context.Context, gen *generation, toolCall *llms.ToolCall, decision *shared.ToolApprovalDecision) (string, error) {
+	tool, exists := gen.toolsMap[toolCall.FunctionCall.Name]
+	if !exists || !toolRequiresApproval(tool) {
+		return "", nil
+	}
+
+	if decision == nil && gen.approveTool != nil {
+		var err error
+		decision, err = gen.approveTool(ctx, *toolCall)
+		if err != nil {
+			return "", err
+		}
+	}
+	if decision == nil {
+		decision = &shared.ToolApprovalDecision{Action: "reject", Reason: "no decision was made"}
+	}
 
-	return fmt.Errorf("maximum tool iterations reached")
+	switch decision.Action {
+	case "approve":
+		return "", nil
+	case "edit":
+		args, err := json.Marshal(decision.Arguments)
+		if err != nil {
+			return "", fmt.Errorf("invalid edited arguments: %w", err)
+		}
+		toolCall.FunctionCall.Arguments = string(args)
+		return "", nil
+	}
+
+	if gen.toolEventFunc != nil {
+		gen.toolEventFunc(&shared.ToolCallEvent{
+			Type:     "tool_rejected",
+			CallID:   toolCall.ID,
+			ToolName: toolCall.FunctionCall.Name,
+			Error:    decision.Reason,
+		})
+	}
+
+	rejection := "The user rejected this tool call."
+	if decision.Reason != "" {
+		rejection += " Reason: " + decision.Reason
+	}
+	return rejection, nil
+}
+
+// mergeChoices folds a response into a single choice. Anthropic returns one
+// choice per content block, so text written before a tool call arrives
+// separately from the call itself.
+func mergeChoices(choices []*llms.ContentChoice) *llms.ContentChoice {
+	if len(choices) == 1 {
+		return choices[0]
+	}
+
+	merged := &llms.ContentChoice{}
+	for _, c := range choices {
+		merged.Content += c.Content
+		merged.ToolCalls = append(merged.ToolCalls, c.ToolCalls...)
+		if c.StopReason != "" {
+			merged.StopReason = c.StopReason
+		}
+		if merged.GenerationInfo == nil {
+			merged.GenerationInfo = c.GenerationInfo
+		}
+	}
+	return merged
 }
 
-func (s *LLMService) executeToolCall(ctx context.Context, toolCall llms.ToolCall, toolsMap map[string]tools.Tool, toolEventFunc func(*shared.ToolCallEvent)) (string, error) {
+func mergeToolResults(toolResults []llms.MessageContent) []llms.MessageContent {
+	merged := llms.MessageContent{Role: llms.ChatMessageTypeTool}
+	for _, result := range toolResults {
+		merged.Parts = append(merged.Parts, result.Parts...)
+	}
+	return []llms.MessageContent{merged}
+}
+
+// usageFromGenerationInfo reads the token counts a provider reported for a
+// single call. Anthropic reports InputTokens/OutputTokens while OpenAI and
+// Gemini report PromptTokens/CompletionTokens.
+func usageFromGenerationInfo(info map[string]any) shared.Usage {
+	promptTokens := intFromGenerationInfo(info, "PromptTokens", "InputTokens")
+	completionTokens := intFromGenerationInfo(info, "CompletionTokens", "OutputTokens")
+	return shared.Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+func intFromGenerationInfo(info map[string]any, keys ...string) int {
+	for _, key := range keys {
+		switch v := info[key].(type) {
+		case int:
+			return v
+		case int32:
+			return int(v)
+		case int64:
+			return int(v)
+		case float64:
+			return int(v)
+		}
+	}
+	return 0
+}
+
+// isToolCallDelta reports whether a streamed chunk is a tool call fragment
+// rather than response text. OpenAI passes tool call deltas to the streaming
+// func as marshaled JSON, which must not be forwarded as tokens.
+func isToolCallDelta(chunk []byte) bool {
+	if chunk[0] != '[' {
+		return false
+	}
+
+	var deltas []struct {
+		Function json.RawMessage `json:"function"`
+	}
+	if err := json.Unmarshal(chunk, &deltas); err != nil {
+		return false
+	}
+	return len(deltas) > 0 && deltas[0].Function != nil
+}
+
+func (s *LLMService) executeToolCall(ctx context.Context, gen *generation, toolCall llms.ToolCall) (string, error) {
+	toolsMap, toolEventFunc := gen.toolsMap, gen.toolEventFunc
 	startTime := time.Now()
 	toolName := toolCall.FunctionCall.Name
 
@@ -336,6 +753,7 @@ func (s *LLMService) executeToolCall(ctx context.Context, toolCall llms.ToolCall
 	tool, exists := toolsMap[toolName]
 	if !exists {
 		err := fmt.Errorf("tool not found: %s", toolName)
+		s.reportToolError(gen.agent, toolName, err)
 		if toolEventFunc != nil {
 			toolEventFunc(&shared.ToolCallEvent{
 				Type:     "tool_error",
@@ -348,10 +766,31 @@ func (s *LLMService) executeToolCall(ctx context.Context, toolCall llms.ToolCall
 		return "", err
 	}
 
-	result, err := tool.Call(ctx, toolCall.FunctionCall.Arguments)
+	var result string
+	var err error
+	if schemaTool, ok := tool.(SchemaTool); ok {
+		var args map[string]any
+		if toolCall.FunctionCall.Arguments != "" {
+			if err = json.Unmarshal([]byte(toolCall.FunctionCall.Arguments), &args); err != nil {
+				err = fmt.Errorf("invalid tool arguments: %w", err)
+			}
+		}
+		if err == nil {
+			if delegateTool, ok := tool.(*DelegateTool); ok {
+				// Delegates report their own tool calls under this one and
+				// ask for approval the same way the caller does.
+				result, err = delegateTool.run(ctx, args, toolCall.ID, toolEventFunc, gen.approveTool)
+			} else {
+				result, err = schemaTool.CallWithArguments(ctx, args)
+			}
+		}
+	} else {
+		result, err = tool.Call(ctx, toolCall.FunctionCall.Arguments)
+	}
 	duration := time.Since(startTime).Milliseconds()
 
 	if err != nil {
+		s.reportToolError(gen.agent, toolName, err)
 		if toolEventFunc != nil {
 			toolEventFunc(&shared.ToolCallEvent{
 				Type:     "tool_error",
@@ -377,24 +816,40 @@ func (s *LLMService) executeToolCall(ctx context.Context, toolCall llms.ToolCall
 	return result, nil
 }
 
-func (s *LLMService) convertToLLMSTools(toolsList []tools.Tool) []llms.Tool {
+// reportToolError tells the event sink of a failed tool call. Calls that
+// fail because the run was cancelled are not reported.
+func (s *LLMService) reportToolError(agent *shared.AgentConfig, toolName string, err error) {
+	if s.events == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	s.events.ToolError(agent, toolName, err)
+}
+
+// convertToLLMSTools advertises each tool with its own input schema, adjusted
+// for what the provider accepts.
+func (s *LLMService) convertToLLMSTools(toolsList []tools.Tool, provider shared.InferenceProvider) []llms.Tool {
 	llmsTools := make([]llms.Tool, len(toolsList))
 	for i, tool := range toolsList {
+		parameters := map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"input": map[string]any{
+					"type":        "string",
+					"description": "JSON input for the tool",
+				},
+			},
+			"required": []string{"input"},
+		}
+		if schemaTool, ok := tool.(SchemaTool); ok {
+			parameters = sanitizeToolSchema(schemaTool.InputSchema(), provider)
+		}
+
 		llmsTools[i] = llms.Tool{
 			Type: "function",
 			Function: &llms.FunctionDefinition{
 				Name:        tool.Name(),
 				Description: tool.Description(),
-				Parameters: map[string]any{
-					"type": "object",
-					"properties": map[string]any{
-						"input": map[string]any{
-							"type":        "string",
-							"description": "JSON input for the tool",
-						},
-					},
-					"required": []string{"input"},
-				},
+				Parameters:  parameters,
 			},
 		}
 	}
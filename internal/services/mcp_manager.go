@@ -1,24 +1,28 @@
 package services
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/arnavsurve/glyfs/internal/shared"
 	"github.com/google/uuid"
-	"github.com/i2y/langchaingo-mcp-adapter"
 	"github.com/mark3labs/mcp-go/client"
 	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/tmc/langchaingo/tools"
 	"gorm.io/gorm"
 )
 
 type MCPConnectionManager struct {
 	connections map[uuid.UUID]*MCPConnection
+	restarts    map[uuid.UUID]int
 	mutex       sync.RWMutex
 	db          *gorm.DB
 }
@@ -27,11 +31,21 @@ type MCPConnection struct {
 	ServerID uuid.UUID
 	Server   *shared.MCPServer
 	Client   *client.Client
-	Adapter  *langchaingo_mcp_adapter.MCPAdapter
-	Tools    []tools.Tool
+	Tools    []*MCPTool
 	LastUsed time.Time
 	Status   ConnectionStatus
 	Error    error
+
+	process *stdioProcess
+}
+
+// close shuts down the client and, for stdio servers, the subprocess.
+func (c *MCPConnection) close() {
+	if c.process != nil {
+		c.process.stop(c.Client)
+		return
+	}
+	c.Client.Close()
 }
 
 type ConnectionStatus string
@@ -45,6 +59,7 @@ const (
 func NewMCPConnectionManager(db *gorm.DB) *MCPConnectionManager {
 	manager := &MCPConnectionManager{
 		connections: make(map[uuid.UUID]*MCPConnection),
+		restarts:    make(map[uuid.UUID]int),
 		db:          db,
 	}
 
@@ -98,6 +113,7 @@ func (m *MCPConnectionManager) createConnection(ctx context.Context, serverID uu
 	// Use individual columns directly from server struct
 
 	var mcpClient *client.Client
+	var process *stdioProcess
 	var err error
 
 	switch server.ServerType {
@@ -105,36 +121,63 @@ func (m *MCPConnectionManager) createConnection(ctx context.Context, serverID uu
 		mcpClient, err = m.createHTTPClient(decryptedServer)
 	case "sse":
 		mcpClient, err = m.createSSEClient(decryptedServer)
+	case "stdio":
+		mcpClient, process, err = m.createStdioClient(decryptedServer)
 	default:
-		return nil, fmt.Errorf("unsupported server type: %s (only http and sse are supported)", server.ServerType)
+		return nil, fmt.Errorf("unsupported server type: %s (only http, sse and stdio are supported)", server.ServerType)
 	}
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MCP client: %w", err)
 	}
 
-	adapter, err := langchaingo_mcp_adapter.New(mcpClient)
-	if err != nil {
-		mcpClient.Close()
-		return nil, fmt.Errorf("failed to create MCP adapter: %w", err)
-	}
-
-	tools, err := adapter.Tools()
-	if err != nil {
-		mcpClient.Close()
-		return nil, fmt.Errorf("failed to get tools: %w", err)
+	timeout := time.Duration(decryptedServer.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 30 * time.Second
 	}
 
 	connection := &MCPConnection{
 		ServerID: serverID,
 		Server:   &server,
 		Client:   mcpClient,
-		Adapter:  adapter,
-		Tools:    tools,
-		LastUsed: time.Now(),
-		Status:   StatusConnected,
+		process:  process,
+	}
+
+	// The SSE transport keeps its event stream open for the lifetime of the
+	// context passed to Start, so it must not be the request context.
+	if err := mcpClient.Start(context.Background()); err != nil {
+		connection.close()
+		return nil, fmt.Errorf("failed to start MCP client: %w", err)
 	}
 
+	if stderr, ok := client.GetStderr(mcpClient); ok {
+		go logStdioStderr(serverID, stderr)
+	}
+
+	initCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	initRequest := mcp.InitializeRequest{}
+	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	initRequest.Params.ClientInfo = mcp.Implementation{
+		Name:    "glyfs",
+		Version: "1.0.0",
+	}
+	if _, err := mcpClient.Initialize(initCtx, initRequest); err != nil {
+		connection.close()
+		return nil, fmt.Errorf("failed to initialize MCP client: %w", err)
+	}
+
+	tools, err := listMCPTools(initCtx, mcpClient, timeout)
+	if err != nil {
+		connection.close()
+		return nil, fmt.Errorf("failed to get tools: %w", err)
+	}
+
+	connection.Tools = tools
+	connection.LastUsed = time.Now()
+	connection.Status = StatusConnected
+
 	m.connections[serverID] = connection
 
 	return connection, nil
@@ -196,10 +239,14 @@ func (m *MCPConnectionManager) GetAgentTools(ctx context.Context, agentID uuid.U
 		}
 
 		for _, tool := range conn.Tools {
+			if !assoc.AllowsTool(tool.Name()) {
+				continue
+			}
 			wrappedTool := &ServerTool{
-				Tool:       tool,
-				ServerID:   assoc.MCPServerID,
-				ServerName: assoc.MCPServer.Name,
+				MCPTool:          tool,
+				ServerID:         assoc.MCPServerID,
+				ServerName:       assoc.MCPServer.Name,
+				approvalRequired: assoc.RequiresApproval(tool.Name()),
 			}
 			allTools = append(allTools, wrappedTool)
 		}
@@ -217,9 +264,10 @@ func (m *MCPConnectionManager) CloseConnection(serverID uuid.UUID) {
 	defer m.mutex.Unlock()
 
 	if conn, exists := m.connections[serverID]; exists {
-		conn.Client.Close()
+		conn.close()
 		delete(m.connections, serverID)
 	}
+	delete(m.restarts, serverID)
 }
 
 func (m *MCPConnectionManager) healthChecker() {
@@ -233,22 +281,72 @@ func (m *MCPConnectionManager) healthChecker() {
 
 func (m *MCPConnectionManager) checkConnections() {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
+	var stdioConns []*MCPConnection
 	for serverID, conn := range m.connections {
 		if time.Since(conn.LastUsed) > 10*time.Minute {
-			conn.Client.Close()
+			conn.close()
 			delete(m.connections, serverID)
+			delete(m.restarts, serverID)
 			continue
 		}
 
 		if conn.Status == StatusError {
-			conn.Client.Close()
+			conn.close()
 			delete(m.connections, serverID)
+			continue
+		}
+
+		if conn.process != nil {
+			stdioConns = append(stdioConns, conn)
+		}
+	}
+	m.mutex.Unlock()
+
+	// Stdio servers run as local processes, so a failed ping means the
+	// process crashed or hung. Restart it up to the server's MaxRetries.
+	for _, conn := range stdioConns {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := conn.Client.Ping(ctx)
+		cancel()
+
+		m.mutex.Lock()
+		if m.connections[conn.ServerID] != conn {
+			m.mutex.Unlock()
+			continue
+		}
+		if err == nil {
+			delete(m.restarts, conn.ServerID)
+			m.mutex.Unlock()
+			continue
+		}
+
+		conn.close()
+		delete(m.connections, conn.ServerID)
+		m.restarts[conn.ServerID]++
+		attempt := m.restarts[conn.ServerID]
+		m.mutex.Unlock()
+
+		if attempt > conn.Server.MaxRetries {
+			log.Printf("MCP stdio server %s is not responding and has used all %d restarts: %v", conn.ServerID, conn.Server.MaxRetries, err)
+			continue
+		}
+
+		log.Printf("MCP stdio server %s is not responding, restarting (attempt %d): %v", conn.ServerID, attempt, err)
+		if _, err := m.createConnection(context.Background(), conn.ServerID); err != nil {
+			log.Printf("Failed to restart MCP stdio server %s: %v", conn.ServerID, err)
 		}
 	}
 }
 
+// logStdioStderr forwards a stdio server's stderr to the log. Reading it also
+// keeps the process from blocking on a full pipe.
+func logStdioStderr(serverID uuid.UUID, stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Printf("MCP server %s: %s", serverID, scanner.Text())
+	}
+}
+
 func (m *MCPConnectionManager) TestConnection(ctx context.Context, serverID uuid.UUID) error {
 	m.CloseConnection(serverID)
 
@@ -279,22 +377,32 @@ func (m *MCPConnectionManager) GetServerTools(ctx context.Context, serverID uuid
 }
 
 type ServerTool struct {
-	tools.Tool
+	*MCPTool
 	ServerID   uuid.UUID
 	ServerName string
+
+	approvalRequired bool
+}
+
+func (st *ServerTool) RequiresApproval() bool {
+	return st.approvalRequired
 }
 
+// Name prefixes the tool with its server name. Characters providers reject in
+// function names are replaced and the result is capped at 64 characters.
 func (st *ServerTool) Name() string {
-	return fmt.Sprintf("%s_%s", st.ServerName, st.Tool.Name())
+	name := toolNamePattern.ReplaceAllString(fmt.Sprintf("%s_%s", st.ServerName, st.MCPTool.Name()), "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
 }
 
 func (st *ServerTool) Description() string {
-	return fmt.Sprintf("[%s] %s", st.ServerName, st.Tool.Description())
+	return fmt.Sprintf("[%s] %s", st.ServerName, st.MCPTool.Description())
 }
 
-func (st *ServerTool) Call(ctx context.Context, input string) (string, error) {
-	return st.Tool.Call(ctx, input)
-}
+var toolNamePattern = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
 
 func (m *MCPConnectionManager) decryptServerData(server shared.MCPServer, encryptionService *EncryptionService) (shared.MCPServer, error) {
 	decryptedServer := server
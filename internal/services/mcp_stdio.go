@@ -0,0 +1,253 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+)
+
+// stdioShutdownGrace is how long a stdio server gets to exit after its stdin
+// is closed before the process group is killed.
+const stdioShutdownGrace = 5 * time.Second
+
+// StdioSandbox holds the operator controls for stdio MCP servers. Stdio is
+// disabled unless MCP_STDIO_ALLOWED_COMMANDS lists at least one command and
+// MCP_STDIO_UID names an unprivileged user for the servers to run as.
+type StdioSandbox struct {
+	AllowedCommands []StdioCommand
+	// AllowedEnv lists the variables servers may set, by name or by a
+	// prefix ending in *, like GITHUB_*.
+	AllowedEnv   []string
+	WorkDir      string
+	UID          *uint32
+	GID          *uint32
+	MaxProcesses int
+}
+
+// StdioCommand is an entry of MCP_STDIO_ALLOWED_COMMANDS: a command and the
+// arguments a server's arguments must start with.
+type StdioCommand struct {
+	Command string
+	Args    []string
+}
+
+func (c StdioCommand) String() string {
+	return strings.Join(append([]string{c.Command}, c.Args...), " ")
+}
+
+// allows reports whether a server may run command with args.
+func (c StdioCommand) allows(command string, args []string) bool {
+	return c.Command == command && len(args) >= len(c.Args) && slices.Equal(args[:len(c.Args)], c.Args)
+}
+
+var stdioEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var loadStdioSandbox = sync.OnceValues(func() (*StdioSandbox, error) {
+	sandbox := &StdioSandbox{
+		WorkDir:      filepath.Join(os.TempDir(), "glyfs-mcp"),
+		MaxProcesses: 50,
+	}
+
+	for _, entry := range strings.Split(os.Getenv("MCP_STDIO_ALLOWED_COMMANDS"), ",") {
+		if fields := strings.Fields(entry); len(fields) > 0 {
+			sandbox.AllowedCommands = append(sandbox.AllowedCommands, StdioCommand{Command: fields[0], Args: fields[1:]})
+		}
+	}
+
+	for _, name := range strings.Split(os.Getenv("MCP_STDIO_ALLOWED_ENV"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			sandbox.AllowedEnv = append(sandbox.AllowedEnv, name)
+		}
+	}
+
+	if dir := os.Getenv("MCP_STDIO_WORKDIR"); dir != "" {
+		sandbox.WorkDir = dir
+	}
+
+	if v := os.Getenv("MCP_STDIO_MAX_PROCESSES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid MCP_STDIO_MAX_PROCESSES: %q", v)
+		}
+		sandbox.MaxProcesses = n
+	}
+
+	for name, target := range map[string]**uint32{"MCP_STDIO_UID": &sandbox.UID, "MCP_STDIO_GID": &sandbox.GID} {
+		if v := os.Getenv(name); v != "" {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q", name, v)
+			}
+			id32 := uint32(id)
+			*target = &id32
+		}
+	}
+
+	return sandbox, nil
+})
+
+// checkIdentity checks that servers run as a user and group other than root
+// and the server's own, so that they cannot read the server's environment or
+// files.
+func (s *StdioSandbox) checkIdentity() error {
+	if s.UID == nil {
+		return fmt.Errorf("MCP_STDIO_UID is not set")
+	}
+	gid := *s.UID
+	if s.GID != nil {
+		gid = *s.GID
+	}
+	if *s.UID == 0 || int64(*s.UID) == int64(os.Getuid()) {
+		return fmt.Errorf("MCP_STDIO_UID must be an unprivileged user other than the server's")
+	}
+	if gid == 0 || int64(gid) == int64(os.Getgid()) {
+		return fmt.Errorf("MCP_STDIO_GID must be an unprivileged group other than the server's")
+	}
+	return nil
+}
+
+// ValidateStdioServer checks a stdio server definition against the sandbox
+// configuration before it is saved.
+func ValidateStdioServer(command string, args []string, env map[string]string) error {
+	sandbox, err := loadStdioSandbox()
+	if err != nil {
+		return err
+	}
+
+	if len(sandbox.AllowedCommands) == 0 {
+		return fmt.Errorf("stdio MCP servers are not enabled on this instance")
+	}
+	if err := sandbox.checkIdentity(); err != nil {
+		return fmt.Errorf("stdio MCP servers are not enabled on this instance: %v", err)
+	}
+	if command == "" {
+		return fmt.Errorf("command is required for stdio servers")
+	}
+	if !slices.ContainsFunc(sandbox.AllowedCommands, func(allowed StdioCommand) bool { return allowed.allows(command, args) }) {
+		return fmt.Errorf("command %q with these args is not allowed; allowed commands: %s", command, sandbox.allowedCommandList())
+	}
+
+	for key := range env {
+		if !sandbox.envAllowed(key) {
+			if len(sandbox.AllowedEnv) == 0 {
+				return fmt.Errorf("environment variable %q cannot be set; this instance allows none", key)
+			}
+			return fmt.Errorf("environment variable %q cannot be set; allowed variables: %s", key, strings.Join(sandbox.AllowedEnv, ", "))
+		}
+	}
+
+	return nil
+}
+
+func (s *StdioSandbox) allowedCommandList() string {
+	commands := make([]string, len(s.AllowedCommands))
+	for i, command := range s.AllowedCommands {
+		commands[i] = command.String()
+	}
+	return strings.Join(commands, ", ")
+}
+
+// envAllowed reports whether a server may set a variable. The variables the
+// sandbox controls can never be set.
+func (s *StdioSandbox) envAllowed(key string) bool {
+	if !stdioEnvName.MatchString(key) {
+		return false
+	}
+	switch key {
+	case "PATH", "HOME", "TMPDIR":
+		return false
+	}
+	return slices.ContainsFunc(s.AllowedEnv, func(allowed string) bool {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			return strings.HasPrefix(key, prefix)
+		}
+		return key == allowed
+	})
+}
+
+// stdioProcess tracks the subprocess behind a stdio connection so it can be
+// killed if it does not exit when the client closes.
+type stdioProcess struct {
+	cancel context.CancelFunc
+}
+
+func (p *stdioProcess) stop(mcpClient *client.Client) {
+	timer := time.AfterFunc(stdioShutdownGrace, p.cancel)
+	mcpClient.Close()
+	timer.Stop()
+	p.cancel()
+}
+
+// createStdioClient prepares a client that launches the server's command in
+// its own working directory with a minimal environment. The process is
+// spawned when the client is started.
+func (m *MCPConnectionManager) createStdioClient(server shared.MCPServer) (*client.Client, *stdioProcess, error) {
+	if err := ValidateStdioServer(server.Command, server.Args, server.Env); err != nil {
+		return nil, nil, err
+	}
+
+	sandbox, err := loadStdioSandbox()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	running := 0
+	for _, conn := range m.connections {
+		if conn.process != nil {
+			running++
+		}
+	}
+	if running >= sandbox.MaxProcesses {
+		return nil, nil, fmt.Errorf("stdio process limit reached (%d)", sandbox.MaxProcesses)
+	}
+
+	workDir := filepath.Join(sandbox.WorkDir, server.ID.String())
+	if err := os.MkdirAll(workDir, 0o700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create working directory: %w", err)
+	}
+	gid := *sandbox.UID
+	if sandbox.GID != nil {
+		gid = *sandbox.GID
+	}
+	if err := os.Chown(workDir, int(*sandbox.UID), int(gid)); err != nil {
+		return nil, nil, fmt.Errorf("failed to set working directory owner: %w", err)
+	}
+
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + workDir,
+		"TMPDIR=" + workDir,
+	}
+	for key, value := range server.Env {
+		env = append(env, key+"="+value)
+	}
+
+	procCtx, cancel := context.WithCancel(context.Background())
+	process := &stdioProcess{cancel: cancel}
+
+	commandFunc := func(_ context.Context, command string, env []string, args []string) (*exec.Cmd, error) {
+		cmd := exec.CommandContext(procCtx, command, args...)
+		cmd.Env = env
+		cmd.Dir = workDir
+		if err := configureStdioCommand(cmd, sandbox); err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	}
+
+	stdioTransport := transport.NewStdioWithOptions(server.Command, env, server.Args, transport.WithCommandFunc(commandFunc))
+
+	return client.NewClient(stdioTransport), process, nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package services
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func configureStdioCommand(cmd *exec.Cmd, sandbox *StdioSandbox) error {
+	if sandbox.UID != nil || sandbox.GID != nil {
+		return fmt.Errorf("MCP_STDIO_UID and MCP_STDIO_GID are only supported on unix")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"os"
+	"testing"
+)
+
+func TestStdioCommandAllows(t *testing.T) {
+	tests := []struct {
+		allowed StdioCommand
+		command string
+		args    []string
+		want    bool
+	}{
+		{StdioCommand{Command: "uvx"}, "uvx", []string{"anything"}, true},
+		{StdioCommand{Command: "uvx"}, "npx", nil, false},
+		{StdioCommand{Command: "npx", Args: []string{"-y", "@scope/server"}}, "npx", []string{"-y", "@scope/server"}, true},
+		{StdioCommand{Command: "npx", Args: []string{"-y", "@scope/server"}}, "npx", []string{"-y", "@scope/server", "/data"}, true},
+		{StdioCommand{Command: "npx", Args: []string{"-y", "@scope/server"}}, "npx", []string{"-y", "@scope/other"}, false},
+		{StdioCommand{Command: "npx", Args: []string{"-y", "@scope/server"}}, "npx", []string{"-y"}, false},
+		{StdioCommand{Command: "npx", Args: []string{"-y", "@scope/server"}}, "npx", []string{"@scope/server", "-y"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.allowed.allows(tt.command, tt.args); got != tt.want {
+			t.Errorf("%q allows(%q, %q) = %v, want %v", tt.allowed, tt.command, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestStdioSandboxEnvAllowed(t *testing.T) {
+	sandbox := &StdioSandbox{AllowedEnv: []string{"GITHUB_TOKEN", "SLACK_*", "PATH"}}
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"GITHUB_TOKEN", true},
+		{"GITHUB_TOKEN_2", false},
+		{"SLACK_BOT_TOKEN", true},
+		{"NODE_OPTIONS", false},
+		{"PYTHONPATH", false},
+		{"LD_PRELOAD", false},
+		{"PATH", false},
+		{"SLACK_A=B", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := sandbox.envAllowed(tt.key); got != tt.want {
+			t.Errorf("envAllowed(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestStdioSandboxCheckIdentity(t *testing.T) {
+	id := func(n int) *uint32 {
+		v := uint32(n)
+		return &v
+	}
+	other := 60000
+	if os.Getuid() == other || os.Getgid() == other {
+		other++
+	}
+
+	tests := []struct {
+		name     string
+		uid, gid *uint32
+		wantErr  bool
+	}{
+		{"unset", nil, nil, true},
+		{"root", id(0), id(other), true},
+		{"server user", id(os.Getuid()), id(other), true},
+		{"root group", id(other), id(0), true},
+		{"server group", id(other), id(os.Getgid()), true},
+		{"separate user", id(other), nil, false},
+		{"separate user and group", id(other), id(other + 1), false},
+	}
+	for _, tt := range tests {
+		sandbox := &StdioSandbox{UID: tt.uid, GID: tt.gid}
+		if err := sandbox.checkIdentity(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkIdentity() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package services
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// configureStdioCommand runs the server in its own process group, as the
+// sandbox user, and kills the whole group on cancel so children spawned by
+// launchers such as npx do not outlive the server.
+func configureStdioCommand(cmd *exec.Cmd, sandbox *StdioSandbox) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if sandbox.UID != nil {
+		credential := &syscall.Credential{Uid: *sandbox.UID, Gid: *sandbox.UID}
+		if sandbox.GID != nil {
+			credential.Gid = *sandbox.GID
+		}
+		cmd.SysProcAttr.Credential = credential
+	}
+
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	return nil
+}
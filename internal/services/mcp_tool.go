@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/tmc/langchaingo/tools"
+)
+
+// SchemaTool is a tool that publishes a JSON Schema for its arguments and can
+// be called with structured arguments instead of a single input string.
+type SchemaTool interface {
+	tools.Tool
+	InputSchema() map[string]any
+	CallWithArguments(ctx context.Context, args map[string]any) (string, error)
+}
+
+// MCPTool is a tool published by an MCP server. It keeps the input schema
+// exactly as the server listed it in tools/list.
+type MCPTool struct {
+	name        string
+	description string
+	inputSchema map[string]any
+	client      *client.Client
+	timeout     time.Duration
+}
+
+type mcpToolDefinition struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+func (t *MCPTool) Name() string {
+	return t.name
+}
+
+func (t *MCPTool) Description() string {
+	return t.description
+}
+
+func (t *MCPTool) InputSchema() map[string]any {
+	return t.inputSchema
+}
+
+// Call satisfies tools.Tool. The input must be a JSON object of arguments.
+func (t *MCPTool) Call(ctx context.Context, input string) (string, error) {
+	var args map[string]any
+	if input != "" {
+		if err := json.Unmarshal([]byte(input), &args); err != nil {
+			return "", fmt.Errorf("tool arguments must be a JSON object: %w", err)
+		}
+	}
+	return t.CallWithArguments(ctx, args)
+}
+
+// CallWithArguments calls the tool. If ctx ends first, the server is sent a
+// cancellation notification so it can stop the work.
+func (t *MCPTool) CallWithArguments(ctx context.Context, args map[string]any) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	// The request is sent through the transport with an ID of our own because
+	// the client does not expose the IDs it assigns, and the ID is needed to
+	// cancel the call.
+	requestID := mcp.NewRequestId("call-" + uuid.NewString())
+	resp, err := t.client.GetTransport().SendRequest(ctx, transport.JSONRPCRequest{
+		JSONRPC: mcp.JSONRPC_VERSION,
+		ID:      requestID,
+		Method:  "tools/call",
+		Params: map[string]any{
+			"name":      t.name,
+			"arguments": args,
+		},
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			t.cancelRequest(requestID, context.Cause(ctx))
+		}
+		return "", err
+	}
+	if resp.Error != nil {
+		return "", fmt.Errorf("%s", resp.Error.Message)
+	}
+
+	res, err := mcp.ParseCallToolResult(&resp.Result)
+	if err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, content := range res.Content {
+		switch c := content.(type) {
+		case mcp.TextContent:
+			parts = append(parts, c.Text)
+		case mcp.ImageContent:
+			parts = append(parts, fmt.Sprintf("[image content omitted: %s]", c.MIMEType))
+		case mcp.AudioContent:
+			parts = append(parts, fmt.Sprintf("[audio content omitted: %s]", c.MIMEType))
+		case mcp.EmbeddedResource:
+			if text, ok := c.Resource.(mcp.TextResourceContents); ok {
+				parts = append(parts, text.Text)
+			} else {
+				parts = append(parts, "[binary resource omitted]")
+			}
+		}
+	}
+	result := strings.Join(parts, "\n")
+
+	if res.IsError {
+		return "", fmt.Errorf("tool returned an error: %s", result)
+	}
+
+	return result, nil
+}
+
+// cancelRequest tells the server to stop working on an abandoned request.
+func (t *MCPTool) cancelRequest(requestID mcp.RequestId, reason error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	notification := mcp.JSONRPCNotification{
+		JSONRPC: mcp.JSONRPC_VERSION,
+		Notification: mcp.Notification{
+			Method: "notifications/cancelled",
+			Params: mcp.NotificationParams{
+				AdditionalFields: map[string]any{
+					"requestId": requestID,
+					"reason":    reason.Error(),
+				},
+			},
+		},
+	}
+	if err := t.client.GetTransport().SendNotification(ctx, notification); err != nil {
+		log.Printf("Failed to send cancellation for MCP tool %s: %v", t.name, err)
+	}
+}
+
+// listMCPTools fetches every tool the server publishes. It reads tools/list
+// through the transport directly because mcp.Tool only keeps the type,
+// properties and required fields of each input schema.
+func listMCPTools(ctx context.Context, mcpClient *client.Client, timeout time.Duration) ([]*MCPTool, error) {
+	var mcpTools []*MCPTool
+	cursor := ""
+
+	for page := 0; ; page++ {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+
+		resp, err := mcpClient.GetTransport().SendRequest(ctx, transport.JSONRPCRequest{
+			JSONRPC: mcp.JSONRPC_VERSION,
+			ID:      mcp.NewRequestId(fmt.Sprintf("tools-list-%d", page)),
+			Method:  "tools/list",
+			Params:  params,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list tools: %w", err)
+		}
+		if resp.Error != nil {
+			return nil, fmt.Errorf("list tools: %s", resp.Error.Message)
+		}
+
+		var result struct {
+			Tools      []mcpToolDefinition `json:"tools"`
+			NextCursor string              `json:"nextCursor"`
+		}
+		if err := json.Unmarshal(resp.Result, &result); err != nil {
+			return nil, fmt.Errorf("decoding tools/list response: %w", err)
+		}
+
+		for _, def := range result.Tools {
+			mcpTools = append(mcpTools, &MCPTool{
+				name:        def.Name,
+				description: def.Description,
+				inputSchema: def.InputSchema,
+				client:      mcpClient,
+				timeout:     timeout,
+			})
+		}
+
+		if result.NextCursor == "" || result.NextCursor == cursor {
+			break
+		}
+		cursor = result.NextCursor
+	}
+
+	return mcpTools, nil
+}
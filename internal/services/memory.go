@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/tools"
+)
+
+const (
+	// defaultMemoryTokenBudget bounds the memories added to the system
+	// prompt of an agent that does not set a budget.
+	defaultMemoryTokenBudget = 500
+
+	// MaxMemoryLength bounds, in characters, a single memory.
+	MaxMemoryLength = 500
+
+	// maxRecalledMemories bounds the memories returned by one recall.
+	maxRecalledMemories = 20
+)
+
+// MemorySource stores the memories of the person a run talks to. The
+// handler binds the source to that person, so agents only see their own
+// memories of them.
+type MemorySource interface {
+	// Memories lists the agent's memories, most recently updated first.
+	Memories(ctx context.Context, agentID uuid.UUID) ([]shared.AgentMemory, error)
+	Remember(ctx context.Context, agent *shared.AgentConfig, content string) (*shared.AgentMemory, error)
+	Forget(ctx context.Context, agentID, memoryID uuid.UUID) error
+}
+
+func memoryTokenBudget(agent *shared.AgentConfig) int {
+	if agent.MemoryTokenBudget > 0 {
+		return agent.MemoryTokenBudget
+	}
+	return defaultMemoryTokenBudget
+}
+
+// formatMemory writes a memory as a line the model can refer to by ID.
+func formatMemory(memory shared.AgentMemory) string {
+	return fmt.Sprintf("- [%s] %s", memory.ID, memory.Content)
+}
+
+// memoryTool holds what the remember, recall and forget tools share.
+type memoryTool struct {
+	source MemorySource
+	agent  *shared.AgentConfig
+}
+
+// RememberTool stores a new memory.
+type RememberTool struct{ memoryTool }
+
+func (t *RememberTool) Name() string {
+	return "remember"
+}
+
+func (t *RememberTool) Description() string {
+	return "Save a fact about the user to remember in future conversations, such as a preference, a detail about their work, or something they asked you to remember. Write it as a short, self-contained statement. Do not save secrets or passing details of the current task."
+}
+
+func (t *RememberTool) InputSchema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"content": map[string]any{
+				"type":        "string",
+				"description": "The fact to remember, like \"Prefers answers in metric units\".",
+			},
+		},
+		"required": []string{"content"},
+	}
+}
+
+func (t *RememberTool) Call(ctx context.Context, input string) (string, error) {
+	return t.CallWithArguments(ctx, map[string]any{"content": input})
+}
+
+func (t *RememberTool) CallWithArguments(ctx context.Context, args map[string]any) (string, error) {
+	content, _ := args["content"].(string)
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return "", fmt.Errorf("content is required")
+	}
+	if len(content) > MaxMemoryLength {
+		return "", fmt.Errorf("content is longer than %d characters; save a shorter statement", MaxMemoryLength)
+	}
+
+	memory, err := t.source.Remember(ctx, t.agent, content)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Remembered with ID %s.", memory.ID), nil
+}
+
+// RecallTool searches the memories.
+type RecallTool struct{ memoryTool }
+
+func (t *RecallTool) Name() string {
+	return "recall"
+}
+
+func (t *RecallTool) Description() string {
+	return "Search what you remember about the user from earlier conversations. The memories that fit are already in your instructions; use this to find older ones."
+}
+
+func (t *RecallTool) InputSchema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"query": map[string]any{
+				"type":        "string",
+				"description": "Words to look for. Leave empty to list the most recent memories.",
+			},
+		},
+	}
+}
+
+func (t *RecallTool) Call(ctx context.Context, input string) (string, error) {
+	return t.CallWithArguments(ctx, map[string]any{"query": input})
+}
+
+func (t *RecallTool) CallWithArguments(ctx context.Context, args map[string]any) (string, error) {
+	query, _ := args["query"].(string)
+
+	memories, err := t.source.Memories(ctx, t.agent.ID)
+	if err != nil {
+		return "", err
+	}
+	memories = matchMemories(memories, query)
+	if len(memories) == 0 {
+		return "No memories found.", nil
+	}
+
+	lines := make([]string, 0, min(len(memories), maxRecalledMemories))
+	for _, memory := range memories[:min(len(memories), maxRecalledMemories)] {
+		lines = append(lines, formatMemory(memory))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// matchMemories returns the memories containing any word of query, those
+// with the most words first. An empty query matches every memory.
+func matchMemories(memories []shared.AgentMemory, query string) []shared.AgentMemory {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return memories
+	}
+
+	type match struct {
+		memory shared.AgentMemory
+		words  int
+	}
+	var matches []match
+	for _, memory := range memories {
+		content := strings.ToLower(memory.Content)
+		count := 0
+		for _, word := range words {
+			if strings.Contains(content, word) {
+				count++
+			}
+		}
+		if count > 0 {
+			matches = append(matches, match{memory, count})
+		}
+	}
+	// The sort is stable, so equal matches stay most recent first.
+	slices.SortStableFunc(matches, func(a, b match) int { return b.words - a.words })
+
+	matched := make([]shared.AgentMemory, len(matches))
+	for i, m := range matches {
+		matched[i] = m.memory
+	}
+	return matched
+}
+
+// ForgetTool deletes a memory.
+type ForgetTool struct{ memoryTool }
+
+func (t *ForgetTool) Name() string {
+	return "forget"
+}
+
+func (t *ForgetTool) Description() string {
+	return "Delete a memory that is wrong, outdated, or that the user asked you to forget. To change a memory, forget it and remember the corrected fact."
+}
+
+func (t *ForgetTool) InputSchema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"id": map[string]any{
+				"type":        "string",
+				"description": "The ID of the memory, shown in brackets before it.",
+			},
+		},
+		"required": []string{"id"},
+	}
+}
+
+func (t *ForgetTool) Call(ctx context.Context, input string) (string, error) {
+	return t.CallWithArguments(ctx, map[string]any{"id": input})
+}
+
+func (t *ForgetTool) CallWithArguments(ctx context.Context, args map[string]any) (string, error) {
+	id, _ := args["id"].(string)
+	memoryID, err := uuid.Parse(strings.Trim(strings.TrimSpace(id), "[]"))
+	if err != nil {
+		return "", fmt.Errorf("id must be the ID of a memory")
+	}
+
+	if err := t.source.Forget(ctx, t.agent.ID, memoryID); err != nil {
+		return "", err
+	}
+	return "Forgotten.", nil
+}
+
+// memoryTools returns the remember, recall and forget tools of an agent with
+// memory enabled, or nil.
+func (s *LLMService) memoryTools(agent *shared.AgentConfig) []tools.Tool {
+	if s.memory == nil || !agent.MemoryEnabled {
+		return nil
+	}
+	base := memoryTool{source: s.memory, agent: agent}
+	return []tools.Tool{&RememberTool{base}, &RecallTool{base}, &ForgetTool{base}}
+}
+
+// injectMemories adds the agent's most recently updated memories that fit
+// its memory budget to a copy of its system prompt, for agents with memory
+// enabled. A failed lookup is logged and the agent answers without them.
+func (s *LLMService) injectMemories(ctx context.Context, agent *shared.AgentConfig) *shared.AgentConfig {
+	if s.memory == nil || !agent.MemoryEnabled {
+		return agent
+	}
+
+	memories, err := s.memory.Memories(ctx, agent.ID)
+	if err != nil {
+		log.Printf("Warning: Failed to get memories of agent %s: %v\n", agent.ID, err)
+		return agent
+	}
+
+	budget := memoryTokenBudget(agent)
+	var lines []string
+	for _, memory := range memories {
+		line := formatMemory(memory)
+		budget -= estimateTokens(line)
+		if budget < 0 {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	section := "You have not saved any memories about the user yet."
+	if len(lines) > 0 {
+		section = "What you remember about the user from earlier conversations, most recent first:\n\n" + strings.Join(lines, "\n")
+		if len(lines) < len(memories) {
+			section += "\n\nOlder memories can be found with the recall tool."
+		}
+	}
+
+	injected := *agent
+	injected.SystemPrompt = strings.TrimSpace(agent.SystemPrompt + "\n\n## Memory\n\n" + section + "\n\nUse the remember tool to save lasting facts about the user and the forget tool, with a memory's ID, to delete ones that are wrong or outdated.")
+	return &injected
+}
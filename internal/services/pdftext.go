@@ -0,0 +1,501 @@
+package services
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+const (
+	// maxPDFStreamBytes bounds the decompressed size of each PDF stream read.
+	maxPDFStreamBytes = 64 << 20
+
+	// maxPDFArrayDepth bounds the nesting of the arrays kept by the lexer.
+	// Text arrays are never nested, so deeper arrays are flattened.
+	maxPDFArrayDepth = 32
+)
+
+var (
+	pdfLengthPattern = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+	pdfSkipPattern   = regexp.MustCompile(`/Subtype\s*/Image|/Type\s*/(XRef|XObject|Font|FontDescriptor|Metadata)|/Length1|/Length2|/Length3`)
+)
+
+// extractPDFText returns the text drawn by the content streams of a PDF.
+// Only uncompressed and Flate-compressed streams are read, and strings are
+// decoded as PDFDocEncoding or UTF-16, so PDFs that draw text with embedded
+// CID fonts, and scanned PDFs, yield no text.
+func extractPDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "", fmt.Errorf("not a PDF file")
+	}
+
+	var text strings.Builder
+	for offset := 0; ; {
+		dict, content, next, ok := nextPDFStream(data, offset)
+		if !ok {
+			break
+		}
+		offset = next
+
+		if pdfSkipPattern.Match(dict) {
+			continue
+		}
+		decoded, ok := decodePDFStream(dict, content)
+		if !ok || !bytes.Contains(decoded, []byte("BT")) {
+			continue
+		}
+		text.WriteString(pdfContentText(decoded))
+		text.WriteString("\n")
+	}
+
+	result := normalizeExtractedText(text.String())
+	if result == "" {
+		return "", fmt.Errorf("no text found in PDF; scanned PDFs and PDFs with embedded fonts only are not supported")
+	}
+	return result, nil
+}
+
+// nextPDFStream finds the first stream at or after offset and returns its
+// dictionary, its raw content and the offset after it.
+func nextPDFStream(data []byte, offset int) (dict, content []byte, next int, ok bool) {
+	for {
+		i := bytes.Index(data[offset:], []byte("stream"))
+		if i < 0 {
+			return nil, nil, 0, false
+		}
+		start := offset + i
+		offset = start + len("stream")
+
+		// Skip "endstream" and "stream" that is not preceded by a dictionary.
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+		dictEnd := bytes.LastIndex(data[:start], []byte(">>"))
+		if dictEnd < 0 || len(bytes.TrimSpace(data[dictEnd+2:start])) != 0 {
+			continue
+		}
+		dictStart := matchingDictStart(data, dictEnd+1)
+		if dictStart < 0 {
+			continue
+		}
+
+		contentStart := offset
+		if bytes.HasPrefix(data[contentStart:], []byte("\r\n")) {
+			contentStart += 2
+		} else if contentStart < len(data) && (data[contentStart] == '\n' || data[contentStart] == '\r') {
+			contentStart++
+		}
+
+		dict = data[dictStart : dictEnd+2]
+		contentEnd := -1
+		if m := pdfLengthPattern.FindSubmatch(dict); m != nil && len(m[2]) == 0 {
+			if length, err := strconv.Atoi(string(m[1])); err == nil && contentStart+length <= len(data) {
+				contentEnd = contentStart + length
+			}
+		}
+		if contentEnd < 0 {
+			end := bytes.Index(data[contentStart:], []byte("endstream"))
+			if end < 0 {
+				return nil, nil, 0, false
+			}
+			contentEnd = contentStart + end
+		}
+		return dict, data[contentStart:contentEnd], contentEnd, true
+	}
+}
+
+// matchingDictStart returns the offset of the "<<" that opens the dictionary
+// closed by the ">>" whose last byte is at end.
+func matchingDictStart(data []byte, end int) int {
+	depth := 0
+	for i := end; i > 0; i-- {
+		switch {
+		case data[i] == '>' && data[i-1] == '>':
+			depth++
+			i--
+		case data[i] == '<' && data[i-1] == '<':
+			depth--
+			i--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// decodePDFStream decompresses a stream with no filter or FlateDecode.
+func decodePDFStream(dict, content []byte) ([]byte, bool) {
+	if !bytes.Contains(dict, []byte("/Filter")) {
+		return content, true
+	}
+	if !bytes.Contains(dict, []byte("/FlateDecode")) || bytes.Contains(dict, []byte("/DecodeParms")) {
+		return nil, false
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, false
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(io.LimitReader(reader, maxPDFStreamBytes))
+	if err != nil && len(decoded) == 0 {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// pdfContentText returns the text shown by the operators of a content
+// stream, with line breaks where the text moves to a new line.
+func pdfContentText(content []byte) string {
+	var text strings.Builder
+	var operands []any
+	newline := func() {
+		if text.Len() > 0 && !strings.HasSuffix(text.String(), "\n") {
+			text.WriteString("\n")
+		}
+	}
+
+	lexer := &pdfLexer{data: content}
+	for {
+		token, ok := lexer.next()
+		if !ok {
+			break
+		}
+		operator, isOperator := token.(pdfOperator)
+		if !isOperator {
+			operands = append(operands, token)
+			continue
+		}
+
+		switch operator {
+		case "Tj":
+			if s, ok := lastOperand[[]byte](operands); ok {
+				text.WriteString(decodePDFString(s))
+			}
+		case "'", "\"":
+			newline()
+			if s, ok := lastOperand[[]byte](operands); ok {
+				text.WriteString(decodePDFString(s))
+			}
+		case "TJ":
+			if array, ok := lastOperand[[]any](operands); ok {
+				for _, element := range array {
+					switch element := element.(type) {
+					case []byte:
+						text.WriteString(decodePDFString(element))
+					case float64:
+						// Large negative adjustments move the text right
+						// by about a word space.
+						if element < -200 {
+							text.WriteString(" ")
+						}
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				if ty, ok := operands[len(operands)-1].(float64); ok && ty != 0 {
+					newline()
+				} else {
+					text.WriteString(" ")
+				}
+			}
+		case "T*", "ET":
+			newline()
+		case "Tm":
+			newline()
+		}
+		operands = operands[:0]
+	}
+	return text.String()
+}
+
+func lastOperand[T any](operands []any) (T, bool) {
+	var zero T
+	if len(operands) == 0 {
+		return zero, false
+	}
+	value, ok := operands[len(operands)-1].(T)
+	return value, ok
+}
+
+// decodePDFString decodes a PDF text string: UTF-16 with a byte order mark,
+// or else a single-byte encoding read as Latin-1.
+func decodePDFString(s []byte) string {
+	if len(s) >= 2 && s[0] == 0xFE && s[1] == 0xFF {
+		units := make([]uint16, 0, len(s)/2)
+		for i := 2; i+1 < len(s); i += 2 {
+			units = append(units, uint16(s[i])<<8|uint16(s[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+
+	runes := make([]rune, 0, len(s))
+	for _, b := range s {
+		r := rune(b)
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			continue
+		}
+		runes = append(runes, r)
+	}
+	return string(runes)
+}
+
+// normalizeExtractedText trims lines and collapses runs of blank lines.
+func normalizeExtractedText(text string) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// pdfOperator is an operator token of a content stream.
+type pdfOperator string
+
+// pdfLexer reads the tokens of a content stream: numbers as float64, strings
+// as []byte, arrays as []any, operators as pdfOperator, and names as string.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func (l *pdfLexer) next() (any, bool) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, false
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case c == '(':
+		return l.literalString(), true
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.pos += 2
+		return pdfOperator("<<"), true
+	case c == '>' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '>':
+		l.pos += 2
+		return pdfOperator(">>"), true
+	case c == '<':
+		return l.hexString(), true
+	case c == '[':
+		return l.array(), true
+	case c == '/':
+		start := l.pos
+		l.pos++
+		for l.pos < len(l.data) && !isPDFDelimiter(l.data[l.pos]) {
+			l.pos++
+		}
+		return string(l.data[start:l.pos]), true
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	if l.pos == start {
+		// A stray delimiter such as ")" or "]".
+		l.pos++
+		return pdfOperator(l.data[start:l.pos]), true
+	}
+	word := string(l.data[start:l.pos])
+	if number, err := strconv.ParseFloat(word, 64); err == nil {
+		return number, true
+	}
+	if word == "BI" {
+		l.skipInlineImage()
+	}
+	return pdfOperator(word), true
+}
+
+// array reads an array and the arrays nested in it. It keeps its own stack
+// rather than recursing, so that a stream of brackets cannot exhaust the
+// goroutine stack, and flattens arrays nested deeper than maxPDFArrayDepth.
+func (l *pdfLexer) array() []any {
+	l.pos++
+	stack := [][]any{nil}
+	flattened := 0
+	for {
+		l.skipSpace()
+		if l.pos >= len(l.data) {
+			break
+		}
+		switch l.data[l.pos] {
+		case '[':
+			l.pos++
+			if len(stack) < maxPDFArrayDepth {
+				stack = append(stack, nil)
+			} else {
+				flattened++
+			}
+			continue
+		case ']':
+			l.pos++
+			if flattened > 0 {
+				flattened--
+				continue
+			}
+			closed := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return closed
+			}
+			stack[len(stack)-1] = append(stack[len(stack)-1], closed)
+			continue
+		}
+
+		element, ok := l.next()
+		if !ok {
+			break
+		}
+		stack[len(stack)-1] = append(stack[len(stack)-1], element)
+	}
+
+	// The stream ended inside the array, so close the arrays still open.
+	for len(stack) > 1 {
+		closed := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		stack[len(stack)-1] = append(stack[len(stack)-1], closed)
+	}
+	return stack[0]
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// skipInlineImage skips the binary data of an inline image up to its EI.
+func (l *pdfLexer) skipInlineImage() {
+	end := bytes.Index(l.data[l.pos:], []byte("EI"))
+	for end >= 0 {
+		after := l.pos + end + 2
+		if after >= len(l.data) || isPDFSpace(l.data[after]) {
+			l.pos = after
+			return
+		}
+		next := bytes.Index(l.data[after:], []byte("EI"))
+		if next < 0 {
+			break
+		}
+		end = after - l.pos + next
+	}
+	l.pos = len(l.data)
+}
+
+func (l *pdfLexer) literalString() []byte {
+	var s []byte
+	depth := 0
+	l.pos++
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+			s = append(s, c)
+		case ')':
+			if depth == 0 {
+				return s
+			}
+			depth--
+			s = append(s, c)
+		case '\\':
+			if l.pos >= len(l.data) {
+				return s
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b':
+				s = append(s, '\b')
+			case 'f':
+				s = append(s, '\f')
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+			case '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					value := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						value = value*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					s = append(s, byte(value))
+				} else {
+					s = append(s, e)
+				}
+			}
+		default:
+			s = append(s, c)
+		}
+	}
+	return s
+}
+
+func (l *pdfLexer) hexString() []byte {
+	l.pos++
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if c := l.data[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	s := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		b, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			return s
+		}
+		s = append(s, byte(b))
+	}
+	return s
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return isPDFSpace(c) || strings.IndexByte("()<>[]{}/%", c) >= 0
+}
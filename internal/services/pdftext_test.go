@@ -0,0 +1,163 @@
+package services
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// pdfWithContent returns a one-page PDF whose content stream is content,
+// Flate-compressed when compress is set.
+func pdfWithContent(content []byte, compress bool) []byte {
+	dict := fmt.Sprintf("<< /Length %d >>", len(content))
+	if compress {
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		w.Write(content)
+		w.Close()
+		content = b.Bytes()
+		dict = fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", len(content))
+	}
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	pdf.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	pdf.WriteString("2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n")
+	pdf.WriteString("3 0 obj\n<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>\nendobj\n")
+	pdf.WriteString("4 0 obj\n" + dict + "\nstream\n")
+	pdf.Write(content)
+	pdf.WriteString("\nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return pdf.Bytes()
+}
+
+func TestExtractPDFTextFixture(t *testing.T) {
+	data, err := os.ReadFile("testdata/hello.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := extractPDFText(data)
+	if err != nil {
+		t.Fatalf("extractPDFText() error = %v", err)
+	}
+	want := "Hello world\nSecond line\n\nCompressed page\nété"
+	if text != want {
+		t.Errorf("extractPDFText() = %q, want %q", text, want)
+	}
+}
+
+func TestExtractPDFText(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		compress bool
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:    "show string",
+			content: "BT /F1 12 Tf (Hello world) Tj ET",
+			want:    "Hello world",
+		},
+		{
+			name:     "flate stream",
+			content:  "BT (Hello world) Tj ET",
+			compress: true,
+			want:     "Hello world",
+		},
+		{
+			name:    "text array with word spacing",
+			content: "BT [(Hel) -20 (lo) -300 (world)] TJ ET",
+			want:    "Hello world",
+		},
+		{
+			name:    "new lines",
+			content: "BT (One) Tj 0 -14 Td (Two) Tj T* (Three) Tj ET",
+			want:    "One\nTwo\nThree",
+		},
+		{
+			name:    "escapes and hex strings",
+			content: `BT (a\(b\) \101) Tj ( ) Tj <48692E> Tj ET`,
+			want:    "a(b) A Hi.",
+		},
+		{
+			name:    "nested dictionary operands",
+			content: "BT /Span << /MCID 0 /Attrs << /A 1 >> >> BDC (Tagged) Tj EMC ET",
+			want:    "Tagged",
+		},
+		{
+			name:    "no text",
+			content: "0 0 m 100 100 l S",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, err := extractPDFText(pdfWithContent([]byte(tt.content), tt.compress))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("extractPDFText() = %q, want error", text)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractPDFText() error = %v", err)
+			}
+			if text != tt.want {
+				t.Errorf("extractPDFText() = %q, want %q", text, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractPDFTextNotPDF(t *testing.T) {
+	if _, err := extractPDFText([]byte("hello")); err == nil {
+		t.Error("extractPDFText() error = nil, want error")
+	}
+}
+
+func TestMatchingDictStart(t *testing.T) {
+	tests := []struct {
+		data string
+		want int
+	}{
+		{"<< /Length 5 >>", 0},
+		{"1 0 obj << /A << /B 1 >> >>", 8},
+		{"<< /A 1 >> << /B 2 >>", 11},
+		{"/B 2 >>", -1},
+	}
+	for _, tt := range tests {
+		if got := matchingDictStart([]byte(tt.data), len(tt.data)-1); got != tt.want {
+			t.Errorf("matchingDictStart(%q) = %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestPDFLexerDeepArrays(t *testing.T) {
+	// Deeply nested and unterminated arrays must not recurse per bracket.
+	depth := 1 << 20
+	content := "BT " + strings.Repeat("[", depth) + "(deep)" + strings.Repeat("]", depth) + " TJ ET"
+	lexer := &pdfLexer{data: []byte(content)}
+	for {
+		if _, ok := lexer.next(); !ok {
+			break
+		}
+	}
+
+	unterminated := "BT " + strings.Repeat("[", depth)
+	lexer = &pdfLexer{data: []byte(unterminated)}
+	for {
+		if _, ok := lexer.next(); !ok {
+			break
+		}
+	}
+
+	array := (&pdfLexer{data: []byte("[[(a)] (b) [[(c)]]]")}).array()
+	if fmt.Sprint(array) != "[[[97]] [98] [[[99]]]]" {
+		t.Errorf("array() = %v", array)
+	}
+}
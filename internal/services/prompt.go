@@ -0,0 +1,131 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+)
+
+// promptPlaceholder matches a {{name}} placeholder in a system prompt.
+var promptPlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+var promptVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// builtinPromptVariables are filled in by the server for every request and
+// cannot be declared or supplied.
+var builtinPromptVariables = map[string]func(agent *shared.AgentConfig, now time.Time) string{
+	"current_date": func(_ *shared.AgentConfig, now time.Time) string { return now.UTC().Format("2006-01-02") },
+	"current_time": func(_ *shared.AgentConfig, now time.Time) string { return now.UTC().Format(time.RFC3339) },
+	"weekday":      func(_ *shared.AgentConfig, now time.Time) string { return now.UTC().Weekday().String() },
+	"agent_name":   func(agent *shared.AgentConfig, _ time.Time) string { return agent.Name },
+}
+
+// ValidatePromptTemplate checks the declared variables of an agent and that
+// its system prompt uses only declared and built-in variables.
+func ValidatePromptTemplate(prompt string, variables []shared.PromptVariable) error {
+	declared := make(map[string]bool)
+	for _, variable := range variables {
+		if !promptVariableName.MatchString(variable.Name) {
+			return fmt.Errorf("invalid prompt variable name %q: use letters, digits and underscores, not starting with a digit", variable.Name)
+		}
+		if _, ok := builtinPromptVariables[variable.Name]; ok {
+			return fmt.Errorf("prompt variable %q is built in and cannot be declared", variable.Name)
+		}
+		if declared[variable.Name] {
+			return fmt.Errorf("prompt variable %q is declared more than once", variable.Name)
+		}
+		if variable.Required && variable.Default != "" {
+			return fmt.Errorf("prompt variable %q cannot be required and have a default", variable.Name)
+		}
+		declared[variable.Name] = true
+	}
+
+	var undeclared []string
+	for _, match := range promptPlaceholder.FindAllStringSubmatch(prompt, -1) {
+		name := match[1]
+		if _, ok := builtinPromptVariables[name]; ok || declared[name] || slices.Contains(undeclared, name) {
+			continue
+		}
+		undeclared = append(undeclared, name)
+	}
+	if len(undeclared) > 0 {
+		return fmt.Errorf("system prompt uses undeclared variables: %s", strings.Join(undeclared, ", "))
+	}
+
+	return nil
+}
+
+// RenderSystemPrompt returns a copy of agent whose system prompt has its
+// placeholders replaced by values, the variables' defaults and the built-in
+// variables. It fails if a required variable is missing or a value is given
+// for a variable the agent does not declare.
+func RenderSystemPrompt(agent *shared.AgentConfig, values map[string]string, now time.Time) (*shared.AgentConfig, error) {
+	var unknown []string
+	for name := range values {
+		if !slices.ContainsFunc(agent.PromptVariables, func(v shared.PromptVariable) bool { return v.Name == name }) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown prompt variables: %s", strings.Join(unknown, ", "))
+	}
+
+	resolved := make(map[string]string)
+	var missing []string
+	for _, variable := range agent.PromptVariables {
+		value, ok := values[variable.Name]
+		switch {
+		case ok:
+			resolved[variable.Name] = value
+		case variable.Required:
+			missing = append(missing, variable.Name)
+		default:
+			resolved[variable.Name] = variable.Default
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing required prompt variables: %s", strings.Join(missing, ", "))
+	}
+
+	rendered := *agent
+	rendered.SystemPrompt = promptPlaceholder.ReplaceAllStringFunc(agent.SystemPrompt, func(match string) string {
+		name := promptPlaceholder.FindStringSubmatch(match)[1]
+		if builtin, ok := builtinPromptVariables[name]; ok {
+			return builtin(agent, now)
+		}
+		if value, ok := resolved[name]; ok {
+			return value
+		}
+		// Undeclared names, as in prompts written before templating, are
+		// left as they are.
+		return match
+	})
+	return &rendered, nil
+}
+
+// RenderMessageTemplate fills the {{name}} placeholders of a message with
+// values and with current_date, current_time and weekday in now's time zone.
+// Other placeholders are left as they are.
+func RenderMessageTemplate(template string, values map[string]string, now time.Time) string {
+	builtins := map[string]string{
+		"current_date": now.Format("2006-01-02"),
+		"current_time": now.Format(time.RFC3339),
+		"weekday":      now.Weekday().String(),
+	}
+	return promptPlaceholder.ReplaceAllStringFunc(template, func(match string) string {
+		name := promptPlaceholder.FindStringSubmatch(match)[1]
+		if value, ok := values[name]; ok {
+			return value
+		}
+		if value, ok := builtins[name]; ok {
+			return value
+		}
+		return match
+	})
+}
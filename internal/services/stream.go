@@ -0,0 +1,122 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StreamRetention is how long the events of a finished stream stay available
+// for replay.
+const StreamRetention = 5 * time.Minute
+
+// StreamEvent is a serialized stream event and its position in the run.
+type StreamEvent struct {
+	ID   int
+	Data []byte
+}
+
+// RunStream buffers the events of one streaming run so that clients can
+// reconnect and replay what they missed. Event IDs start at 1.
+type RunStream struct {
+	ID       uuid.UUID
+	userID   uint
+	agentID  uuid.UUID
+	apiKeyID *uint
+
+	mutex   sync.Mutex
+	events  []StreamEvent
+	done    bool
+	updated chan struct{}
+}
+
+// Publish appends an event and wakes every follower.
+func (s *RunStream) Publish(data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.done {
+		return
+	}
+	s.events = append(s.events, StreamEvent{ID: len(s.events) + 1, Data: data})
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// Since returns the events after lastID and whether the run has finished. If
+// it has not, the returned channel is closed when more events arrive.
+func (s *RunStream) Since(lastID int) ([]StreamEvent, bool, <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var events []StreamEvent
+	if lastID < 0 {
+		lastID = 0
+	}
+	if lastID < len(s.events) {
+		events = s.events[lastID:]
+	}
+	return events, s.done, s.updated
+}
+
+// StreamBuffer holds the streams of in-flight runs and of runs that finished
+// within StreamRetention.
+type StreamBuffer struct {
+	mutex   sync.Mutex
+	streams map[uuid.UUID]*RunStream
+}
+
+func NewStreamBuffer() *StreamBuffer {
+	return &StreamBuffer{
+		streams: make(map[uuid.UUID]*RunStream),
+	}
+}
+
+// Start creates the stream for a new run. apiKeyID is the API key the run
+// was started with, or nil for the dashboard.
+func (b *StreamBuffer) Start(userID uint, agentID uuid.UUID, apiKeyID *uint) *RunStream {
+	stream := &RunStream{
+		ID:       uuid.New(),
+		userID:   userID,
+		agentID:  agentID,
+		apiKeyID: apiKeyID,
+		updated:  make(chan struct{}),
+	}
+
+	b.mutex.Lock()
+	b.streams[stream.ID] = stream
+	b.mutex.Unlock()
+
+	return stream
+}
+
+// Get returns the stream for runID if it belongs to the given user and agent
+// and was started with the given API key.
+func (b *StreamBuffer) Get(runID uuid.UUID, userID uint, agentID uuid.UUID, apiKeyID *uint) (*RunStream, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stream, ok := b.streams[runID]
+	if !ok || stream.userID != userID || stream.agentID != agentID || !sameAPIKey(stream.apiKeyID, apiKeyID) {
+		return nil, false
+	}
+	return stream, true
+}
+
+// Finish marks the run as finished and drops its events after
+// StreamRetention.
+func (b *StreamBuffer) Finish(stream *RunStream) {
+	stream.mutex.Lock()
+	if !stream.done {
+		stream.done = true
+		close(stream.updated)
+	}
+	stream.mutex.Unlock()
+
+	time.AfterFunc(StreamRetention, func() {
+		b.mutex.Lock()
+		delete(b.streams, stream.ID)
+		b.mutex.Unlock()
+	})
+}
@@ -0,0 +1,447 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/arnavsurve/glyfs/internal/shared"
+)
+
+// structuredOutputRetries is how many times the model is asked to correct a
+// reply that does not match the agent's response schema.
+const structuredOutputRetries = 2
+
+// supportedSchemaKeywords are the JSON Schema keywords the validator
+// understands. Schemas using others are rejected rather than half enforced.
+var supportedSchemaKeywords = map[string]bool{
+	"$schema": true, "title": true, "description": true, "default": true, "examples": true,
+	"type": true, "enum": true, "const": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"minLength": true, "maxLength": true, "pattern": true, "format": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+	"anyOf": true, "oneOf": true, "allOf": true, "not": true,
+}
+
+// ValidateResponseSchema checks that schema is a JSON Schema for an object
+// that uses only supported keywords.
+func ValidateResponseSchema(schema map[string]any) error {
+	if schema["type"] != "object" {
+		return fmt.Errorf(`response_schema must describe an object ("type": "object")`)
+	}
+	return checkSchema(schema, "response_schema")
+}
+
+func checkSchema(schema map[string]any, path string) error {
+	for keyword, value := range schema {
+		if !supportedSchemaKeywords[keyword] {
+			return fmt.Errorf("%s: unsupported keyword %q", path, keyword)
+		}
+
+		switch keyword {
+		case "properties":
+			properties, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s.properties must be an object", path)
+			}
+			for name, property := range properties {
+				if err := checkSubschema(property, path+".properties."+name); err != nil {
+					return err
+				}
+			}
+		case "items", "not":
+			if err := checkSubschema(value, path+"."+keyword); err != nil {
+				return err
+			}
+		case "additionalProperties":
+			if _, ok := value.(bool); !ok {
+				if err := checkSubschema(value, path+".additionalProperties"); err != nil {
+					return err
+				}
+			}
+		case "anyOf", "oneOf", "allOf":
+			subschemas, ok := value.([]any)
+			if !ok || len(subschemas) == 0 {
+				return fmt.Errorf("%s.%s must be a non-empty array", path, keyword)
+			}
+			for i, subschema := range subschemas {
+				if err := checkSubschema(subschema, fmt.Sprintf("%s.%s[%d]", path, keyword, i)); err != nil {
+					return err
+				}
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s.pattern must be a string", path)
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("%s.pattern: %v", path, err)
+			}
+		case "type":
+			for _, name := range schemaTypes(value) {
+				if !slices.Contains([]string{"object", "array", "string", "number", "integer", "boolean", "null"}, name) {
+					return fmt.Errorf("%s.type: unknown type %q", path, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func checkSubschema(value any, path string) error {
+	schema, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s must be a schema object", path)
+	}
+	return checkSchema(schema, path)
+}
+
+// schemaTypes returns the types allowed by a "type" keyword, which is either
+// a name or a list of names.
+func schemaTypes(value any) []string {
+	switch t := value.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		var names []string
+		for _, name := range t {
+			if s, ok := name.(string); ok {
+				names = append(names, s)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// parseStructuredOutput decodes the model's reply and validates it against
+// schema. Code fences around the JSON are tolerated.
+func parseStructuredOutput(content string, schema map[string]any) (any, error) {
+	text := strings.TrimSpace(content)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(text, "```")
+		text = strings.TrimSpace(text)
+	}
+
+	var value any
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("reply is not valid JSON: %v", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("reply has text after the JSON value")
+	}
+
+	if err := validateSchema(schema, value, "$"); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// validateSchema checks value, decoded with UseNumber, against schema.
+func validateSchema(schema map[string]any, value any, path string) error {
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		if !slices.ContainsFunc(types, func(t string) bool { return hasSchemaType(value, t) }) {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonTypeName(value))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		if !slices.ContainsFunc(enum, func(option any) bool { return jsonEqual(option, value) }) {
+			return fmt.Errorf("%s: must be one of %s", path, compactJSON(enum))
+		}
+	}
+	if constant, ok := schema["const"]; ok && !jsonEqual(constant, value) {
+		return fmt.Errorf("%s: must be %s", path, compactJSON(constant))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		if err := validateObject(schema, v, path); err != nil {
+			return err
+		}
+	case []any:
+		if err := validateArray(schema, v, path); err != nil {
+			return err
+		}
+	case string:
+		if err := validateString(schema, v, path); err != nil {
+			return err
+		}
+	case json.Number:
+		if err := validateNumber(schema, v, path); err != nil {
+			return err
+		}
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		subschemas, ok := schema[keyword].([]any)
+		if !ok {
+			continue
+		}
+		matched := 0
+		var firstErr error
+		for _, subschema := range subschemas {
+			err := validateSchema(subschema.(map[string]any), value, path)
+			if err == nil {
+				matched++
+			} else if firstErr == nil {
+				firstErr = err
+			}
+		}
+		switch {
+		case keyword == "allOf" && matched < len(subschemas):
+			return firstErr
+		case keyword == "anyOf" && matched == 0:
+			return fmt.Errorf("%s: does not match any allowed schema (%v)", path, firstErr)
+		case keyword == "oneOf" && matched != 1:
+			return fmt.Errorf("%s: must match exactly one allowed schema, matches %d", path, matched)
+		}
+	}
+	if not, ok := schema["not"].(map[string]any); ok {
+		if validateSchema(not, value, path) == nil {
+			return fmt.Errorf("%s: matches a schema it must not match", path)
+		}
+	}
+
+	return nil
+}
+
+func validateObject(schema map[string]any, object map[string]any, path string) error {
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, present := object[key]; !present {
+					return fmt.Errorf("%s: missing required property %q", path, key)
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	for key, item := range object {
+		itemPath := path + "." + key
+		if property, ok := properties[key].(map[string]any); ok {
+			if err := validateSchema(property, item, itemPath); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: property %q is not allowed", path, key)
+			}
+		case map[string]any:
+			if err := validateSchema(additional, item, itemPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateArray(schema map[string]any, array []any, path string) error {
+	if min, ok := schemaInt(schema, "minItems"); ok && len(array) < min {
+		return fmt.Errorf("%s: must have at least %d items", path, min)
+	}
+	if max, ok := schemaInt(schema, "maxItems"); ok && len(array) > max {
+		return fmt.Errorf("%s: must have at most %d items", path, max)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if jsonEqual(array[i], array[j]) {
+					return fmt.Errorf("%s: items must be unique", path)
+				}
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range array {
+			if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(schema map[string]any, s string, path string) error {
+	length := utf8.RuneCountInString(s)
+	if min, ok := schemaInt(schema, "minLength"); ok && length < min {
+		return fmt.Errorf("%s: must be at least %d characters", path, min)
+	}
+	if max, ok := schemaInt(schema, "maxLength"); ok && length > max {
+		return fmt.Errorf("%s: must be at most %d characters", path, max)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if matched, _ := regexp.MatchString(pattern, s); !matched {
+			return fmt.Errorf("%s: must match pattern %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(schema map[string]any, n json.Number, path string) error {
+	value, err := n.Float64()
+	if err != nil {
+		return fmt.Errorf("%s: invalid number", path)
+	}
+	if min, ok := schemaFloat(schema, "minimum"); ok && value < min {
+		return fmt.Errorf("%s: must be at least %v", path, min)
+	}
+	if max, ok := schemaFloat(schema, "maximum"); ok && value > max {
+		return fmt.Errorf("%s: must be at most %v", path, max)
+	}
+	if min, ok := schemaFloat(schema, "exclusiveMinimum"); ok && value <= min {
+		return fmt.Errorf("%s: must be greater than %v", path, min)
+	}
+	if max, ok := schemaFloat(schema, "exclusiveMaximum"); ok && value >= max {
+		return fmt.Errorf("%s: must be less than %v", path, max)
+	}
+	if step, ok := schemaFloat(schema, "multipleOf"); ok && step > 0 {
+		if q := value / step; math.Abs(q-math.Round(q)) > 1e-9 {
+			return fmt.Errorf("%s: must be a multiple of %v", path, step)
+		}
+	}
+	return nil
+}
+
+func hasSchemaType(value any, name string) bool {
+	switch v := value.(type) {
+	case nil:
+		return name == "null"
+	case bool:
+		return name == "boolean"
+	case string:
+		return name == "string"
+	case json.Number:
+		if name == "number" {
+			return true
+		}
+		f, err := v.Float64()
+		return name == "integer" && err == nil && f == math.Trunc(f)
+	case []any:
+		return name == "array"
+	case map[string]any:
+		return name == "object"
+	}
+	return false
+}
+
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+// jsonEqual compares a schema value, decoded without UseNumber, with a reply
+// value, decoded with it.
+func jsonEqual(a, b any) bool {
+	return reflect.DeepEqual(normalizeNumbers(a), normalizeNumbers(b))
+}
+
+func normalizeNumbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case int:
+		return float64(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = normalizeNumbers(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, item := range v {
+			out[key] = normalizeNumbers(item)
+		}
+		return out
+	}
+	return value
+}
+
+func compactJSON(value any) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func schemaInt(schema map[string]any, keyword string) (int, bool) {
+	f, ok := schemaFloat(schema, keyword)
+	return int(f), ok
+}
+
+func schemaFloat(schema map[string]any, keyword string) (float64, bool) {
+	switch v := schema[keyword].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// structuredOutputInstruction tells the model to reply with JSON matching the
+// agent's schema. It is added to the system prompt for every provider, since
+// the native JSON modes do not all take a schema.
+func structuredOutputInstruction(schema map[string]any) string {
+	data, _ := json.MarshalIndent(schema, "", "  ")
+	return "When you give your final answer, reply with only a JSON value that matches this JSON Schema, with no other text or code fences:\n" + string(data)
+}
+
+// usesJSONMode reports whether the provider's native JSON mode is used for
+// an agent with a response schema. Gemini rejects JSON mode combined with
+// function calling, and custom endpoints may not support it.
+func usesJSONMode(agent *shared.AgentConfig, hasTools bool) bool {
+	switch shared.InferenceProvider(agent.Provider) {
+	case shared.OpenAI:
+		return agent.LLMModel != string(shared.O1Mini)
+	case shared.Google:
+		return !hasTools
+	}
+	return false
+}
+
+// structuredOutputRetryPrompt asks the model to correct a reply that failed
+// validation.
+func structuredOutputRetryPrompt(err error) string {
+	return fmt.Sprintf("Your reply does not match the required JSON Schema: %v. Reply again with only the corrected JSON value.", err)
+}
+
+// systemPromptWithSchema appends the structured output instruction to the
+// agent's system prompt when it has a response schema.
+func systemPromptWithSchema(agent *shared.AgentConfig) string {
+	if agent.ResponseSchema == nil {
+		return agent.SystemPrompt
+	}
+	instruction := structuredOutputInstruction(agent.ResponseSchema)
+	if agent.SystemPrompt == "" {
+		return instruction
+	}
+	return agent.SystemPrompt + "\n\n" + instruction
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func mustSchema(t *testing.T, raw string) map[string]any {
+	t.Helper()
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+		t.Fatalf("invalid test schema %s: %v", raw, err)
+	}
+	return schema
+}
+
+func TestValidateResponseSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr bool
+	}{
+		{"object", `{"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}`, false},
+		{"nested keywords", `{"type": "object", "properties": {"tags": {"type": "array", "items": {"anyOf": [{"type": "string"}, {"type": "null"}]}}}}`, false},
+		{"not an object", `{"type": "array"}`, true},
+		{"unsupported keyword", `{"type": "object", "$ref": "#/defs/a"}`, true},
+		{"unsupported nested keyword", `{"type": "object", "properties": {"a": {"if": {}}}}`, true},
+		{"unknown type", `{"type": "object", "properties": {"a": {"type": "date"}}}`, true},
+		{"invalid pattern", `{"type": "object", "properties": {"a": {"pattern": "("}}}`, true},
+		{"empty anyOf", `{"type": "object", "anyOf": []}`, true},
+		{"property not a schema", `{"type": "object", "properties": {"a": true}}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateResponseSchema(mustSchema(t, tt.schema))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateResponseSchema() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseStructuredOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		reply   string
+		wantErr bool
+	}{
+		{"type", `{"type": "string"}`, `"a"`, false},
+		{"type mismatch", `{"type": "string"}`, `1`, true},
+		{"type list", `{"type": ["string", "null"]}`, `null`, false},
+		{"integer", `{"type": "integer"}`, `3.0`, false},
+		{"not an integer", `{"type": "integer"}`, `3.5`, true},
+		{"enum", `{"enum": ["a", 1]}`, `1`, false},
+		{"not in enum", `{"enum": ["a", 1]}`, `"b"`, true},
+		{"const", `{"const": {"a": [1, 2]}}`, `{"a": [1, 2]}`, false},
+		{"const mismatch", `{"const": {"a": [1, 2]}}`, `{"a": [2, 1]}`, true},
+		{"required", `{"type": "object", "required": ["a"]}`, `{"a": 1}`, false},
+		{"missing required", `{"type": "object", "required": ["a"]}`, `{"b": 1}`, true},
+		{"property", `{"properties": {"a": {"type": "number"}}}`, `{"a": "1"}`, true},
+		{"additionalProperties false", `{"properties": {"a": {}}, "additionalProperties": false}`, `{"a": 1, "b": 2}`, true},
+		{"additionalProperties schema", `{"additionalProperties": {"type": "string"}}`, `{"a": "x", "b": 2}`, true},
+		{"items", `{"items": {"type": "string"}}`, `["a", "b"]`, false},
+		{"item mismatch", `{"items": {"type": "string"}}`, `["a", 2]`, true},
+		{"minItems", `{"minItems": 2}`, `[1]`, true},
+		{"maxItems", `{"maxItems": 1}`, `[1, 2]`, true},
+		{"uniqueItems", `{"uniqueItems": true}`, `[1, 1.0]`, true},
+		{"minLength counts characters", `{"minLength": 3}`, `"été"`, false},
+		{"maxLength", `{"maxLength": 2}`, `"abc"`, true},
+		{"pattern", `{"pattern": "^[a-z]+$"}`, `"abc"`, false},
+		{"pattern mismatch", `{"pattern": "^[a-z]+$"}`, `"ab1"`, true},
+		{"minimum", `{"minimum": 1}`, `1`, false},
+		{"below minimum", `{"minimum": 1}`, `0.5`, true},
+		{"maximum", `{"maximum": 1}`, `2`, true},
+		{"exclusiveMinimum", `{"exclusiveMinimum": 1}`, `1`, true},
+		{"exclusiveMaximum", `{"exclusiveMaximum": 1}`, `1`, true},
+		{"multipleOf", `{"multipleOf": 0.1}`, `0.3`, false},
+		{"not a multiple", `{"multipleOf": 0.5}`, `0.3`, true},
+		{"allOf", `{"allOf": [{"minimum": 1}, {"maximum": 3}]}`, `4`, true},
+		{"anyOf", `{"anyOf": [{"type": "string"}, {"type": "number"}]}`, `1`, false},
+		{"anyOf mismatch", `{"anyOf": [{"type": "string"}, {"type": "number"}]}`, `true`, true},
+		{"oneOf", `{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `1.5`, false},
+		{"oneOf matches two", `{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `1`, true},
+		{"not", `{"not": {"type": "null"}}`, `null`, true},
+		{"code fence", `{"type": "object"}`, "```json\n{\"a\": 1}\n```", false},
+		{"invalid JSON", `{"type": "object"}`, `{"a": }`, true},
+		{"text after JSON", `{"type": "object"}`, `{"a": 1} done`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseStructuredOutput(tt.reply, mustSchema(t, tt.schema))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseStructuredOutput(%s) error = %v, wantErr %v", tt.reply, err, tt.wantErr)
+			}
+		})
+	}
+}
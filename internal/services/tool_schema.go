@@ -0,0 +1,146 @@
+package services
+
+import (
+	"github.com/arnavsurve/glyfs/internal/shared"
+)
+
+// googleSchemaKeys are the JSON Schema keywords Gemini function declarations
+// understand. Anything else is dropped before the schema is sent.
+var googleSchemaKeys = map[string]bool{
+	"type":        true,
+	"description": true,
+	"properties":  true,
+	"items":       true,
+	"required":    true,
+}
+
+// sanitizeToolSchema prepares a tool's input schema for the given provider.
+// The input is never modified.
+func sanitizeToolSchema(schema map[string]any, provider shared.InferenceProvider) map[string]any {
+	var out map[string]any
+	if provider == shared.Google {
+		out = sanitizeGoogleSchema(schema)
+		if props, ok := out["properties"].(map[string]any); !ok || len(props) == 0 {
+			// Gemini rejects object parameters with no properties, so tools
+			// without arguments are declared with an empty schema instead.
+			return map[string]any{}
+		}
+	} else {
+		out = copySchema(schema)
+	}
+
+	// Every provider expects the top level to be an object with properties.
+	out["type"] = "object"
+	if _, ok := out["properties"].(map[string]any); !ok {
+		out["properties"] = map[string]any{}
+	}
+
+	return out
+}
+
+// sanitizeGoogleSchema reduces a JSON Schema to the subset Gemini accepts:
+// a single string type, no combinators, and required entries that name
+// existing properties.
+func sanitizeGoogleSchema(schema map[string]any) map[string]any {
+	schema = flattenSchemaUnion(schema)
+	out := map[string]any{}
+
+	for key, value := range schema {
+		if !googleSchemaKeys[key] {
+			continue
+		}
+		out[key] = value
+	}
+
+	switch ty := out["type"].(type) {
+	case string:
+	case []any:
+		// ["string", "null"] and similar become the first non-null type.
+		delete(out, "type")
+		for _, t := range ty {
+			if s, ok := t.(string); ok && s != "null" {
+				out["type"] = s
+				break
+			}
+		}
+	default:
+		delete(out, "type")
+	}
+	if _, ok := out["type"]; !ok {
+		out["type"] = inferSchemaType(out)
+	}
+
+	if props, ok := out["properties"].(map[string]any); ok {
+		cleaned := make(map[string]any, len(props))
+		for name, prop := range props {
+			if propSchema, ok := prop.(map[string]any); ok {
+				cleaned[name] = sanitizeGoogleSchema(propSchema)
+			}
+		}
+		out["properties"] = cleaned
+
+		if required, ok := out["required"].([]any); ok {
+			kept := make([]any, 0, len(required))
+			for _, r := range required {
+				if name, ok := r.(string); ok && cleaned[name] != nil {
+					kept = append(kept, name)
+				}
+			}
+			out["required"] = kept
+		}
+	} else {
+		delete(out, "properties")
+		delete(out, "required")
+	}
+
+	if items, ok := out["items"].(map[string]any); ok && out["type"] == "array" {
+		out["items"] = sanitizeGoogleSchema(items)
+	} else {
+		delete(out, "items")
+	}
+
+	return out
+}
+
+// flattenSchemaUnion replaces an anyOf/oneOf schema with its first non-null
+// option, keeping the outer description when the option has none.
+func flattenSchemaUnion(schema map[string]any) map[string]any {
+	for _, key := range []string{"anyOf", "oneOf"} {
+		options, ok := schema[key].([]any)
+		if !ok {
+			continue
+		}
+		for _, option := range options {
+			optionSchema, ok := option.(map[string]any)
+			if !ok || optionSchema["type"] == "null" {
+				continue
+			}
+			merged := copySchema(optionSchema)
+			if _, ok := merged["description"]; !ok {
+				if desc, ok := schema["description"]; ok {
+					merged["description"] = desc
+				}
+			}
+			return flattenSchemaUnion(merged)
+		}
+	}
+	return schema
+}
+
+func inferSchemaType(schema map[string]any) string {
+	if _, ok := schema["properties"]; ok {
+		return "object"
+	}
+	if _, ok := schema["items"]; ok {
+		return "array"
+	}
+	return "string"
+}
+
+func copySchema(schema map[string]any) map[string]any {
+	out := make(map[string]any, len(schema))
+	for key, value := range schema {
+		out[key] = value
+	}
+	return out
+}
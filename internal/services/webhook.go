@@ -0,0 +1,206 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookSignatureTolerance bounds the age of a timestamped signature, so
+// that a captured request cannot be replayed later.
+const webhookSignatureTolerance = 5 * time.Minute
+
+// WebhookReceiptRetention is how long a GitHub signature, which has no time,
+// is remembered after it was accepted.
+const WebhookReceiptRetention = 30 * 24 * time.Hour
+
+// ErrMissingSignature is returned for a webhook request without a signature
+// header.
+var ErrMissingSignature = errors.New("missing signature header")
+
+// SignWebhookPayload returns the signature of a body sent at timestamp, in
+// Unix seconds, in the format of the X-Glyfs-Signature header: sha256= and
+// the hex HMAC-SHA256 of "<timestamp>.<body>".
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	return "sha256=" + hex.EncodeToString(webhookMAC(secret, timestampedPayload(strconv.FormatInt(timestamp, 10), body)))
+}
+
+func webhookMAC(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func timestampedPayload(timestamp string, body []byte) []byte {
+	return append([]byte(timestamp+"."), body...)
+}
+
+// WebhookReplayKey identifies a verified webhook request, so that a replay
+// of it can be refused. The keys of timestamped signatures are only needed
+// until the signature expires, and GitHub's for a retention window.
+type WebhookReplayKey struct {
+	Key       string
+	ExpiresAt time.Time
+}
+
+// VerifyWebhookSignature checks that an inbound webhook request was signed
+// with secret and returns its replay key. It accepts the X-Glyfs-Signature
+// header with X-Glyfs-Timestamp and Stripe's Stripe-Signature header, which
+// sign a recent timestamp and the body, and GitHub's X-Hub-Signature-256
+// header, which signs the body only. Every key is derived from the verified
+// signature, since the other headers can be changed by whoever replays it.
+func VerifyWebhookSignature(secret string, header http.Header, body []byte, now time.Time) (*WebhookReplayKey, error) {
+	if signature := header.Get("X-Glyfs-Signature"); signature != "" {
+		timestamp := header.Get("X-Glyfs-Timestamp")
+		expiresAt, err := checkSignatureTimestamp(timestamp, now)
+		if err != nil {
+			return nil, err
+		}
+		signature = strings.TrimPrefix(signature, "sha256=")
+		if err := verifyHexSignature(signature, webhookMAC(secret, timestampedPayload(timestamp, body))); err != nil {
+			return nil, err
+		}
+		return &WebhookReplayKey{Key: "glyfs:" + strings.ToLower(signature), ExpiresAt: expiresAt}, nil
+	}
+	if signature := header.Get("X-Hub-Signature-256"); signature != "" {
+		signature = strings.TrimPrefix(signature, "sha256=")
+		if err := verifyHexSignature(signature, webhookMAC(secret, body)); err != nil {
+			return nil, err
+		}
+		return &WebhookReplayKey{Key: "github:" + strings.ToLower(signature), ExpiresAt: now.Add(WebhookReceiptRetention)}, nil
+	}
+	if signature := header.Get("Stripe-Signature"); signature != "" {
+		return verifyStripeSignature(secret, signature, body, now)
+	}
+	return nil, ErrMissingSignature
+}
+
+// checkSignatureTimestamp checks that a signature's Unix timestamp is within
+// the tolerance of now and returns when the signature expires.
+func checkSignatureTimestamp(timestamp string, now time.Time) (time.Time, error) {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("missing or malformed signature timestamp")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if age := now.Sub(signedAt); age > webhookSignatureTolerance || age < -webhookSignatureTolerance {
+		return time.Time{}, errors.New("signature timestamp is too old")
+	}
+	return signedAt.Add(webhookSignatureTolerance), nil
+}
+
+func verifyHexSignature(signature string, expected []byte) error {
+	decoded, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, expected) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// verifyStripeSignature checks a t=<unix time>,v1=<signature> header. Any
+// of several v1 signatures may match, as when Stripe rolls a secret.
+func verifyStripeSignature(secret, header string, body []byte, now time.Time) (*WebhookReplayKey, error) {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	if len(signatures) == 0 {
+		return nil, errors.New("malformed Stripe-Signature header")
+	}
+	expiresAt, err := checkSignatureTimestamp(timestamp, now)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := webhookMAC(secret, timestampedPayload(timestamp, body))
+	for _, signature := range signatures {
+		if verifyHexSignature(signature, expected) == nil {
+			return &WebhookReplayKey{Key: "stripe:" + strings.ToLower(signature), ExpiresAt: expiresAt}, nil
+		}
+	}
+	return nil, errors.New("signature does not match")
+}
+
+// payloadPlaceholder matches a {{payload}}, {{payload.path}} or
+// {{headers.Name}} placeholder in a webhook's message template.
+var payloadPlaceholder = regexp.MustCompile(`\{\{\s*(payload(?:\.[^{}\s]+)?|headers\.[^{}\s]+)\s*\}\}`)
+
+// RenderPayloadTemplate fills the placeholders of a webhook's message
+// template from the request. {{payload}} is the whole body and
+// {{payload.a.b}} a field of a JSON body, with array elements by index like
+// {{payload.commits.0.message}}. {{headers.Name}} is a request header.
+// Objects and arrays are written as JSON, and fields that are missing are
+// empty.
+func RenderPayloadTemplate(template string, body []byte, header http.Header) string {
+	var payload any
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		payload = nil
+	}
+
+	return payloadPlaceholder.ReplaceAllStringFunc(template, func(match string) string {
+		path := payloadPlaceholder.FindStringSubmatch(match)[1]
+		if name, ok := strings.CutPrefix(path, "headers."); ok {
+			return header.Get(name)
+		}
+		if path == "payload" {
+			return string(body)
+		}
+		return formatPayloadValue(lookupPayloadPath(payload, strings.Split(strings.TrimPrefix(path, "payload."), ".")))
+	})
+}
+
+func lookupPayloadPath(value any, path []string) any {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]any:
+			value = v[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+func formatPayloadValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(encoded)
+	}
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	const secret = "whsec_test_secret_value"
+	body := []byte(`{"event":"ping"}`)
+	now := time.Unix(1_700_000_000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	old := strconv.FormatInt(now.Add(-6*time.Minute).Unix(), 10)
+
+	hexMAC := func(data string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(data))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	glyfs := SignWebhookPayload(secret, now.Unix(), body)
+
+	tests := []struct {
+		name    string
+		header  map[string]string
+		wantKey string
+		expires time.Time
+		wantErr bool
+	}{
+		{
+			name:    "glyfs",
+			header:  map[string]string{"X-Glyfs-Signature": glyfs, "X-Glyfs-Timestamp": ts},
+			wantKey: "glyfs:" + hexMAC(ts+"."+string(body)),
+			expires: now.Add(webhookSignatureTolerance),
+		},
+		{
+			name:    "glyfs without timestamp",
+			header:  map[string]string{"X-Glyfs-Signature": glyfs},
+			wantErr: true,
+		},
+		{
+			name:    "glyfs with another timestamp",
+			header:  map[string]string{"X-Glyfs-Signature": glyfs, "X-Glyfs-Timestamp": strconv.FormatInt(now.Unix()-1, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "glyfs expired",
+			header:  map[string]string{"X-Glyfs-Signature": "sha256=" + hexMAC(old+"."+string(body)), "X-Glyfs-Timestamp": old},
+			wantErr: true,
+		},
+		{
+			name:    "glyfs body only",
+			header:  map[string]string{"X-Glyfs-Signature": "sha256=" + hexMAC(string(body)), "X-Glyfs-Timestamp": ts},
+			wantErr: true,
+		},
+		{
+			name:    "github",
+			header:  map[string]string{"X-Hub-Signature-256": "sha256=" + hexMAC(string(body)), "X-GitHub-Delivery": "72d3162e-cc78-11e3-81ab-4c9367dc0958"},
+			wantKey: "github:" + hexMAC(string(body)),
+			expires: now.Add(WebhookReceiptRetention),
+		},
+		{
+			name:    "github replayed with another delivery",
+			header:  map[string]string{"X-Hub-Signature-256": "sha256=" + hexMAC(string(body)), "X-GitHub-Delivery": "8f4d2a10-0000-4000-8000-000000000000"},
+			wantKey: "github:" + hexMAC(string(body)),
+			expires: now.Add(WebhookReceiptRetention),
+		},
+		{
+			name:    "github without delivery",
+			header:  map[string]string{"X-Hub-Signature-256": "sha256=" + hexMAC(string(body))},
+			wantKey: "github:" + hexMAC(string(body)),
+			expires: now.Add(WebhookReceiptRetention),
+		},
+		{
+			name:    "github wrong secret",
+			header:  map[string]string{"X-Hub-Signature-256": "sha256=" + hex.EncodeToString(webhookMAC("other", body)), "X-GitHub-Delivery": "1"},
+			wantErr: true,
+		},
+		{
+			name:    "stripe",
+			header:  map[string]string{"Stripe-Signature": fmt.Sprintf("t=%s,v1=%s,v1=%s", ts, hexMAC("x"), hexMAC(ts+"."+string(body)))},
+			wantKey: "stripe:" + hexMAC(ts+"."+string(body)),
+			expires: now.Add(webhookSignatureTolerance),
+		},
+		{
+			name:    "stripe expired",
+			header:  map[string]string{"Stripe-Signature": fmt.Sprintf("t=%s,v1=%s", old, hexMAC(old+"."+string(body)))},
+			wantErr: true,
+		},
+		{
+			name:    "stripe malformed",
+			header:  map[string]string{"Stripe-Signature": "t=" + ts},
+			wantErr: true,
+		},
+		{
+			name:    "missing",
+			header:  map[string]string{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range tt.header {
+				header.Set(name, value)
+			}
+			key, err := VerifyWebhookSignature(secret, header, body, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("VerifyWebhookSignature() = %+v, want error", key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyWebhookSignature() error = %v", err)
+			}
+			if key.Key != tt.wantKey {
+				t.Errorf("Key = %q, want %q", key.Key, tt.wantKey)
+			}
+			if !key.ExpiresAt.Equal(tt.expires) {
+				t.Errorf("ExpiresAt = %v, want %v", key.ExpiresAt, tt.expires)
+			}
+		})
+	}
+
+	if _, err := VerifyWebhookSignature(secret, http.Header{}, body, now); !errors.Is(err, ErrMissingSignature) {
+		t.Errorf("VerifyWebhookSignature() error = %v, want ErrMissingSignature", err)
+	}
+}
+
+func TestRenderPayloadTemplate(t *testing.T) {
+	body := []byte(`{"pull_request": {"title": "Fix"}, "commits": [{"id": 7}], "draft": false, "labels": ["a"]}`)
+	header := http.Header{"X-Github-Event": []string{"pull_request"}}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{{payload.pull_request.title}}", "Fix"},
+		{"{{ payload.commits.0.id }}", "7"},
+		{"{{payload.draft}} {{payload.labels}}", "false [\"a\"]"},
+		{"[{{payload.missing.field}}] [{{payload.commits.5}}]", "[] []"},
+		{"{{headers.X-GitHub-Event}}", "pull_request"},
+		{"{{payload}}", string(body)},
+		{"{{other}}", "{{other}}"},
+	}
+	for _, tt := range tests {
+		if got := RenderPayloadTemplate(tt.template, body, header); got != tt.want {
+			t.Errorf("RenderPayloadTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,13 @@
 package shared
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,17 +15,102 @@ import (
 )
 
 type AgentConfig struct {
-	ID           uuid.UUID      `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	DeletedAt    gorm.DeletedAt `gorm:"index" json:"deleted_at"`
-	UserID       uint           `gorm:"not null" json:"user_id"`
-	Name         string         `gorm:"type:text;not null" json:"name"`
-	Provider     string         `gorm:"type:text;not null" json:"provider"`
-	LLMModel     string         `gorm:"type:text;not null" json:"llm_model"`
-	SystemPrompt string         `gorm:"type:text" json:"system_prompt"`
-	MaxTokens    int            `gorm:"type:int" json:"max_tokens"`
-	Temperature  float64        `gorm:"type:float" json:"temperature"`
+	ID        uuid.UUID      `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at"`
+	UserID    uint           `gorm:"not null" json:"user_id"`
+	Name      string         `gorm:"type:text;not null" json:"name"`
+
+	AgentSettings
+
+	// Version is the number of the AgentVersion holding the current
+	// settings. It is 0 for agents created before versioning until their
+	// first version is recorded.
+	Version int `gorm:"not null;default:0" json:"version"`
+}
+
+// AgentSettings are the agent fields that are versioned. Every change to them
+// is recorded as a new AgentVersion.
+type AgentSettings struct {
+	Provider     string  `gorm:"type:text;not null" json:"provider"`
+	LLMModel     string  `gorm:"type:text;not null" json:"llm_model"`
+	SystemPrompt string  `gorm:"type:text" json:"system_prompt"`
+	MaxTokens    int     `gorm:"type:int" json:"max_tokens"`
+	Temperature  float64 `gorm:"type:float" json:"temperature"`
+
+	// ToolResultHistoryLimit caps, in characters, each tool result replayed
+	// from earlier turns. Zero replays results in full.
+	ToolResultHistoryLimit int `gorm:"type:int" json:"tool_result_history_limit"`
+
+	// Context management for long conversations. Zero values use the
+	// defaults: keep_system_and_recent, a budget derived from the model's
+	// context window, and a 20 message sliding window.
+	ContextStrategy       string `gorm:"type:text" json:"context_strategy"`
+	ContextBudget         int    `gorm:"type:int" json:"context_budget"`
+	ContextWindowMessages int    `gorm:"type:int" json:"context_window_messages"`
+
+	// PromptVariables are the variables the system prompt may use as
+	// {{name}}, supplied with each request.
+	PromptVariables []PromptVariable `gorm:"type:jsonb;serializer:json" json:"prompt_variables,omitempty"`
+
+	// ResponseSchema is a JSON Schema the agent's final answer must match.
+	// When set, the answer is validated and returned parsed as structured.
+	ResponseSchema map[string]any `gorm:"type:jsonb;serializer:json" json:"response_schema,omitempty"`
+
+	// Retrieval from the agent's knowledge bases. Zero values use the
+	// defaults: a search_knowledge tool returning 5 chunks per search.
+	KnowledgeMode string `gorm:"type:text" json:"knowledge_mode"`
+	KnowledgeTopK int    `gorm:"type:int" json:"knowledge_top_k"`
+
+	// Long-term memory across conversations. MemoryTokenBudget bounds the
+	// memories added to the system prompt; zero uses 500 tokens.
+	MemoryEnabled     bool `gorm:"default:false" json:"memory_enabled"`
+	MemoryTokenBudget int  `gorm:"type:int" json:"memory_token_budget"`
+}
+
+// PromptVariable is a variable declared by an agent for its system prompt.
+// A variable that is not required and not supplied takes its default.
+type PromptVariable struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Default     string `json:"default,omitempty" yaml:"default,omitempty"`
+	Required    bool   `json:"required,omitempty" yaml:"required,omitempty"`
+}
+
+// AgentVersion is an immutable snapshot of an agent's settings. Versions are
+// numbered from 1 per agent.
+type AgentVersion struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	AgentID   uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_agent_version" json:"agent_id"`
+	Version   int       `gorm:"not null;uniqueIndex:idx_agent_version" json:"version"`
+	Comment   string    `gorm:"type:text" json:"comment,omitempty"`
+
+	AgentSettings
+}
+
+// AgentSettingChange is one field that differs between two versions.
+type AgentSettingChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// DiffAgentSettings lists the fields that differ between from and to, named
+// by their JSON keys.
+func DiffAgentSettings(from, to AgentSettings) []AgentSettingChange {
+	changes := []AgentSettingChange{}
+	fromValue, toValue := reflect.ValueOf(from), reflect.ValueOf(to)
+	for i := 0; i < fromValue.NumField(); i++ {
+		a, b := fromValue.Field(i).Interface(), toValue.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		field := strings.Split(fromValue.Type().Field(i).Tag.Get("json"), ",")[0]
+		changes = append(changes, AgentSettingChange{Field: field, From: a, To: b})
+	}
+	return changes
 }
 
 type User struct {
@@ -40,6 +132,11 @@ type UserSettings struct {
 	AnthropicAPIKey string `gorm:"type:text" json:"-"` // Encrypted, never serialize
 	OpenAIAPIKey    string `gorm:"type:text" json:"-"` // Encrypted, never serialize
 	GeminiAPIKey    string `gorm:"type:text" json:"-"` // Encrypted, never serialize
+
+	// OpenAI-compatible endpoint (Ollama, vLLM, LM Studio) used by the custom provider
+	CustomBaseURL         string `gorm:"type:text" json:"-"`
+	CustomAuthHeaderName  string `gorm:"type:text" json:"-"`
+	CustomAuthHeaderValue string `gorm:"type:text" json:"-"` // Encrypted, never serialize
 }
 
 type AgentAPIKey struct {
@@ -49,6 +146,10 @@ type AgentAPIKey struct {
 	Name     string     `gorm:"type:text;not null" json:"name"`
 	LastUsed *time.Time `json:"last_used,omitempty"`
 	IsActive bool       `gorm:"default:true" json:"is_active"`
+
+	// PinnedVersion makes requests with this key use that agent version
+	// instead of the current one.
+	PinnedVersion *int `json:"pinned_version,omitempty"`
 }
 
 type RefreshToken struct {
@@ -82,6 +183,13 @@ type ChatSession struct {
 	AgentID   uuid.UUID      `gorm:"type:uuid;not null;index" json:"agent_id"`
 	UserID    uint           `gorm:"not null;index" json:"user_id"`
 	Title     string         `gorm:"type:text;not null" json:"title"`
+	APIKeyID  *uint          `gorm:"index" json:"-"`                               // set for sessions created through the invoke API
+	EndUserID string         `gorm:"type:text;index" json:"end_user_id,omitempty"` // caller's own user ID, invoke API only
+
+	// Summary of the first SummarizedMessages user and assistant messages,
+	// kept so that compaction does not re-summarize them every turn.
+	ContextSummary     string `gorm:"type:text" json:"-"`
+	SummarizedMessages int    `gorm:"type:int" json:"-"`
 
 	// Relationships
 	Agent    AgentConfig   `gorm:"foreignKey:AgentID;references:ID" json:"agent"`
@@ -89,29 +197,316 @@ type ChatSession struct {
 }
 
 type ChatMessage struct {
+	ID           uuid.UUID   `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt    time.Time   `json:"created_at"`
+	SessionID    uuid.UUID   `gorm:"type:uuid;not null;index" json:"session_id"`
+	Role         string      `gorm:"type:text;not null" json:"role"` // "user" or "assistant"
+	Content      string      `gorm:"type:text;not null" json:"content"`
+	Metadata     string      `gorm:"type:jsonb" json:"metadata,omitempty"`
+	Status       string      `gorm:"type:text;not null;default:'completed'" json:"status"`    // "completed", "cancelled" or "pending_approval"
+	ToolSteps    []ToolStep  `gorm:"type:jsonb;serializer:json" json:"tool_steps,omitempty"`  // assistant only
+	AgentVersion int         `gorm:"type:int" json:"agent_version,omitempty"`                 // assistant only
+	Attachments  []uuid.UUID `gorm:"type:jsonb;serializer:json" json:"attachments,omitempty"` // user only
+
+	// Relationships
+	Session ChatSession `gorm:"foreignKey:SessionID;references:ID" json:"session"`
+}
+
+// Attachment is a file uploaded for an agent to be sent with messages. Files
+// uploaded with an API key are only visible to that key.
+type Attachment struct {
+	ID          uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UserID      uint      `gorm:"not null;index" json:"-"`
+	AgentID     uuid.UUID `gorm:"type:uuid;not null;index" json:"agent_id"`
+	APIKeyID    *uint     `gorm:"index" json:"-"`
+	Filename    string    `gorm:"type:text;not null" json:"filename"`
+	ContentType string    `gorm:"type:text;not null" json:"content_type"`
+	Size        int64     `gorm:"not null" json:"size"`
+	StorageKey  string    `gorm:"type:text;not null" json:"-"`
+}
+
+// FileContent is an attachment loaded to be sent to the model.
+type FileContent struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// KnowledgeBase is a collection of documents that agents of the same user
+// can search. Its documents are embedded with one model, so that their
+// vectors can be compared.
+type KnowledgeBase struct {
+	ID          uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UserID      uint      `gorm:"not null;index" json:"-"`
+	Name        string    `gorm:"type:text;not null" json:"name"`
+	Description string    `gorm:"type:text" json:"description,omitempty"`
+
+	EmbeddingProvider string `gorm:"type:text;not null" json:"embedding_provider"`
+	EmbeddingModel    string `gorm:"type:text;not null" json:"embedding_model"`
+
+	// Relationships
+	Documents []KnowledgeDocument `gorm:"foreignKey:KnowledgeBaseID;references:ID" json:"documents,omitempty"`
+}
+
+// KnowledgeDocument is a file uploaded to a knowledge base. Documents are
+// chunked and embedded in the background: Status is "processing" until
+// that finishes, then "ready", or "failed" with Error set.
+type KnowledgeDocument struct {
+	ID              uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	KnowledgeBaseID uuid.UUID `gorm:"type:uuid;not null;index" json:"knowledge_base_id"`
+	Filename        string    `gorm:"type:text;not null" json:"filename"`
+	ContentType     string    `gorm:"type:text;not null" json:"content_type"`
+	Size            int64     `gorm:"not null" json:"size"`
+	Status          string    `gorm:"type:text;not null" json:"status"`
+	Error           string    `gorm:"type:text" json:"error,omitempty"`
+	ChunkCount      int       `gorm:"not null;default:0" json:"chunk_count"`
+}
+
+// KnowledgeChunk is a passage of a document with its embedding.
+type KnowledgeChunk struct {
+	ID              uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	KnowledgeBaseID uuid.UUID `gorm:"type:uuid;not null;index" json:"knowledge_base_id"`
+	DocumentID      uuid.UUID `gorm:"type:uuid;not null;index" json:"document_id"`
+	Position        int       `gorm:"not null" json:"position"`
+	Content         string    `gorm:"type:text;not null" json:"content"`
+	Embedding       Vector    `gorm:"type:vector;not null" json:"-"`
+}
+
+// Vector is an embedding stored in a pgvector column.
+type Vector []float32
+
+func (v Vector) Value() (driver.Value, error) {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, x := range v {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(x), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String(), nil
+}
+
+func (v *Vector) Scan(src any) error {
+	var text string
+	switch src := src.(type) {
+	case string:
+		text = src
+	case []byte:
+		text = string(src)
+	default:
+		return fmt.Errorf("cannot scan %T into Vector", src)
+	}
+
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "["), "]")
+	*v = nil
+	if text == "" {
+		return nil
+	}
+	for _, field := range strings.Split(text, ",") {
+		x, err := strconv.ParseFloat(strings.TrimSpace(field), 32)
+		if err != nil {
+			return fmt.Errorf("invalid vector element %q: %w", field, err)
+		}
+		*v = append(*v, float32(x))
+	}
+	return nil
+}
+
+// AgentKnowledgeBase gives an agent access to a knowledge base.
+type AgentKnowledgeBase struct {
+	ID              uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	AgentID         uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_agent_knowledge_base" json:"agent_id"`
+	KnowledgeBaseID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_agent_knowledge_base;index" json:"knowledge_base_id"`
+
+	// Relationships
+	KnowledgeBase KnowledgeBase `gorm:"foreignKey:KnowledgeBaseID;references:ID" json:"knowledge_base"`
+}
+
+// AgentMemory is a fact an agent remembers about the person it talks to,
+// kept across conversations. Memories are scoped like invoke API sessions:
+// those without an API key belong to the agent's owner in the dashboard,
+// those with an end user ID to that end user, and the rest to the API key.
+type AgentMemory struct {
 	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
 	CreatedAt time.Time `json:"created_at"`
-	SessionID uuid.UUID `gorm:"type:uuid;not null;index" json:"session_id"`
-	Role      string    `gorm:"type:text;not null" json:"role"` // "user" or "assistant"
+	UpdatedAt time.Time `json:"updated_at"`
+	AgentID   uuid.UUID `gorm:"type:uuid;not null;index" json:"agent_id"`
+	UserID    uint      `gorm:"not null;index" json:"-"`
+	APIKeyID  *uint     `gorm:"index" json:"-"`
+	EndUserID string    `gorm:"type:text;index" json:"end_user_id,omitempty"`
 	Content   string    `gorm:"type:text;not null" json:"content"`
-	Metadata  string    `gorm:"type:jsonb" json:"metadata,omitempty"`
+}
 
-	// Relationships
-	Session ChatSession `gorm:"foreignKey:SessionID;references:ID" json:"session"`
+// AgentSchedule runs an agent with a message on a cron schedule. Each run
+// can be stored as a chat session and posted to a webhook.
+type AgentSchedule struct {
+	ID             uuid.UUID         `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	AgentID        uuid.UUID         `gorm:"type:uuid;not null;index" json:"agent_id"`
+	UserID         uint              `gorm:"not null;index" json:"-"`
+	Name           string            `gorm:"type:text;not null" json:"name"`
+	CronExpression string            `gorm:"type:text;not null" json:"cron_expression"`
+	Timezone       string            `gorm:"type:text;not null" json:"timezone"`
+	Message        string            `gorm:"type:text;not null" json:"message"` // template rendered for each run
+	Variables      map[string]string `gorm:"type:jsonb;serializer:json" json:"variables,omitempty"`
+	StoreSession   bool              `gorm:"default:false" json:"store_session"`
+	WebhookURL     string            `gorm:"type:text" json:"webhook_url,omitempty"`
+	Enabled        bool              `gorm:"default:false" json:"enabled"`
+
+	// NextRunAt is when the schedule is next due, nil while disabled. The
+	// worker that claims a due run advances it in the same transaction.
+	NextRunAt  *time.Time `gorm:"index" json:"next_run_at"`
+	LastRunAt  *time.Time `json:"last_run_at,omitempty"`
+	LastStatus string     `gorm:"type:text" json:"last_status,omitempty"`
+}
+
+// ScheduleRun is one run of a schedule.
+type ScheduleRun struct {
+	ID           uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt    time.Time  `gorm:"index" json:"created_at"`
+	ScheduleID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"schedule_id"`
+	AgentID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"agent_id"`
+	ScheduledFor time.Time  `json:"scheduled_for"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	Status       string     `gorm:"type:text;not null" json:"status"` // "running", "succeeded", "failed"
+	Message      string     `gorm:"type:text" json:"message"`
+	Response     string     `gorm:"type:text" json:"response,omitempty"`
+	Error        string     `gorm:"type:text" json:"error,omitempty"`
+	SessionID    *uuid.UUID `gorm:"type:uuid" json:"session_id,omitempty"`
+	TotalTokens  int        `gorm:"type:int" json:"total_tokens"`
+
+	// WebhookStatus is the HTTP status the webhook answered with, zero if
+	// it was not called or could not be reached.
+	WebhookStatus int `gorm:"type:int" json:"webhook_status,omitempty"`
+}
+
+// AgentWebhook lets another system run an agent by posting to a public URL
+// signed with the webhook's secret. The request body is rendered into the
+// agent's message, and the result can be stored as a chat session and
+// posted to a result URL.
+type AgentWebhook struct {
+	ID              uuid.UUID         `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+	AgentID         uuid.UUID         `gorm:"type:uuid;not null;index" json:"agent_id"`
+	UserID          uint              `gorm:"not null;index" json:"-"`
+	Name            string            `gorm:"type:text;not null" json:"name"`
+	Secret          string            `gorm:"type:text;not null" json:"-"` // encrypted
+	MessageTemplate string            `gorm:"type:text" json:"message_template"`
+	Variables       map[string]string `gorm:"type:jsonb;serializer:json" json:"variables,omitempty"`
+	StoreSession    bool              `gorm:"default:false" json:"store_session"`
+	ResultURL       string            `gorm:"type:text" json:"result_url,omitempty"`
+	Enabled         bool              `gorm:"default:false" json:"enabled"`
+
+	LastTriggeredAt *time.Time `json:"last_triggered_at,omitempty"`
+	LastStatus      string     `gorm:"type:text" json:"last_status,omitempty"`
+}
+
+// WebhookRun is one run of an agent started by an inbound webhook.
+type WebhookRun struct {
+	ID          uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt   time.Time  `gorm:"index" json:"created_at"`
+	WebhookID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"webhook_id"`
+	AgentID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"agent_id"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Status      string     `gorm:"type:text;not null" json:"status"` // "running", "succeeded", "failed"
+	Message     string     `gorm:"type:text" json:"message"`
+	Response    string     `gorm:"type:text" json:"response,omitempty"`
+	Error       string     `gorm:"type:text" json:"error,omitempty"`
+	SessionID   *uuid.UUID `gorm:"type:uuid" json:"session_id,omitempty"`
+	TotalTokens int        `gorm:"type:int" json:"total_tokens"`
+
+	// ResultStatus is the HTTP status the result URL answered with, zero if
+	// it was not called or could not be reached.
+	ResultStatus int `gorm:"type:int" json:"result_status,omitempty"`
+}
+
+// WebhookReceipt records a request a webhook accepted, so that a replay of
+// it is refused. Receipts are kept until ExpiresAt: when a timestamped
+// signature expires, or 30 days after a GitHub request.
+type WebhookReceipt struct {
+	WebhookID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Key       string    `gorm:"type:text;primaryKey"`
+	RunID     uuid.UUID `gorm:"type:uuid;not null"`
+	CreatedAt time.Time
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+// EventWebhook posts the events of the user's account that it subscribes
+// to, signed with its secret, to a URL.
+type EventWebhook struct {
+	ID          uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UserID      uint      `gorm:"not null;index" json:"-"`
+	URL         string    `gorm:"type:text;not null" json:"url"`
+	Description string    `gorm:"type:text" json:"description,omitempty"`
+	Events      []string  `gorm:"type:jsonb;serializer:json" json:"events"`
+	Secret      string    `gorm:"type:text;not null" json:"-"` // encrypted
+	Enabled     bool      `gorm:"default:false" json:"enabled"`
+
+	// UsageThreshold is the number of tokens used in a calendar month that
+	// sends a usage.threshold_crossed event, and UsageThresholdCrossedAt
+	// when it was last sent, so that it is sent once a month.
+	UsageThreshold          int        `gorm:"type:int" json:"usage_threshold,omitempty"`
+	UsageThresholdCrossedAt *time.Time `json:"usage_threshold_crossed_at,omitempty"`
+}
+
+// EventDelivery is an event queued for an event webhook. Failed attempts are
+// retried with exponential backoff until the event is delivered or the
+// attempts run out. Redelivering an event queues a new delivery of it.
+type EventDelivery struct {
+	ID             uuid.UUID       `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt      time.Time       `gorm:"index" json:"created_at"`
+	WebhookID      uuid.UUID       `gorm:"type:uuid;not null;index" json:"webhook_id"`
+	UserID         uint            `gorm:"not null;index" json:"-"`
+	EventID        uuid.UUID       `gorm:"type:uuid;not null;index" json:"event_id"`
+	EventType      string          `gorm:"type:text;not null" json:"event_type"`
+	Payload        json.RawMessage `gorm:"type:jsonb;not null" json:"payload"`
+	Status         string          `gorm:"type:text;not null;index" json:"status"` // "pending", "succeeded", "failed"
+	Attempts       int             `gorm:"type:int;not null;default:0" json:"attempts"`
+	NextAttemptAt  *time.Time      `gorm:"index" json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at,omitempty"`
+	ResponseStatus int             `gorm:"type:int" json:"response_status,omitempty"`
+	Error          string          `gorm:"type:text" json:"error,omitempty"`
 }
 
 // Chat API Types
 type ChatContextMessage struct {
-	ID        string `json:"id"`
-	Role      string `json:"role"`
-	Content   string `json:"content"`
-	CreatedAt string `json:"created_at"`
+	ID        string     `json:"id"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	CreatedAt string     `json:"created_at"`
+	ToolSteps []ToolStep `json:"-"` // loaded from the session, never from clients
+
+	Attachments []uuid.UUID   `json:"attachments,omitempty"`
+	Files       []FileContent `json:"-"` // the attachments' content, loaded by the server
 }
 
 type ChatStreamRequest struct {
 	Message   string               `json:"message"`
 	SessionID *uuid.UUID           `json:"session_id,omitempty"`
 	Context   []ChatContextMessage `json:"context,omitempty"`
+
+	// ContextSummary summarizes the conversation before Context. It is set
+	// by context compaction, never by callers.
+	ContextSummary string `json:"-"`
+
+	// Variables are the values of the agent's prompt variables.
+	Variables map[string]string `json:"variables,omitempty"`
+
+	// Attachments are uploaded files sent with the message.
+	Attachments []uuid.UUID   `json:"attachments,omitempty"`
+	Files       []FileContent `json:"-"` // the attachments' content, loaded by the server
 }
 
 type ChatStreamEvent struct {
@@ -124,6 +519,7 @@ type ChatSessionResponse struct {
 	ID        uuid.UUID     `json:"id"`
 	Title     string        `json:"title"`
 	AgentID   uuid.UUID     `json:"agent_id"`
+	EndUserID string        `json:"end_user_id,omitempty"`
 	CreatedAt time.Time     `json:"created_at"`
 	UpdatedAt time.Time     `json:"updated_at"`
 	Messages  []ChatMessage `json:"messages,omitempty"`
@@ -138,7 +534,9 @@ type MCPServer struct {
 	Name        string            `gorm:"type:text;not null" json:"name"`
 	Description string            `gorm:"type:text" json:"description"`
 	ServerURL   string            `gorm:"type:text;not null" json:"server_url"`
-	ServerType  string            `gorm:"type:text;not null" json:"server_type"` // "sse", "http"
+	ServerType  string            `gorm:"type:text;not null" json:"server_type"` // "sse", "http", "stdio"
+	Command     string            `gorm:"type:text" json:"command,omitempty"`    // stdio only
+	Args        []string          `gorm:"type:jsonb;serializer:json" json:"args,omitempty"`
 	Env         map[string]string `gorm:"type:jsonb;serializer:json" json:"env,omitempty"`
 	Timeout     int               `gorm:"type:int;default:30" json:"timeout"`
 	Headers     map[string]string `gorm:"type:jsonb;serializer:json" json:"headers,omitempty"`
@@ -154,6 +552,21 @@ type MCPServer struct {
 	AgentMCPServers []AgentMCPServer `gorm:"foreignKey:MCPServerID;references:ID" json:"agent_mcp_servers,omitempty"`
 }
 
+// AgentDelegate lets an agent call another agent of the same user as a tool.
+type AgentDelegate struct {
+	ID         uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	AgentID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_agent_delegate" json:"agent_id"`
+	DelegateID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_agent_delegate;index" json:"delegate_id"`
+
+	// Description tells the parent agent when to delegate. When empty, a
+	// description is made from the delegate's name.
+	Description string `gorm:"type:text" json:"description,omitempty"`
+
+	// Relationships
+	Delegate AgentConfig `gorm:"foreignKey:DelegateID;references:ID" json:"delegate"`
+}
+
 type AgentMCPServer struct {
 	ID          uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
 	AgentID     uuid.UUID `gorm:"type:uuid;not null;index" json:"agent_id"`
@@ -161,11 +574,60 @@ type AgentMCPServer struct {
 	Enabled     bool      `gorm:"default:true" json:"enabled"`
 	CreatedAt   time.Time `json:"created_at"`
 
+	// Tool selection by MCP tool name, glob patterns allowed. An empty
+	// allowlist allows every tool; the denylist always wins.
+	AllowedTools []string `gorm:"type:jsonb;serializer:json" json:"allowed_tools,omitempty"`
+	DeniedTools  []string `gorm:"type:jsonb;serializer:json" json:"denied_tools,omitempty"`
+
+	// Tools that wait for a human decision before each call, glob patterns
+	// allowed.
+	ApprovalRequiredTools []string `gorm:"type:jsonb;serializer:json" json:"approval_required_tools,omitempty"`
+
 	// Relationships
 	Agent     AgentConfig `gorm:"foreignKey:AgentID;references:ID" json:"agent"`
 	MCPServer MCPServer   `gorm:"foreignKey:MCPServerID;references:ID" json:"mcp_server"`
 }
 
+// AllowsTool reports whether the agent may use the named MCP tool. A
+// malformed pattern allows nothing and denies everything.
+func (a *AgentMCPServer) AllowsTool(name string) bool {
+	if len(a.AllowedTools) > 0 && !matchesToolPattern(a.AllowedTools, name, false) {
+		return false
+	}
+	return !matchesToolPattern(a.DeniedTools, name, true)
+}
+
+// RequiresApproval reports whether calls to the named MCP tool must be
+// approved first. A malformed pattern requires approval for every tool.
+func (a *AgentMCPServer) RequiresApproval(name string) bool {
+	return matchesToolPattern(a.ApprovalRequiredTools, name, true)
+}
+
+// ValidateToolPatterns checks that every pattern of the tool lists is a
+// non-empty path.Match pattern.
+func ValidateToolPatterns(lists ...[]string) error {
+	for _, patterns := range lists {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("invalid tool pattern: %s", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesToolPattern reports whether name matches one of patterns. A
+// malformed pattern matches when malformedMatches is set.
+func matchesToolPattern(patterns []string, name string, malformedMatches bool) bool {
+	for _, pattern := range patterns {
+		ok, err := path.Match(pattern, name)
+		if ok || (err != nil && malformedMatches) {
+			return true
+		}
+	}
+	return false
+}
+
 // API Response Types
 type MCPServerResponse struct {
 	ID               uuid.UUID         `json:"id"`
@@ -173,6 +635,8 @@ type MCPServerResponse struct {
 	Description      string            `json:"description"`
 	ServerURL        string            `json:"server_url"`
 	ServerType       string            `json:"server_type"`
+	Command          string            `json:"command,omitempty"`
+	Args             []string          `json:"args,omitempty"`
 	Env              map[string]string `json:"env,omitempty"`
 	Timeout          int               `json:"timeout"`
 	Headers          map[string]string `json:"headers,omitempty"`
@@ -191,6 +655,8 @@ type MCPServerDetailResponse struct {
 	Description      string            `json:"description"`
 	ServerURL        string            `json:"server_url"`
 	ServerType       string            `json:"server_type"`
+	Command          string            `json:"command,omitempty"`
+	Args             []string          `json:"args,omitempty"`
 	Env              map[string]string `json:"env,omitempty"`
 	Timeout          int               `json:"timeout"`
 	Headers          map[string]string `json:"headers,omitempty"`
@@ -210,21 +676,43 @@ type AgentMCPServerResponse struct {
 
 // Detailed response for agent MCP servers (includes full server details)
 type AgentMCPServerDetailResponse struct {
-	ServerID         uuid.UUID         `json:"server_id"`
-	ServerName       string            `json:"server_name"`
-	Description      string            `json:"description"`
-	ServerURL        string            `json:"server_url"`
-	ServerType       string            `json:"server_type"`
-	Env              map[string]string `json:"env,omitempty"`
-	Timeout          int               `json:"timeout"`
-	Headers          map[string]string `json:"headers,omitempty"`
-	MaxRetries       int               `json:"max_retries"`
-	Enabled          bool              `json:"enabled"`
-	LastSeen         *time.Time        `json:"last_seen,omitempty"`
-	CreatedAt        time.Time         `json:"created_at"`
-	UpdatedAt        time.Time         `json:"updated_at"`
-	EncryptedURL     bool              `json:"encrypted_url,omitempty"`
-	SensitiveHeaders []string          `json:"sensitive_headers,omitempty"`
+	ServerID              uuid.UUID         `json:"server_id"`
+	ServerName            string            `json:"server_name"`
+	Description           string            `json:"description"`
+	ServerURL             string            `json:"server_url"`
+	ServerType            string            `json:"server_type"`
+	Command               string            `json:"command,omitempty"`
+	Args                  []string          `json:"args,omitempty"`
+	Env                   map[string]string `json:"env,omitempty"`
+	Timeout               int               `json:"timeout"`
+	Headers               map[string]string `json:"headers,omitempty"`
+	MaxRetries            int               `json:"max_retries"`
+	Enabled               bool              `json:"enabled"`
+	AllowedTools          []string          `json:"allowed_tools,omitempty"`
+	DeniedTools           []string          `json:"denied_tools,omitempty"`
+	ApprovalRequiredTools []string          `json:"approval_required_tools,omitempty"`
+	LastSeen              *time.Time        `json:"last_seen,omitempty"`
+	CreatedAt             time.Time         `json:"created_at"`
+	UpdatedAt             time.Time         `json:"updated_at"`
+	EncryptedURL          bool              `json:"encrypted_url,omitempty"`
+	SensitiveHeaders      []string          `json:"sensitive_headers,omitempty"`
+}
+
+// Tool selection for an agent's MCP server, with every tool the server
+// currently publishes and whether the agent can use it
+type AgentMCPToolsResponse struct {
+	ServerID              uuid.UUID           `json:"server_id"`
+	AllowedTools          []string            `json:"allowed_tools"`
+	DeniedTools           []string            `json:"denied_tools"`
+	ApprovalRequiredTools []string            `json:"approval_required_tools"`
+	Tools                 []AgentMCPToolState `json:"tools"`
+	Error                 string              `json:"error,omitempty"`
+}
+
+type AgentMCPToolState struct {
+	Name             string `json:"name"`
+	Enabled          bool   `json:"enabled"`
+	RequiresApproval bool   `json:"requires_approval"`
 }
 
 // Usage tracking types
@@ -237,6 +725,8 @@ type UsageMetric struct {
 	MessageID        *uuid.UUID `gorm:"type:uuid;index" json:"message_id,omitempty"`
 	Provider         string     `gorm:"type:text;not null" json:"provider"`
 	Model            string     `gorm:"type:text;not null" json:"model"`
+	AgentVersion     int        `gorm:"type:int" json:"agent_version,omitempty"`
+	ParentAgentID    *uuid.UUID `gorm:"type:uuid;index" json:"parent_agent_id,omitempty"` // set when the agent ran as a delegate
 	PromptTokens     int        `gorm:"not null" json:"prompt_tokens"`
 	CompletionTokens int        `gorm:"not null" json:"completion_tokens"`
 	TotalTokens      int        `gorm:"not null" json:"total_tokens"`
@@ -251,11 +741,64 @@ type UsageMetric struct {
 
 // Tool calling related types
 type ToolCallEvent struct {
-	Type      string         `json:"type"` // "tool_start", "tool_result", "tool_error", "tool_batch_complete"
-	CallID    string         `json:"call_id,omitempty"`
-	ToolName  string         `json:"tool_name,omitempty"`
-	Arguments map[string]any `json:"arguments,omitempty"`
-	Result    string         `json:"result,omitempty"`
-	Error     string         `json:"error,omitempty"`
-	Duration  int64          `json:"duration_ms,omitempty"`
+	Type       string         `json:"type"` // "tool_start", "tool_result", "tool_error", "tool_approval_required", "tool_rejected", "tool_batch_complete"
+	CallID     string         `json:"call_id,omitempty"`
+	ToolName   string         `json:"tool_name,omitempty"`
+	Arguments  map[string]any `json:"arguments,omitempty"`
+	Result     string         `json:"result,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Duration   int64          `json:"duration_ms,omitempty"`
+	ApprovalID string         `json:"approval_id,omitempty"`
+	ExpiresAt  *time.Time     `json:"expires_at,omitempty"`
+	Step       *ToolStep      `json:"step,omitempty"` // tool_batch_complete only
+
+	// Set on events of a delegated agent's tools: the call of the parent
+	// agent that delegated to it, and the delegated agent.
+	ParentCallID string `json:"parent_call_id,omitempty"`
+	AgentID      string `json:"agent_id,omitempty"`
+}
+
+// ToolStep is one round of tool use within an assistant reply: the text the
+// model wrote before calling the tools, and each call with its result. Steps
+// are stored with the reply so later turns can replay them to the model.
+type ToolStep struct {
+	Content string           `json:"content,omitempty"`
+	Calls   []ToolCallRecord `json:"calls"`
+}
+
+type ToolCallRecord struct {
+	CallID    string `json:"call_id"`
+	ToolName  string `json:"tool_name"`
+	Arguments string `json:"arguments"` // JSON object the tool was called with
+	Result    string `json:"result"`    // what the model was given, including errors and rejections
+}
+
+// AgentRun is a non-streaming invocation paused until the caller decides on
+// tool calls that require approval.
+type AgentRun struct {
+	ID               uuid.UUID         `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	CreatedAt        time.Time         `json:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at"`
+	UserID           uint              `gorm:"not null;index" json:"user_id"`
+	AgentID          uuid.UUID         `gorm:"type:uuid;not null;index" json:"agent_id"`
+	SessionID        *uuid.UUID        `gorm:"type:uuid;index" json:"session_id,omitempty"`
+	APIKeyID         *uint             `gorm:"index" json:"-"`                   // memory scope of invoke API runs
+	EndUserID        string            `gorm:"type:text" json:"-"`               // memory scope of invoke API runs
+	Status           string            `gorm:"type:text;not null" json:"status"` // "pending_approval", "running", "completed", "failed"
+	State            []byte            `gorm:"type:jsonb" json:"-"`              // serialized conversation, owned by the LLM service
+	PendingToolCalls []PendingToolCall `gorm:"type:jsonb;serializer:json" json:"pending_tool_calls"`
+	Response         string            `gorm:"type:text" json:"response"`
+	ExpiresAt        time.Time         `json:"expires_at"`
+
+	// AgentVersion is the version of the agent's settings the run started
+	// with. The run is resumed with that version even if the agent has been
+	// changed since.
+	AgentVersion int `gorm:"type:int" json:"agent_version"`
+}
+
+type PendingToolCall struct {
+	CallID           string         `json:"call_id"`
+	ToolName         string         `json:"tool_name"`
+	Arguments        map[string]any `json:"arguments,omitempty"`
+	RequiresApproval bool           `json:"requires_approval"`
 }
@@ -0,0 +1,56 @@
+package shared
+
+import "testing"
+
+func TestAgentMCPServerToolPatterns(t *testing.T) {
+	assoc := &AgentMCPServer{
+		AllowedTools:          []string{"read_*", "delete_*"},
+		DeniedTools:           []string{"delete_*["},
+		ApprovalRequiredTools: []string{"write_*["},
+	}
+	for _, name := range []string{"read_file", "delete_file"} {
+		if assoc.AllowsTool(name) {
+			t.Errorf("AllowsTool(%q) = true with a malformed deny pattern", name)
+		}
+		if !assoc.RequiresApproval(name) {
+			t.Errorf("RequiresApproval(%q) = false with a malformed approval pattern", name)
+		}
+	}
+
+	assoc = &AgentMCPServer{AllowedTools: []string{"read_*["}}
+	if assoc.AllowsTool("read_file") {
+		t.Error("AllowsTool(\"read_file\") = true with a malformed allow pattern")
+	}
+
+	assoc = &AgentMCPServer{AllowedTools: []string{"read_*"}, DeniedTools: []string{"read_secret"}, ApprovalRequiredTools: []string{"read_s*"}}
+	tests := []struct {
+		name         string
+		allowed      bool
+		needApproval bool
+	}{
+		{"read_file", true, false},
+		{"read_secret", false, true},
+		{"read_summary", true, true},
+		{"write_file", false, false},
+	}
+	for _, tt := range tests {
+		if got := assoc.AllowsTool(tt.name); got != tt.allowed {
+			t.Errorf("AllowsTool(%q) = %v, want %v", tt.name, got, tt.allowed)
+		}
+		if got := assoc.RequiresApproval(tt.name); got != tt.needApproval {
+			t.Errorf("RequiresApproval(%q) = %v, want %v", tt.name, got, tt.needApproval)
+		}
+	}
+}
+
+func TestValidateToolPatterns(t *testing.T) {
+	if err := ValidateToolPatterns([]string{"read_*"}, nil, []string{"write_?"}); err != nil {
+		t.Errorf("ValidateToolPatterns() error = %v", err)
+	}
+	if err := ValidateToolPatterns(nil, []string{"delete_*["}); err == nil {
+		t.Error("ValidateToolPatterns() accepted a malformed pattern")
+	}
+	if err := ValidateToolPatterns([]string{""}); err == nil {
+		t.Error("ValidateToolPatterns() accepted an empty pattern")
+	}
+}
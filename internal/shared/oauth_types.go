@@ -95,4 +95,4 @@ type AuthProviderInfo struct {
 
 type AuthProvidersResponse struct {
 	Providers []AuthProviderInfo `json:"providers"`
-}
\ No newline at end of file
+}
@@ -4,17 +4,61 @@ type TierLimits struct {
 	AgentLimit     int
 	MCPServerLimit int
 	APIKeyLimit    int
+
+	// AttachmentMaxBytes caps the size of each uploaded attachment, and
+	// AttachmentTypes lists the content types that may be uploaded.
+	AttachmentMaxBytes int64
+	AttachmentTypes    []string
+
+	// KnowledgeBaseLimit caps the user's knowledge bases, and
+	// KnowledgeDocumentMaxBytes the size of each document uploaded to one.
+	KnowledgeBaseLimit        int
+	KnowledgeDocumentMaxBytes int64
+
+	// ScheduleLimit caps the user's scheduled runs across all agents.
+	ScheduleLimit int
+
+	// WebhookLimit caps the user's inbound webhooks across all agents, and
+	// EventWebhookLimit the URLs subscribed to the user's events.
+	WebhookLimit      int
+	EventWebhookLimit int
 }
 
+// ImageAttachmentTypes are the image formats accepted as attachments.
+var ImageAttachmentTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// PDFAttachmentType is the content type of PDF attachments.
+const PDFAttachmentType = "application/pdf"
+
 var TierConfigs = map[string]TierLimits{
 	"free": {
-		AgentLimit:     3,
-		MCPServerLimit: 9,
-		APIKeyLimit:    3,
+		AgentLimit:         3,
+		MCPServerLimit:     9,
+		APIKeyLimit:        3,
+		AttachmentMaxBytes: 5 << 20,
+		AttachmentTypes:    ImageAttachmentTypes,
+
+		KnowledgeBaseLimit:        1,
+		KnowledgeDocumentMaxBytes: 5 << 20,
+
+		ScheduleLimit: 2,
+		WebhookLimit:  2,
+
+		EventWebhookLimit: 2,
 	},
 	"pro": {
-		AgentLimit:     20,
-		MCPServerLimit: 100, // Effectively unlimited
-		APIKeyLimit:    50,  // Effectively unlimited
+		AgentLimit:         20,
+		MCPServerLimit:     100, // Effectively unlimited
+		APIKeyLimit:        50,  // Effectively unlimited
+		AttachmentMaxBytes: 20 << 20,
+		AttachmentTypes:    append([]string{PDFAttachmentType}, ImageAttachmentTypes...),
+
+		KnowledgeBaseLimit:        20,
+		KnowledgeDocumentMaxBytes: 25 << 20,
+
+		ScheduleLimit: 50,
+		WebhookLimit:  50,
+
+		EventWebhookLimit: 20,
 	},
 }
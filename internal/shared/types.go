@@ -1,5 +1,14 @@
 package shared
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
 type LLM interface {
 	IsValid() bool
 }
@@ -46,14 +55,131 @@ func (om OpenAIModel) IsValid() bool {
 	return false
 }
 
+type GoogleModel string
+
+const (
+	Gemini25Pro       GoogleModel = "gemini-2.5-pro"
+	Gemini25Flash     GoogleModel = "gemini-2.5-flash"
+	Gemini25FlashLite GoogleModel = "gemini-2.5-flash-lite"
+	Gemini20Flash     GoogleModel = "gemini-2.0-flash"
+	Gemini20FlashLite GoogleModel = "gemini-2.0-flash-lite"
+)
+
+func (gm GoogleModel) IsValid() bool {
+	switch gm {
+	case Gemini25Pro, Gemini25Flash, Gemini25FlashLite, Gemini20Flash, Gemini20FlashLite:
+		return true
+	}
+	return false
+}
+
 type InferenceProvider string
 
 const (
 	Anthropic InferenceProvider = "anthropic"
 	OpenAI    InferenceProvider = "openai"
 	Google    InferenceProvider = "google"
+	Custom    InferenceProvider = "custom" // OpenAI-compatible endpoint configured in user settings
+)
+
+// DefaultContextWindow is assumed for models whose context window is not
+// known, such as those behind custom endpoints.
+const DefaultContextWindow = 8192
+
+// modelContextWindows lists the context window, in tokens, of each built-in
+// model.
+var modelContextWindows = map[string]int{
+	string(Claude35Sonnet):    200000,
+	string(Claude35Haiku):     200000,
+	string(Claude37Sonnet):    200000,
+	string(Claude4Sonnet):     200000,
+	string(Claude4Opus):       200000,
+	string(O4Mini):            200000,
+	string(O3):                200000,
+	string(O3Mini):            200000,
+	string(O3Pro):             200000,
+	string(O1):                200000,
+	string(O1Mini):            128000,
+	string(GPT41):             1047576,
+	string(GPT4o):             128000,
+	string(GPT4oMini):         128000,
+	string(GPT41Nano):         1047576,
+	string(GPT5):              400000,
+	string(Gemini25Pro):       1048576,
+	string(Gemini25Flash):     1048576,
+	string(Gemini25FlashLite): 1048576,
+	string(Gemini20Flash):     1048576,
+	string(Gemini20FlashLite): 1048576,
+}
+
+// ModelContextWindow returns the context window of a model in tokens.
+func ModelContextWindow(model string) int {
+	if window, ok := modelContextWindows[model]; ok {
+		return window
+	}
+	return DefaultContextWindow
+}
+
+// ContextStrategy decides what part of a long conversation is sent to the
+// model once the history no longer fits the agent's context budget.
+type ContextStrategy string
+
+const (
+	// ContextKeepSystemAndRecent sends the system prompt and as many of the
+	// most recent messages as fit. It is the default.
+	ContextKeepSystemAndRecent ContextStrategy = "keep_system_and_recent"
+	// ContextSlidingWindow sends at most the last ContextWindowMessages
+	// messages, fewer if they do not fit.
+	ContextSlidingWindow ContextStrategy = "sliding_window"
+	// ContextSummarize replaces the messages that do not fit with a summary
+	// written by a small model.
+	ContextSummarize ContextStrategy = "summarize"
+)
+
+func (s ContextStrategy) IsValid() bool {
+	switch s {
+	case "", ContextKeepSystemAndRecent, ContextSlidingWindow, ContextSummarize:
+		return true
+	}
+	return false
+}
+
+// KnowledgeMode decides how an agent uses its knowledge bases.
+type KnowledgeMode string
+
+const (
+	// KnowledgeTool gives the agent a search_knowledge tool to search its
+	// knowledge bases when it needs to. It is the default.
+	KnowledgeTool KnowledgeMode = "tool"
+	// KnowledgeInject searches the knowledge bases for each message and adds
+	// the closest chunks to the system prompt.
+	KnowledgeInject KnowledgeMode = "inject"
 )
 
+func (m KnowledgeMode) IsValid() bool {
+	switch m {
+	case "", KnowledgeTool, KnowledgeInject:
+		return true
+	}
+	return false
+}
+
+// MaxKnowledgeTopK bounds the chunks retrieved per knowledge search.
+const MaxKnowledgeTopK = 20
+
+// MaxMemoryTokenBudget bounds the tokens of memories added to an agent's
+// system prompt.
+const MaxMemoryTokenBudget = 4000
+
+// ProviderCredentials carries what LLMService needs to reach an agent's
+// provider. BaseURL and the auth header are only used by the custom provider.
+type ProviderCredentials struct {
+	APIKey          string
+	BaseURL         string
+	AuthHeaderName  string
+	AuthHeaderValue string
+}
+
 type CreateAgentRequest struct {
 	Name         string            `json:"name"`
 	Provider     InferenceProvider `json:"provider"`
@@ -61,6 +187,22 @@ type CreateAgentRequest struct {
 	SystemPrompt *string           `json:"system_prompt,omitempty"`
 	MaxTokens    int               `json:"max_tokens"`
 	Temperature  float64           `json:"temperature"`
+
+	ToolResultHistoryLimit int `json:"tool_result_history_limit,omitempty"`
+
+	ContextStrategy       ContextStrategy `json:"context_strategy,omitempty"`
+	ContextBudget         int             `json:"context_budget,omitempty"`
+	ContextWindowMessages int             `json:"context_window_messages,omitempty"`
+
+	PromptVariables []PromptVariable `json:"prompt_variables,omitempty"`
+
+	ResponseSchema map[string]any `json:"response_schema,omitempty"`
+
+	KnowledgeMode KnowledgeMode `json:"knowledge_mode,omitempty"`
+	KnowledgeTopK int           `json:"knowledge_top_k,omitempty"`
+
+	MemoryEnabled     bool `json:"memory_enabled,omitempty"`
+	MemoryTokenBudget int  `json:"memory_token_budget,omitempty"`
 }
 
 func (r *CreateAgentRequest) IsValidModel() bool {
@@ -70,7 +212,9 @@ func (r *CreateAgentRequest) IsValidModel() bool {
 	case OpenAI:
 		return OpenAIModel(r.Model).IsValid()
 	case Google:
-		return false
+		return GoogleModel(r.Model).IsValid()
+	case Custom:
+		return strings.TrimSpace(r.Model) != ""
 	default:
 		return false
 	}
@@ -83,6 +227,23 @@ type UpdateAgentRequest struct {
 	SystemPrompt *string            `json:"system_prompt,omitempty"`
 	MaxTokens    *int               `json:"max_tokens,omitempty"`
 	Temperature  *float64           `json:"temperature,omitempty"`
+
+	ToolResultHistoryLimit *int `json:"tool_result_history_limit,omitempty"`
+
+	ContextStrategy       *ContextStrategy `json:"context_strategy,omitempty"`
+	ContextBudget         *int             `json:"context_budget,omitempty"`
+	ContextWindowMessages *int             `json:"context_window_messages,omitempty"`
+
+	PromptVariables *[]PromptVariable `json:"prompt_variables,omitempty"`
+
+	// ResponseSchema replaces the agent's response schema. null removes it.
+	ResponseSchema json.RawMessage `json:"response_schema,omitempty"`
+
+	KnowledgeMode *KnowledgeMode `json:"knowledge_mode,omitempty"`
+	KnowledgeTopK *int           `json:"knowledge_top_k,omitempty"`
+
+	MemoryEnabled     *bool `json:"memory_enabled,omitempty"`
+	MemoryTokenBudget *int  `json:"memory_token_budget,omitempty"`
 }
 
 func (r *UpdateAgentRequest) IsValidModel() bool {
@@ -93,7 +254,9 @@ func (r *UpdateAgentRequest) IsValidModel() bool {
 		case OpenAI:
 			return OpenAIModel(*r.Model).IsValid()
 		case Google:
-			return false
+			return GoogleModel(*r.Model).IsValid()
+		case Custom:
+			return strings.TrimSpace(*r.Model) != ""
 		default:
 			return false
 		}
@@ -101,6 +264,300 @@ func (r *UpdateAgentRequest) IsValidModel() bool {
 	return true
 }
 
+// AddAgentDelegateRequest lets an agent delegate to another agent, with an
+// optional description telling the agent when to use it.
+type AddAgentDelegateRequest struct {
+	DelegateID  uuid.UUID `json:"delegate_id"`
+	Description string    `json:"description,omitempty"`
+}
+
+// CreateKnowledgeBaseRequest creates a knowledge base. The embedding
+// provider defaults to OpenAI, and the model to the provider's default.
+type CreateKnowledgeBaseRequest struct {
+	Name              string            `json:"name"`
+	Description       string            `json:"description,omitempty"`
+	EmbeddingProvider InferenceProvider `json:"embedding_provider,omitempty"`
+	EmbeddingModel    string            `json:"embedding_model,omitempty"`
+}
+
+// CreateScheduleRequest creates a scheduled run of an agent. StoreSession and
+// Enabled default to true.
+type CreateScheduleRequest struct {
+	Name           string            `json:"name"`
+	CronExpression string            `json:"cron_expression"`
+	Timezone       string            `json:"timezone"`
+	Message        string            `json:"message"`
+	Variables      map[string]string `json:"variables,omitempty"`
+	StoreSession   *bool             `json:"store_session,omitempty"`
+	WebhookURL     string            `json:"webhook_url,omitempty"`
+	Enabled        *bool             `json:"enabled,omitempty"`
+}
+
+// UpdateScheduleRequest changes the fields of a schedule that are set.
+type UpdateScheduleRequest struct {
+	Name           *string            `json:"name,omitempty"`
+	CronExpression *string            `json:"cron_expression,omitempty"`
+	Timezone       *string            `json:"timezone,omitempty"`
+	Message        *string            `json:"message,omitempty"`
+	Variables      *map[string]string `json:"variables,omitempty"`
+	StoreSession   *bool              `json:"store_session,omitempty"`
+	WebhookURL     *string            `json:"webhook_url,omitempty"`
+	Enabled        *bool              `json:"enabled,omitempty"`
+}
+
+// ScheduleWebhookPayload is posted to a schedule's webhook after each run.
+type ScheduleWebhookPayload struct {
+	ScheduleID   uuid.UUID  `json:"schedule_id"`
+	ScheduleName string     `json:"schedule_name"`
+	RunID        uuid.UUID  `json:"run_id"`
+	AgentID      uuid.UUID  `json:"agent_id"`
+	Status       string     `json:"status"`
+	ScheduledFor time.Time  `json:"scheduled_for"`
+	Message      string     `json:"message"`
+	Response     string     `json:"response,omitempty"`
+	Structured   any        `json:"structured,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	SessionID    *uuid.UUID `json:"session_id,omitempty"`
+	Usage        *Usage     `json:"usage,omitempty"`
+}
+
+// CreateWebhookRequest creates an inbound webhook of an agent. Without a
+// secret one is generated. StoreSession and Enabled default to true.
+type CreateWebhookRequest struct {
+	Name            string            `json:"name"`
+	Secret          string            `json:"secret,omitempty"`
+	MessageTemplate string            `json:"message_template"`
+	Variables       map[string]string `json:"variables,omitempty"`
+	StoreSession    *bool             `json:"store_session,omitempty"`
+	ResultURL       string            `json:"result_url,omitempty"`
+	Enabled         *bool             `json:"enabled,omitempty"`
+}
+
+// UpdateWebhookRequest changes the fields of a webhook that are set. The
+// secret is changed with RotateWebhookSecretRequest.
+type UpdateWebhookRequest struct {
+	Name            *string            `json:"name,omitempty"`
+	MessageTemplate *string            `json:"message_template,omitempty"`
+	Variables       *map[string]string `json:"variables,omitempty"`
+	StoreSession    *bool              `json:"store_session,omitempty"`
+	ResultURL       *string            `json:"result_url,omitempty"`
+	Enabled         *bool              `json:"enabled,omitempty"`
+}
+
+// RotateWebhookSecretRequest replaces a webhook's secret with the given one,
+// or a generated one.
+type RotateWebhookSecretRequest struct {
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookResultPayload is posted to a webhook's result URL after each run.
+type WebhookResultPayload struct {
+	WebhookID   uuid.UUID  `json:"webhook_id"`
+	WebhookName string     `json:"webhook_name"`
+	RunID       uuid.UUID  `json:"run_id"`
+	AgentID     uuid.UUID  `json:"agent_id"`
+	Status      string     `json:"status"`
+	Message     string     `json:"message"`
+	Response    string     `json:"response,omitempty"`
+	Structured  any        `json:"structured,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	SessionID   *uuid.UUID `json:"session_id,omitempty"`
+	Usage       *Usage     `json:"usage,omitempty"`
+}
+
+// Event types sent to event webhooks.
+const (
+	EventRunCompleted          = "run.completed"
+	EventRunFailed             = "run.failed"
+	EventToolError             = "tool.error"
+	EventAPIKeyRevoked         = "api_key.revoked"
+	EventUsageThresholdCrossed = "usage.threshold_crossed"
+)
+
+// EventTypes lists the events an event webhook can subscribe to.
+var EventTypes = []string{
+	EventRunCompleted,
+	EventRunFailed,
+	EventToolError,
+	EventAPIKeyRevoked,
+	EventUsageThresholdCrossed,
+}
+
+// CreateEventWebhookRequest subscribes a URL to events. Without a secret one
+// is generated. Enabled defaults to true.
+type CreateEventWebhookRequest struct {
+	URL            string   `json:"url"`
+	Description    string   `json:"description,omitempty"`
+	Events         []string `json:"events"`
+	Secret         string   `json:"secret,omitempty"`
+	UsageThreshold int      `json:"usage_threshold,omitempty"`
+	Enabled        *bool    `json:"enabled,omitempty"`
+}
+
+// UpdateEventWebhookRequest changes the fields of an event webhook that are
+// set. The secret is changed with RotateWebhookSecretRequest.
+type UpdateEventWebhookRequest struct {
+	URL            *string   `json:"url,omitempty"`
+	Description    *string   `json:"description,omitempty"`
+	Events         *[]string `json:"events,omitempty"`
+	UsageThreshold *int      `json:"usage_threshold,omitempty"`
+	Enabled        *bool     `json:"enabled,omitempty"`
+}
+
+// Event is the body posted to event webhooks. Redeliveries of an event keep
+// its ID.
+type Event struct {
+	ID        uuid.UUID `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// RunEventData describes a finished run in run.completed and run.failed
+// events.
+type RunEventData struct {
+	AgentID    uuid.UUID  `json:"agent_id"`
+	AgentName  string     `json:"agent_name"`
+	Source     string     `json:"source"` // "chat", "api", "schedule" or "webhook"
+	SessionID  *uuid.UUID `json:"session_id,omitempty"`
+	Response   string     `json:"response,omitempty"`
+	Structured any        `json:"structured,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Usage      *Usage     `json:"usage,omitempty"`
+}
+
+// ToolErrorEventData describes a failed tool call in tool.error events.
+type ToolErrorEventData struct {
+	AgentID   uuid.UUID `json:"agent_id"`
+	AgentName string    `json:"agent_name"`
+	ToolName  string    `json:"tool_name"`
+	Error     string    `json:"error"`
+}
+
+// APIKeyRevokedEventData describes a revoked key in api_key.revoked events.
+type APIKeyRevokedEventData struct {
+	AgentID   uuid.UUID `json:"agent_id"`
+	AgentName string    `json:"agent_name"`
+	KeyID     uint      `json:"key_id"`
+	KeyName   string    `json:"key_name"`
+}
+
+// UsageThresholdEventData describes the month's usage in
+// usage.threshold_crossed events.
+type UsageThresholdEventData struct {
+	Threshold   int       `json:"threshold"`
+	TokensUsed  int64     `json:"tokens_used"`
+	PeriodStart time.Time `json:"period_start"`
+}
+
+// AttachKnowledgeBaseRequest gives an agent access to a knowledge base.
+type AttachKnowledgeBaseRequest struct {
+	KnowledgeBaseID uuid.UUID `json:"knowledge_base_id"`
+}
+
+// CloneAgentRequest names the copy of an agent. Without a name the copy is
+// named after the original, e.g. "Support Bot (copy)".
+type CloneAgentRequest struct {
+	Name *string `json:"name,omitempty"`
+
+	// CopyAPIKeys creates a new key for each active key of the original,
+	// with the same name. Key secrets are never copied.
+	CopyAPIKeys bool `json:"copy_api_keys,omitempty"`
+}
+
+// AgentManifestVersion is the manifest format written by agent export.
+const AgentManifestVersion = 1
+
+// AgentManifest is a portable description of an agent and its MCP servers,
+// for moving agents between accounts and environments. Secrets are written
+// as ${secret:NAME} placeholders and supplied again on import.
+type AgentManifest struct {
+	ManifestVersion int               `json:"manifest_version" yaml:"manifest_version"`
+	Name            string            `json:"name" yaml:"name"`
+	Provider        InferenceProvider `json:"provider" yaml:"provider"`
+	Model           string            `json:"model" yaml:"model"`
+	SystemPrompt    string            `json:"system_prompt,omitempty" yaml:"system_prompt,omitempty"`
+	MaxTokens       int               `json:"max_tokens" yaml:"max_tokens"`
+	Temperature     float64           `json:"temperature" yaml:"temperature"`
+
+	ToolResultHistoryLimit int `json:"tool_result_history_limit,omitempty" yaml:"tool_result_history_limit,omitempty"`
+
+	ContextStrategy       ContextStrategy `json:"context_strategy,omitempty" yaml:"context_strategy,omitempty"`
+	ContextBudget         int             `json:"context_budget,omitempty" yaml:"context_budget,omitempty"`
+	ContextWindowMessages int             `json:"context_window_messages,omitempty" yaml:"context_window_messages,omitempty"`
+
+	PromptVariables []PromptVariable `json:"prompt_variables,omitempty" yaml:"prompt_variables,omitempty"`
+
+	ResponseSchema map[string]any `json:"response_schema,omitempty" yaml:"response_schema,omitempty"`
+
+	KnowledgeMode KnowledgeMode `json:"knowledge_mode,omitempty" yaml:"knowledge_mode,omitempty"`
+	KnowledgeTopK int           `json:"knowledge_top_k,omitempty" yaml:"knowledge_top_k,omitempty"`
+
+	MemoryEnabled     bool `json:"memory_enabled,omitempty" yaml:"memory_enabled,omitempty"`
+	MemoryTokenBudget int  `json:"memory_token_budget,omitempty" yaml:"memory_token_budget,omitempty"`
+
+	MCPServers []MCPServerManifest `json:"mcp_servers,omitempty" yaml:"mcp_servers,omitempty"`
+}
+
+// CreateRequest returns the agent settings of the manifest as a create
+// request, so that they are validated like a new agent.
+func (m *AgentManifest) CreateRequest() CreateAgentRequest {
+	systemPrompt := m.SystemPrompt
+	return CreateAgentRequest{
+		Name:         m.Name,
+		Provider:     m.Provider,
+		Model:        m.Model,
+		SystemPrompt: &systemPrompt,
+		MaxTokens:    m.MaxTokens,
+		Temperature:  m.Temperature,
+
+		ToolResultHistoryLimit: m.ToolResultHistoryLimit,
+
+		ContextStrategy:       m.ContextStrategy,
+		ContextBudget:         m.ContextBudget,
+		ContextWindowMessages: m.ContextWindowMessages,
+
+		PromptVariables: m.PromptVariables,
+
+		ResponseSchema: m.ResponseSchema,
+
+		KnowledgeMode: m.KnowledgeMode,
+		KnowledgeTopK: m.KnowledgeTopK,
+
+		MemoryEnabled:     m.MemoryEnabled,
+		MemoryTokenBudget: m.MemoryTokenBudget,
+	}
+}
+
+// MCPServerManifest is an MCP server in an agent manifest, together with the
+// agent's settings for it.
+type MCPServerManifest struct {
+	Name             string            `json:"name" yaml:"name"`
+	Description      string            `json:"description,omitempty" yaml:"description,omitempty"`
+	ServerType       string            `json:"server_type" yaml:"server_type"`
+	ServerURL        string            `json:"server_url,omitempty" yaml:"server_url,omitempty"`
+	Command          string            `json:"command,omitempty" yaml:"command,omitempty"`
+	Args             []string          `json:"args,omitempty" yaml:"args,omitempty"`
+	Env              map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	Timeout          int               `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	MaxRetries       int               `json:"max_retries,omitempty" yaml:"max_retries,omitempty"`
+	SensitiveURL     bool              `json:"sensitive_url,omitempty" yaml:"sensitive_url,omitempty"`
+	SensitiveHeaders []string          `json:"sensitive_headers,omitempty" yaml:"sensitive_headers,omitempty"`
+
+	Enabled               *bool    `json:"enabled,omitempty" yaml:"enabled,omitempty"` // defaults to true
+	AllowedTools          []string `json:"allowed_tools,omitempty" yaml:"allowed_tools,omitempty"`
+	DeniedTools           []string `json:"denied_tools,omitempty" yaml:"denied_tools,omitempty"`
+	ApprovalRequiredTools []string `json:"approval_required_tools,omitempty" yaml:"approval_required_tools,omitempty"`
+}
+
+// ImportAgentRequest is a manifest with the values of its secret
+// placeholders, keyed by name.
+type ImportAgentRequest struct {
+	AgentManifest `yaml:",inline"`
+	Secrets       map[string]string `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+}
+
 type CreateUserRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
@@ -112,18 +569,92 @@ type LoginRequest struct {
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	ToolSteps []ToolStep `json:"-"` // loaded from the session, never from callers
+
+	Attachments []uuid.UUID   `json:"attachments,omitempty"`
+	Files       []FileContent `json:"-"` // the attachments' content, loaded by the server
 }
 
 type AgentInferenceRequest struct {
 	Message string    `json:"message"`
 	History []Message `json:"history,omitempty"`
+
+	// ContextSummary summarizes the conversation before History. It is set
+	// by context compaction, never by callers.
+	ContextSummary string `json:"-"`
+
+	// Variables are the values of the agent's prompt variables.
+	Variables map[string]string `json:"variables,omitempty"`
+
+	// Attachments are uploaded files sent with the message.
+	Attachments []uuid.UUID   `json:"attachments,omitempty"`
+	Files       []FileContent `json:"-"` // the attachments' content, loaded by the server
+
+	// Server-stored conversations. Store starts a new session; SessionID
+	// continues one. Sessions are scoped to EndUserID when set, otherwise to
+	// the API key.
+	SessionID *uuid.UUID `json:"session_id,omitempty"`
+	Store     bool       `json:"store,omitempty"`
+	EndUserID string     `json:"end_user_id,omitempty"`
 }
 
 type AgentInferenceResponse struct {
-	Response string `json:"response"`
-	Usage    *Usage `json:"usage,omitempty"`
+	Response  string     `json:"response"`
+	Usage     *Usage     `json:"usage,omitempty"`
+	SessionID *uuid.UUID `json:"session_id,omitempty"`
+
+	// Set when the run paused for tool approval. Resume it with the run ID.
+	Status           string            `json:"status,omitempty"` // "completed" or "pending_approval"
+	RunID            *uuid.UUID        `json:"run_id,omitempty"`
+	PendingToolCalls []PendingToolCall `json:"pending_tool_calls,omitempty"`
+	ExpiresAt        *time.Time        `json:"expires_at,omitempty"`
+
+	// Structured is the parsed response when the agent has a response schema.
+	Structured any `json:"structured,omitempty"`
+
+	// Citations are the knowledge base chunks the agent was given while
+	// answering, numbered as the agent was asked to cite them.
+	Citations []Citation `json:"citations,omitempty"`
+}
+
+// Citation is a knowledge base chunk given to an agent.
+type Citation struct {
+	Index           int       `json:"index"`
+	KnowledgeBaseID uuid.UUID `json:"knowledge_base_id"`
+	DocumentID      uuid.UUID `json:"document_id"`
+	ChunkID         uuid.UUID `json:"chunk_id"`
+	Filename        string    `json:"filename"`
+	Content         string    `json:"content"`
+	Score           float64   `json:"score"`
+}
+
+// ToolApprovalDecision is a human decision on a tool call that requires
+// approval. "edit" runs the tool with Arguments in place of the model's.
+type ToolApprovalDecision struct {
+	Action    string         `json:"action"` // "approve", "edit", "reject"
+	Arguments map[string]any `json:"arguments,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+}
+
+func (d *ToolApprovalDecision) Validate() error {
+	switch d.Action {
+	case "approve", "reject":
+		return nil
+	case "edit":
+		if d.Arguments == nil {
+			return fmt.Errorf("arguments are required to edit a tool call")
+		}
+		return nil
+	default:
+		return fmt.Errorf("action must be 'approve', 'edit' or 'reject'")
+	}
+}
+
+type ResumeRunRequest struct {
+	Decisions map[string]*ToolApprovalDecision `json:"decisions"`             // keyed by call_id
+	EndUserID string                           `json:"end_user_id,omitempty"` // must match the run's, for invoke runs started with one
 }
 
 type Usage struct {
@@ -132,14 +663,26 @@ type Usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
+func (u *Usage) Add(other Usage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+}
+
 type UserSettingsResponse struct {
-	AnthropicAPIKey string `json:"anthropic_api_key"`
-	OpenAIAPIKey    string `json:"openai_api_key"`
-	GeminiAPIKey    string `json:"gemini_api_key"`
+	AnthropicAPIKey       string `json:"anthropic_api_key"`
+	OpenAIAPIKey          string `json:"openai_api_key"`
+	GeminiAPIKey          string `json:"gemini_api_key"`
+	CustomBaseURL         string `json:"custom_base_url"`
+	CustomAuthHeaderName  string `json:"custom_auth_header_name"`
+	CustomAuthHeaderValue string `json:"custom_auth_header_value"`
 }
 
 type UpdateUserSettingsRequest struct {
-	AnthropicAPIKey *string `json:"anthropic_api_key,omitempty"`
-	OpenAIAPIKey    *string `json:"openai_api_key,omitempty"`
-	GeminiAPIKey    *string `json:"gemini_api_key,omitempty"`
+	AnthropicAPIKey       *string `json:"anthropic_api_key,omitempty"`
+	OpenAIAPIKey          *string `json:"openai_api_key,omitempty"`
+	GeminiAPIKey          *string `json:"gemini_api_key,omitempty"`
+	CustomBaseURL         *string `json:"custom_base_url,omitempty"`
+	CustomAuthHeaderName  *string `json:"custom_auth_header_name,omitempty"`
+	CustomAuthHeaderValue *string `json:"custom_auth_header_value,omitempty"`
 }